@@ -0,0 +1,180 @@
+package tusgo
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// NewCircuitBreaker constructs a new CircuitBreaker, which opens after threshold consecutive failures and lets
+// a probe request through after cooldown
+func NewCircuitBreaker(threshold int, cooldown time.Duration) *CircuitBreaker {
+	if threshold <= 0 {
+		panic("threshold must be positive")
+	}
+	if cooldown <= 0 {
+		panic("cooldown must be positive")
+	}
+	return &CircuitBreaker{threshold: threshold, cooldown: cooldown}
+}
+
+// BreakerState is the state of CircuitBreaker
+type BreakerState int
+
+const (
+	// BreakerClosed means that the requests are sent as usual
+	BreakerClosed BreakerState = iota
+	// BreakerOpen means that the requests are rejected with ErrCircuitOpen without sending
+	BreakerOpen
+	// BreakerHalfOpen means that the cooldown has passed, and a single probe request is sent to check the server
+	BreakerHalfOpen
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	}
+	return fmt.Sprintf("BreakerState(%d)", int(s))
+}
+
+// CircuitBreaker stops sending requests to a failing server. It is safe for concurrent use, and usually is shared by
+// all streams uploading to the same server, see Client.CircuitBreaker.
+//
+// The failures are network errors, server errors (5xx) and rate limiting (429), i.e. the ones the server is to blame
+// for. Other responses, including 4xx, mean that the server works, and the requests aborted by context are not
+// counted. After threshold consecutive
+// failures the breaker opens, and the requests fail with ErrCircuitOpen immediately. Once the cooldown has passed,
+// the breaker becomes half-open and lets one probe request through: if it succeeds, the breaker closes, otherwise
+// it opens for another cooldown.
+type CircuitBreaker struct {
+	mu        sync.Mutex
+	threshold int
+	cooldown  time.Duration
+	state     BreakerState
+	failures  int       // Consecutive failures in closed state
+	openedAt  time.Time // When the breaker has opened last time
+	probing   bool      // Probe request is in flight in half-open state
+}
+
+// breakerResult is the outcome of request for CircuitBreaker
+type breakerResult int
+
+const (
+	breakerSuccess breakerResult = iota
+	breakerFailure
+	breakerIgnore // The request was aborted on our side, e.g. by context, so it tells nothing about the server
+)
+
+// State returns the current breaker state
+func (cb *CircuitBreaker) State() BreakerState {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	return cb.state
+}
+
+// allow returns nil if a request may be sent. probe is true if the request is the half-open probe, then its result
+// must be reported to done anyway.
+func (cb *CircuitBreaker) allow() (probe bool, err error) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	if cb.state == BreakerOpen {
+		if wait := cb.cooldown - time.Since(cb.openedAt); wait > 0 {
+			return false, ErrCircuitOpen.WithErr(CircuitOpenError{RetryAfter: wait})
+		}
+		cb.state = BreakerHalfOpen
+	}
+	if cb.state == BreakerHalfOpen {
+		if cb.probing {
+			return false, ErrCircuitOpen.WithErr(CircuitOpenError{})
+		}
+		cb.probing = true
+		return true, nil
+	}
+	return false, nil
+}
+
+// done records the result of request allowed by allow
+func (cb *CircuitBreaker) done(probe bool, res breakerResult) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	if probe {
+		cb.probing = false
+	}
+	switch res {
+	case breakerSuccess:
+		cb.state = BreakerClosed
+		cb.failures = 0
+	case breakerFailure:
+		cb.failures++
+		if cb.state == BreakerHalfOpen && probe || cb.state == BreakerClosed && cb.failures >= cb.threshold {
+			cb.state = BreakerOpen
+			cb.openedAt = time.Now()
+			cb.failures = 0
+		}
+	}
+}
+
+// breakerResultOf classifies the request outcome for CircuitBreaker
+func breakerResultOf(response *http.Response, err error) breakerResult {
+	switch {
+	case err != nil && IsTransientError(err):
+		return breakerFailure
+	case err != nil:
+		return breakerIgnore
+	case response.StatusCode >= http.StatusInternalServerError || response.StatusCode == http.StatusTooManyRequests:
+		return breakerFailure
+	}
+	return breakerSuccess
+}
+
+// CircuitOpenError is returned wrapped in ErrCircuitOpen
+type CircuitOpenError struct {
+	// RetryAfter is the time left until the breaker lets a probe request through. Zero if a probe is in flight
+	RetryAfter time.Duration
+}
+
+func (e CircuitOpenError) Error() string {
+	if e.RetryAfter <= 0 {
+		return "probe request is in flight"
+	}
+	return fmt.Sprintf("retry after %s", e.RetryAfter.Round(time.Millisecond))
+}
+
+// NewRetryBudget constructs a new RetryBudget, which allows a given number of retries
+func NewRetryBudget(retries int) *RetryBudget {
+	if retries < 0 {
+		panic("retries must not be negative")
+	}
+	return &RetryBudget{left: retries}
+}
+
+// RetryBudget limits the total number of retries of an upload, see UploadStream.RetryBudget. It is safe for
+// concurrent use.
+type RetryBudget struct {
+	mu   sync.Mutex
+	left int
+}
+
+// Remaining returns the number of retries left
+func (rb *RetryBudget) Remaining() int {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	return rb.left
+}
+
+// take spends one retry. Returns false if the budget is exhausted
+func (rb *RetryBudget) take() bool {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	if rb.left <= 0 {
+		return false
+	}
+	rb.left--
+	return true
+}
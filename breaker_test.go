@@ -0,0 +1,119 @@
+package tusgo
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("CircuitBreaker", func() {
+	It("should open after threshold consecutive failures", func() {
+		cb := NewCircuitBreaker(3, time.Hour)
+		for i := 0; i < 2; i++ {
+			_, err := cb.allow()
+			Ω(err).Should(Succeed())
+			cb.done(false, breakerFailure)
+		}
+		cb.done(false, breakerSuccess) // Resets the counter
+		for i := 0; i < 3; i++ {
+			Ω(cb.State()).Should(Equal(BreakerClosed))
+			cb.done(false, breakerFailure)
+		}
+		Ω(cb.State()).Should(Equal(BreakerOpen))
+
+		_, err := cb.allow()
+		Ω(err).Should(MatchError(ErrCircuitOpen))
+		var coe CircuitOpenError
+		Ω(errors.As(err, &coe)).Should(BeTrue())
+		Ω(coe.RetryAfter).Should(BeNumerically("~", time.Hour, time.Minute))
+	})
+	It("should let one probe through after cooldown", func() {
+		cb := NewCircuitBreaker(1, 10*time.Millisecond)
+		cb.done(false, breakerFailure)
+		Ω(cb.State()).Should(Equal(BreakerOpen))
+		time.Sleep(20 * time.Millisecond)
+
+		probe, err := cb.allow()
+		Ω(err).Should(Succeed())
+		Ω(probe).Should(BeTrue())
+		Ω(cb.State()).Should(Equal(BreakerHalfOpen))
+		_, err = cb.allow()
+		Ω(err).Should(MatchError(ErrCircuitOpen)) // Probe is in flight
+
+		cb.done(true, breakerSuccess)
+		Ω(cb.State()).Should(Equal(BreakerClosed))
+		Ω(cb.allow()).Should(BeFalse())
+	})
+	It("should open again if probe fails", func() {
+		cb := NewCircuitBreaker(5, 10*time.Millisecond)
+		for i := 0; i < 5; i++ {
+			cb.done(false, breakerFailure)
+		}
+		time.Sleep(20 * time.Millisecond)
+		probe, _ := cb.allow()
+
+		cb.done(probe, breakerFailure)
+		Ω(cb.State()).Should(Equal(BreakerOpen))
+		_, err := cb.allow()
+		Ω(err).Should(MatchError(ErrCircuitOpen))
+	})
+	It("should let another probe through if the previous one was aborted", func() {
+		cb := NewCircuitBreaker(1, 10*time.Millisecond)
+		cb.done(false, breakerFailure)
+		time.Sleep(20 * time.Millisecond)
+		probe, _ := cb.allow()
+
+		cb.done(probe, breakerIgnore)
+		Ω(cb.State()).Should(Equal(BreakerHalfOpen))
+		Ω(cb.allow()).Should(BeTrue())
+	})
+	It("should stop sending requests of the client to a failing server", func() {
+		var requests atomic.Int32
+		status := atomic.Int32{}
+		status.Store(http.StatusServiceUnavailable)
+		testSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			requests.Add(1)
+			w.Header().Set("Tus-Resumable", "1.0.0")
+			w.Header().Set("Cache-Control", "no-store")
+			w.Header().Set("Upload-Offset", "0")
+			w.Header().Set("Upload-Length", "10")
+			w.WriteHeader(int(status.Load()))
+		}))
+		defer testSrv.Close()
+		u, _ := url.Parse(testSrv.URL + "/files/")
+		testClient := NewClient(testSrv.Client(), u)
+		testClient.CircuitBreaker = NewCircuitBreaker(2, 50*time.Millisecond)
+
+		for i := 0; i < 2; i++ {
+			_, err := testClient.GetUpload(&Upload{}, "/files/foo")
+			Ω(err).Should(MatchError(ErrUnexpectedResponse))
+		}
+		_, err := testClient.WithContext(context.Background()).GetUpload(&Upload{}, "/files/foo")
+		Ω(err).Should(MatchError(ErrCircuitOpen))
+		Ω(IsTransientError(err)).Should(BeTrue())
+		Ω(requests.Load()).Should(BeEquivalentTo(2))
+
+		status.Store(http.StatusOK)
+		time.Sleep(60 * time.Millisecond)
+		_, err = testClient.GetUpload(&Upload{}, "/files/foo")
+		Ω(err).Should(Succeed())
+		Ω(testClient.CircuitBreaker.State()).Should(Equal(BreakerClosed))
+	})
+})
+
+var _ = Describe("RetryBudget", func() {
+	It("should spend the retries", func() {
+		rb := NewRetryBudget(2)
+		Ω(rb.take()).Should(BeTrue())
+		Ω(rb.take()).Should(BeTrue())
+		Ω(rb.take()).Should(BeFalse())
+		Ω(rb.Remaining()).Should(BeZero())
+	})
+})
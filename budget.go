@@ -0,0 +1,99 @@
+package tusgo
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// NewMemoryBudget constructs a new MemoryBudget, which allows maxBytes bytes to be reserved at once
+func NewMemoryBudget(maxBytes int64) *MemoryBudget {
+	if maxBytes <= 0 {
+		panic("maxBytes must be positive")
+	}
+	return &MemoryBudget{max: maxBytes}
+}
+
+// MemoryBudget caps the total size of chunk buffers of streams sharing it. It is safe for concurrent use.
+//
+// A stream reserves ChunkSize bytes before allocating its dirty buffer and releases them when the buffer is dropped,
+// i.e. when the stream becomes "clean". If the budget is exhausted, the stream waits until other streams release
+// their buffers or until its context is done. Streams are served in the order they came, so a stream with large
+// ChunkSize is not starved by ones with small chunks.
+type MemoryBudget struct {
+	mu      sync.Mutex
+	max     int64
+	used    int64
+	waiters []*budgetWaiter
+}
+
+// budgetWaiter is a pending reservation in MemoryBudget
+type budgetWaiter struct {
+	n     int64
+	ready chan struct{} // Closed when the reservation has been granted
+}
+
+// InUse returns the number of bytes reserved at the moment
+func (mb *MemoryBudget) InUse() int64 {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	return mb.used
+}
+
+// acquire blocks until n bytes are reserved, or until ctx is done
+func (mb *MemoryBudget) acquire(ctx context.Context, n int64) error {
+	if n > mb.max {
+		panic(fmt.Sprintf("cannot reserve %d bytes in memory budget of %d bytes, decrease the ChunkSize", n, mb.max))
+	}
+	mb.mu.Lock()
+	if len(mb.waiters) == 0 && mb.used+n <= mb.max {
+		mb.used += n
+		mb.mu.Unlock()
+		return nil
+	}
+	w := &budgetWaiter{n: n, ready: make(chan struct{})}
+	mb.waiters = append(mb.waiters, w)
+	mb.mu.Unlock()
+
+	select {
+	case <-w.ready:
+		return nil
+	case <-ctx.Done():
+		mb.mu.Lock()
+		select {
+		case <-w.ready: // Granted concurrently, give the bytes back
+			mb.used -= n
+		default:
+			for i, ww := range mb.waiters {
+				if ww == w {
+					mb.waiters = append(mb.waiters[:i], mb.waiters[i+1:]...)
+					break
+				}
+			}
+		}
+		mb.grantLocked() // The next waiters may fit now
+		mb.mu.Unlock()
+		return ctx.Err()
+	}
+}
+
+// release returns n reserved bytes to the budget
+func (mb *MemoryBudget) release(n int64) {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	mb.used -= n
+	if mb.used < 0 {
+		panic("programming error: memory budget released more than reserved")
+	}
+	mb.grantLocked()
+}
+
+// grantLocked grants the reservations to waiters in order while they fit into the budget
+func (mb *MemoryBudget) grantLocked() {
+	for len(mb.waiters) > 0 && mb.used+mb.waiters[0].n <= mb.max {
+		w := mb.waiters[0]
+		mb.waiters = mb.waiters[1:]
+		mb.used += w.n
+		close(w.ready)
+	}
+}
@@ -0,0 +1,85 @@
+package tusgo
+
+import (
+	"bytes"
+	"errors"
+	"sync"
+)
+
+// errBufferReleased is returned by bufferReader when its buffer has been returned to the pool
+var errBufferReleased = errors.New("buffer has been released")
+
+// bufferPool keeps the chunk buffers for reuse. Every buffer size has its own sync.Pool, since streams with different
+// ChunkSize may share a client. Zero value is ready to use.
+type bufferPool struct {
+	mu    sync.Mutex
+	pools map[int]*sync.Pool
+}
+
+// get returns a buffer of size bytes. Its contents are undefined. We pass the buffers by pointer, so get and put
+// don't allocate
+func (bp *bufferPool) get(size int) *[]byte {
+	if bp == nil {
+		b := make([]byte, size)
+		return &b
+	}
+	if b, ok := bp.pool(size).Get().(*[]byte); ok {
+		return b
+	}
+	b := make([]byte, size)
+	return &b
+}
+
+// put returns a buffer obtained by get to the pool. The buffer must not be used after that. Nil pool allocates
+// the buffers without reusing them
+func (bp *bufferPool) put(b *[]byte) {
+	if bp == nil {
+		return
+	}
+	bp.pool(len(*b)).Put(b)
+}
+
+func (bp *bufferPool) pool(size int) *sync.Pool {
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+	if bp.pools == nil {
+		bp.pools = make(map[int]*sync.Pool)
+	}
+	p, ok := bp.pools[size]
+	if !ok {
+		p = &sync.Pool{}
+		bp.pools[size] = p
+	}
+	return p
+}
+
+// bufferReader reads a pooled buffer until it is detached. The http.Transport may read a request body even after
+// the response has been received, so we detach the body before the buffer goes back to the pool.
+type bufferReader struct {
+	mu       sync.Mutex
+	rd       bytes.Reader
+	detached bool
+}
+
+// newBufferReader returns a bufferReader of b
+func newBufferReader(b []byte) *bufferReader {
+	r := &bufferReader{}
+	r.rd.Reset(b)
+	return r
+}
+
+func (r *bufferReader) Read(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.detached {
+		return 0, errBufferReleased
+	}
+	return r.rd.Read(p)
+}
+
+// detach makes further reads fail, so the buffer may be reused
+func (r *bufferReader) detach() {
+	r.mu.Lock()
+	r.detached = true
+	r.mu.Unlock()
+}
@@ -1,21 +1,49 @@
 package tusgo
 
+// Extension is a Tus protocol extension name
+type Extension string
+
+// Tus protocol extensions
+const (
+	ExtensionCreation                Extension = "creation"
+	ExtensionCreationDeferLength     Extension = "creation-defer-length"
+	ExtensionCreationWithUpload      Extension = "creation-with-upload"
+	ExtensionExpiration              Extension = "expiration"
+	ExtensionTermination             Extension = "termination"
+	ExtensionConcatenation           Extension = "concatenation"
+	ExtensionConcatenationUnfinished Extension = "concatenation-unfinished"
+	ExtensionChecksum                Extension = "checksum"
+	ExtensionChecksumTrailer         Extension = "checksum-trailer"
+)
+
 // ServerCapabilities contains features and limits of a Tus server. These features are exposed by a server itself
-// in OPTIONS endpoint and may be fetched by Client.UpdateCapabilities method.
+// in OPTIONS endpoint and may be fetched by Client.UpdateCapabilities method. Also, they may be declared statically,
+// e.g. loaded from a JSON config, and set by Client.AssumeCapabilities.
 type ServerCapabilities struct {
 	// Tus protocol extensions the server supports. For full extensions list see Tus protocol description.
 	// Some of them are: creation, creation-defer-length, creation-with-upload, termination, concatenation,
-	// concatenation-unfinished, checksum, checksum-trailer, creation-defer-length, expiration
-	Extensions []string
+	// concatenation-unfinished, checksum, checksum-trailer, creation-defer-length, expiration. See also Extension*
+	// constants and HasExtension method.
+	Extensions []string `json:"extensions"`
 
 	// Size of upload the server is capable to accept. 0 means that server does not set such limit.
-	MaxSize int64
+	MaxSize int64 `json:"max_size"`
 
 	// Tus protocol version a server supports. A client must select one of these versions by setting
 	// Client.ProtocolVersion
-	ProtocolVersions []string
+	ProtocolVersions []string `json:"protocol_versions"`
 
 	// Algorithms which server supports. For this feature a server must expose at least the "checksum" extension.
 	// See also checksum.Algorithms for list of hashes the tusgo can use.
-	ChecksumAlgorithms []string
+	ChecksumAlgorithms []string `json:"checksum_algorithms"`
+}
+
+// HasExtension returns true if server supports a given extension
+func (sc *ServerCapabilities) HasExtension(extension Extension) bool {
+	for _, e := range sc.Extensions {
+		if Extension(e) == extension {
+			return true
+		}
+	}
+	return false
 }
@@ -9,6 +9,10 @@ import (
 	"hash/fnv"
 	"strings"
 	"unicode"
+
+	"github.com/cespare/xxhash/v2"
+	"github.com/zeebo/blake3"
+	"github.com/zeebo/xxh3"
 )
 
 type Algorithm string
@@ -39,6 +43,10 @@ const (
 	FNV         Algorithm = "fnv"
 	FNV1        Algorithm = "fnv1"
 	FNV1A       Algorithm = "fnv1a"
+	XXH3        Algorithm = "xxh3"
+	XXH64       Algorithm = "xxh64"
+	XXHASH64    Algorithm = "xxhash64"
+	BLAKE3      Algorithm = "blake3"
 )
 
 //revive:enable
@@ -68,6 +76,10 @@ var Algorithms = map[Algorithm]func() hash.Hash{
 	FNV:         func() hash.Hash { return fnv.New32() },
 	FNV1:        func() hash.Hash { return fnv.New32() },
 	FNV1A:       func() hash.Hash { return fnv.New32a() },
+	XXH3:        func() hash.Hash { return xxh3.New() },
+	XXH64:       func() hash.Hash { return xxhash.New() },
+	XXHASH64:    func() hash.Hash { return xxhash.New() },
+	BLAKE3:      func() hash.Hash { return blake3.New() },
 }
 
 func GetAlgorithm(name string) (algo Algorithm, ok bool) {
@@ -19,6 +19,9 @@ var _ = Describe("GetAlgorithm", func() {
 			Entry("SHA-1", "SHA-1", checksum.SHA1),
 			Entry("md_5", "md_5", checksum.MD5),
 			Entry("Blake-2B-256", "Blake-2B-256", checksum.BLAKE2B_256),
+			Entry("XXH3", "XXH3", checksum.XXH3),
+			Entry("xxhash-64", "xxhash-64", checksum.XXHASH64),
+			Entry("BLAKE3", "BLAKE3", checksum.BLAKE3),
 		)
 	})
 	When("pass an unknown name", func() {
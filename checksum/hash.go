@@ -1,17 +1,18 @@
 package checksum
 
 import (
+	"bytes"
 	"encoding/base64"
 	"hash"
-	"io"
-	"strings"
 )
 
 // HashBase64ReadWriter an io.Reader that wraps a hash.Hash, it feeds the prefix + hash in base64 format
 type HashBase64ReadWriter struct {
 	hash.Hash
-	rd     io.Reader
 	prefix string
+	buf    []byte // Prefix + hash result, reused after Reset
+	rd     bytes.Reader
+	ready  bool // Hash result has been calculated to buf
 }
 
 // NewHashBase64ReadWriter constructs a new HashBase64ReadWriter. Receives a hash object to wrap and a prefix
@@ -24,10 +25,29 @@ func NewHashBase64ReadWriter(h hash.Hash, prefix string) *HashBase64ReadWriter {
 // The function returns the number of bytes read (0 <= n <= len(p)) and any error
 // encountered. Returns io.EOF error if all result has read and no more data available.
 func (h *HashBase64ReadWriter) Read(p []byte) (n int, err error) {
-	if h.rd == nil {
-		sum := h.Hash.Sum(make([]byte, 0))
-		s := h.prefix + base64.StdEncoding.EncodeToString(sum)
-		h.rd = strings.NewReader(s)
+	if !h.ready {
+		h.buf = h.AppendSum(h.buf[:0])
+		h.rd.Reset(h.buf)
+		h.ready = true
 	}
 	return h.rd.Read(p)
 }
+
+// Reset resets the wrapped hash to its initial state, so the object can be reused for the next data. The hash result
+// will be calculated again on the next Read.
+func (h *HashBase64ReadWriter) Reset() {
+	h.Hash.Reset()
+	h.ready = false
+}
+
+// AppendSum appends the prefix + hash in base64 format to b and returns the resulting slice. Unlike Read, it doesn't
+// change the reading position.
+func (h *HashBase64ReadWriter) AppendSum(b []byte) []byte {
+	b = append(b, h.prefix...)
+	return base64.StdEncoding.AppendEncode(b, h.Hash.Sum(nil))
+}
+
+// SumString returns the prefix + hash in base64 format, e.g. to be put to a header instead of trailer
+func (h *HashBase64ReadWriter) SumString() string {
+	return string(h.AppendSum(nil))
+}
@@ -1,6 +1,7 @@
 package checksum_test
 
 import (
+	"crypto/sha1"
 	"io"
 
 	"github.com/bdragon300/tusgo/checksum"
@@ -74,5 +75,25 @@ var _ = Describe("HashBase64ReadWriter", func() {
 			})
 		})
 	})
-})
+	Context("SumString()", func() {
+		It("should return prefixed base64 hash", func() {
+			Ω(rd.SumString()).Should(Equal(string(expectValue)))
+		})
+		It("should not affect reading", func() {
+			_ = rd.SumString()
+			Ω(io.ReadAll(rd)).Should(Equal(expectValue))
+		})
+	})
+	Context("Reset()", func() {
+		It("should calculate hash of new data", func() {
+			rw := checksum.NewHashBase64ReadWriter(sha1.New(), "sha1 ")
+			_, _ = rw.Write([]byte("foo"))
+			_, _ = io.ReadAll(rw)
 
+			rw.Reset()
+			_, _ = rw.Write([]byte("Hello world!"))
+			Ω(io.ReadAll(rw)).Should(Equal([]byte("sha1 00hq6RNueFa8QiEjhep5cJRHWAI=")))
+			Ω(rw.SumString()).Should(Equal("sha1 00hq6RNueFa8QiEjhep5cJRHWAI="))
+		})
+	})
+})
@@ -0,0 +1,113 @@
+package checksum
+
+import (
+	"encoding"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+)
+
+// resumableHashVersion is the version of ResumableHash serialized state format
+const resumableHashVersion = 1
+
+// ResumableHash is a hash.Hash wrapper, which state can be saved and restored later. This is useful to calculate
+// the checksum of a huge file being uploaded across process restarts, without re-reading the data already hashed.
+// The hash also counts the bytes written to it, so the caller knows the file offset to resume hashing from.
+//
+// The underlying hash must implement encoding.BinaryMarshaler and encoding.BinaryUnmarshaler. Most of the stdlib
+// hashes do, but some algorithms, such as xxh3 and blake3, don't.
+type ResumableHash struct {
+	hash.Hash
+	algo   Algorithm
+	offset int64
+}
+
+// NewResumableHash constructs a new ResumableHash of a given algorithm. Returns error if the algorithm is unknown or
+// its state can't be serialized.
+func NewResumableHash(algo Algorithm) (*ResumableHash, error) {
+	h, err := newMarshalableHash(algo)
+	if err != nil {
+		return nil, err
+	}
+	return &ResumableHash{Hash: h, algo: algo}, nil
+}
+
+// Write adds more data to the running hash
+func (h *ResumableHash) Write(p []byte) (n int, err error) {
+	n, err = h.Hash.Write(p)
+	h.offset += int64(n)
+	return
+}
+
+// Reset resets the hash to its initial state
+func (h *ResumableHash) Reset() {
+	h.Hash.Reset()
+	h.offset = 0
+}
+
+// Offset returns the number of bytes written to the hash
+func (h *ResumableHash) Offset() int64 {
+	return h.offset
+}
+
+// Algorithm returns the hash algorithm
+func (h *ResumableHash) Algorithm() Algorithm {
+	return h.algo
+}
+
+// MarshalBinary returns the serialized hash state, including the algorithm and the number of bytes written
+func (h *ResumableHash) MarshalBinary() ([]byte, error) {
+	state, err := h.Hash.(encoding.BinaryMarshaler).MarshalBinary()
+	if err != nil {
+		return nil, fmt.Errorf("cannot marshal %s hash state: %w", h.algo, err)
+	}
+	res := []byte{resumableHashVersion}
+	res = binary.AppendUvarint(res, uint64(len(h.algo)))
+	res = append(res, h.algo...)
+	res = binary.AppendUvarint(res, uint64(h.offset))
+	return append(res, state...), nil
+}
+
+// UnmarshalBinary restores the hash state returned by MarshalBinary. It may be called on zero ResumableHash value.
+func (h *ResumableHash) UnmarshalBinary(data []byte) error {
+	if len(data) == 0 || data[0] != resumableHashVersion {
+		return errors.New("unknown hash state format")
+	}
+	data = data[1:]
+	l, n := binary.Uvarint(data)
+	if n <= 0 || uint64(len(data)-n) < l {
+		return errors.New("malformed hash state")
+	}
+	algo := Algorithm(data[n : n+int(l)])
+	data = data[n+int(l):]
+	offset, n := binary.Uvarint(data)
+	if n <= 0 || offset > 1<<63-1 {
+		return errors.New("malformed hash state")
+	}
+	data = data[n:]
+
+	hsh, err := newMarshalableHash(algo)
+	if err != nil {
+		return err
+	}
+	if err = hsh.(encoding.BinaryUnmarshaler).UnmarshalBinary(data); err != nil {
+		return fmt.Errorf("cannot unmarshal %s hash state: %w", algo, err)
+	}
+	h.Hash, h.algo, h.offset = hsh, algo, int64(offset)
+	return nil
+}
+
+func newMarshalableHash(algo Algorithm) (hash.Hash, error) {
+	f, ok := Algorithms[algo]
+	if !ok {
+		return nil, fmt.Errorf("unknown checksum algorithm %q", algo)
+	}
+	h := f()
+	_, ok1 := h.(encoding.BinaryMarshaler)
+	_, ok2 := h.(encoding.BinaryUnmarshaler)
+	if !ok1 || !ok2 {
+		return nil, fmt.Errorf("checksum algorithm %q state can't be serialized", algo)
+	}
+	return h, nil
+}
@@ -0,0 +1,49 @@
+package checksum_test
+
+import (
+	"crypto/sha256"
+
+	"github.com/bdragon300/tusgo/checksum"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("ResumableHash", func() {
+	data := []byte("Hello world! Hello world!")
+
+	It("should continue hashing from restored state", func() {
+		h, err := checksum.NewResumableHash(checksum.SHA256)
+		Ω(err).Should(Succeed())
+		Ω(h.Write(data[:10])).Should(Equal(10))
+		state, err := h.MarshalBinary()
+		Ω(err).Should(Succeed())
+
+		var restored checksum.ResumableHash
+		Ω(restored.UnmarshalBinary(state)).Should(Succeed())
+		Ω(restored.Algorithm()).Should(Equal(checksum.SHA256))
+		Ω(restored.Offset()).Should(BeEquivalentTo(10))
+		Ω(restored.Write(data[10:])).Should(Equal(len(data) - 10))
+		sum := sha256.Sum256(data)
+		Ω(restored.Sum(nil)).Should(Equal(sum[:]))
+		Ω(restored.Offset()).Should(BeEquivalentTo(len(data)))
+	})
+	It("should return error if algorithm state can't be serialized", func() {
+		_, err := checksum.NewResumableHash(checksum.XXH3)
+		Ω(err).Should(HaveOccurred())
+	})
+	It("should return error if algorithm is unknown", func() {
+		_, err := checksum.NewResumableHash("unknown")
+		Ω(err).Should(HaveOccurred())
+	})
+	DescribeTable("should return error on malformed state",
+		func(state []byte) {
+			var h checksum.ResumableHash
+			Ω(h.UnmarshalBinary(state)).ShouldNot(Succeed())
+		},
+		Entry("empty", []byte{}),
+		Entry("unknown version", []byte{2, 1, 'a'}),
+		Entry("truncated algorithm", []byte{1, 10, 's', 'h', 'a'}),
+		Entry("no offset", []byte{1, 6, 's', 'h', 'a', '2', '5', '6'}),
+		Entry("no hash state", []byte{1, 6, 's', 'h', 'a', '2', '5', '6', 0}),
+	)
+})
@@ -2,8 +2,11 @@ package checksum
 
 import (
 	"bytes"
+	"errors"
+	"fmt"
 	"io"
 	"net/http"
+	"slices"
 )
 
 // DeferTrailerReader is io.Reader that concatenates body and trailer readers and substitutes trailer values to
@@ -13,6 +16,7 @@ type DeferTrailerReader struct {
 	body    io.Reader
 	readers map[string]io.Reader
 	request *http.Request
+	err     error // Sticky error returned after the body has been drawn out
 }
 
 // NewDeferTrailerReader constructs a new DeferTrailerReader object. Receives a body data reader,
@@ -33,21 +37,58 @@ func NewDeferTrailerReader(body io.Reader, trailers map[string]io.Reader, reques
 	}
 }
 
-// Read reads up to len(p) bytes of request body into p. After the body reader has fully drawn out, it sequentially
-// gets given trailers data from their readers and assigns it to the request.
+// Read reads up to len(p) bytes of request body into p. After the body reader has fully drawn out, it gets given
+// trailers data from their readers in order of trailer names and assigns it to the request.
 // The function returns the number of bytes read (0 <= n <= len(p)) and any error
-// encountered. Returns io.EOF error if all result has read and no more data available.
-func (h DeferTrailerReader) Read(p []byte) (n int, err error) {
+// encountered. Returns io.EOF error if all result has read and no more data available. If a trailer reader fails,
+// its error is returned instead of io.EOF by this and all subsequent calls.
+func (h *DeferTrailerReader) Read(p []byte) (n int, err error) {
+	if h.err != nil {
+		return 0, h.err
+	}
 	n, err = h.body.Read(p)
 	if err == io.EOF {
-		buf := bytes.NewBuffer(make([]byte, 0))
-		for k, r := range h.readers {
-			buf.Reset()
-			if _, e := buf.ReadFrom(r); e != nil && e != io.EOF {
-				return n, e
-			}
-			h.request.Trailer.Set(k, buf.String())
+		if e := h.setTrailers(); e != nil {
+			err = e
 		}
+		h.err = err
 	}
 	return
 }
+
+// Close closes the body and trailer readers, which implement io.Closer. Returns the errors of all readers failed
+// to close.
+func (h *DeferTrailerReader) Close() error {
+	var errs []error
+	if c, ok := h.body.(io.Closer); ok {
+		errs = append(errs, c.Close())
+	}
+	for _, k := range h.trailerNames() {
+		if c, ok := h.readers[k].(io.Closer); ok {
+			errs = append(errs, c.Close())
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (h *DeferTrailerReader) setTrailers() error {
+	buf := bytes.NewBuffer(make([]byte, 0))
+	for _, k := range h.trailerNames() {
+		buf.Reset()
+		if _, err := buf.ReadFrom(h.readers[k]); err != nil {
+			return fmt.Errorf("cannot read trailer %q: %w", k, err)
+		}
+		h.request.Trailer.Set(k, buf.String())
+	}
+	return nil
+}
+
+// trailerNames returns the trailer names in sorted order, so the trailers are read deterministically
+func (h *DeferTrailerReader) trailerNames() []string {
+	res := make([]string, 0, len(h.readers))
+	for k := range h.readers {
+		res = append(res, k)
+	}
+	slices.Sort(res)
+	return res
+}
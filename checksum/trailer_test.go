@@ -1,16 +1,35 @@
 package checksum_test
 
 import (
+	"errors"
 	"io"
 	"net/http"
 	"net/http/httptest"
 	"strings"
+	"testing/iotest"
 
 	"github.com/bdragon300/tusgo/checksum"
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
 )
 
+// orderedReader records its name to order when read
+type orderedReader struct {
+	name   string
+	order  *[]string
+	closed bool
+}
+
+func (o *orderedReader) Read(_ []byte) (n int, err error) {
+	*o.order = append(*o.order, o.name)
+	return 0, io.EOF
+}
+
+func (o *orderedReader) Close() error {
+	o.closed = true
+	return nil
+}
+
 var _ = Describe("DeferTrailerReader", func() {
 	var testSrv *httptest.Server
 	var srvBody []byte
@@ -60,4 +79,56 @@ var _ = Describe("DeferTrailerReader", func() {
 			})
 		})
 	})
+	Context("read directly", func() {
+		var req *http.Request
+		BeforeEach(func() {
+			var err error
+			req, err = http.NewRequest(http.MethodPost, "http://example.com", nil)
+			Ω(err).Should(Succeed())
+		})
+		It("should set trailers if body returns data along with io.EOF", func() {
+			readers := map[string]io.Reader{"test-trailer": strings.NewReader("trailer value")}
+			data := checksum.NewDeferTrailerReader(iotest.DataErrReader(strings.NewReader(bodyValue)), readers, req)
+
+			buf := make([]byte, 100)
+			n, err := data.Read(buf)
+			Ω(n).Should(Equal(len(bodyValue)))
+			Ω(err).Should(Equal(io.EOF))
+			Ω(req.Trailer.Get("Test-Trailer")).Should(Equal("trailer value"))
+		})
+		It("should read trailers in sorted order", func() {
+			var order []string
+			readers := map[string]io.Reader{
+				"c": &orderedReader{name: "c", order: &order},
+				"a": &orderedReader{name: "a", order: &order},
+				"b": &orderedReader{name: "b", order: &order},
+			}
+			data := checksum.NewDeferTrailerReader(strings.NewReader(bodyValue), readers, req)
+
+			Ω(io.ReadAll(data)).Should(Equal([]byte(bodyValue)))
+			Ω(order).Should(Equal([]string{"a", "b", "c"}))
+		})
+		It("should return trailer reader error on every subsequent read", func() {
+			testErr := errors.New("test error")
+			readers := map[string]io.Reader{"test-trailer": iotest.ErrReader(testErr)}
+			data := checksum.NewDeferTrailerReader(strings.NewReader(bodyValue), readers, req)
+
+			_, err := io.ReadAll(data)
+			Ω(err).Should(MatchError(testErr))
+			_, err = data.Read(make([]byte, 10))
+			Ω(err).Should(MatchError(testErr))
+			Ω(req.Trailer.Get("Test-Trailer")).Should(BeEmpty())
+		})
+		It("should close the wrapped readers", func() {
+			var order []string
+			body := &orderedReader{name: "body", order: &order}
+			trailer := &orderedReader{name: "trailer", order: &order}
+			readers := map[string]io.Reader{"test-trailer": trailer, "other-trailer": strings.NewReader("")}
+			data := checksum.NewDeferTrailerReader(body, readers, req)
+
+			Ω(data.Close()).Should(Succeed())
+			Ω(body.closed).Should(BeTrue())
+			Ω(trailer.closed).Should(BeTrue())
+		})
+	})
 })
@@ -1,18 +1,26 @@
 package tusgo
 
 import (
+	"bufio"
 	"bytes"
 	"context"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"net/url"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// maxDrainSize is the maximum response body size we read out before closing it in order to reuse a connection
+const maxDrainSize = 64 * 1024
+
 // NewClient returns a new Client instance with given underlying http client and base url where the requests will be
 // headed to
 func NewClient(client *http.Client, baseURL *url.URL) *Client {
@@ -21,6 +29,7 @@ func NewClient(client *http.Client, baseURL *url.URL) *Client {
 		GetRequest:      newRequest,
 		client:          client,
 		BaseURL:         baseURL,
+		state:           &clientState{},
 	}
 	if client == nil {
 		c.client = http.DefaultClient
@@ -44,7 +53,18 @@ func NewClient(client *http.Client, baseURL *url.URL) *Client {
 //
 //   - ErrUploadDoesNotExist -- requested upload does not exist or access denied
 //
+//   - ErrUploadExpired -- requested upload does not exist, because it has expired. Wraps ErrUploadDoesNotExist, so
+//     the upload can be re-created instead of treating it as a permanent failure
+//
 //   - ErrUnexpectedResponse -- unexpected server response code
+//
+//   - ErrMetadataTooLarge -- encoded upload metadata exceeds MaxMetadataSize
+//
+// The errors caused by a server response contain ErrorDetails with the response status, headers and body excerpt.
+//
+// Client is safe for concurrent use by multiple goroutines, e.g. by several UploadStream objects, as long as its
+// fields are not modified concurrently. The server capabilities are shared between the client and its copies made by
+// WithContext, and they are fetched only once even if requested by several goroutines. See CurrentCapabilities.
 type Client struct {
 	// BaseURL is base url the client making queries to. For example, "http://example.com/files"
 	BaseURL *url.URL
@@ -52,22 +72,114 @@ type Client struct {
 	// ProtocolVersion is TUS protocol version will be used in requests. Default is "1.0.0"
 	ProtocolVersion string
 
-	// Server capabilities and settings. Use UpdateCapabilities to query the capabilities from a server
+	// Server capabilities and settings. Use UpdateCapabilities to query the capabilities from a server. The field is
+	// set by UpdateCapabilities and AssumeCapabilities, but not when the capabilities are fetched lazily or by a client
+	// copy, so CurrentCapabilities is preferred to read them. Capabilities assigned manually are used by this client
+	// and its copies made afterwards instead of the shared ones, and never become stale.
 	Capabilities *ServerCapabilities
 
 	// GetRequest is a callback function that are called by the library to get a new request object
 	// By default it returns a new empty http.Request
 	GetRequest GetRequestFunc
 
-	client *http.Client
-	ctx    context.Context
+	// MaxMetadataSize is the maximum size of encoded Upload-Metadata header value in bytes. Many proxies limit the
+	// request headers size by 8-16 KiB, so the requests with larger metadata are rejected before reaching the server.
+	// If metadata exceeds the limit, we return ErrMetadataTooLarge before sending the request. The check is client-side
+	// only, a 431 response from a server is returned as ErrUnexpectedResponse.
+	// Zero value means no limit.
+	MaxMetadataSize int
+
+	// DefaultMetadata is merged into metadata of every upload created by CreateUpload, CreateUploadWithData and
+	// ConcatenateUploads. Values passed by the caller take precedence. Useful to stamp, for example, tenant or user
+	// identifiers on all uploads.
+	DefaultMetadata map[string]string
+
+	// CapabilitiesTTL, if positive, is a time after which Capabilities fetched by UpdateCapabilities are considered
+	// stale. Stale capabilities are updated lazily, before the next request which needs them. Capabilities set by
+	// AssumeCapabilities never become stale. Zero value means that capabilities are fetched only once.
+	CapabilitiesTTL time.Duration
+
+	// SkipExtensionChecks disables checking if the server supports an extension before using it. Useful for servers
+	// which support features without advertising them in Tus-Extension header. Capabilities are not requested as well.
+	SkipExtensionChecks bool
+
+	// DefaultHeaders are set to every request the client makes, unless the request already has such header. Useful
+	// for authorization headers, for example.
+	DefaultHeaders http.Header
+
+	// ExpectContinue makes the client send "Expect: 100-continue" header in requests with upload data. The body is
+	// sent only after the server has responded with "100 Continue", so the rejected request (e.g. due to offset
+	// mismatch or expired upload) doesn't waste the bandwidth. The http.Transport should have ExpectContinueTimeout
+	// set, otherwise the body is sent without waiting, see NewTransportForUploads.
+	ExpectContinue bool
+
+	// Middlewares wrap the sending of every request the client makes. The first middleware is the outermost one.
+	Middlewares []Middleware
+
+	// Lenient makes the client tolerate the common server deviations from the protocol: missing Tus-Resumable header
+	// in responses, 200 instead of 204 response on PATCH, missing Upload-Offset header in creation response with
+	// uploaded data (we assume that all data has been accepted), header values in a different case. Default is false,
+	// i.e. such responses are treated as errors
+	Lenient bool
+
+	// RateLimiter, if set, limits the total upload bandwidth of all streams using this client and its copies. The
+	// bandwidth is shared fairly between the concurrent streams. See also UploadStream.WithRateLimit
+	RateLimiter *RateLimiter
+
+	// MemoryBudget, if set, caps the total size of chunk buffers of all streams using this client and its copies.
+	// Streams wait for the memory when the budget is exhausted. A dirty stream holds its buffer until it becomes
+	// clean, so call Flush, Close or ForceClean on the stream you abandon. See MemoryBudget
+	MemoryBudget *MemoryBudget
+
+	// CircuitBreaker, if set, stops sending requests after consecutive failures of the server, so the streams using
+	// this client and its copies don't hammer it. The requests fail with ErrCircuitOpen until the breaker lets a probe
+	// request through. See CircuitBreaker
+	CircuitBreaker *CircuitBreaker
+
+	// Deviations, if set, collects the protocol deviations observed in server responses, such as unexpected status
+	// codes, missing headers, unparseable values. Deviations are recorded in both strict and lenient modes. Useful
+	// when qualifying a new server implementation. The report is shared between client copies.
+	Deviations *DeviationReport
+
+	// ErrorBodyParser, if set, extracts the server error code and message from error response bodies, which are put
+	// to ErrorDetails of returned errors. See TusdErrorBodyParser
+	ErrorBodyParser ErrorBodyParser
+
+	client              *http.Client
+	ctx                 context.Context
+	state               *clientState        // Shared between client copies
+	fetchedCapabilities *ServerCapabilities // Capabilities field value set by the library, to detect manual assignment
 }
 
+// DoFunc sends a http request and returns a response
+type DoFunc func(req *http.Request) (*http.Response, error)
+
+// Middleware wraps a DoFunc, e.g. to log the requests or to sign them
+type Middleware func(next DoFunc) DoFunc
+
 type GetRequestFunc func(method, url string, body io.Reader, tusClient *Client, httpClient *http.Client) (*http.Request, error)
 
+// clientState is the client state shared between its copies
+type clientState struct {
+	discardedConns      atomic.Int64
+	capabilitiesMu      sync.Mutex // Guards capabilities, capabilitiesUpdated and capabilitiesCall
+	capabilities        *ServerCapabilities
+	capabilitiesUpdated time.Time         // Zero if capabilities have been assumed
+	capabilitiesCall    *capabilitiesCall // OPTIONS request in flight, if any
+	buffers             bufferPool
+}
+
+// capabilitiesCall is the OPTIONS request made by loadCapabilities, which the concurrent callers wait for
+type capabilitiesCall struct {
+	done chan struct{}
+	err  error
+}
+
 // WithContext returns a client copy with given context object assigned to it
 func (c *Client) WithContext(ctx context.Context) *Client {
+	c.lockCapabilities() // Capabilities field may be set by UpdateCapabilities at this moment
 	res := *c
+	c.unlockCapabilities()
 	res.ctx = ctx
 	return &res
 }
@@ -75,9 +187,12 @@ func (c *Client) WithContext(ctx context.Context) *Client {
 // GetUpload obtains an upload by location. Fills `u` variable with upload info.
 // Returns http response from server (with closed body) and error (if any).
 //
-// For regular upload we fill in just a remote offset and set Partial flag. For final concatenated uploads we also
-// may set upload size (if server provided). Also, we may set remote offset to OffsetUnknown for concatenated final
-// uploads, if concatenation still in progress on server side.
+// For regular upload we fill in just a remote offset and set Partial flag. For final upload we set Final flag and
+// the partial uploads locations it was built from. If the upload was created with deferred length, which the server
+// still doesn't know, we set RemoteSize to SizeUnknown and DeferredLength flag. If server has sent the expiration
+// time, we also set UploadExpired. For final concatenated uploads we also may set upload size (if server provided).
+// Also, we may set remote offset to OffsetUnknown for concatenated final uploads, if concatenation still in progress
+// on server side.
 //
 // This method may return ErrUploadDoesNotExist error if upload with such location has not found on the server. If other
 // unexpected response has received from the server, method returns ErrUnexpectedResponse
@@ -99,45 +214,73 @@ func (c *Client) GetUpload(u *Upload, location string) (response *http.Response,
 	if response, err = c.tusRequest(c.ctx, req); err != nil {
 		return
 	}
-	defer response.Body.Close()
+	defer c.closeResponse(response)
 
 	switch response.StatusCode {
 	case http.StatusOK:
+		if err = c.checkResumable(response); err != nil {
+			return
+		}
 		u2 := Upload{}
 		u2.Location = location
-		u2.Partial = response.Header.Get("Upload-Concat") == "partial"
+		if !strings.Contains(response.Header.Get("Cache-Control"), "no-store") {
+			c.recordDeviation(response, "lack of Cache-Control: no-store header in HEAD response")
+		}
+		concat := c.headerValue(response, "Upload-Concat")
+		u2.Partial = concat == "partial"
+		u2.Extra = extraHeaders(response.Header)
+		if v := concat; strings.HasPrefix(v, "final") {
+			u2.Final = true
+			if parts, ok := strings.CutPrefix(v, "final;"); ok {
+				u2.FinalParts = strings.Fields(parts)
+			}
+		}
 
 		uploadOffset := response.Header.Get("Upload-Offset")
 		// Upload-Offset may not be present if final upload concatenation still in progress on server side
 		if uploadOffset == "" {
-			if response.Header.Get("Upload-Concat") != "final" {
-				err = ErrProtocol.WithText("lack of Upload-Offset required header in response")
+			if !u2.Final {
+				err = c.protocolError(response, errors.New("lack of Upload-Offset required header in response"))
 				return
 			}
 			u2.RemoteOffset = OffsetUnknown
 		} else if uploadOffset != "" {
 			if u2.RemoteOffset, err = strconv.ParseInt(uploadOffset, 10, 64); err != nil {
-				err = ErrProtocol.WithErr(fmt.Errorf("cannot parse Upload-Offset header %q: %w", uploadOffset, err))
+				err = c.protocolError(response, fmt.Errorf("cannot parse Upload-Offset header %q: %w", uploadOffset, err))
 				return
 			}
 		}
+		// Upload created with deferred length, which has not been set yet
+		if response.Header.Get("Upload-Defer-Length") == "1" {
+			u2.RemoteSize = SizeUnknown
+			u2.DeferredLength = true
+		}
 		// Responses for final concatenated upload may contain Upload-Length header
 		if v := response.Header.Get("Upload-Length"); v != "" {
 			if u2.RemoteSize, err = strconv.ParseInt(v, 10, 64); err != nil {
-				err = ErrProtocol.WithErr(fmt.Errorf("cannot parse Upload-Length header %q: %w", v, err))
+				err = c.protocolError(response, fmt.Errorf("cannot parse Upload-Length header %q: %w", v, err))
+				return
+			}
+		}
+		// Server supporting "expiration" extension may tell when the upload expires
+		if v := response.Header.Get("Upload-Expires"); v != "" {
+			var t time.Time
+			if t, err = time.Parse(time.RFC1123, v); err != nil {
+				err = c.protocolError(response, fmt.Errorf("cannot parse Upload-Expires RFC1123 header %q: %w", v, err))
 				return
 			}
+			u2.UploadExpired = &t
 		}
 		if v := response.Header.Get("Upload-Metadata"); v != "" {
 			if u2.Metadata, err = DecodeMetadata(v); err != nil {
-				err = ErrProtocol.WithErr(fmt.Errorf("cannot parse Upload-Metadata header %q: %w", v, err))
+				err = c.protocolError(response, fmt.Errorf("cannot parse Upload-Metadata header %q: %w", v, err))
 			}
 		}
 		*u = u2
 	case http.StatusNotFound, http.StatusGone, http.StatusForbidden:
-		err = ErrUploadDoesNotExist.WithResponse(response)
+		err = c.notExistError(u, response)
 	default:
-		err = ErrUnexpectedResponse
+		err = c.withResponse(ErrUnexpectedResponse, response)
 	}
 	return
 }
@@ -146,21 +289,27 @@ func (c *Client) GetUpload(u *Upload, location string) (response *http.Response,
 // Returns http response from server (with closed body) and error (if any).
 //
 // Server must support "creation" extension. We create an upload with given size and metadata.
-// If Partial flag is true, we create a partial upload. Metadata map keys must not contain spaces.
+// If Partial flag is true, we create a partial upload. Metadata map keys must not contain spaces. Metadata keys are
+// encoded in sorted order, so the requests are byte-stable for the same arguments.
 //
 // If `remoteSize` is equal to SizeUnknown, we create an upload with deferred size, i.e. upload with size that is
 // unknown for a moment, but must be known once the upload will be started. Server must also support
 // "creation-defer-length" extension for this feature.
 //
-// This method may return ErrUploadTooLarge if upload size exceeds maximum MaxSize that server is capable to accept.
+// This method may return ErrUploadTooLarge if upload size exceeds maximum MaxSize that server is capable to accept
+// (if the server has advertised MaxSize, we check it before the request and wrap UploadSizeError).
 // If other unexpected response has received from the server, method returns ErrUnexpectedResponse
 func (c *Client) CreateUpload(u *Upload, remoteSize int64, partial bool, meta map[string]string) (response *http.Response, err error) {
 	if u == nil {
 		panic("u is nil")
 	}
-	if err = c.ensureExtension("creation"); err != nil {
+	if err = c.ensureExtension(ExtensionCreation); err != nil {
+		return
+	}
+	if err = c.checkUploadSize(remoteSize); err != nil {
 		return
 	}
+	meta = c.mergeMetadata(meta)
 
 	var req *http.Request
 	if req, err = c.GetRequest(http.MethodPost, c.BaseURL.String(), nil, c, c.client); err != nil {
@@ -173,11 +322,11 @@ func (c *Client) CreateUpload(u *Upload, remoteSize int64, partial bool, meta ma
 	}
 	switch {
 	case remoteSize == SizeUnknown:
-		if err = c.ensureExtension("creation-defer-length"); err != nil {
+		if err = c.ensureExtension(ExtensionCreationDeferLength); err != nil {
 			return
 		}
 		req.Header.Set("Upload-Defer-Length", "1")
-	case remoteSize > 0:
+	case remoteSize >= 0:
 		req.Header.Set("Upload-Length", strconv.FormatInt(remoteSize, 10))
 	default:
 		panic(fmt.Sprintf("upload size is negative: %d", remoteSize))
@@ -185,7 +334,7 @@ func (c *Client) CreateUpload(u *Upload, remoteSize int64, partial bool, meta ma
 
 	if len(meta) > 0 {
 		var m string
-		if m, err = EncodeMetadata(meta); err != nil {
+		if m, err = c.encodeMetadata(meta); err != nil {
 			return
 		}
 		req.Header.Set("Upload-Metadata", m)
@@ -194,28 +343,36 @@ func (c *Client) CreateUpload(u *Upload, remoteSize int64, partial bool, meta ma
 	if response, err = c.tusRequest(c.ctx, req); err != nil {
 		return
 	}
-	defer response.Body.Close()
+	defer c.closeResponse(response)
 
 	switch response.StatusCode {
 	case http.StatusCreated:
+		if err = c.checkResumable(response); err != nil {
+			return
+		}
 		u2 := Upload{}
 		u2.Location = response.Header.Get("Location")
+		if u2.Location == "" {
+			c.recordDeviation(response, "lack of Location required header in response")
+		}
 		u2.Metadata = meta
 		u2.Partial = partial
 		u2.RemoteSize = remoteSize
+		u2.DeferredLength = remoteSize == SizeUnknown
+		u2.Extra = extraHeaders(response.Header)
 		if v := response.Header.Get("Upload-Expires"); v != "" {
 			var t time.Time
 			if t, err = time.Parse(time.RFC1123, v); err != nil {
-				err = ErrProtocol.WithErr(fmt.Errorf("cannot parse Upload-Expires RFC1123 header %q: %w", v, err))
+				err = c.protocolError(response, fmt.Errorf("cannot parse Upload-Expires RFC1123 header %q: %w", v, err))
 				return
 			}
 			u2.UploadExpired = &t
 		}
 		*u = u2
 	case http.StatusRequestEntityTooLarge:
-		err = ErrUploadTooLarge.WithResponse(response)
+		err = c.withResponse(ErrUploadTooLarge, response)
 	default:
-		err = ErrUnexpectedResponse
+		err = c.withResponse(ErrUnexpectedResponse, response)
 	}
 
 	return
@@ -229,40 +386,105 @@ func (c *Client) CreateUpload(u *Upload, remoteSize int64, partial bool, meta ma
 // This method may return ErrUnsupportedFeature if server doesn't support an extension. Also, it may return all errors
 // the UploadStream methods may return.
 func (c *Client) CreateUploadWithData(u *Upload, data []byte, remoteSize int64, partial bool, meta map[string]string) (uploadedBytes int64, response *http.Response, err error) {
-	if err = c.ensureExtension("creation-with-upload"); err != nil {
+	return c.CreateUploadWithReader(u, bytes.NewReader(data), int64(len(data)), remoteSize, partial, meta)
+}
+
+// CreateUploadWithReader is like CreateUploadWithData, but takes the data from a reader. Exactly `length` bytes are
+// read from r and streamed directly to the request body, so the large data don't need to be loaded in memory.
+// If `length` exceeds `remoteSize`, only `remoteSize` bytes are read. If `remoteSize` is SizeUnknown, the upload is
+// created with deferred length, which requires "creation-defer-length" extension.
+//
+// If the server accepts fewer bytes than sent, the rest of data is uploaded by PATCH requests the same way as
+// UploadStream does. This requires r to be io.Seeker, because the data after server offset has already been read.
+// Otherwise, the method returns io.ErrShortWrite with `u` filled in, so the caller can continue uploading. The
+// returned response is the last one received, i.e. the response to the last PATCH request in this case.
+//
+// If r ends before `length` bytes are read, the request is aborted and the method returns io.ErrUnexpectedEOF.
+func (c *Client) CreateUploadWithReader(u *Upload, r io.Reader, length, remoteSize int64, partial bool, meta map[string]string) (uploadedBytes int64, response *http.Response, err error) {
+	if err = c.ensureExtension(ExtensionCreationWithUpload); err != nil {
 		return
 	}
+	if err = c.checkUploadSize(remoteSize); err != nil {
+		return
+	}
+	meta = c.mergeMetadata(meta)
 	u2 := Upload{}
 	s := NewUploadStream(c, &u2)
-	s.ChunkSize = int64(len(data)) // Data must be uploaded in one request
+	s.ChunkSize = NoChunked // Data must be uploaded in one request
 	s.uploadMethod = http.MethodPost
-	headers := map[string]string{"Upload-Length": strconv.Itoa(int(remoteSize)), "Upload-Offset": ""}
-	if partial {
-		headers["Upload-Concat"] = "partial"
-	}
-	if len(meta) > 0 {
-		var m string
-		if m, err = EncodeMetadata(meta); err != nil {
-			return
-		}
-		headers["Upload-Metadata"] = m
+	var headers map[string]string
+	if headers, err = c.creationWithUploadHeaders(remoteSize, partial, meta); err != nil {
+		return
 	}
 	u2.RemoteSize = remoteSize
 	u2.Partial = partial
 	u2.Metadata = meta
+	u2.DeferredLength = remoteSize == SizeUnknown
 
-	rd := bytes.NewReader(data)
-	s.setupDirtyBuffer()
+	if remoteSize != SizeUnknown && length > remoteSize {
+		length = remoteSize
+	}
+	var start int64
+	seeker, canSeek := r.(io.Seeker)
+	if canSeek {
+		if start, err = seeker.Seek(0, io.SeekCurrent); err != nil {
+			return
+		}
+	}
+	rd := &exactReader{R: r, N: length}
 	uploadedBytes, _, response, err = s.uploadChunkImpl(c.BaseURL.String(), rd, headers) // Upload in one request
-	if err == nil {
-		u2.Location = response.Header.Get("Location")
-		u2.RemoteOffset = uploadedBytes
-		*u = u2
+	if err != nil {
+		return
+	}
+	u2.Location = response.Header.Get("Location")
+	u2.RemoteOffset = uploadedBytes
+	*u = u2
+	if uploadedBytes >= length {
+		return
+	}
+
+	// Server has accepted fewer bytes than we sent. Continue uploading the rest by PATCH requests
+	if !canSeek {
+		err = io.ErrShortWrite
+		return
+	}
+	if _, err = seeker.Seek(start+uploadedBytes, io.SeekStart); err != nil {
+		return
+	}
+	var n int64
+	s = NewUploadStream(c, u)
+	n, err = s.ReadFrom(&exactReader{R: r, N: length - uploadedBytes})
+	uploadedBytes += n
+	if s.LastResponse != nil {
+		response = s.LastResponse
 	}
 
 	return
 }
 
+// creationWithUploadHeaders returns the extra headers of "creation-with-upload" request
+func (c *Client) creationWithUploadHeaders(remoteSize int64, partial bool, meta map[string]string) (map[string]string, error) {
+	headers := map[string]string{"Upload-Length": strconv.Itoa(int(remoteSize)), "Upload-Offset": ""}
+	if remoteSize == SizeUnknown {
+		if err := c.ensureExtension(ExtensionCreationDeferLength); err != nil {
+			return nil, err
+		}
+		headers["Upload-Length"] = ""
+		headers["Upload-Defer-Length"] = "1"
+	}
+	if partial {
+		headers["Upload-Concat"] = "partial"
+	}
+	if len(meta) > 0 {
+		m, err := c.encodeMetadata(meta)
+		if err != nil {
+			return nil, err
+		}
+		headers["Upload-Metadata"] = m
+	}
+	return headers, nil
+}
+
 // DeleteUpload deletes an upload. Receives `u` with upload to be deleted. Returns http response from server
 // (with closed body) and error (if any).
 //
@@ -272,7 +494,7 @@ func (c *Client) CreateUploadWithData(u *Upload, data []byte, remoteSize int64,
 // the server doesn't support "termination" extension. If unexpected response has received from the
 // server, the method returns ErrUnexpectedResponse
 func (c *Client) DeleteUpload(u Upload) (response *http.Response, err error) {
-	if err = c.ensureExtension("termination"); err != nil {
+	if err = c.ensureExtension(ExtensionTermination); err != nil {
 		return
 	}
 
@@ -288,22 +510,75 @@ func (c *Client) DeleteUpload(u Upload) (response *http.Response, err error) {
 	if response, err = c.tusRequest(c.ctx, req); err != nil {
 		return
 	}
-	defer response.Body.Close()
+	defer c.closeResponse(response)
 
 	switch response.StatusCode {
 	case http.StatusNoContent:
+		err = c.checkResumable(response)
 	case http.StatusNotFound, http.StatusGone, http.StatusForbidden:
-		err = ErrUploadDoesNotExist.WithResponse(response)
+		err = c.notExistError(&u, response)
 	default:
-		err = ErrUnexpectedResponse
+		err = c.withResponse(ErrUnexpectedResponse, response)
 	}
 
 	return
 }
 
+// DeleteUploadAndReset deletes an upload the same way as DeleteUpload does, and on success resets `u`, so the stale
+// upload state can't be reused accidentally.
+func (c *Client) DeleteUploadAndReset(u *Upload) (response *http.Response, err error) {
+	if u == nil {
+		panic("u is nil")
+	}
+	if response, err = c.DeleteUpload(*u); err == nil {
+		u.Reset()
+	}
+	return
+}
+
+// DeleteByLocation deletes an upload by its location. Useful when only the upload URL is known.
+func (c *Client) DeleteByLocation(location string) (response *http.Response, err error) {
+	return c.DeleteUpload(Upload{Location: location})
+}
+
+// DeleteUploads deletes many uploads using at most `concurrency` parallel requests. Returns the errors slice, where
+// an item is the result of DeleteUpload for upload with the same index, nil means the upload has been deleted.
+//
+// Useful for cleanup jobs removing a lot of abandoned uploads. The uploads already deleted on the server get
+// ErrUploadDoesNotExist, so the caller may consider them as deleted as well.
+func (c *Client) DeleteUploads(uploads []Upload, concurrency int) (errs []error) {
+	if concurrency <= 0 {
+		panic("concurrency must be positive")
+	}
+	errs = make([]error, len(uploads))
+	if err := c.ensureExtension(ExtensionTermination); err != nil {
+		for i := range errs {
+			errs[i] = err
+		}
+		return
+	}
+
+	wg := sync.WaitGroup{}
+	sem := make(chan struct{}, concurrency)
+	for i := range uploads {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(i int) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			_, errs[i] = c.DeleteUpload(uploads[i])
+		}(i)
+	}
+	wg.Wait()
+
+	return
+}
+
 // ConcatenateUploads makes a request to concatenate the partial uploads created before into one final upload. Fills
-// `final` with upload that was created. Returns http response from server
-// (with closed body) and error (if any).
+// `final` with upload that was created, with Final flag and the partial uploads locations set. Returns http response
+// from server (with closed body) and error (if any).
 //
 // Server must support "concatenation" extension for this feature. Typically, partial uploads must be fully uploaded
 // to the server, but if server supports "concatenation-unfinished" extension, it may accept unfinished uploads.
@@ -317,12 +592,7 @@ func (c *Client) ConcatenateUploads(final *Upload, partials []Upload, meta map[s
 	if len(partials) == 0 {
 		panic("must be at least one partial upload to concatenate")
 	}
-	if err = c.ensureExtension("concatenation"); err != nil {
-		return
-	}
-
-	var req *http.Request
-	if req, err = c.GetRequest(http.MethodPost, c.BaseURL.String(), nil, c, c.client); err != nil {
+	if err = c.ensureExtension(ExtensionConcatenation); err != nil {
 		return
 	}
 
@@ -333,11 +603,33 @@ func (c *Client) ConcatenateUploads(final *Upload, partials []Upload, meta map[s
 		}
 		locations = append(locations, f.Location)
 	}
+
+	return c.ConcatenateLocations(final, locations, meta)
+}
+
+// ConcatenateLocations is like ConcatenateUploads, but receives the locations of partial uploads. Useful if the caller
+// has persisted only the upload URLs. We don't check if the uploads are partial, the server does it.
+func (c *Client) ConcatenateLocations(final *Upload, locations []string, meta map[string]string) (response *http.Response, err error) {
+	if final == nil {
+		panic("final is nil")
+	}
+	if len(locations) == 0 {
+		panic("must be at least one partial upload to concatenate")
+	}
+	if err = c.ensureExtension(ExtensionConcatenation); err != nil {
+		return
+	}
+	meta = c.mergeMetadata(meta)
+
+	var req *http.Request
+	if req, err = c.GetRequest(http.MethodPost, c.BaseURL.String(), nil, c, c.client); err != nil {
+		return
+	}
 	req.Header.Set("Upload-Concat", "final;"+strings.Join(locations, " "))
 
 	if len(meta) > 0 {
 		var m string
-		if m, err = EncodeMetadata(meta); err != nil {
+		if m, err = c.encodeMetadata(meta); err != nil {
 			return
 		}
 		req.Header.Set("Upload-Metadata", m)
@@ -346,19 +638,150 @@ func (c *Client) ConcatenateUploads(final *Upload, partials []Upload, meta map[s
 	if response, err = c.tusRequest(c.ctx, req); err != nil {
 		return
 	}
-	defer response.Body.Close()
+	defer c.closeResponse(response)
 
 	switch response.StatusCode {
 	case http.StatusCreated:
-		u2 := Upload{}
+		if err = c.checkResumable(response); err != nil {
+			return
+		}
+		u2 := Upload{Final: true, FinalParts: slices.Clone(locations)}
 		u2.Location = response.Header.Get("Location")
 		u2.Metadata = meta
 		*final = u2
 	case http.StatusNotFound, http.StatusGone:
-		err = ErrUploadDoesNotExist.WithResponse(response)
+		err = c.notExistError(nil, response)
 	default:
-		err = ErrUnexpectedResponse
+		err = c.withResponse(ErrUnexpectedResponse, response)
+	}
+	return
+}
+
+// UploadLarge creates an upload and uploads `size` bytes from r into it. If size exceeds maxPartSize, we split the data
+// into partial uploads of at most maxPartSize bytes, upload them one by one and concatenate them into a final upload.
+// Fills `final` with the upload created. Returns the partial uploads (if the data has been split), the http response
+// of the last request (with closed body) and error (if any). The partial uploads are returned on error as well, so
+// the failed part can be resumed, or the parts can be deleted.
+//
+// If maxPartSize is not positive, the server MaxSize is used. If it's not set as well, the data is uploaded without
+// splitting. Splitting requires the "concatenation" extension on server.
+//
+// This method may return all errors CreateUpload, ConcatenateUploads and UploadStream methods may return. Also, it
+// returns io.ErrShortWrite if r has ended before `size` bytes were uploaded.
+func (c *Client) UploadLarge(final *Upload, r io.ReaderAt, size, maxPartSize int64, meta map[string]string) (partials []Upload, response *http.Response, err error) {
+	if final == nil {
+		panic("final is nil")
+	}
+	if maxPartSize <= 0 {
+		if err = c.ensureExtension(ExtensionCreation); err != nil {
+			return
+		}
+		if caps := c.CurrentCapabilities(); caps != nil {
+			maxPartSize = caps.MaxSize
+		}
+	}
+	if maxPartSize <= 0 || size <= maxPartSize {
+		u := Upload{}
+		if response, err = c.CreateUpload(&u, size, false, meta); err != nil {
+			return
+		}
+		*final = u
+		err = c.uploadPart(final, io.NewSectionReader(r, 0, size))
+		return
+	}
+
+	if err = c.ensureExtension(ExtensionConcatenation); err != nil {
+		return
+	}
+	partials = make([]Upload, 0, (size+maxPartSize-1)/maxPartSize)
+	for off := int64(0); off < size; off += maxPartSize {
+		partSize := min(maxPartSize, size-off)
+		p := Upload{}
+		if response, err = c.CreateUpload(&p, partSize, true, nil); err != nil {
+			return
+		}
+		err = c.uploadPart(&p, io.NewSectionReader(r, off, partSize))
+		partials = append(partials, p)
+		if err != nil {
+			return
+		}
 	}
+
+	response, err = c.ConcatenateUploads(final, partials, meta)
+	return
+}
+
+func (c *Client) uploadPart(u *Upload, r io.Reader) error {
+	if _, err := NewUploadStream(c, u).ReadFrom(r); err != nil {
+		return err
+	}
+	if !u.IsComplete() {
+		return io.ErrShortWrite
+	}
+	return nil
+}
+
+// UploadFromReader creates an upload and uploads the data from r, which length is not known beforehand and which can't
+// be read again, e.g. os.Stdin, a named pipe or a network stream. Fills `u` with the upload created. Returns count of
+// bytes uploaded, the http response of the last request (with closed body) and error (if any).
+//
+// We create an upload with deferred size and upload r by chunks. Once r has been drawn out, we send the upload size
+// along with the last chunk. Server must support "creation-defer-length" extension for this feature.
+//
+// Since r can't be repositioned, we keep the current chunk in memory (the UploadStream default ChunkSize) until
+// the server acknowledges it, and retry it on transient errors as many times as UploadStream.MaxAttempts allows.
+// The data consumed from r, but not acknowledged by the server, is lost if the attempts are exhausted, so
+// the upload can't be resumed from r after that.
+//
+// This method may return all errors CreateUpload and UploadStream methods may return.
+func (c *Client) UploadFromReader(u *Upload, r io.Reader, partial bool, meta map[string]string) (uploadedBytes int64, response *http.Response, err error) {
+	if u == nil {
+		panic("u is nil")
+	}
+	if err = c.ensureExtension(ExtensionCreationDeferLength); err != nil {
+		return
+	}
+	br := bufio.NewReader(r)
+	if _, err = br.Peek(1); errors.Is(err, io.EOF) {
+		response, err = c.CreateUpload(u, 0, partial, meta) // Nothing to upload
+		return
+	} else if err != nil {
+		return
+	}
+	if response, err = c.CreateUpload(u, SizeUnknown, partial, meta); err != nil {
+		return
+	}
+
+	s := NewUploadStream(c, u)
+	uploadedBytes, err = s.uploadUnseekable(br)
+	if s.LastResponse != nil {
+		response = s.LastResponse
+	}
+	return
+}
+
+// ResumeUpload continues uploading src to the existing upload by its location, e.g. after the process restart. We
+// obtain the upload from the server, seek src to the server offset and upload the rest of data. The src beginning must
+// correspond to the upload offset 0. If the upload is already complete, we do nothing.
+//
+// Returns the stream used for uploading, so the caller may inspect its Upload and LastResponse, or call ReadFrom again
+// to continue after an error. The stream is nil if the upload has not been obtained.
+//
+// This method may return all errors GetUpload and UploadStream.ReadFrom may return.
+func (c *Client) ResumeUpload(ctx context.Context, location string, src io.ReadSeeker) (stream *UploadStream, err error) {
+	cl := c.WithContext(ctx)
+	u := Upload{}
+	if _, err = cl.GetUpload(&u, location); err != nil {
+		return
+	}
+	stream = NewUploadStream(cl, &u)
+	if u.IsComplete() {
+		return
+	}
+	if _, err = src.Seek(u.RemoteOffset, io.SeekStart); err != nil {
+		return
+	}
+	_, err = stream.ReadFrom(src)
 	return
 }
 
@@ -379,7 +802,7 @@ func (c *Client) ConcatenateStreams(final *Upload, streams []*UploadStream, meta
 	uploads := make([]Upload, 0)
 	for i, s := range streams {
 		if s.Tell() < s.Len() {
-			if err = c.ensureExtension("concatenation-unfinished"); err != nil {
+			if err = c.ensureExtension(ExtensionConcatenationUnfinished); err != nil {
 				return nil, fmt.Errorf("stream #%d is not finished: %w", i, err)
 			}
 		}
@@ -389,9 +812,92 @@ func (c *Client) ConcatenateStreams(final *Upload, streams []*UploadStream, meta
 	return c.ConcatenateUploads(final, uploads, meta)
 }
 
+// PollOptions set the polling intervals. The interval is multiplied by Multiplier after every attempt, but doesn't
+// exceed MaxInterval. Zero values are replaced by defaults: Interval is 1 second, MaxInterval is 30 seconds,
+// Multiplier is 2.
+type PollOptions struct {
+	Interval    time.Duration
+	MaxInterval time.Duration
+	Multiplier  float64
+}
+
+// WaitForConcatenation polls the final upload `u` until server finishes its concatenation, i.e. until the upload
+// offset and size are known and are equal. The size is known only if server has sent Upload-Length, since its absence
+// doesn't mean the zero size. Fills `u` with upload info on every attempt. Returns error if GetUpload has failed or
+// ctx is done.
+func (c *Client) WaitForConcatenation(ctx context.Context, u *Upload, opts PollOptions) error {
+	if u == nil {
+		panic("u is nil")
+	}
+	if opts.Interval <= 0 {
+		opts.Interval = time.Second
+	}
+	if opts.MaxInterval <= 0 {
+		opts.MaxInterval = 30 * time.Second
+	}
+	if opts.Multiplier <= 0 {
+		opts.Multiplier = 2
+	}
+
+	cl := c.WithContext(ctx)
+	interval := opts.Interval
+	for {
+		response, err := cl.GetUpload(u, u.Location)
+		if err != nil {
+			return err
+		}
+		// When concatenation still in progress the offset can be either OffsetUnknown or a value less than size
+		// depending on server implementation. Also, server may not send the size until it's computed
+		if response.Header.Get("Upload-Length") != "" && u.IsComplete() {
+			return nil
+		}
+
+		t := time.NewTimer(interval)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return ctx.Err()
+		case <-t.C:
+		}
+		if interval = time.Duration(float64(interval) * opts.Multiplier); interval > opts.MaxInterval {
+			interval = opts.MaxInterval
+		}
+	}
+}
+
+// AssumeCapabilities sets the statically declared server capabilities, so the client never makes OPTIONS requests
+// to obtain them. Useful for servers which don't implement OPTIONS or require authorization for it. Such capabilities
+// never become stale, regardless of CapabilitiesTTL.
+func (c *Client) AssumeCapabilities(caps ServerCapabilities) {
+	c.lockCapabilities()
+	defer c.unlockCapabilities()
+	c.publishCapabilitiesLocked(&caps, time.Time{})
+}
+
+// CurrentCapabilities returns the server capabilities fetched or assumed by the client or its copies, nil if they are
+// not known yet. Unlike Capabilities field, it's safe to call concurrently with the requests. The returned object
+// must not be modified, since it's shared between the client copies.
+func (c *Client) CurrentCapabilities() *ServerCapabilities {
+	c.lockCapabilities()
+	defer c.unlockCapabilities()
+	return c.capabilitiesLocked()
+}
+
 // UpdateCapabilities gathers server capabilities and updates Capabilities client variable. Returns http response
 // from server (with closed body) and error (if any).
 func (c *Client) UpdateCapabilities() (response *http.Response, err error) {
+	var caps *ServerCapabilities
+	if caps, response, err = c.fetchCapabilities(); err != nil {
+		return
+	}
+	c.lockCapabilities()
+	defer c.unlockCapabilities()
+	c.publishCapabilitiesLocked(caps, time.Now())
+	return
+}
+
+// fetchCapabilities requests the server capabilities by OPTIONS request
+func (c *Client) fetchCapabilities() (caps *ServerCapabilities, response *http.Response, err error) {
 	var req *http.Request
 	if req, err = c.GetRequest(http.MethodOptions, c.BaseURL.String(), nil, c, c.client); err != nil {
 		return
@@ -399,83 +905,413 @@ func (c *Client) UpdateCapabilities() (response *http.Response, err error) {
 	if response, err = c.tusRequest(c.ctx, req); err != nil {
 		return
 	}
-	defer response.Body.Close()
+	defer c.closeResponse(response)
 
 	switch response.StatusCode {
 	case http.StatusNoContent, http.StatusOK:
-		c.Capabilities = &ServerCapabilities{}
+		caps = &ServerCapabilities{}
 		if v := response.Header.Get("Tus-Max-Size"); v != "" {
-			if c.Capabilities.MaxSize, err = strconv.ParseInt(v, 10, 64); err != nil {
-				err = ErrProtocol.WithErr(fmt.Errorf("cannot parse Tus-Max-Size integer value %q: %w", v, err))
-				return
+			if caps.MaxSize, err = strconv.ParseInt(v, 10, 64); err != nil {
+				err = c.protocolError(response, fmt.Errorf("cannot parse Tus-Max-Size integer value %q: %w", v, err))
+				return nil, response, err
 			}
 		}
-		if v := response.Header.Get("Tus-Extension"); v != "" {
-			c.Capabilities.Extensions = strings.Split(v, ",")
+		if v := c.headerValue(response, "Tus-Extension"); v != "" {
+			caps.Extensions = strings.Split(v, ",")
 		}
 		if v := response.Header.Get("Tus-Version"); v != "" {
-			c.Capabilities.ProtocolVersions = strings.Split(v, ",")
+			caps.ProtocolVersions = strings.Split(v, ",")
 		}
-		if v := response.Header.Get("Tus-Checksum-Algorithm"); v != "" {
-			c.Capabilities.ChecksumAlgorithms = strings.Split(v, ",")
+		if v := c.headerValue(response, "Tus-Checksum-Algorithm"); v != "" {
+			caps.ChecksumAlgorithms = strings.Split(v, ",")
 		}
 	default:
-		err = ErrUnexpectedResponse
+		err = c.withResponse(ErrUnexpectedResponse, response)
 	}
 	return
 }
 
+// Do sends a custom request with Tus protocol semantics: sets Tus-Resumable and default headers, applies middlewares
+// and returns ErrProtocol if server doesn't support the protocol version (412 response). Useful to make requests of
+// extensions the library doesn't support. If ctx is nil, the client context is used.
+//
+// As with http.Client.Do, the caller must close the response body. Body is closed if error is returned.
+func (c *Client) Do(ctx context.Context, req *http.Request) (*http.Response, error) {
+	if ctx == nil {
+		ctx = c.ctx
+	}
+	return c.tusRequest(ctx, req)
+}
+
 func (c *Client) tusRequest(ctx context.Context, req *http.Request) (response *http.Response, err error) {
 	if req.Method != http.MethodOptions && req.Header.Get("Tus-Resumable") == "" {
 		req.Header.Set("Tus-Resumable", c.ProtocolVersion)
 	}
+	for k, v := range c.DefaultHeaders {
+		if len(req.Header.Values(k)) == 0 {
+			for _, vv := range v {
+				req.Header.Add(k, vv)
+			}
+		}
+	}
+	if c.ExpectContinue && req.Body != nil && req.Body != http.NoBody && req.ContentLength != 0 &&
+		req.Header.Get("Expect") == "" {
+		req.Header.Set("Expect", "100-continue")
+	}
 	if ctx != nil {
 		req = req.WithContext(ctx)
 	}
-	response, err = c.client.Do(req)
-	if err == nil && response.StatusCode == http.StatusPreconditionFailed {
+	var probe bool
+	if c.CircuitBreaker != nil {
+		if probe, err = c.CircuitBreaker.allow(); err != nil {
+			if req.Body != nil {
+				_ = req.Body.Close()
+			}
+			return
+		}
+	}
+	response, err = c.do(req)
+	if c.CircuitBreaker != nil {
+		c.CircuitBreaker.done(probe, breakerResultOf(response, err))
+	}
+	switch {
+	case err != nil && response != nil && response.Body != nil:
+		c.closeResponse(response) // Middleware may return the response along with error
+	case err == nil && response.StatusCode == http.StatusPreconditionFailed:
 		versions := response.Header.Get("Tus-Version")
-		err = ErrProtocol.WithText(fmt.Sprintf("request protocol version %q, server supported versions are %q", c.ProtocolVersion, versions))
+		err = ErrProtocol.WithErr(fmt.Errorf(
+			"request protocol version %q, server supported versions are %q: %w", c.ProtocolVersion, versions, c.errorDetails(response),
+		))
+		c.closeResponse(response)
 	}
 	return
 }
 
-func (c *Client) ensureExtension(extension string) error {
-	if c.Capabilities == nil {
-		if _, err := c.UpdateCapabilities(); err != nil {
-			return fmt.Errorf("cannot obtain server capabilities: %w", err)
+// do sends the request through Middlewares
+func (c *Client) do(req *http.Request) (*http.Response, error) {
+	if len(c.Middlewares) == 0 {
+		return c.client.Do(req) // The method value would allocate on every request
+	}
+	do := c.client.Do
+	for i := len(c.Middlewares) - 1; i >= 0; i-- {
+		do = c.Middlewares[i](do)
+	}
+	return do(req)
+}
+
+// checkResumable returns ErrProtocol if a successful response lacks Tus-Resumable header, unless the client is lenient
+func (c *Client) checkResumable(response *http.Response) error {
+	if response.Header.Get("Tus-Resumable") != "" {
+		return nil
+	}
+	c.recordDeviation(response, "lack of Tus-Resumable required header in response")
+	if c.Lenient {
+		return nil
+	}
+	return ErrProtocol.WithText("lack of Tus-Resumable required header in response")
+}
+
+// headerValue returns the response header value. In lenient mode, the value is converted to lower case, since
+// the protocol values are always lower case
+func (c *Client) headerValue(response *http.Response, key string) string {
+	v := response.Header.Get(key)
+	if lv := strings.ToLower(v); lv != v {
+		c.recordDeviation(response, "%s header value %q is not lower case", key, v)
+		if c.Lenient {
+			return lv
 		}
 	}
-	for _, e := range c.Capabilities.Extensions {
-		if extension == e {
-			return nil
+	return v
+}
+
+// recordDeviation records the protocol deviation observed in response to Deviations report, if it's set
+func (c *Client) recordDeviation(response *http.Response, format string, args ...any) {
+	if c.Deviations != nil {
+		c.Deviations.Record(newDeviation(response, fmt.Sprintf(format, args...)))
+	}
+}
+
+// protocolError records the deviation and returns ErrProtocol wrapping err
+func (c *Client) protocolError(response *http.Response, err error) TusError {
+	c.recordDeviation(response, "%s", err)
+	return ErrProtocol.WithErr(err)
+}
+
+// buffers returns the buffer pool shared between the client copies, nil if the client has not been created by NewClient
+func (c *Client) buffers() *bufferPool {
+	if c.state == nil {
+		return nil
+	}
+	return &c.state.buffers
+}
+
+// DiscardedConnections returns the number of connections which could not be reused, because the response body was too
+// large to drain it or the error occurred while draining. The value is shared between the client copies.
+func (c *Client) DiscardedConnections() int64 {
+	if c.state == nil {
+		return 0
+	}
+	return c.state.discardedConns.Load()
+}
+
+// closeResponse drains and closes the response body. The http client reuses the connection only if the previous
+// response body was read to the end, so we read out the body, but no more than maxDrainSize bytes.
+func (c *Client) closeResponse(response *http.Response) {
+	if response.Body == http.NoBody { // Responses with no content, such as 204, have nothing to drain
+		return
+	}
+	n, err := io.Copy(io.Discard, io.LimitReader(response.Body, maxDrainSize+1))
+	if (err != nil || n > maxDrainSize) && c.state != nil {
+		c.state.discardedConns.Add(1)
+	}
+	_ = response.Body.Close()
+}
+
+func (c *Client) capabilitiesStale() bool {
+	if c.state == nil || c.Capabilities != c.fetchedCapabilities {
+		return false // Capabilities assigned manually
+	}
+	updated := c.state.capabilitiesUpdated
+	return c.CapabilitiesTTL > 0 && !updated.IsZero() && time.Since(updated) > c.CapabilitiesTTL
+}
+
+func (c *Client) ensureExtension(extension Extension) error {
+	if c.SkipExtensionChecks {
+		return nil
+	}
+	caps, err := c.loadCapabilities()
+	if err != nil {
+		return fmt.Errorf("cannot obtain server capabilities: %w", err)
+	}
+	if !caps.HasExtension(extension) {
+		return ErrUnsupportedFeature.WithText(string(extension))
+	}
+	return nil
+}
+
+// loadCapabilities returns the capabilities, updating them if they are not fetched yet or stale. If several
+// goroutines call it at the same time, only one request is made. The lock is not held during the request, so the
+// request hooks may read the capabilities.
+func (c *Client) loadCapabilities() (*ServerCapabilities, error) {
+	if c.state == nil {
+		if c.Capabilities == nil {
+			if _, err := c.UpdateCapabilities(); err != nil {
+				return nil, err
+			}
+		}
+		return c.Capabilities, nil
+	}
+
+	c.state.capabilitiesMu.Lock()
+	if caps := c.capabilitiesLocked(); caps != nil && !c.capabilitiesStale() {
+		c.state.capabilitiesMu.Unlock()
+		return caps, nil
+	}
+	call := c.state.capabilitiesCall
+	if call == nil {
+		call = &capabilitiesCall{done: make(chan struct{})}
+		c.state.capabilitiesCall = call
+		c.state.capabilitiesMu.Unlock()
+
+		var caps *ServerCapabilities
+		caps, _, call.err = c.fetchCapabilities()
+		c.state.capabilitiesMu.Lock()
+		if call.err == nil {
+			c.state.capabilities, c.state.capabilitiesUpdated = caps, time.Now()
+		}
+		c.state.capabilitiesCall = nil
+		c.state.capabilitiesMu.Unlock()
+		close(call.done)
+	} else {
+		c.state.capabilitiesMu.Unlock()
+		var ctxDone <-chan struct{}
+		if c.ctx != nil {
+			ctxDone = c.ctx.Done()
+		}
+		select {
+		case <-call.done:
+		case <-ctxDone:
+			return nil, c.ctx.Err()
+		}
+	}
+	if call.err != nil {
+		return nil, call.err
+	}
+	return c.CurrentCapabilities(), nil
+}
+
+// capabilitiesLocked returns the capabilities assigned to the Capabilities field manually, or the shared ones
+func (c *Client) capabilitiesLocked() *ServerCapabilities {
+	if c.state == nil || c.Capabilities != c.fetchedCapabilities {
+		return c.Capabilities
+	}
+	return c.state.capabilities
+}
+
+// publishCapabilitiesLocked sets the shared capabilities and the Capabilities field. We publish a new object every
+// time, since the concurrent readers may already use the previous one
+func (c *Client) publishCapabilitiesLocked(caps *ServerCapabilities, updated time.Time) {
+	if c.state != nil {
+		c.state.capabilities, c.state.capabilitiesUpdated = caps, updated
+	}
+	c.Capabilities, c.fetchedCapabilities = caps, caps
+}
+
+// lockCapabilities locks the capabilities. We don't return the unlock function, since it would allocate on every
+// upload request
+func (c *Client) lockCapabilities() {
+	if c.state != nil {
+		c.state.capabilitiesMu.Lock()
+	}
+}
+
+func (c *Client) unlockCapabilities() {
+	if c.state != nil {
+		c.state.capabilitiesMu.Unlock()
+	}
+}
+
+// checkUploadSize returns ErrUploadTooLarge if size exceeds the server limit known from capabilities
+func (c *Client) checkUploadSize(size int64) error {
+	if caps := c.CurrentCapabilities(); caps != nil && caps.MaxSize > 0 && size > caps.MaxSize {
+		return ErrUploadTooLarge.WithErr(UploadSizeError{Size: size, Limit: caps.MaxSize})
+	}
+	return nil
+}
+
+// withResponse is like TusError.WithResponse, but also parses the response body by ErrorBodyParser
+func (c *Client) withResponse(te TusError, response *http.Response) TusError {
+	if errors.Is(te, ErrUnexpectedResponse) {
+		c.recordDeviation(response, "unexpected response status code %d", response.StatusCode)
+	}
+	return te.WithErr(c.errorDetails(response))
+}
+
+// errorDetails returns ErrorDetails of the response with body parsed by ErrorBodyParser
+func (c *Client) errorDetails(response *http.Response) ErrorDetails {
+	d := newErrorDetails(response)
+	if c.ErrorBodyParser != nil && len(d.Body) > 0 {
+		if code, message, ok := c.ErrorBodyParser(d.Body); ok {
+			d.Code, d.Message = code, message
+		}
+	}
+	return d
+}
+
+// notExistError returns ErrUploadDoesNotExist for a response. If the upload is known to be expired, either by its
+// UploadExpired or by Upload-Expires response header, the error is ErrUploadExpired, wrapping ErrUploadDoesNotExist.
+// u may be nil.
+func (c *Client) notExistError(u *Upload, response *http.Response) TusError {
+	err := c.withResponse(ErrUploadDoesNotExist, response)
+	if response.StatusCode != http.StatusNotFound && response.StatusCode != http.StatusGone {
+		return err
+	}
+	now := time.Now()
+	expired := u != nil && u.Expired(now)
+	if v := response.Header.Get("Upload-Expires"); v != "" {
+		if t, e := time.Parse(time.RFC1123, v); e == nil && !now.Before(t) {
+			expired = true
 		}
 	}
-	return ErrUnsupportedFeature.WithText(extension)
+	if expired {
+		return ErrUploadExpired.WithErr(err)
+	}
+	return err
+}
+
+func (c *Client) mergeMetadata(meta map[string]string) map[string]string {
+	if len(c.DefaultMetadata) == 0 {
+		return meta
+	}
+	res := make(map[string]string, len(c.DefaultMetadata)+len(meta))
+	for k, v := range c.DefaultMetadata {
+		res[k] = v
+	}
+	for k, v := range meta {
+		res[k] = v
+	}
+	return res
+}
+
+func (c *Client) encodeMetadata(meta map[string]string) (string, error) {
+	m, err := EncodeMetadata(meta)
+	if err != nil {
+		return "", err
+	}
+	if c.MaxMetadataSize > 0 && len(m) > c.MaxMetadataSize {
+		return "", ErrMetadataTooLarge.WithErr(MetadataSizeError{Size: len(m), Limit: c.MaxMetadataSize})
+	}
+	return m, nil
 }
 
-// EncodeMetadata converts map of values to the Tus Upload-Metadata header format
+// metadataKeysPool keeps the slices for sorting metadata keys
+var metadataKeysPool = sync.Pool{New: func() any {
+	k := make([]string, 0, 16)
+	return &k
+}}
+
+// EncodeMetadata converts map of values to the Tus Upload-Metadata header format. A key with empty value is encoded
+// as a bare key without value, as the protocol allows.
+//
+// Keys are encoded in sorted order, so the result is the same for the same metadata. The result length is computed
+// beforehand, so the header value is built in a single allocation.
 func EncodeMetadata(metadata map[string]string) (string, error) {
-	var encoded []string
+	keysp := metadataKeysPool.Get().(*[]string)
+	defer metadataKeysPool.Put(keysp)
+	keys := (*keysp)[:0]
 
+	size := 0
 	for k, v := range metadata {
 		if strings.Contains(k, " ") {
 			return "", fmt.Errorf("key %q contains spaces", k)
 		}
-		encoded = append(encoded, fmt.Sprintf("%s %s", k, base64.StdEncoding.EncodeToString([]byte(v))))
+		keys = append(keys, k)
+		size += len(k) + 1 // Key and comma
+		if v != "" {
+			size += 1 + base64.StdEncoding.EncodedLen(len(v))
+		}
+	}
+	*keysp = keys
+	if size == 0 {
+		return "", nil
+	}
+	slices.Sort(keys)
+
+	bufp := encodeBufPool.Get().(*[]byte)
+	defer encodeBufPool.Put(bufp)
+	b := strings.Builder{}
+	b.Grow(size - 1) // No trailing comma
+	for i, k := range keys {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(k)
+		if v := metadata[k]; v != "" {
+			b.WriteByte(' ')
+			// Put the value to the scratch buffer and encode it just after it
+			buf := append((*bufp)[:0], v...)
+			buf = base64.StdEncoding.AppendEncode(buf, buf)
+			b.Write(buf[len(v):])
+			*bufp = buf
+		}
 	}
 
-	return strings.Join(encoded, ","), nil
+	return b.String(), nil
 }
 
-// DecodeMetadata decodes metadata in Tus Upload-Metadata header format
+// DecodeMetadata decodes metadata in Tus Upload-Metadata header format. A bare key without value is decoded as
+// a key with empty value.
 func DecodeMetadata(raw string) (map[string]string, error) {
 	res := make(map[string]string)
 	for _, item := range strings.Split(raw, ",") {
-		kv := strings.SplitN(item, " ", 2)
-		if len(kv) <= 1 {
+		kv := strings.SplitN(strings.TrimSpace(item), " ", 2)
+		if kv[0] == "" {
 			return res, fmt.Errorf("metadata item %q has bad format", item)
 		}
+		if len(kv) == 1 {
+			res[kv[0]] = ""
+			continue
+		}
 		val, err := base64.StdEncoding.DecodeString(kv[1])
 		if err != nil {
 			return res, err
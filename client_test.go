@@ -1,19 +1,26 @@
 package tusgo
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
 	"io"
 	"math/rand"
 	"net/http"
 	"net/url"
 	"reflect"
+	"slices"
 	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
 	"github.com/vitorsalgado/mocha/v3"
 	"github.com/vitorsalgado/mocha/v3/expect"
+	"github.com/vitorsalgado/mocha/v3/params"
 	"github.com/vitorsalgado/mocha/v3/reply"
 )
 
@@ -27,10 +34,34 @@ func tRequest(method, location string, emptyHeaders []string) *mocha.MockBuilder
 	return b
 }
 
+// closeTracker is a response body which remembers if it has been closed
+type closeTracker struct {
+	io.Reader
+	closed bool
+}
+
+func (ct *closeTracker) Close() error {
+	ct.closed = true
+	return nil
+}
+
 func tReply(startReply *reply.StdReply) *reply.StdReply {
 	return startReply.Header("Tus-Resumable", "1.0.0")
 }
 
+// modifyCapabilities makes the client assume the modified copy of its current capabilities
+func modifyCapabilities(c *Client, modify func(caps *ServerCapabilities)) {
+	caps := *c.CurrentCapabilities()
+	caps.Extensions = slices.Clone(caps.Extensions)
+	modify(&caps)
+	c.AssumeCapabilities(caps)
+}
+
+// assumeExtensions makes the client assume the extensions in addition to the current capabilities
+func assumeExtensions(c *Client, extensions ...string) {
+	modifyCapabilities(c, func(caps *ServerCapabilities) { caps.Extensions = append(caps.Extensions, extensions...) })
+}
+
 var _ = Describe("Client", func() {
 	var testClient *Client
 	var testURL *url.URL
@@ -42,9 +73,9 @@ var _ = Describe("Client", func() {
 		srvMock.Start()
 		testURL, _ = url.Parse(srvMock.URL())
 		testClient = NewClient(http.DefaultClient, testURL)
-		testClient.Capabilities = &ServerCapabilities{
+		testClient.AssumeCapabilities(ServerCapabilities{
 			ProtocolVersions: []string{"1.0.0"},
-		}
+		})
 		tusHeaders = []string{"Upload-Concat", "Upload-Defer-Length", "Upload-Length", "Upload-Metadata", "Upload-Checksum", "Upload-Offset"}
 	})
 	AfterEach(func() {
@@ -117,6 +148,35 @@ var _ = Describe("Client", func() {
 					MatchError(ContainSubstring("protocol error: request protocol version \"1.0.0\", server supported versions are \"1.0.1,0.9.0\"")),
 				))
 			})
+			It("should keep the response body excerpt on http 412", func() {
+				srvMock.AddMocks(tRequest(http.MethodGet, "/foo", tusHeaders).
+					Reply(reply.Status(http.StatusPreconditionFailed).
+						Header("Tus-Version", "1.0.1").
+						BodyString("unsupported version")),
+				)
+				req, err := http.NewRequest(http.MethodGet, srvMock.URL()+"/foo", nil)
+				Ω(err).Should(Succeed())
+
+				_, err = testClient.tusRequest(context.Background(), req)
+				var details ErrorDetails
+				Ω(errors.As(err, &details)).Should(BeTrue())
+				Ω(details.StatusCode).Should(Equal(http.StatusPreconditionFailed))
+				Ω(string(details.Body)).Should(Equal("unsupported version"))
+			})
+			It("should close the response returned by middleware along with error", func() {
+				body := &closeTracker{Reader: bytes.NewReader([]byte("error"))}
+				testClient.Middlewares = []Middleware{func(_ DoFunc) DoFunc {
+					return func(_ *http.Request) (*http.Response, error) {
+						return &http.Response{StatusCode: http.StatusBadGateway, Body: body}, io.ErrUnexpectedEOF
+					}
+				}}
+				req, err := http.NewRequest(http.MethodGet, srvMock.URL()+"/foo", nil)
+				Ω(err).Should(Succeed())
+
+				_, err = testClient.tusRequest(context.Background(), req)
+				Ω(err).Should(MatchError(io.ErrUnexpectedEOF))
+				Ω(body.closed).Should(BeTrue())
+			})
 		})
 	})
 	Context("GetUpload", func() {
@@ -156,6 +216,53 @@ var _ = Describe("Client", func() {
 					}))
 				})
 			})
+			When("response has non-standard headers", func() {
+				It("should keep them in Extra", func() {
+					srvMock.AddMocks(tRequest(http.MethodHead, "/foo/bar", tusHeaders).
+						Reply(tReply(reply.OK()).
+							Header("Upload-Offset", "64").
+							Header("X-Request-Id", "abc").
+							Header("X-Upload-Id", "123")),
+					)
+					f := Upload{}
+
+					Ω(testClient.GetUpload(&f, "/foo/bar")).ShouldNot(BeNil())
+					Ω(f.Extra).Should(Equal(http.Header{"X-Request-Id": {"abc"}, "X-Upload-Id": {"123"}}))
+				})
+			})
+			When("upload with deferred length", func() {
+				It("should set size unknown", func() {
+					srvMock.AddMocks(tRequest(http.MethodHead, "/foo/bar", tusHeaders).
+						Reply(tReply(reply.OK()).
+							Header("Upload-Offset", "64").
+							Header("Upload-Defer-Length", "1")),
+					)
+					f := Upload{}
+
+					Ω(testClient.GetUpload(&f, "/foo/bar")).ShouldNot(BeNil())
+					Ω(f).Should(Equal(Upload{
+						Location:       "/foo/bar",
+						RemoteOffset:   64,
+						RemoteSize:     SizeUnknown,
+						DeferredLength: true,
+					}))
+				})
+			})
+			When("upload with expiration", func() {
+				It("should parse expiration time", func() {
+					dt := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+					srvMock.AddMocks(tRequest(http.MethodHead, "/foo/bar", tusHeaders).
+						Reply(tReply(reply.OK()).
+							Header("Upload-Offset", "64").
+							Header("Upload-Expires", dt.Format(time.RFC1123))),
+					)
+					f := Upload{}
+
+					Ω(testClient.GetUpload(&f, "/foo/bar")).ShouldNot(BeNil())
+					Ω(f.RemoteOffset).Should(BeEquivalentTo(64))
+					Ω(dt.Equal(*f.UploadExpired)).Should(BeTrue())
+				})
+			})
 			When("partial upload", func() {
 				It("should get upload info", func() {
 					srvMock.AddMocks(tRequest(http.MethodHead, "/foo/bar", tusHeaders).
@@ -177,7 +284,7 @@ var _ = Describe("Client", func() {
 				It("should get upload info", func() {
 					srvMock.AddMocks(tRequest(http.MethodHead, "/foo/bar", tusHeaders).
 						Reply(tReply(reply.OK()).
-							Header("Upload-Concat", "final").
+							Header("Upload-Concat", "final;/foo/1 http://example.com/foo/2").
 							Header("Upload-Offset", "64").
 							Header("Upload-Length", "1024")),
 					)
@@ -189,6 +296,8 @@ var _ = Describe("Client", func() {
 						RemoteOffset: 64,
 						Partial:      false,
 						RemoteSize:   1024,
+						Final:        true,
+						FinalParts:   []string{"/foo/1", "http://example.com/foo/2"},
 					}))
 				})
 				When("concatenated upload is still in progress", func() {
@@ -206,6 +315,7 @@ var _ = Describe("Client", func() {
 							Partial:      false,
 							RemoteSize:   1024,
 							RemoteOffset: OffsetUnknown,
+							Final:        true,
 						}))
 					})
 				})
@@ -235,6 +345,51 @@ var _ = Describe("Client", func() {
 					Entry("201", http.StatusCreated, ErrUnexpectedResponse),
 				)
 			})
+			When("upload has expired", func() {
+				It("should return ErrUploadExpired if server indicates expiration", func() {
+					dt := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+					srvMock.AddMocks(tRequest(http.MethodHead, "/foo/bar", tusHeaders).
+						Reply(tReply(reply.Status(http.StatusGone)).Header("Upload-Expires", dt.Format(time.RFC1123))),
+					)
+					f := Upload{}
+
+					_, err := testClient.GetUpload(&f, "/foo/bar")
+					Ω(err).Should(MatchError(ErrUploadExpired))
+					Ω(err).Should(MatchError(ErrUploadDoesNotExist))
+				})
+				It("should return ErrUploadExpired if upload is expired locally", func() {
+					dt := time.Now().Add(-time.Minute)
+					srvMock.AddMocks(tRequest(http.MethodHead, "/foo/bar", tusHeaders).Reply(reply.Status(http.StatusNotFound)))
+					f := Upload{UploadExpired: &dt}
+
+					_, err := testClient.GetUpload(&f, "/foo/bar")
+					Ω(err).Should(MatchError(ErrUploadExpired))
+					Ω(err).Should(MatchError(ErrUploadDoesNotExist))
+				})
+				It("should not return ErrUploadExpired if upload is not expired yet", func() {
+					dt := time.Now().Add(time.Hour)
+					srvMock.AddMocks(tRequest(http.MethodHead, "/foo/bar", tusHeaders).Reply(reply.Status(http.StatusNotFound)))
+					f := Upload{UploadExpired: &dt}
+
+					_, err := testClient.GetUpload(&f, "/foo/bar")
+					Ω(err).Should(MatchError(ErrUploadDoesNotExist))
+					Ω(err).ShouldNot(MatchError(ErrUploadExpired))
+				})
+			})
+			When("corrupted Upload-Expires value", func() {
+				It("should return protocol error", func() {
+					srvMock.AddMocks(tRequest(http.MethodHead, "/foo/bar", tusHeaders).
+						Reply(tReply(reply.OK()).
+							Header("Upload-Offset", "64").
+							Header("Upload-Expires", "asdf")),
+					)
+					f := Upload{}
+
+					_, err := testClient.GetUpload(&f, "/foo/bar")
+					Ω(err).Should(MatchError(ContainSubstring("cannot parse Upload-Expires RFC1123 header")))
+					Ω(f).Should(Equal(Upload{}))
+				})
+			})
 			When("corrupted numeric header value", func() {
 				DescribeTable("should return protocol error",
 					func(header, value string) {
@@ -258,7 +413,7 @@ var _ = Describe("Client", func() {
 	Context("CreateUpload", func() {
 		Context("happy path", func() {
 			BeforeEach(func() {
-				testClient.Capabilities.Extensions = append(testClient.Capabilities.Extensions, "creation")
+				assumeExtensions(testClient, "creation")
 			})
 			When("upload with size, without metadata", func() {
 				It("should create upload", func() {
@@ -278,6 +433,23 @@ var _ = Describe("Client", func() {
 					}))
 				})
 			})
+			When("response has non-standard headers", func() {
+				It("should keep them in Extra", func() {
+					srvMock.AddMocks(tRequest(http.MethodPost, "/", nil).
+						Reply(tReply(reply.Created()).
+							Header("Location", "/foo/bar").
+							Header("X-Request-Id", "abc")),
+					)
+					f := Upload{}
+
+					Ω(testClient.CreateUpload(&f, 1024, false, nil)).ShouldNot(BeNil())
+					Ω(f).Should(Equal(Upload{
+						RemoteSize: 1024,
+						Location:   "/foo/bar",
+						Extra:      http.Header{"X-Request-Id": {"abc"}},
+					}))
+				})
+			})
 			When("upload with size, with metadata", func() {
 				It("should encode metadata and create upload", func() {
 					eh := []string{"Upload-Concat", "Upload-Defer-Length", "Upload-Checksum", "Upload-Offset"}
@@ -305,6 +477,43 @@ var _ = Describe("Client", func() {
 					}))
 				})
 			})
+			When("client has default metadata", func() {
+				It("should merge it with metadata passed by caller", func() {
+					eh := []string{"Upload-Concat", "Upload-Defer-Length", "Upload-Checksum", "Upload-Offset"}
+					testClient.DefaultMetadata = map[string]string{"tenant": "foo", "key1": "default"}
+					md := map[string]string{"key1": "value1"}
+					expectMd := map[string]string{"tenant": "foo", "key1": "value1"}
+					srvMock.AddMocks(tRequest(http.MethodPost, "/", eh).
+						Header("Upload-Metadata", expect.Func(func(v any, _ expect.Args) (bool, error) {
+							m, e := DecodeMetadata(v.(string))
+							return reflect.DeepEqual(m, expectMd), e
+						})).
+						Reply(tReply(reply.Created()).
+							Header("Location", "/foo/bar")),
+					)
+					f := Upload{}
+
+					Ω(testClient.CreateUpload(&f, 1024, false, md)).ShouldNot(BeNil())
+					Ω(f.Metadata).Should(Equal(expectMd))
+					Ω(md).Should(Equal(map[string]string{"key1": "value1"}))
+				})
+			})
+			When("upload with metadata, the same request twice", func() {
+				It("should send byte-identical Upload-Metadata header", func() {
+					eh := []string{"Upload-Concat", "Upload-Defer-Length", "Upload-Checksum", "Upload-Offset"}
+					md := map[string]string{"key2": "&^%$\"\t", "key1": "value1", "key3": ""}
+					srvMock.AddMocks(tRequest(http.MethodPost, "/", eh).
+						Header("Upload-Metadata", expect.ToEqual("key1 dmFsdWUx,key2 Jl4lJCIJ,key3")).
+						Repeat(2).
+						Reply(tReply(reply.Created()).
+							Header("Location", "/foo/bar")),
+					)
+					f := Upload{}
+
+					Ω(testClient.CreateUpload(&f, 1024, false, md)).ShouldNot(BeNil())
+					Ω(testClient.CreateUpload(&f, 1024, false, md)).ShouldNot(BeNil())
+				})
+			})
 			When("partial upload with size, with metadata", func() {
 				It("should encode metadata and create upload", func() {
 					eh := []string{"Upload-Defer-Length", "Upload-Checksum", "Upload-Offset"}
@@ -336,7 +545,7 @@ var _ = Describe("Client", func() {
 			})
 			When("partial upload with defer size, with metadata", func() {
 				It("should encode metadata and create upload", func() {
-					testClient.Capabilities.Extensions = append(testClient.Capabilities.Extensions, "creation-defer-length")
+					assumeExtensions(testClient, "creation-defer-length")
 					eh := []string{"Upload-Length", "Upload-Checksum", "Upload-Offset"}
 					md := map[string]string{
 						"key1": "value1",
@@ -357,14 +566,30 @@ var _ = Describe("Client", func() {
 
 					Ω(testClient.CreateUpload(&f, SizeUnknown, true, md)).ShouldNot(BeNil())
 					Ω(f).Should(Equal(Upload{
-						RemoteSize: SizeUnknown,
-						Location:   "/foo/bar",
-						Metadata:   md,
-						Partial:    true,
+						RemoteSize:     SizeUnknown,
+						Location:       "/foo/bar",
+						Metadata:       md,
+						Partial:        true,
+						DeferredLength: true,
 					}))
 				})
 			})
 		})
+		Context("upload size exceeds server MaxSize", func() {
+			It("should return error without request", func() {
+				assumeExtensions(testClient, "creation")
+				modifyCapabilities(testClient, func(caps *ServerCapabilities) { caps.MaxSize = 1024 })
+				f := Upload{}
+
+				resp, err := testClient.CreateUpload(&f, 1025, false, nil)
+				Ω(resp).Should(BeNil())
+				Ω(err).Should(MatchError(ErrUploadTooLarge))
+				var se UploadSizeError
+				Ω(errors.As(err, &se)).Should(BeTrue())
+				Ω(se).Should(Equal(UploadSizeError{Size: 1025, Limit: 1024}))
+				Ω(f).Should(Equal(Upload{}))
+			})
+		})
 		Context("error path", func() {
 			When("f is nil", func() {
 				It("should panic", func() {
@@ -379,7 +604,7 @@ var _ = Describe("Client", func() {
 				))
 			})
 			Specify("no creation-defer-length extension and trying to create defer size upload", func() {
-				testClient.Capabilities.Extensions = append(testClient.Capabilities.Extensions, "creation")
+				assumeExtensions(testClient, "creation")
 				f := Upload{}
 				_, err := testClient.CreateUpload(&f, SizeUnknown, false, nil)
 				Ω(err).Should(And(
@@ -388,13 +613,13 @@ var _ = Describe("Client", func() {
 			})
 			When("upload size is negative", func() {
 				It("should panic", func() {
-					testClient.Capabilities.Extensions = append(testClient.Capabilities.Extensions, "creation")
+					assumeExtensions(testClient, "creation")
 					f := Upload{}
 					Ω(func() { _, _ = testClient.CreateUpload(&f, -2, false, nil) }).Should(Panic())
 				})
 			})
 			Specify("metadata key contains a space", func() {
-				testClient.Capabilities.Extensions = append(testClient.Capabilities.Extensions, "creation")
+				assumeExtensions(testClient, "creation")
 				md := map[string]string{
 					"key 1": "value1",
 					"key2":  "&^%$\"\t",
@@ -403,11 +628,23 @@ var _ = Describe("Client", func() {
 				_, err := testClient.CreateUpload(&f, 1024, false, md)
 				Ω(err).Should(MatchError(ContainSubstring("key \"key 1\" contains spaces")))
 			})
+			Specify("encoded metadata exceeds the limit", func() {
+				assumeExtensions(testClient, "creation")
+				testClient.MaxMetadataSize = 16
+				md := map[string]string{"key1": "value1", "key2": "value2"}
+				f := Upload{}
+				resp, err := testClient.CreateUpload(&f, 1024, false, md)
+				Ω(resp).Should(BeNil())
+				Ω(err).Should(MatchError(ErrMetadataTooLarge))
+				var sizeErr MetadataSizeError
+				Ω(errors.As(err, &sizeErr)).Should(BeTrue())
+				Ω(sizeErr).Should(Equal(MetadataSizeError{Size: 27, Limit: 16}))
+			})
 			When("http error or unexpected code", func() {
 				DescribeTable("should return error",
 					func(status int, expectErr error) {
 						eh := []string{"Upload-Concat", "Upload-Defer-Length", "Upload-Metadata", "Upload-Checksum", "Upload-Offset"}
-						testClient.Capabilities.Extensions = append(testClient.Capabilities.Extensions, "creation")
+						assumeExtensions(testClient, "creation")
 						srvMock.AddMocks(tRequest(http.MethodPost, "/", eh).
 							Header("Content-Length", expect.ToEqual("0")).
 							Header("Upload-Length", expect.ToEqual("1024")).
@@ -420,6 +657,7 @@ var _ = Describe("Client", func() {
 						Ω(f).Should(Equal(Upload{RemoteSize: 0}))
 					},
 					Entry("413", http.StatusRequestEntityTooLarge, ErrUploadTooLarge),
+					Entry("431", http.StatusRequestHeaderFieldsTooLarge, ErrUnexpectedResponse),
 					Entry("404", http.StatusNotFound, ErrUnexpectedResponse),
 					Entry("410", http.StatusGone, ErrUnexpectedResponse),
 					Entry("403", http.StatusForbidden, ErrUnexpectedResponse),
@@ -432,7 +670,7 @@ var _ = Describe("Client", func() {
 	Context("CreateUploadWithData", func() {
 		Context("happy path", func() {
 			BeforeEach(func() {
-				testClient.Capabilities.Extensions = append(testClient.Capabilities.Extensions, "creation", "creation-with-upload")
+				assumeExtensions(testClient, "creation", "creation-with-upload")
 			})
 			When("upload without metadata", func() {
 				DescribeTable("should upload data in one request",
@@ -464,6 +702,116 @@ var _ = Describe("Client", func() {
 					Entry("full upload length", 1024),
 				)
 			})
+			When("upload with deferred length", func() {
+				It("should upload data and leave the size deferred", func() {
+					assumeExtensions(testClient, "creation-defer-length")
+					eh := []string{"Upload-Concat", "Upload-Length", "Upload-Metadata", "Upload-Checksum", "Upload-Offset"}
+					srvMock.AddMocks(tRequest(http.MethodPost, "/", eh).
+						Header("Content-Length", expect.ToEqual("5")).
+						Header("Upload-Defer-Length", expect.ToEqual("1")).
+						Body(expect.ToEqual([]byte("hello"))).
+						Reply(tReply(reply.Created()).
+							Header("Location", "/foo/bar").
+							Header("Upload-Offset", "5")),
+					)
+					u := Upload{}
+
+					bytes, resp, err := testClient.CreateUploadWithData(&u, []byte("hello"), SizeUnknown, false, nil)
+					Ω(bytes).Should(BeEquivalentTo(5))
+					Ω(resp).ShouldNot(BeNil())
+					Ω(err).Should(Succeed())
+					Ω(u).Should(Equal(Upload{
+						RemoteSize:     SizeUnknown,
+						Location:       "/foo/bar",
+						RemoteOffset:   5,
+						DeferredLength: true,
+					}))
+				})
+			})
+			When("upload from reader", func() {
+				It("should stream data in one request", func() {
+					eh := []string{"Upload-Concat", "Upload-Defer-Length", "Upload-Metadata", "Upload-Checksum", "Upload-Offset"}
+					d, _ := io.ReadAll(io.LimitReader(rand.New(rand.NewSource(time.Now().UnixNano())), 1024))
+					srvMock.AddMocks(tRequest(http.MethodPost, "/", eh).
+						Header("Content-Length", expect.ToEqual("512")).
+						Header("Upload-Length", expect.ToEqual("1024")).
+						Header("Content-Type", expect.ToEqual("application/offset+octet-stream")).
+						Body(expect.ToEqual(d[:512])).
+						Reply(tReply(reply.Created()).
+							Header("Location", "/foo/bar").
+							Header("Upload-Offset", "512")),
+					)
+					u := Upload{}
+					rd := io.MultiReader(bytes.NewReader(d)) // Hide the reader size
+
+					n, resp, err := testClient.CreateUploadWithReader(&u, rd, 512, 1024, false, nil)
+					Ω(n).Should(BeEquivalentTo(512))
+					Ω(resp).ShouldNot(BeNil())
+					Ω(err).Should(Succeed())
+					Ω(u).Should(Equal(Upload{
+						RemoteSize:   1024,
+						Location:     "/foo/bar",
+						RemoteOffset: 512,
+					}))
+				})
+				It("should return io.ErrUnexpectedEOF if reader is shorter than length", func() {
+					d, _ := io.ReadAll(io.LimitReader(rand.New(rand.NewSource(time.Now().UnixNano())), 512))
+					u := Upload{}
+					rd := io.MultiReader(bytes.NewReader(d))
+
+					n, _, err := testClient.CreateUploadWithReader(&u, rd, 1024, 1024, false, nil)
+					Ω(n).Should(BeEquivalentTo(0))
+					Ω(err).Should(MatchError(io.ErrUnexpectedEOF))
+					Ω(u).Should(Equal(Upload{}))
+				})
+			})
+			When("server accepts fewer bytes than sent", func() {
+				It("should continue uploading by PATCH", func() {
+					d, _ := io.ReadAll(io.LimitReader(rand.New(rand.NewSource(time.Now().UnixNano())), 1024))
+					srvMock.AddMocks(
+						tRequest(http.MethodPost, "/", nil).
+							Body(expect.ToEqual(d)).
+							Reply(tReply(reply.Created()).
+								Header("Location", "/foo/bar").
+								Header("Upload-Offset", "256")),
+						tRequest(http.MethodPatch, "/foo/bar", nil).
+							Header("Upload-Offset", expect.ToEqual("256")).
+							Body(expect.ToEqual(d[256:])).
+							Reply(tReply(reply.NoContent()).Header("Upload-Offset", "1024")),
+					)
+					u := Upload{}
+
+					n, resp, err := testClient.CreateUploadWithData(&u, d, 1024, false, nil)
+					Ω(n).Should(BeEquivalentTo(1024))
+					Ω(resp).ShouldNot(BeNil())
+					Ω(resp.StatusCode).Should(Equal(http.StatusNoContent)) // The last PATCH response
+					Ω(err).Should(Succeed())
+					Ω(u).Should(Equal(Upload{
+						RemoteSize:   1024,
+						Location:     "/foo/bar",
+						RemoteOffset: 1024,
+					}))
+				})
+				It("should return io.ErrShortWrite if reader is not seekable", func() {
+					d, _ := io.ReadAll(io.LimitReader(rand.New(rand.NewSource(time.Now().UnixNano())), 1024))
+					srvMock.AddMocks(tRequest(http.MethodPost, "/", nil).
+						Reply(tReply(reply.Created()).
+							Header("Location", "/foo/bar").
+							Header("Upload-Offset", "256")),
+					)
+					u := Upload{}
+					rd := io.MultiReader(bytes.NewReader(d))
+
+					n, _, err := testClient.CreateUploadWithReader(&u, rd, 1024, 1024, false, nil)
+					Ω(n).Should(BeEquivalentTo(256))
+					Ω(err).Should(MatchError(io.ErrShortWrite))
+					Ω(u).Should(Equal(Upload{
+						RemoteSize:   1024,
+						Location:     "/foo/bar",
+						RemoteOffset: 256,
+					}))
+				})
+			})
 			When("upload all data with metadata", func() {
 				It("should upload data in one request and add metadata", func() {
 					eh := []string{"Upload-Concat", "Upload-Defer-Length", "Upload-Checksum", "Upload-Offset"}
@@ -527,7 +875,7 @@ var _ = Describe("Client", func() {
 		})
 		Context("error path", func() {
 			Specify("no 'creation-with-upload' extension", func() {
-				testClient.Capabilities.Extensions = append(testClient.Capabilities.Extensions, "creation")
+				assumeExtensions(testClient, "creation")
 				f := Upload{Location: "/foo/bar"}
 				bytes, resp, err := testClient.CreateUploadWithData(&f, make([]byte, 10), 1024, false, nil)
 				Ω(bytes).Should(BeEquivalentTo(0))
@@ -538,7 +886,7 @@ var _ = Describe("Client", func() {
 			})
 			DescribeTable("http errors handling",
 				func(expectStatus int, expectErr error) {
-					testClient.Capabilities.Extensions = append(testClient.Capabilities.Extensions, "creation", "creation-with-upload")
+					assumeExtensions(testClient, "creation", "creation-with-upload")
 					d, _ := io.ReadAll(io.LimitReader(rand.New(rand.NewSource(time.Now().UnixNano())), 1024))
 					eh := []string{"Upload-Defer-Length", "Upload-Metadata", "Upload-Checksum", "Upload-Offset"}
 					srvMock.AddMocks(tRequest(http.MethodPost, "/", eh).
@@ -572,7 +920,7 @@ var _ = Describe("Client", func() {
 	Context("DeleteUpload", func() {
 		Context("happy path", func() {
 			BeforeEach(func() {
-				testClient.Capabilities.Extensions = append(testClient.Capabilities.Extensions, "termination")
+				assumeExtensions(testClient, "termination")
 			})
 			Specify("make a request", func() {
 				srvMock.AddMocks(
@@ -582,8 +930,65 @@ var _ = Describe("Client", func() {
 				Ω(testClient.DeleteUpload(f)).ShouldNot(BeNil())
 				Ω(f).Should(Equal(Upload{Location: "/foo/bar"}))
 			})
+			Specify("reset upload on success", func() {
+				srvMock.AddMocks(
+					tRequest(http.MethodDelete, "/foo/bar", tusHeaders).
+						Reply(tReply(reply.NoContent())))
+				f := Upload{Location: "/foo/bar", RemoteSize: 1024, RemoteOffset: 512, Partial: true}
+				Ω(testClient.DeleteUploadAndReset(&f)).ShouldNot(BeNil())
+				Ω(f).Should(BeZero())
+			})
+			Specify("delete by location", func() {
+				srvMock.AddMocks(
+					tRequest(http.MethodDelete, "/foo/bar", tusHeaders).
+						Reply(tReply(reply.NoContent())))
+				Ω(testClient.DeleteByLocation("/foo/bar")).ShouldNot(BeNil())
+			})
 		})
 		Context("error path", func() {
+			Specify("keep upload on error", func() {
+				assumeExtensions(testClient, "termination")
+				srvMock.AddMocks(tRequest(http.MethodDelete, "/foo/bar", tusHeaders).Reply(reply.InternalServerError()))
+				f := Upload{Location: "/foo/bar", RemoteOffset: 512}
+				_, err := testClient.DeleteUploadAndReset(&f)
+				Ω(err).Should(MatchError(ErrUnexpectedResponse))
+				Ω(f).Should(Equal(Upload{Location: "/foo/bar", RemoteOffset: 512}))
+			})
+			Specify("error details", func() {
+				assumeExtensions(testClient, "termination")
+				srvMock.AddMocks(tRequest(http.MethodDelete, "/foo/bar", tusHeaders).
+					Reply(reply.InternalServerError().Header("X-Request-Id", "abc").Header("X-Other", "1").BodyString("oops")))
+
+				_, err := testClient.DeleteByLocation("/foo/bar")
+				Ω(err).Should(MatchError(ErrUnexpectedResponse))
+				Ω(err).Should(MatchError("unexpected HTTP response code: HTTP 500: oops"))
+				var details ErrorDetails
+				Ω(errors.As(err, &details)).Should(BeTrue())
+				Ω(details.StatusCode).Should(Equal(http.StatusInternalServerError))
+				Ω(details.Header).Should(HaveKeyWithValue("X-Request-Id", []string{"abc"}))
+				Ω(details.Header).ShouldNot(HaveKey("X-Other"))
+				Ω(details.Body).Should(Equal([]byte("oops")))
+			})
+			Specify("error details with parsed body", func() {
+				assumeExtensions(testClient, "termination")
+				testClient.ErrorBodyParser = TusdErrorBodyParser
+				srvMock.AddMocks(tRequest(http.MethodDelete, "/foo/bar", tusHeaders).
+					Reply(reply.InternalServerError().BodyString(`{"error":{"code":"ERR_INTERNAL","message":"disk full"}}`)))
+
+				_, err := testClient.DeleteByLocation("/foo/bar")
+				Ω(err).Should(MatchError("unexpected HTTP response code: HTTP 500: ERR_INTERNAL: disk full"))
+				var details ErrorDetails
+				Ω(errors.As(err, &details)).Should(BeTrue())
+				Ω(details.Code).Should(Equal("ERR_INTERNAL"))
+				Ω(details.Message).Should(Equal("disk full"))
+			})
+			Specify("error details without body", func() {
+				assumeExtensions(testClient, "termination")
+				srvMock.AddMocks(tRequest(http.MethodDelete, "/foo/bar", tusHeaders).Reply(reply.NotFound()))
+
+				_, err := testClient.DeleteByLocation("/foo/bar")
+				Ω(err).Should(MatchError("upload does not exist: HTTP 404: <no body>"))
+			})
 			Specify("no termination extension", func() {
 				f := Upload{Location: "/foo/bar"}
 				_, err := testClient.DeleteUpload(f)
@@ -594,7 +999,7 @@ var _ = Describe("Client", func() {
 			When("http error or unexpected code", func() {
 				DescribeTable("should return error",
 					func(status int, expectErr error) {
-						testClient.Capabilities.Extensions = append(testClient.Capabilities.Extensions, "termination")
+						assumeExtensions(testClient, "termination")
 						srvMock.AddMocks(tRequest(http.MethodDelete, "/foo/bar", tusHeaders).Reply(reply.Status(status)))
 						f := Upload{Location: "/foo/bar"}
 
@@ -613,10 +1018,151 @@ var _ = Describe("Client", func() {
 			})
 		})
 	})
+	Context("lenient mode", func() {
+		It("should return error if response lacks Tus-Resumable in strict mode", func() {
+			srvMock.AddMocks(tRequest(http.MethodHead, "/foo/bar", tusHeaders).
+				Reply(reply.OK().Header("Upload-Offset", "64")))
+			f := Upload{}
+
+			_, err := testClient.GetUpload(&f, "/foo/bar")
+			Ω(err).Should(MatchError(ErrProtocol))
+		})
+		It("should tolerate missing Tus-Resumable and header values case", func() {
+			testClient.Lenient = true
+			srvMock.AddMocks(tRequest(http.MethodHead, "/foo/bar", tusHeaders).
+				Reply(reply.OK().Header("Upload-Offset", "64").Header("Upload-Concat", "Partial")))
+			f := Upload{}
+
+			_, err := testClient.GetUpload(&f, "/foo/bar")
+			Ω(err).Should(Succeed())
+			Ω(f.RemoteOffset).Should(BeEquivalentTo(64))
+			Ω(f.Partial).Should(BeTrue())
+		})
+		It("should lowercase capabilities values", func() {
+			testClient.Lenient = true
+			srvMock.AddMocks(mocha.Request().Method(http.MethodOptions).URL(expect.URLPath("/")).
+				Reply(reply.NoContent().Header("Tus-Extension", "Creation,Termination").Header("Tus-Version", "1.0.0")))
+
+			_, err := testClient.UpdateCapabilities()
+			Ω(err).Should(Succeed())
+			Ω(testClient.CurrentCapabilities().HasExtension(ExtensionTermination)).Should(BeTrue())
+		})
+		It("should tolerate 200 on PATCH", func() {
+			testClient.Lenient = true
+			srvMock.AddMocks(tRequest(http.MethodPatch, "/foo/bar", nil).
+				Reply(reply.OK().Header("Upload-Offset", "256")))
+			u := Upload{Location: "/foo/bar", RemoteSize: 1024}
+
+			Ω(NewUploadStream(testClient, &u).Write(make([]byte, 256))).Should(Equal(256))
+			Ω(u.RemoteOffset).Should(BeEquivalentTo(256))
+		})
+		It("should assume all data accepted if creation response lacks Upload-Offset", func() {
+			testClient.Lenient = true
+			assumeExtensions(testClient, "creation", "creation-with-upload")
+			srvMock.AddMocks(tRequest(http.MethodPost, "/", nil).
+				Reply(reply.Created().Header("Location", "/foo/bar")))
+			u := Upload{}
+
+			n, _, err := testClient.CreateUploadWithData(&u, make([]byte, 512), 1024, false, nil)
+			Ω(err).Should(Succeed())
+			Ω(n).Should(BeEquivalentTo(512))
+			Ω(u.RemoteOffset).Should(BeEquivalentTo(512))
+		})
+	})
+	Context("deviations report", func() {
+		It("should record the protocol deviations", func() {
+			testClient.Lenient = true
+			testClient.Deviations = &DeviationReport{}
+			srvMock.AddMocks(
+				tRequest(http.MethodHead, "/foo/bar", tusHeaders).
+					Reply(reply.OK().Header("Upload-Offset", "64").Header("Upload-Concat", "Partial")),
+				tRequest(http.MethodHead, "/foo/baz", tusHeaders).
+					Reply(tReply(reply.OK()).Header("Cache-Control", "no-store").Header("Upload-Offset", "asdf")),
+			)
+
+			_, err := testClient.GetUpload(&Upload{}, "/foo/bar")
+			Ω(err).Should(Succeed())
+			_, err = testClient.GetUpload(&Upload{}, "/foo/baz")
+			Ω(err).Should(MatchError(ErrProtocol))
+
+			deviations := testClient.Deviations.Deviations()
+			Ω(deviations).Should(HaveLen(4))
+			Ω(deviations[0].Method).Should(Equal(http.MethodHead))
+			Ω(deviations[0].URL).Should(HaveSuffix("/foo/bar"))
+			Ω(deviations[0].StatusCode).Should(Equal(http.StatusOK))
+			Ω(deviations[0].Description).Should(Equal("lack of Tus-Resumable required header in response"))
+			Ω(deviations[1].Description).Should(Equal("lack of Cache-Control: no-store header in HEAD response"))
+			Ω(deviations[2].Description).Should(Equal(`Upload-Concat header value "Partial" is not lower case`))
+			Ω(deviations[3].URL).Should(HaveSuffix("/foo/baz"))
+			Ω(deviations[3].Description).Should(HavePrefix(`cannot parse Upload-Offset header "asdf"`))
+		})
+		It("should record unexpected status codes", func() {
+			testClient.Deviations = &DeviationReport{}
+			srvMock.AddMocks(tRequest(http.MethodHead, "/foo/bar", tusHeaders).Reply(reply.Status(http.StatusCreated)))
+
+			_, err := testClient.GetUpload(&Upload{}, "/foo/bar")
+			Ω(err).Should(MatchError(ErrUnexpectedResponse))
+			deviations := testClient.Deviations.Deviations()
+			Ω(deviations).Should(HaveLen(1))
+			Ω(deviations[0].StatusCode).Should(Equal(http.StatusCreated))
+			Ω(deviations[0].Description).Should(Equal("unexpected response status code 201"))
+		})
+	})
+	DescribeTable("TusdErrorBodyParser",
+		func(body string, expectCode, expectMessage string, expectOk bool) {
+			code, message, ok := TusdErrorBodyParser([]byte(body))
+			Ω(code).Should(Equal(expectCode))
+			Ω(message).Should(Equal(expectMessage))
+			Ω(ok).Should(Equal(expectOk))
+		},
+		Entry("nested", `{"error":{"code":"ERR_UPLOAD_NOT_FOUND","message":"upload not found"}}`, "ERR_UPLOAD_NOT_FOUND", "upload not found", true),
+		Entry("flat", `{"code":"ERR_UPLOAD_NOT_FOUND","message":"upload not found"}`, "ERR_UPLOAD_NOT_FOUND", "upload not found", true),
+		Entry("no fields", `{"foo":"bar"}`, "", "", false),
+		Entry("plain text", "upload not found", "", "", false),
+		Entry("truncated", `{"error":{"code":"ERR_UPLOAD_NOT`, "", "", false),
+	)
+	Context("response body draining", func() {
+		BeforeEach(func() {
+			assumeExtensions(testClient, "termination")
+		})
+		DescribeTable("should count discarded connections",
+			func(bodySize int, expect int) {
+				srvMock.AddMocks(tRequest(http.MethodDelete, "/foo/bar", tusHeaders).
+					Reply(reply.NotFound().Body(bytes.Repeat([]byte("aaaaaaa\n"), bodySize/8))))
+
+				_, err := testClient.WithContext(context.Background()).DeleteUpload(Upload{Location: "/foo/bar"})
+				Ω(err).Should(MatchError(ErrUploadDoesNotExist))
+				Ω(testClient.DiscardedConnections()).Should(BeEquivalentTo(expect))
+			},
+			Entry("small body is drained", 1024, 0),
+			Entry("large body is not drained", 256*1024, 1),
+		)
+	})
+	Context("DeleteUploads", func() {
+		It("should delete uploads and report errors per item", func() {
+			assumeExtensions(testClient, "termination")
+			srvMock.AddMocks(
+				tRequest(http.MethodDelete, "/foo/1", tusHeaders).Reply(tReply(reply.NoContent())),
+				tRequest(http.MethodDelete, "/foo/2", tusHeaders).Reply(tReply(reply.NotFound())),
+				tRequest(http.MethodDelete, "/foo/3", tusHeaders).Reply(tReply(reply.NoContent())),
+			)
+			uploads := []Upload{{Location: "/foo/1"}, {Location: "/foo/2"}, {Location: "/foo/3"}}
+
+			errs := testClient.DeleteUploads(uploads, 2)
+			Ω(errs).Should(HaveLen(3))
+			Ω(errs[0]).Should(Succeed())
+			Ω(errs[1]).Should(MatchError(ErrUploadDoesNotExist))
+			Ω(errs[2]).Should(Succeed())
+		})
+		It("should return error for every item if termination is not supported", func() {
+			errs := testClient.DeleteUploads([]Upload{{Location: "/foo/1"}, {Location: "/foo/2"}}, 2)
+			Ω(errs).Should(HaveEach(MatchError(ErrUnsupportedFeature)))
+		})
+	})
 	Context("ConcatenateUploads", func() {
 		Context("happy path", func() {
 			BeforeEach(func() {
-				testClient.Capabilities.Extensions = append(testClient.Capabilities.Extensions, "concatenation")
+				assumeExtensions(testClient, "concatenation")
 			})
 			When("send several uploads, no metadata", func() {
 				It("should make a request", func() {
@@ -631,11 +1177,25 @@ var _ = Describe("Client", func() {
 
 					Ω(testClient.ConcatenateUploads(&f, []Upload{f1, f2}, nil)).ShouldNot(BeNil())
 					Ω(f).Should(Equal(Upload{
-						Location: "/foo/bar/baz",
-						Partial:  false,
+						Location:   "/foo/bar/baz",
+						Final:      true,
+						FinalParts: []string{"/foo/bar", "/foo/baz"},
 					}))
 				})
 			})
+			When("send locations", func() {
+				It("should make a request", func() {
+					eh := []string{"Upload-Defer-Length", "Upload-Length", "Upload-Metadata", "Upload-Checksum", "Upload-Offset"}
+					srvMock.AddMocks(tRequest(http.MethodPost, "/", eh).
+						Header("Upload-Concat", expect.ToEqual("final;/foo/bar /foo/baz")).
+						Reply(tReply(reply.Created()).Header("Location", "/foo/bar/baz")),
+					)
+					f := Upload{}
+
+					Ω(testClient.ConcatenateLocations(&f, []string{"/foo/bar", "/foo/baz"}, nil)).ShouldNot(BeNil())
+					Ω(f).Should(Equal(Upload{Location: "/foo/bar/baz", Final: true, FinalParts: []string{"/foo/bar", "/foo/baz"}}))
+				})
+			})
 			When("send several uploads, with metadata", func() {
 				It("should make a request", func() {
 					eh := []string{"Upload-Defer-Length", "Upload-Length", "Upload-Checksum", "Upload-Offset"}
@@ -657,9 +1217,10 @@ var _ = Describe("Client", func() {
 
 					Ω(testClient.ConcatenateUploads(&f, []Upload{f1, f2}, md)).ShouldNot(BeNil())
 					Ω(f).Should(Equal(Upload{
-						Location: "/foo/bar/baz",
-						Partial:  false,
-						Metadata: md,
+						Location:   "/foo/bar/baz",
+						Final:      true,
+						FinalParts: []string{"/foo/bar", "/foo/baz"},
+						Metadata:   md,
 					}))
 				})
 			})
@@ -667,7 +1228,7 @@ var _ = Describe("Client", func() {
 		Context("error path", func() {
 			When("final is nil", func() {
 				It("should panic", func() {
-					testClient.Capabilities.Extensions = append(testClient.Capabilities.Extensions, "concatenation")
+					assumeExtensions(testClient, "concatenation")
 					f1 := Upload{Location: "/foo/bar", RemoteSize: 256, RemoteOffset: 256, Partial: true}
 					f2 := Upload{Location: "/foo/baz", RemoteSize: 512, RemoteOffset: 512, Partial: true}
 					Ω(func() { _, _ = testClient.ConcatenateUploads(nil, []Upload{f1, f2}, nil) }).Should(Panic())
@@ -675,7 +1236,7 @@ var _ = Describe("Client", func() {
 			})
 			When("uploads list is empty", func() {
 				It("should panic", func() {
-					testClient.Capabilities.Extensions = append(testClient.Capabilities.Extensions, "concatenation")
+					assumeExtensions(testClient, "concatenation")
 					f := Upload{}
 					Ω(func() { _, _ = testClient.ConcatenateUploads(&f, nil, nil) }).Should(Panic())
 					Ω(f).Should(Equal(Upload{}))
@@ -694,7 +1255,7 @@ var _ = Describe("Client", func() {
 			})
 			When("some uploads are not partial", func() {
 				It("should return error", func() {
-					testClient.Capabilities.Extensions = append(testClient.Capabilities.Extensions, "concatenation")
+					assumeExtensions(testClient, "concatenation")
 					f1 := Upload{Location: "/foo/bar", RemoteSize: 256, RemoteOffset: 256, Partial: true}
 					f2 := Upload{Location: "/foo/baz", RemoteSize: 512, RemoteOffset: 512, Partial: false}
 					f3 := Upload{Location: "/foo/baa", RemoteSize: 512, RemoteOffset: 512, Partial: true}
@@ -709,7 +1270,7 @@ var _ = Describe("Client", func() {
 				DescribeTable("should return error",
 					func(status int, expectErr error) {
 						eh := []string{"Upload-Defer-Length", "Upload-Length", "Upload-Metadata", "Upload-Checksum", "Upload-Offset"}
-						testClient.Capabilities.Extensions = append(testClient.Capabilities.Extensions, "concatenation")
+						assumeExtensions(testClient, "concatenation")
 						srvMock.AddMocks(tRequest(http.MethodPost, "/", eh).
 							Header("Upload-Concat", expect.ToEqual("final;/foo/bar /foo/baz")).
 							Reply(reply.Status(status)))
@@ -731,10 +1292,241 @@ var _ = Describe("Client", func() {
 			})
 		})
 	})
+	Context("UploadLarge", func() {
+		BeforeEach(func() {
+			assumeExtensions(testClient, "creation", "concatenation")
+		})
+		It("should split data into partial uploads and concatenate them", func() {
+			modifyCapabilities(testClient, func(caps *ServerCapabilities) { caps.MaxSize = 512 })
+			data, _ := io.ReadAll(io.LimitReader(rand.New(rand.NewSource(time.Now().UnixNano())), 1024))
+			srvMock.AddMocks(
+				tRequest(http.MethodPost, "/", nil).
+					Header("Upload-Concat", expect.ToEqual("partial")).
+					Header("Upload-Length", expect.ToEqual("512")).
+					Reply(reply.Seq().Add(
+						tReply(reply.Created()).Header("Location", "/foo/1"),
+						tReply(reply.Created()).Header("Location", "/foo/2"),
+					)),
+				tRequest(http.MethodPatch, "/foo/1", nil).
+					Body(expect.ToEqual(data[:512])).
+					Reply(tReply(reply.NoContent()).Header("Upload-Offset", "512")),
+				tRequest(http.MethodPatch, "/foo/2", nil).
+					Body(expect.ToEqual(data[512:])).
+					Reply(tReply(reply.NoContent()).Header("Upload-Offset", "512")),
+				tRequest(http.MethodPost, "/", nil).
+					Header("Upload-Concat", expect.ToEqual("final;/foo/1 /foo/2")).
+					Header("Upload-Metadata", expect.ToEqual("key1 dmFsdWUx")).
+					Reply(tReply(reply.Created()).Header("Location", "/foo/bar")),
+			)
+			f := Upload{}
+
+			partials, resp, err := testClient.UploadLarge(&f, bytes.NewReader(data), 1024, 0, map[string]string{"key1": "value1"})
+			Ω(err).Should(Succeed())
+			Ω(resp).ShouldNot(BeNil())
+			Ω(f.Location).Should(Equal("/foo/bar"))
+			Ω(partials).Should(Equal([]Upload{
+				{Location: "/foo/1", RemoteSize: 512, RemoteOffset: 512, Partial: true},
+				{Location: "/foo/2", RemoteSize: 512, RemoteOffset: 512, Partial: true},
+			}))
+		})
+		It("should return the created partial uploads if a part fails", func() {
+			modifyCapabilities(testClient, func(caps *ServerCapabilities) { caps.MaxSize = 512 })
+			data, _ := io.ReadAll(io.LimitReader(rand.New(rand.NewSource(time.Now().UnixNano())), 1536))
+			srvMock.AddMocks(
+				tRequest(http.MethodPost, "/", nil).
+					Header("Upload-Concat", expect.ToEqual("partial")).
+					Reply(reply.Seq().Add(
+						tReply(reply.Created()).Header("Location", "/foo/1"),
+						tReply(reply.Created()).Header("Location", "/foo/2"),
+					)),
+				tRequest(http.MethodPatch, "/foo/1", nil).
+					Reply(tReply(reply.NoContent()).Header("Upload-Offset", "512")),
+				tRequest(http.MethodPatch, "/foo/2", nil).
+					Reply(tReply(reply.Status(http.StatusForbidden))),
+			)
+			f := Upload{}
+
+			partials, _, err := testClient.UploadLarge(&f, bytes.NewReader(data), 1536, 0, nil)
+			Ω(err).Should(MatchError(ErrCannotUpload))
+			Ω(f).Should(Equal(Upload{}))
+			Ω(partials).Should(Equal([]Upload{
+				{Location: "/foo/1", RemoteSize: 512, RemoteOffset: 512, Partial: true},
+				{Location: "/foo/2", RemoteSize: 512, Partial: true},
+			}))
+		})
+		It("should upload without splitting if data fits", func() {
+			data, _ := io.ReadAll(io.LimitReader(rand.New(rand.NewSource(time.Now().UnixNano())), 1024))
+			srvMock.AddMocks(
+				tRequest(http.MethodPost, "/", []string{"Upload-Concat"}).
+					Header("Upload-Length", expect.ToEqual("1024")).
+					Reply(tReply(reply.Created()).Header("Location", "/foo/bar")),
+				tRequest(http.MethodPatch, "/foo/bar", nil).
+					Body(expect.ToEqual(data)).
+					Reply(tReply(reply.NoContent()).Header("Upload-Offset", "1024")),
+			)
+			f := Upload{}
+
+			partials, _, err := testClient.UploadLarge(&f, bytes.NewReader(data), 1024, 2048, nil)
+			Ω(err).Should(Succeed())
+			Ω(partials).Should(BeNil())
+			Ω(f).Should(Equal(Upload{Location: "/foo/bar", RemoteSize: 1024, RemoteOffset: 1024}))
+		})
+	})
+	Context("UploadFromReader", func() {
+		BeforeEach(func() {
+			assumeExtensions(testClient, "creation", "creation-defer-length")
+		})
+		It("should create upload with deferred size and send the size with the last chunk", func() {
+			data, _ := io.ReadAll(io.LimitReader(rand.New(rand.NewSource(time.Now().UnixNano())), 3*1024*1024))
+			srvMock.AddMocks(
+				tRequest(http.MethodPost, "/", []string{"Upload-Length"}).
+					Header("Upload-Defer-Length", expect.ToEqual("1")).
+					Reply(tReply(reply.Created()).Header("Location", "/foo/bar")),
+				tRequest(http.MethodPatch, "/foo/bar", []string{"Upload-Length"}).
+					Header("Upload-Offset", expect.ToEqual("0")).
+					Reply(tReply(reply.NoContent()).Header("Upload-Offset", "2097152")),
+				tRequest(http.MethodPatch, "/foo/bar", nil).
+					Header("Upload-Offset", expect.ToEqual("2097152")).
+					Header("Upload-Length", expect.ToEqual("3145728")).
+					Reply(tReply(reply.NoContent()).Header("Upload-Offset", "3145728")),
+			)
+			u := Upload{}
+
+			n, resp, err := testClient.UploadFromReader(&u, io.MultiReader(bytes.NewReader(data)), false, nil)
+			Ω(err).Should(Succeed())
+			Ω(n).Should(BeEquivalentTo(len(data)))
+			Ω(resp.StatusCode).Should(Equal(http.StatusNoContent))
+			Ω(u).Should(Equal(Upload{Location: "/foo/bar", RemoteSize: 3145728, RemoteOffset: 3145728}))
+		})
+		It("should send the size with empty request if the data ends on the chunk boundary", func() {
+			data, _ := io.ReadAll(io.LimitReader(rand.New(rand.NewSource(time.Now().UnixNano())), 2*1024*1024))
+			srvMock.AddMocks(
+				tRequest(http.MethodPost, "/", []string{"Upload-Length"}).
+					Header("Upload-Defer-Length", expect.ToEqual("1")).
+					Reply(tReply(reply.Created()).Header("Location", "/foo/bar")),
+				tRequest(http.MethodPatch, "/foo/bar", nil).
+					Header("Upload-Offset", expect.ToEqual("0")).
+					Header("Upload-Length", expect.ToEqual("2097152")).
+					Reply(tReply(reply.NoContent()).Header("Upload-Offset", "2097152")),
+			)
+			u := Upload{}
+
+			n, _, err := testClient.UploadFromReader(&u, io.MultiReader(bytes.NewReader(data)), false, nil)
+			Ω(err).Should(Succeed())
+			Ω(n).Should(BeEquivalentTo(len(data)))
+			Ω(u.IsComplete()).Should(BeTrue())
+		})
+		It("should return error with upload filled in", func() {
+			srvMock.AddMocks(
+				tRequest(http.MethodPost, "/", []string{"Upload-Length"}).
+					Reply(tReply(reply.Created()).Header("Location", "/foo/bar")),
+				tRequest(http.MethodPatch, "/foo/bar", nil).
+					Reply(tReply(reply.Status(http.StatusForbidden))),
+			)
+			u := Upload{}
+
+			n, resp, err := testClient.UploadFromReader(&u, io.MultiReader(bytes.NewReader(make([]byte, 1024))), false, nil)
+			Ω(err).Should(MatchError(ErrCannotUpload))
+			Ω(n).Should(BeEquivalentTo(0))
+			Ω(resp.StatusCode).Should(Equal(http.StatusForbidden))
+			Ω(u.Location).Should(Equal("/foo/bar"))
+		})
+		It("should create empty upload if reader is empty", func() {
+			srvMock.AddMocks(tRequest(http.MethodPost, "/", []string{"Upload-Defer-Length"}).
+				Header("Upload-Length", expect.ToEqual("0")).
+				Reply(tReply(reply.Created()).Header("Location", "/foo/bar")))
+			u := Upload{}
+
+			n, _, err := testClient.UploadFromReader(&u, io.MultiReader(), false, nil)
+			Ω(err).Should(Succeed())
+			Ω(n).Should(BeEquivalentTo(0))
+			Ω(u).Should(Equal(Upload{Location: "/foo/bar"}))
+		})
+	})
+	Context("ResumeUpload", func() {
+		It("should continue uploading from the server offset", func() {
+			data, _ := io.ReadAll(io.LimitReader(rand.New(rand.NewSource(time.Now().UnixNano())), 1024))
+			srvMock.AddMocks(
+				tRequest(http.MethodHead, "/foo/bar", nil).
+					Reply(tReply(reply.OK()).Header("Upload-Offset", "512").Header("Upload-Length", "1024")),
+				tRequest(http.MethodPatch, "/foo/bar", nil).
+					Header("Upload-Offset", expect.ToEqual("512")).
+					Body(expect.ToEqual(data[512:])).
+					Reply(tReply(reply.NoContent()).Header("Upload-Offset", "1024")),
+			)
+
+			s, err := testClient.ResumeUpload(context.Background(), "/foo/bar", bytes.NewReader(data))
+			Ω(err).Should(Succeed())
+			Ω(*s.Upload).Should(Equal(Upload{Location: "/foo/bar", RemoteSize: 1024, RemoteOffset: 1024}))
+		})
+		It("should do nothing if upload is complete", func() {
+			srvMock.AddMocks(tRequest(http.MethodHead, "/foo/bar", nil).
+				Reply(tReply(reply.OK()).Header("Upload-Offset", "1024").Header("Upload-Length", "1024")))
+
+			s, err := testClient.ResumeUpload(context.Background(), "/foo/bar", bytes.NewReader(make([]byte, 1024)))
+			Ω(err).Should(Succeed())
+			Ω(s.Upload.IsComplete()).Should(BeTrue())
+		})
+		It("should return error if upload does not exist", func() {
+			srvMock.AddMocks(tRequest(http.MethodHead, "/foo/bar", nil).Reply(reply.Status(http.StatusNotFound)))
+
+			s, err := testClient.ResumeUpload(context.Background(), "/foo/bar", bytes.NewReader(make([]byte, 1024)))
+			Ω(err).Should(MatchError(ErrUploadDoesNotExist))
+			Ω(s).Should(BeNil())
+		})
+	})
+	Context("WaitForConcatenation", func() {
+		It("should poll until concatenation is finished", func() {
+			srvMock.AddMocks(tRequest(http.MethodHead, "/foo/bar", nil).
+				Reply(reply.Seq().Add(
+					tReply(reply.OK()).Header("Upload-Concat", "final;/foo/1 /foo/2"),
+					tReply(reply.OK()).Header("Upload-Concat", "final;/foo/1 /foo/2").
+						Header("Upload-Offset", "256").Header("Upload-Length", "1024"),
+					tReply(reply.OK()).Header("Upload-Concat", "final;/foo/1 /foo/2").
+						Header("Upload-Offset", "1024").Header("Upload-Length", "1024"),
+				)),
+			)
+			u := Upload{Location: "/foo/bar"}
+
+			Ω(testClient.WaitForConcatenation(context.Background(), &u, PollOptions{Interval: time.Millisecond})).Should(Succeed())
+			Ω(u).Should(Equal(Upload{
+				Location:     "/foo/bar",
+				RemoteOffset: 1024,
+				RemoteSize:   1024,
+				Final:        true,
+				FinalParts:   []string{"/foo/1", "/foo/2"},
+			}))
+		})
+		It("should poll until server sends the upload size", func() {
+			srvMock.AddMocks(tRequest(http.MethodHead, "/foo/bar", nil).
+				Reply(reply.Seq().Add(
+					tReply(reply.OK()).Header("Upload-Concat", "final;/foo/1 /foo/2").Header("Upload-Offset", "0"),
+					tReply(reply.OK()).Header("Upload-Concat", "final;/foo/1 /foo/2").
+						Header("Upload-Offset", "1024").Header("Upload-Length", "1024"),
+				)),
+			)
+			u := Upload{Location: "/foo/bar"}
+
+			Ω(testClient.WaitForConcatenation(context.Background(), &u, PollOptions{Interval: time.Millisecond})).Should(Succeed())
+			Ω(u.RemoteOffset).Should(BeEquivalentTo(1024))
+			Ω(u.RemoteSize).Should(BeEquivalentTo(1024))
+		})
+		It("should stop when context is done", func() {
+			srvMock.AddMocks(tRequest(http.MethodHead, "/foo/bar", nil).
+				Reply(tReply(reply.OK()).Header("Upload-Concat", "final;/foo/1 /foo/2")),
+			)
+			u := Upload{Location: "/foo/bar"}
+			ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+			defer cancel()
+
+			err := testClient.WaitForConcatenation(ctx, &u, PollOptions{Interval: time.Millisecond, MaxInterval: 10 * time.Millisecond})
+			Ω(err).Should(MatchError(context.DeadlineExceeded))
+		})
+	})
 	Context("ConcatenateStreams", func() {
 		Context("happy path", func() {
 			BeforeEach(func() {
-				testClient.Capabilities.Extensions = append(testClient.Capabilities.Extensions, "concatenation", "concatenation-unfinished")
+				assumeExtensions(testClient, "concatenation", "concatenation-unfinished")
 			})
 			Specify("all streams are finished", func() {
 				eh := []string{"Upload-Defer-Length", "Upload-Length", "Upload-Metadata", "Upload-Checksum", "Upload-Offset"}
@@ -750,8 +1542,9 @@ var _ = Describe("Client", func() {
 
 				Ω(testClient.ConcatenateStreams(&f, []*UploadStream{s1, s2}, nil)).ShouldNot(BeNil())
 				Ω(f).Should(Equal(Upload{
-					Location: "/foo/bar/baz",
-					Partial:  false,
+					Location:   "/foo/bar/baz",
+					Final:      true,
+					FinalParts: []string{"/foo/bar", "/foo/baz"},
 				}))
 			})
 			Specify("some streams are not finished", func() {
@@ -768,15 +1561,16 @@ var _ = Describe("Client", func() {
 
 				Ω(testClient.ConcatenateStreams(&f, []*UploadStream{s1, s2}, nil)).ShouldNot(BeNil())
 				Ω(f).Should(Equal(Upload{
-					Location: "/foo/bar/baz",
-					Partial:  false,
+					Location:   "/foo/bar/baz",
+					Final:      true,
+					FinalParts: []string{"/foo/bar", "/foo/baz"},
 				}))
 			})
 		})
 		Context("error path", func() {
 			When("final is nil", func() {
 				It("should panic", func() {
-					testClient.Capabilities.Extensions = append(testClient.Capabilities.Extensions, "concatenation", "concatenation-unfinished")
+					assumeExtensions(testClient, "concatenation", "concatenation-unfinished")
 					f1 := Upload{Location: "/foo/bar", RemoteSize: 256, RemoteOffset: 64, Partial: true}
 					s1 := NewUploadStream(testClient, &f1)
 					f2 := Upload{Location: "/foo/baz", RemoteSize: 512, RemoteOffset: 128, Partial: true}
@@ -787,7 +1581,7 @@ var _ = Describe("Client", func() {
 			})
 			When("some streams are not finished and no 'concatenation-unfinished' extension", func() {
 				It("should return error", func() {
-					testClient.Capabilities.Extensions = append(testClient.Capabilities.Extensions, "concatenation")
+					assumeExtensions(testClient, "concatenation")
 					f1 := Upload{Location: "/foo/bar", RemoteSize: 256, RemoteOffset: 64, Partial: true}
 					s1 := NewUploadStream(testClient, &f1)
 					f2 := Upload{Location: "/foo/baz", RemoteSize: 512, RemoteOffset: 128, Partial: true}
@@ -803,6 +1597,39 @@ var _ = Describe("Client", func() {
 			})
 		})
 	})
+	Context("Do", func() {
+		It("should apply Tus semantics to a custom request", func() {
+			srvMock.AddMocks(tRequest(http.MethodGet, "/foo/bar", nil).
+				Header("Authorization", expect.ToEqual("Bearer token")).
+				Header("X-Custom", expect.ToEqual("custom")).
+				Header("X-Middleware", expect.ToEqual("1")).
+				Reply(tReply(reply.OK())),
+			)
+			testClient.DefaultHeaders = http.Header{"Authorization": {"Bearer token"}, "X-Custom": {"default"}}
+			testClient.Middlewares = []Middleware{func(next DoFunc) DoFunc {
+				return func(req *http.Request) (*http.Response, error) {
+					req.Header.Set("X-Middleware", "1")
+					return next(req)
+				}
+			}}
+			req, _ := http.NewRequest(http.MethodGet, testURL.JoinPath("/foo/bar").String(), nil)
+			req.Header.Set("X-Custom", "custom")
+
+			resp, err := testClient.Do(context.Background(), req)
+			Ω(err).Should(Succeed())
+			Ω(resp.StatusCode).Should(Equal(http.StatusOK))
+			Ω(resp.Body.Close()).Should(Succeed())
+		})
+		It("should return error on protocol version mismatch", func() {
+			srvMock.AddMocks(tRequest(http.MethodGet, "/foo/bar", nil).
+				Reply(reply.Status(http.StatusPreconditionFailed).Header("Tus-Version", "0.2.2")),
+			)
+			req, _ := http.NewRequest(http.MethodGet, testURL.JoinPath("/foo/bar").String(), nil)
+
+			_, err := testClient.Do(context.Background(), req)
+			Ω(err).Should(MatchError(ErrProtocol))
+		})
+	})
 	Context("UpdateCapabilities", func() {
 		Context("happy path", func() {
 			DescribeTable("should fill client capabilities",
@@ -816,7 +1643,8 @@ var _ = Describe("Client", func() {
 								Header("Tus-Checksum-Algorithm", "sha1,md5")),
 					)
 					Ω(testClient.UpdateCapabilities()).ShouldNot(BeNil())
-					Ω(*testClient.Capabilities).Should(Equal(ServerCapabilities{
+					Ω(testClient.Capabilities).Should(BeIdenticalTo(testClient.CurrentCapabilities()))
+					Ω(*testClient.CurrentCapabilities()).Should(Equal(ServerCapabilities{
 						Extensions:         []string{"creation", "expiration", "checksum"},
 						MaxSize:            1073741824,
 						ProtocolVersions:   []string{"1.0.0", "0.2.2", "0.2.1"},
@@ -869,7 +1697,7 @@ var _ = Describe("Client", func() {
 		When("extension exists", func() {
 			When("capabilities are empty", func() {
 				It("should request from server and return no error", func() {
-					testClient.Capabilities = nil
+					testClient.state.capabilities = nil
 					srvMock.AddMocks(
 						mocha.Request().URL(expect.URLPath("/")).Method(http.MethodOptions).
 							Reply(tReply(reply.OK()).
@@ -878,20 +1706,129 @@ var _ = Describe("Client", func() {
 								Header("Tus-Extension", "creation,expiration,checksum").
 								Header("Tus-Checksum-Algorithm", "sha1,md5")),
 					)
-					Ω(testClient.ensureExtension("creation")).Should(Succeed())
+					Ω(testClient.ensureExtension(ExtensionCreation)).Should(Succeed())
 				})
 			})
 			When("capabilities are not empty", func() {
 				It("should use cache and return no error", func() {
-					testClient.Capabilities.Extensions = []string{"creation", "expiration"}
-					Ω(testClient.ensureExtension("creation")).Should(Succeed())
+					modifyCapabilities(testClient, func(caps *ServerCapabilities) { caps.Extensions = []string{"creation", "expiration"} })
+					Ω(testClient.ensureExtension(ExtensionCreation)).Should(Succeed())
 				})
 			})
 		})
 		When("no such extension", func() {
 			It("should return error", func() {
-				Ω(testClient.ensureExtension("creation")).Should(MatchError(ErrUnsupportedFeature))
+				Ω(testClient.ensureExtension(ExtensionCreation)).Should(MatchError(ErrUnsupportedFeature))
+			})
+		})
+		When("capabilities are stale", func() {
+			It("should update them", func() {
+				srvMock.AddMocks(
+					mocha.Request().URL(expect.URLPath("/")).Method(http.MethodOptions).
+						Reply(reply.Seq().Add(
+							tReply(reply.NoContent()).Header("Tus-Version", "1.0.0").Header("Tus-Extension", "creation"),
+							tReply(reply.NoContent()).Header("Tus-Version", "1.0.0").Header("Tus-Extension", "creation,termination"),
+						)),
+				)
+				testClient.CapabilitiesTTL = time.Minute
+				Ω(testClient.UpdateCapabilities()).ShouldNot(BeNil())
+				Ω(testClient.ensureExtension(ExtensionTermination)).Should(MatchError(ErrUnsupportedFeature))
+
+				testClient.state.capabilitiesUpdated = time.Now().Add(-time.Hour)
+				Ω(testClient.ensureExtension(ExtensionTermination)).Should(Succeed())
 			})
+			It("should not update manually assigned ones", func() {
+				testClient.CapabilitiesTTL = time.Nanosecond
+				testClient.Capabilities = &ServerCapabilities{Extensions: []string{"creation"}}
+				time.Sleep(time.Millisecond)
+				Ω(testClient.ensureExtension(ExtensionCreation)).Should(Succeed())
+				Ω(testClient.WithContext(context.Background()).ensureExtension(ExtensionCreation)).Should(Succeed())
+				Ω(testClient.CurrentCapabilities()).Should(BeIdenticalTo(testClient.Capabilities))
+			})
+		})
+		When("capabilities are assumed", func() {
+			It("should not make requests", func() {
+				var caps ServerCapabilities
+				Ω(json.Unmarshal([]byte(`{"extensions": ["creation", "termination"], "max_size": 1024}`), &caps)).Should(Succeed())
+				testClient.CapabilitiesTTL = time.Nanosecond
+				testClient.AssumeCapabilities(caps)
+				time.Sleep(time.Millisecond)
+
+				Ω(testClient.ensureExtension(ExtensionTermination)).Should(Succeed())
+				Ω(testClient.CurrentCapabilities().MaxSize).Should(BeEquivalentTo(1024))
+			})
+		})
+		When("called concurrently", func() {
+			It("should fetch capabilities once", func() {
+				var calls atomic.Int32
+				srvMock.AddMocks(
+					mocha.Request().URL(expect.URLPath("/")).Method(http.MethodOptions).
+						ReplyFunction(func(r *http.Request, m reply.M, p params.P) (*reply.Response, error) {
+							calls.Add(1)
+							return tReply(reply.NoContent()).Header("Tus-Extension", "creation").Build(r, m, p)
+						}),
+				)
+				testClient.state.capabilities = nil
+				wg := sync.WaitGroup{}
+				for i := 0; i < 16; i++ {
+					cl := testClient
+					if i%2 == 1 { // Copies share the capabilities with the original client
+						cl = testClient.WithContext(context.Background())
+					}
+					wg.Add(1)
+					go func() {
+						defer GinkgoRecover()
+						defer wg.Done()
+						Ω(cl.ensureExtension(ExtensionCreation)).Should(Succeed())
+						Ω(cl.CurrentCapabilities().HasExtension(ExtensionCreation)).Should(BeTrue())
+					}()
+				}
+				wg.Wait()
+				Ω(calls.Load()).Should(BeEquivalentTo(1))
+				Ω(testClient.WithContext(context.Background()).CurrentCapabilities()).Should(BeIdenticalTo(testClient.CurrentCapabilities()))
+			})
+			It("should not block the capabilities readers during the request", func() {
+				srvMock.AddMocks(
+					mocha.Request().URL(expect.URLPath("/")).Method(http.MethodOptions).
+						Reply(tReply(reply.NoContent()).Header("Tus-Extension", "creation")),
+				)
+				testClient.state.capabilities = nil
+				var seen *ServerCapabilities
+				testClient.Middlewares = []Middleware{func(next DoFunc) DoFunc {
+					return func(req *http.Request) (*http.Response, error) {
+						seen = testClient.CurrentCapabilities()
+						return next(req)
+					}
+				}}
+
+				Ω(testClient.ensureExtension(ExtensionCreation)).Should(Succeed())
+				Ω(seen).Should(BeNil())
+				Ω(testClient.CurrentCapabilities().HasExtension(ExtensionCreation)).Should(BeTrue())
+			})
+		})
+		When("client is not created by NewClient", func() {
+			It("should use the Capabilities field", func() {
+				cl := &Client{Capabilities: &ServerCapabilities{Extensions: []string{"creation"}}}
+				Ω(cl.ensureExtension(ExtensionCreation)).Should(Succeed())
+				Ω(cl.WithContext(context.Background()).CurrentCapabilities()).Should(BeIdenticalTo(cl.Capabilities))
+
+				cl.AssumeCapabilities(ServerCapabilities{Extensions: []string{"termination"}})
+				Ω(cl.ensureExtension(ExtensionTermination)).Should(Succeed())
+				Ω(cl.DiscardedConnections()).Should(BeZero())
+			})
+		})
+		When("extension checks are skipped", func() {
+			It("should return no error", func() {
+				testClient.state.capabilities = nil
+				testClient.SkipExtensionChecks = true
+				Ω(testClient.ensureExtension(ExtensionCreation)).Should(Succeed())
+				Ω(testClient.CurrentCapabilities()).Should(BeNil())
+			})
+		})
+		Specify("HasExtension", func() {
+			caps := ServerCapabilities{Extensions: []string{"creation", "expiration"}}
+			Ω(caps.HasExtension(ExtensionExpiration)).Should(BeTrue())
+			Ω(caps.HasExtension(ExtensionTermination)).Should(BeFalse())
 		})
 	})
 })
@@ -0,0 +1,62 @@
+// Command tusgo is a command-line tool for inspecting the Tus servers.
+//
+// Usage:
+//
+//	tusgo compat [-create] <url>
+//
+// The "compat" subcommand probes a server and prints its compatibility matrix in JSON format. With -create flag
+// it also creates (and deletes, if possible) a small probe upload on the server.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+
+	"github.com/bdragon300/tusgo"
+)
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+	switch os.Args[1] {
+	case "compat":
+		if err := compat(os.Args[2:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	default:
+		usage()
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: tusgo compat [-create] <url>")
+	os.Exit(2)
+}
+
+func compat(args []string) error {
+	fs := flag.NewFlagSet("compat", flag.ExitOnError)
+	create := fs.Bool("create", false, "create a probe upload to detect more quirks")
+	_ = fs.Parse(args)
+	if fs.NArg() != 1 {
+		usage()
+	}
+	baseURL, err := url.Parse(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	cl := tusgo.NewClient(http.DefaultClient, baseURL)
+	matrix, err := cl.ProbeCompatibility(*create)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(matrix)
+}
@@ -0,0 +1,136 @@
+package tusgo
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/bdragon300/tusgo/checksum"
+)
+
+// Quirks which ProbeCompatibility may detect
+const (
+	// QuirkOptionsStatus200 -- server responds 200 on OPTIONS request instead of 204
+	QuirkOptionsStatus200 = "options-status-200"
+
+	// QuirkNoResumableInOptions -- OPTIONS response does not contain Tus-Resumable header
+	QuirkNoResumableInOptions = "options-without-tus-resumable"
+
+	// QuirkRelativeLocation -- server returns a relative upload Location
+	QuirkRelativeLocation = "relative-location"
+
+	// QuirkHeadWithoutUploadLength -- HEAD response of upload does not contain Upload-Length header
+	QuirkHeadWithoutUploadLength = "head-without-upload-length"
+
+	// QuirkHeadCacheable -- HEAD response of upload has no "Cache-Control: no-store" header, so proxies may cache it
+	QuirkHeadCacheable = "head-cacheable"
+
+	// QuirkProbeUploadLeft -- the probe upload has not been deleted, because server does not support termination
+	QuirkProbeUploadLeft = "probe-upload-left"
+)
+
+// CompatibilityMatrix describes what a server supports. It's meant to be serialized to JSON and kept in the
+// repository, so the server upgrades can be noticed by diffing. All lists are sorted to keep the output stable.
+type CompatibilityMatrix struct {
+	// ProtocolVersions are the protocol versions the server supports
+	ProtocolVersions []string `json:"protocol_versions"`
+
+	// Extensions are the protocol extensions the server supports
+	Extensions []string `json:"extensions"`
+
+	// ChecksumAlgorithms are the checksum algorithms the server supports
+	ChecksumAlgorithms []string `json:"checksum_algorithms"`
+
+	// UsableChecksumAlgorithms are the algorithms both the server and tusgo support
+	UsableChecksumAlgorithms []string `json:"usable_checksum_algorithms"`
+
+	// MaxSize is the maximum upload size, 0 means no limit
+	MaxSize int64 `json:"max_size"`
+
+	// Quirks are the deviations from the protocol or the notable server behavior detected by probes.
+	// See Quirk* constants
+	Quirks []string `json:"quirks"`
+}
+
+// ProbeCompatibility queries the server and returns its compatibility matrix. Also, it updates Client.Capabilities.
+//
+// If createUpload is true and the server supports "creation" extension, we also create a small upload to check how
+// server handles it. The upload is deleted afterwards if the server supports "termination" extension.
+func (c *Client) ProbeCompatibility(createUpload bool) (matrix CompatibilityMatrix, err error) {
+	var response *http.Response
+	if response, err = c.UpdateCapabilities(); err != nil {
+		return
+	}
+	quirks := make([]string, 0)
+	if response.StatusCode == http.StatusOK {
+		quirks = append(quirks, QuirkOptionsStatus200)
+	}
+	if response.Header.Get("Tus-Resumable") == "" {
+		quirks = append(quirks, QuirkNoResumableInOptions)
+	}
+
+	caps := c.CurrentCapabilities()
+	matrix = CompatibilityMatrix{
+		ProtocolVersions:         sortedCopy(caps.ProtocolVersions),
+		Extensions:               sortedCopy(caps.Extensions),
+		ChecksumAlgorithms:       sortedCopy(caps.ChecksumAlgorithms),
+		UsableChecksumAlgorithms: make([]string, 0),
+		MaxSize:                  caps.MaxSize,
+	}
+	for _, a := range matrix.ChecksumAlgorithms {
+		if _, ok := checksum.GetAlgorithm(a); ok {
+			matrix.UsableChecksumAlgorithms = append(matrix.UsableChecksumAlgorithms, a)
+		}
+	}
+
+	if createUpload && caps.HasExtension(ExtensionCreation) {
+		var q []string
+		if q, err = c.probeUpload(); err != nil {
+			return
+		}
+		quirks = append(quirks, q...)
+	}
+	slices.Sort(quirks)
+	matrix.Quirks = quirks
+	return
+}
+
+func (c *Client) probeUpload() (quirks []string, err error) {
+	u := Upload{}
+	if _, err = c.CreateUpload(&u, 1, false, nil); err != nil {
+		return nil, fmt.Errorf("cannot create probe upload: %w", err)
+	}
+	if !strings.HasPrefix(u.Location, "http://") && !strings.HasPrefix(u.Location, "https://") {
+		quirks = append(quirks, QuirkRelativeLocation)
+	}
+
+	var response *http.Response
+	if response, err = c.GetUpload(&u, u.Location); err != nil {
+		return nil, fmt.Errorf("cannot get probe upload: %w", err)
+	}
+	if response.Header.Get("Upload-Length") == "" {
+		quirks = append(quirks, QuirkHeadWithoutUploadLength)
+	}
+	if !strings.Contains(response.Header.Get("Cache-Control"), "no-store") {
+		quirks = append(quirks, QuirkHeadCacheable)
+	}
+
+	if !c.CurrentCapabilities().HasExtension(ExtensionTermination) {
+		quirks = append(quirks, QuirkProbeUploadLeft)
+		return
+	}
+	if _, err = c.DeleteUpload(u); err != nil {
+		return nil, fmt.Errorf("cannot delete probe upload: %w", err)
+	}
+	return
+}
+
+func sortedCopy(s []string) []string {
+	res := make([]string, 0, len(s))
+	for _, v := range s {
+		res = append(res, strings.TrimSpace(v))
+	}
+	slices.Sort(res)
+	return res
+}
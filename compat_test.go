@@ -0,0 +1,64 @@
+package tusgo
+
+import (
+	"net/http"
+	"net/url"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/vitorsalgado/mocha/v3"
+	"github.com/vitorsalgado/mocha/v3/expect"
+	"github.com/vitorsalgado/mocha/v3/reply"
+)
+
+var _ = Describe("ProbeCompatibility", func() {
+	var srvMock *mocha.Mocha
+	var testClient *Client
+
+	BeforeEach(func() {
+		srvMock = mocha.New(GinkgoT())
+		srvMock.Start()
+		testURL, _ := url.Parse(srvMock.URL())
+		testClient = NewClient(http.DefaultClient, testURL)
+	})
+	AfterEach(func() {
+		Ω(srvMock.Close()).Should(Succeed())
+	})
+	It("should return sorted matrix from OPTIONS response", func() {
+		srvMock.AddMocks(mocha.Request().URL(expect.URLPath("/")).Method(http.MethodOptions).
+			Reply(reply.OK().
+				Header("Tus-Version", "1.0.0,0.2.2").
+				Header("Tus-Max-Size", "1024").
+				Header("Tus-Extension", "termination,creation,checksum").
+				Header("Tus-Checksum-Algorithm", "sha1,foo,md5")),
+		)
+
+		Ω(testClient.ProbeCompatibility(false)).Should(Equal(CompatibilityMatrix{
+			ProtocolVersions:         []string{"0.2.2", "1.0.0"},
+			Extensions:               []string{"checksum", "creation", "termination"},
+			ChecksumAlgorithms:       []string{"foo", "md5", "sha1"},
+			UsableChecksumAlgorithms: []string{"md5", "sha1"},
+			MaxSize:                  1024,
+			Quirks:                   []string{QuirkOptionsStatus200, QuirkNoResumableInOptions},
+		}))
+	})
+	It("should detect quirks by probe upload", func() {
+		srvMock.AddMocks(
+			mocha.Request().URL(expect.URLPath("/")).Method(http.MethodOptions).
+				Reply(tReply(reply.NoContent()).
+					Header("Tus-Version", "1.0.0").
+					Header("Tus-Extension", "creation")),
+			tRequest(http.MethodPost, "/", nil).
+				Header("Upload-Length", expect.ToEqual("1")).
+				Reply(tReply(reply.Created()).Header("Location", "/foo/bar")),
+			tRequest(http.MethodHead, "/foo/bar", nil).
+				Reply(tReply(reply.OK()).Header("Upload-Offset", "0")),
+		)
+
+		m, err := testClient.ProbeCompatibility(true)
+		Ω(err).Should(Succeed())
+		Ω(m.Quirks).Should(Equal([]string{
+			QuirkHeadCacheable, QuirkHeadWithoutUploadLength, QuirkProbeUploadLeft, QuirkRelativeLocation,
+		}))
+	})
+})
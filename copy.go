@@ -0,0 +1,64 @@
+package tusgo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// CopyOptions set up the Copy. Zero values mean the stream defaults.
+type CopyOptions struct {
+	// ChunkSize is the upload chunk size, see UploadStream.ChunkSize
+	ChunkSize int64
+
+	// MaxAttempts is the maximum number of attempts of both downloading and uploading, see UploadStream.MaxAttempts
+	// and DownloadStream.MaxAttempts
+	MaxAttempts int
+
+	// RetryDelay is the delay between attempts, see UploadStream.RetryDelay and DownloadStream.RetryDelay
+	RetryDelay time.Duration
+
+	// OnProgress, if set, is called on the upload progress, see UploadStream.OnProgress
+	OnProgress func(p Progress)
+}
+
+// Copy copies the existing upload at srcLocation on the srcClient server to a new upload on the dstClient server,
+// preserving its metadata. The data is streamed from the source server by DownloadStream (the server must serve
+// the upload data by GET request) directly to the UploadStream, without storing it locally. Returns the upload
+// created on the destination server.
+//
+// The transient errors of both downloading and uploading are retried, see UploadStream.UploadAll. If the copying
+// has failed anyway, the destination upload is returned along with the error, so it may be deleted or resumed later.
+// The source upload must be complete.
+func Copy(ctx context.Context, dstClient, srcClient *Client, srcLocation string, opts CopyOptions) (dst Upload, err error) {
+	src := Upload{}
+	if _, err = srcClient.WithContext(ctx).GetUpload(&src, srcLocation); err != nil {
+		return dst, fmt.Errorf("cannot get source upload: %w", err)
+	}
+	if !src.IsComplete() {
+		return dst, errors.New("source upload is not complete")
+	}
+	if _, err = dstClient.WithContext(ctx).CreateUpload(&dst, src.RemoteSize, false, src.Metadata); err != nil {
+		return dst, fmt.Errorf("cannot create destination upload: %w", err)
+	}
+
+	ds := NewDownloadStream(srcClient, &src).WithContext(ctx)
+	us := NewUploadStream(dstClient, &dst).WithContext(ctx)
+	if opts.ChunkSize > 0 {
+		us.ChunkSize = opts.ChunkSize
+	}
+	if opts.MaxAttempts > 0 {
+		us.MaxAttempts, ds.MaxAttempts = opts.MaxAttempts, opts.MaxAttempts
+	}
+	if opts.RetryDelay > 0 {
+		us.RetryDelay, ds.RetryDelay = opts.RetryDelay, opts.RetryDelay
+	}
+	us.OnProgress = opts.OnProgress
+
+	defer ds.Close()
+	if _, err = us.UploadAll(ctx, ds); err != nil {
+		err = fmt.Errorf("cannot copy data: %w", err)
+	}
+	return
+}
@@ -0,0 +1,113 @@
+package tusgo
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Copy", func() {
+	var testSrv *httptest.Server
+	var srcClient, dstClient *Client
+	var data []byte
+	var mu sync.Mutex
+	var dstData *bytes.Buffer
+	var dstMeta string
+	var patchFailures int
+
+	BeforeEach(func() {
+		data, _ = io.ReadAll(io.LimitReader(rand.New(rand.NewSource(time.Now().UnixNano())), 1000))
+		dstData = nil
+		dstMeta = ""
+		patchFailures = 0
+		// Source upload is at /src/foo, destination uploads are created at /dst/
+		testSrv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			defer mu.Unlock()
+			w.Header().Set("Tus-Resumable", "1.0.0")
+			switch r.Method + " " + r.URL.Path {
+			case "HEAD /src/foo":
+				w.Header().Set("Cache-Control", "no-store")
+				w.Header().Set("Upload-Length", strconv.Itoa(len(data)))
+				w.Header().Set("Upload-Offset", strconv.Itoa(len(data)))
+				w.Header().Set("Upload-Metadata", "filename ZmlsZS50eHQ=")
+			case "GET /src/foo":
+				http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+			case "POST /dst/":
+				dstData = bytes.NewBuffer(nil)
+				dstMeta = r.Header.Get("Upload-Metadata")
+				w.Header().Set("Location", "/dst/bar")
+				w.WriteHeader(http.StatusCreated)
+			case "HEAD /dst/bar":
+				w.Header().Set("Upload-Length", strconv.Itoa(len(data)))
+				w.Header().Set("Upload-Offset", strconv.Itoa(dstData.Len()))
+			case "PATCH /dst/bar":
+				if patchFailures > 0 {
+					patchFailures--
+					w.WriteHeader(http.StatusInternalServerError)
+					return
+				}
+				_, _ = io.Copy(dstData, r.Body)
+				w.Header().Set("Upload-Offset", strconv.Itoa(dstData.Len()))
+				w.WriteHeader(http.StatusNoContent)
+			default:
+				w.WriteHeader(http.StatusMethodNotAllowed)
+			}
+		}))
+		caps := ServerCapabilities{ProtocolVersions: []string{"1.0.0"}, Extensions: []string{"creation"}}
+		u, _ := url.Parse(testSrv.URL + "/src/")
+		srcClient = NewClient(testSrv.Client(), u)
+		srcClient.AssumeCapabilities(caps)
+		u, _ = url.Parse(testSrv.URL + "/dst/")
+		dstClient = NewClient(testSrv.Client(), u)
+		dstClient.AssumeCapabilities(caps)
+	})
+	AfterEach(func() {
+		testSrv.Close()
+	})
+
+	It("should copy data and metadata to the new upload", func() {
+		var progress []Progress
+		opts := CopyOptions{ChunkSize: 256, OnProgress: func(p Progress) { progress = append(progress, p) }}
+
+		dst, err := Copy(context.Background(), dstClient, srcClient, "foo", opts)
+		Ω(err).Should(Succeed())
+		Ω(dst.Location).Should(Equal("/dst/bar"))
+		Ω(dst.RemoteOffset).Should(BeEquivalentTo(len(data)))
+		Ω(dstData.Bytes()).Should(Equal(data))
+		Ω(dstMeta).Should(Equal("filename ZmlsZS50eHQ="))
+		Ω(progress).ShouldNot(BeEmpty())
+		Ω(progress[len(progress)-1].BytesAcked).Should(BeEquivalentTo(len(data)))
+	})
+	It("should retry the upload errors", func() {
+		patchFailures = 1
+		opts := CopyOptions{ChunkSize: 256, RetryDelay: time.Millisecond}
+
+		dst, err := Copy(context.Background(), dstClient, srcClient, "foo", opts)
+		Ω(err).Should(Succeed())
+		Ω(dst.RemoteOffset).Should(BeEquivalentTo(len(data)))
+		Ω(dstData.Bytes()).Should(Equal(data))
+	})
+	It("should return destination upload on failure", func() {
+		patchFailures = 100
+		opts := CopyOptions{ChunkSize: 256, RetryDelay: time.Millisecond, MaxAttempts: 2}
+
+		dst, err := Copy(context.Background(), dstClient, srcClient, "foo", opts)
+		Ω(err).Should(MatchError(ErrUnexpectedResponse))
+		Ω(dst.Location).Should(Equal("/dst/bar"))
+	})
+	It("should return error if source upload does not exist", func() {
+		_, err := Copy(context.Background(), dstClient, srcClient, "baz", CopyOptions{})
+		Ω(err).Should(MatchError(ErrUnexpectedResponse))
+	})
+})
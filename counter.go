@@ -13,3 +13,43 @@ func (c *counterReader) Read(p []byte) (n int, err error) {
 	c.BytesRead += int64(n)
 	return n, err
 }
+
+// counterSeeker is seeker that corrects BytesRead of a counterReader by the distance the underlying reader has been
+// moved by a seek, so that the counter reflects the reader position
+type counterSeeker struct {
+	Counter *counterReader
+	Sk      io.Seeker
+}
+
+func (c *counterSeeker) Seek(offset int64, whence int) (int64, error) {
+	cur, err := c.Sk.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return cur, err
+	}
+	pos, err := c.Sk.Seek(offset, whence)
+	if err == nil {
+		c.Counter.BytesRead += pos - cur
+	}
+	return pos, err
+}
+
+// requestBody is the upload request body, which counts the bytes read from underlying reader and reports them to
+// the stream. It's a single object, since we make a request per chunk
+type requestBody struct {
+	Rd        io.Reader
+	Stream    *UploadStream
+	BytesRead int64
+}
+
+func (b *requestBody) Read(p []byte) (n int, err error) {
+	n, err = b.Rd.Read(p)
+	if n > 0 {
+		b.BytesRead += int64(n)
+		b.Stream.addBytesSent(n)
+	}
+	return n, err
+}
+
+func (b *requestBody) Close() error {
+	return nil
+}
@@ -0,0 +1,150 @@
+package tusgo
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Exchange is a summary of an upload request made by UploadStream and of the response received on it
+type Exchange struct {
+	// Time when the request has been sent
+	Time time.Time
+
+	// Duration of the request
+	Duration time.Duration
+
+	// Method and URL of the request
+	Method string
+	URL    string
+
+	// Offset is the Upload-Offset value of the request
+	Offset int64
+
+	// ContentLength is the request body size, -1 means that size is unknown
+	ContentLength int64
+
+	// StatusCode is the response status code, 0 if the response has not been received
+	StatusCode int
+
+	// ServerOffset is the raw Upload-Offset value of the response
+	ServerOffset string
+
+	// Error is the text of error the request was finished with, if any
+	Error string
+}
+
+// DiagnosticsStore receives the summaries of requests and responses the UploadStream makes. Implementations may
+// persist them somewhere in order to debug the failures occurred on unattended machines.
+//
+// Location is the upload location the exchange relates to.
+type DiagnosticsStore interface {
+	Record(location string, e Exchange)
+}
+
+// NewDiagnosticsRing constructs a new DiagnosticsRing, which keeps at most size last exchanges per upload
+func NewDiagnosticsRing(size int) *DiagnosticsRing {
+	if size <= 0 {
+		panic("size must be positive")
+	}
+	return &DiagnosticsRing{size: size, items: make(map[string][]Exchange)}
+}
+
+// DiagnosticsRing is in-memory DiagnosticsStore, that keeps a bounded number of last exchanges per upload.
+// It is safe for concurrent use. UploadManager persists its contents with the failed jobs, see
+// UploadManager.DiagnosticsSize.
+type DiagnosticsRing struct {
+	mu    sync.Mutex
+	size  int
+	items map[string][]Exchange
+}
+
+// Record saves the exchange, evicting the oldest one for this upload if the ring is full
+func (dr *DiagnosticsRing) Record(location string, e Exchange) {
+	dr.mu.Lock()
+	defer dr.mu.Unlock()
+
+	items := dr.items[location]
+	if len(items) >= dr.size {
+		items = append(items[:0], items[len(items)-dr.size+1:]...)
+	}
+	dr.items[location] = append(items, e)
+}
+
+// Describe returns the recorded exchanges for an upload, from the oldest to the newest
+func (dr *DiagnosticsRing) Describe(location string) []Exchange {
+	dr.mu.Lock()
+	defer dr.mu.Unlock()
+
+	return append([]Exchange(nil), dr.items[location]...)
+}
+
+func newExchange(started time.Time, req *http.Request, response *http.Response, err error) Exchange {
+	e := Exchange{
+		Time:          started,
+		Duration:      time.Since(started),
+		Method:        req.Method,
+		URL:           req.URL.String(),
+		ContentLength: -1,
+	}
+	if req.ContentLength > 0 || req.Body == nil {
+		e.ContentLength = req.ContentLength
+	}
+	e.Offset, _ = strconv.ParseInt(req.Header.Get("Upload-Offset"), 10, 64)
+	if response != nil {
+		e.StatusCode = response.StatusCode
+		e.ServerOffset = response.Header.Get("Upload-Offset")
+	}
+	if err != nil {
+		e.Error = err.Error()
+	}
+	return e
+}
+
+// Deviation is a protocol deviation observed in a server response
+type Deviation struct {
+	// Time when the deviation has been observed
+	Time time.Time
+
+	// Method and URL of the request
+	Method string
+	URL    string
+
+	// StatusCode is the response status code
+	StatusCode int
+
+	// Description of the deviation
+	Description string
+}
+
+// DeviationReport collects the protocol deviations observed by Client. It is safe for concurrent use.
+type DeviationReport struct {
+	mu    sync.Mutex
+	items []Deviation
+}
+
+// Record adds a deviation to the report
+func (dr *DeviationReport) Record(d Deviation) {
+	dr.mu.Lock()
+	defer dr.mu.Unlock()
+
+	dr.items = append(dr.items, d)
+}
+
+// Deviations returns the recorded deviations in order they were observed
+func (dr *DeviationReport) Deviations() []Deviation {
+	dr.mu.Lock()
+	defer dr.mu.Unlock()
+
+	return append([]Deviation(nil), dr.items...)
+}
+
+func newDeviation(response *http.Response, description string) Deviation {
+	d := Deviation{Time: time.Now(), StatusCode: response.StatusCode, Description: description}
+	if response.Request != nil {
+		d.Method = response.Request.Method
+		d.URL = response.Request.URL.String()
+	}
+	return d
+}
@@ -0,0 +1,79 @@
+package tusgo
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	. "github.com/onsi/gomega/gstruct"
+	"github.com/vitorsalgado/mocha/v3"
+	"github.com/vitorsalgado/mocha/v3/reply"
+)
+
+var _ = Describe("DiagnosticsRing", func() {
+	It("should keep last exchanges per upload", func() {
+		r := NewDiagnosticsRing(2)
+		r.Record("/foo", Exchange{Offset: 1})
+		r.Record("/foo", Exchange{Offset: 2})
+		r.Record("/bar", Exchange{Offset: 10})
+		r.Record("/foo", Exchange{Offset: 3})
+
+		Ω(r.Describe("/foo")).Should(Equal([]Exchange{{Offset: 2}, {Offset: 3}}))
+		Ω(r.Describe("/bar")).Should(Equal([]Exchange{{Offset: 10}}))
+		Ω(r.Describe("/baz")).Should(BeEmpty())
+	})
+	When("size is not positive", func() {
+		It("should panic", func() {
+			Ω(func() { NewDiagnosticsRing(0) }).Should(Panic())
+		})
+	})
+	When("used by UploadStream", func() {
+		var srvMock *mocha.Mocha
+		var testClient *Client
+
+		BeforeEach(func() {
+			srvMock = mocha.New(GinkgoT())
+			srvMock.Start()
+			testURL, _ := url.Parse(srvMock.URL())
+			testClient = NewClient(http.DefaultClient, testURL)
+			testClient.AssumeCapabilities(ServerCapabilities{ProtocolVersions: []string{"1.0.0"}})
+		})
+		AfterEach(func() {
+			Ω(srvMock.Close()).Should(Succeed())
+		})
+		It("should record every upload request", func() {
+			replies := []*reply.StdReply{tReply(reply.NoContent()), reply.InternalServerError()}
+			up := mockTusUploader{replies: replies, buf: bytes.NewBuffer(make([]byte, 0))}
+			srvMock.AddMocks(up.makeRequest(http.MethodPatch, "/foo/bar", nil).ReplyFunction(up.handler()))
+
+			u := Upload{Location: "/foo/bar", RemoteSize: 1024}
+			s := NewUploadStream(testClient, &u)
+			s.ChunkSize = 256
+			s.Diagnostics = NewDiagnosticsRing(10)
+			data, _ := io.ReadAll(io.LimitReader(rand.New(rand.NewSource(time.Now().UnixNano())), 1024))
+
+			_, err := s.Write(data)
+			Ω(err).Should(MatchError(ErrUnexpectedResponse))
+			res := s.Diagnostics.(*DiagnosticsRing).Describe("/foo/bar")
+			Ω(res).Should(HaveLen(2))
+			Ω(res[0]).Should(MatchFields(IgnoreExtras, Fields{
+				"Method":        Equal(http.MethodPatch),
+				"Offset":        BeEquivalentTo(0),
+				"ContentLength": BeEquivalentTo(256),
+				"StatusCode":    Equal(http.StatusNoContent),
+				"ServerOffset":  Equal("256"),
+				"Error":         BeEmpty(),
+			}))
+			Ω(res[1]).Should(MatchFields(IgnoreExtras, Fields{
+				"Offset":     BeEquivalentTo(256),
+				"StatusCode": Equal(http.StatusInternalServerError),
+				"Error":      ContainSubstring("unexpected HTTP response code"),
+			}))
+		})
+	})
+})
@@ -0,0 +1,359 @@
+package tusgo
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bdragon300/tusgo/checksum"
+)
+
+// NewDownloadStream constructs a new download stream, which reads the data of a given upload from its beginning.
+// Upload.RemoteSize, if known, is used as the data size until the server reports it, so the upload obtained by
+// Client.GetUpload is preferred here.
+func NewDownloadStream(client *Client, upload *Upload) *DownloadStream {
+	if upload == nil {
+		panic("upload is nil")
+	}
+	return &DownloadStream{
+		MaxAttempts: 10,
+		RetryDelay:  5 * time.Second,
+		Upload:      upload,
+		client:      client,
+		ctx:         client.ctx,
+		size:        SizeUnknown,
+	}
+}
+
+// DownloadStream reads the upload data from the server by GET request. This is not a part of TUS protocol, but many
+// servers serve the upload content this way, e.g. tusd or Cloudflare.
+//
+// If the transfer is interrupted by a transient error (see IsTransientError), such as a network error, we request
+// the rest of data by the new GET request with Range header, waiting RetryDelay between attempts, no more than
+// MaxAttempts times in a row. If the server doesn't support ranges, we skip the data already read. The read position
+// can also be moved by Seek, the data from the new position is requested on the next read.
+//
+// To verify the data integrity, set the OnData hook, or use WithChecksumAlgorithm and compare Digest with the checksum
+// of the original data after the whole data has been read.
+//
+// Errors, which the stream methods may return, along with the transport errors, are:
+//
+//   - ErrUploadDoesNotExist -- upload does not exist on the server. ErrUploadExpired if it has expired.
+//
+//   - ErrUnexpectedResponse -- unexpected server response code
+//
+//   - ErrProtocol -- the server has responded with the data range we didn't request
+type DownloadStream struct {
+	// MaxAttempts is the maximum number of attempts to get the data in a row. Default is 10
+	MaxAttempts int
+
+	// RetryDelay is the delay between attempts. Default is 5 seconds
+	RetryDelay time.Duration
+
+	// OnData, if set, is called with every portion of data read and its offset, before the data is returned to the
+	// caller. The data must not be modified or retained. If the hook returns error, Read returns it.
+	OnData func(offset int64, data []byte) error
+
+	// LastResponse is read-only field that contains the last response from server was received by this DownloadStream.
+	// Its body is the data being read, so don't read or close it.
+	LastResponse *http.Response
+
+	Upload *Upload
+	client *Client
+	ctx    context.Context
+	offset int64
+	body   io.ReadCloser // Body of the current response, nil if no request is in progress
+	endErr error         // Error returned once all data has been read: io.EOF or checksum mismatch
+	size   int64         // Data size reported by server
+
+	checksumHash        hash.Hash
+	rawChecksumHashName string
+	hashed              int64 // Number of bytes from offset 0 added to checksumHash
+	hashBroken          bool  // The data has been read not contiguously
+	expectedDigest      []byte
+}
+
+// WithContext assigns a given context to the copy of stream and returns it. The copy reads from the same offset.
+func (ds *DownloadStream) WithContext(ctx context.Context) *DownloadStream {
+	res := *ds
+	res.LastResponse = nil
+	res.body = nil
+	res.ctx = ctx
+	return &res
+}
+
+// WithChecksumAlgorithm sets the checksum algorithm to the copy of stream and returns it. See Digest.
+func (ds *DownloadStream) WithChecksumAlgorithm(name string) *DownloadStream {
+	res := ds.WithContext(ds.ctx)
+	alg, ok := checksum.GetAlgorithm(name)
+	if !ok {
+		panic(fmt.Sprintf("checksum algorithm %q does not supported", name))
+	}
+	res.checksumHash = checksum.Algorithms[alg]()
+	res.rawChecksumHashName = name
+	res.hashed = 0
+	res.hashBroken = false
+	res.expectedDigest = nil
+	return res
+}
+
+// WithExpectedChecksum sets the checksum algorithm and the expected checksum of the whole data to the copy of stream
+// and returns it. Once the data is over, we compare the checksum of data read with the expected one and return
+// ErrChecksumMismatch instead of io.EOF if they differ. The comparison is skipped if the data has been read not
+// contiguously from offset 0, see Digest.
+func (ds *DownloadStream) WithExpectedChecksum(algorithm string, sum []byte) *DownloadStream {
+	res := ds.WithChecksumAlgorithm(algorithm)
+	res.expectedDigest = sum
+	return res
+}
+
+// WithMetadataChecksum is the same as WithExpectedChecksum, but takes the expected checksum from the "checksum" key
+// of Upload.Metadata, see Metadata.SetChecksum. Returns error if the key is absent or malformed.
+func (ds *DownloadStream) WithMetadataChecksum() (*DownloadStream, error) {
+	algorithm, sum, err := Metadata(ds.Upload.Metadata).Checksum()
+	if err != nil {
+		return nil, err
+	}
+	return ds.WithExpectedChecksum(algorithm, sum), nil
+}
+
+// checkDigest compares the data digest with the expected one after all data has been read. Returns io.EOF on success.
+func (ds *DownloadStream) checkDigest() error {
+	digest := ds.Digest()
+	if ds.expectedDigest == nil || digest == nil {
+		return io.EOF
+	}
+	if !bytes.Equal(digest, ds.expectedDigest) {
+		return ErrChecksumMismatch.WithText(fmt.Sprintf(
+			"expected %s, got %s", formatChecksum(ds.rawChecksumHashName, ds.expectedDigest), formatChecksum(ds.rawChecksumHashName, digest),
+		))
+	}
+	return io.EOF
+}
+
+// Digest returns the checksum of the data read so far, calculated by the algorithm set by WithChecksumAlgorithm.
+// Returns nil if the algorithm is not set, or if the data has been read not contiguously from offset 0, e.g. the
+// position has been moved by Seek.
+func (ds *DownloadStream) Digest() []byte {
+	if ds.checksumHash == nil || ds.hashBroken {
+		return nil
+	}
+	return ds.checksumHash.Sum(nil)
+}
+
+// Read reads up to len(p) bytes of upload data to p. Returns io.EOF when the data is over.
+func (ds *DownloadStream) Read(p []byte) (n int, err error) {
+	for attempt := 1; ; attempt++ {
+		if n, err = ds.read(p); n > 0 || err == nil || ds.endErr != nil {
+			return
+		}
+		if !IsTransientError(err) || attempt >= ds.MaxAttempts {
+			return
+		}
+		if err = sleepContext(ds.ctx, ds.RetryDelay); err != nil {
+			return
+		}
+	}
+}
+
+// read reads the data from the current response, requesting the data if there is no response. The response is
+// closed on error, so the next call will make a new request.
+func (ds *DownloadStream) read(p []byte) (n int, err error) {
+	if ds.endErr != nil {
+		return 0, ds.endErr
+	}
+	if ds.body == nil {
+		if err = ds.open(); err != nil {
+			return
+		}
+	}
+	n, err = ds.body.Read(p)
+	if n > 0 {
+		if e := ds.verify(p[:n]); e != nil {
+			_ = ds.Close()
+			return 0, e
+		}
+	}
+	ds.offset += int64(n)
+	if err != nil {
+		_ = ds.body.Close()
+		ds.body = nil
+		if errors.Is(err, io.EOF) {
+			ds.endErr = ds.checkDigest()
+			err = ds.endErr
+		} else if n > 0 && IsTransientError(err) {
+			err = nil // Return the data, the rest of it will be requested on the next call
+		}
+	}
+	return
+}
+
+// verify passes the data read at the current offset to the integrity checks
+func (ds *DownloadStream) verify(data []byte) error {
+	if ds.OnData != nil {
+		if err := ds.OnData(ds.offset, data); err != nil {
+			return err
+		}
+	}
+	if ds.checksumHash != nil && !ds.hashBroken {
+		if ds.hashed != ds.offset {
+			ds.hashBroken = true
+			return nil
+		}
+		ds.checksumHash.Write(data)
+		ds.hashed += int64(len(data))
+	}
+	return nil
+}
+
+// WriteTo writes the upload data to w until the data is over or an error occurs. Returns the number of bytes written.
+func (ds *DownloadStream) WriteTo(w io.Writer) (n int64, err error) {
+	buf := make([]byte, 32*1024)
+	for {
+		nr, er := ds.Read(buf)
+		if nr > 0 {
+			nw, ew := w.Write(buf[:nr])
+			n += int64(nw)
+			if ew != nil {
+				return n, ew
+			}
+			if nw != nr {
+				return n, io.ErrShortWrite
+			}
+		}
+		if errors.Is(er, io.EOF) {
+			return n, nil
+		}
+		if er != nil {
+			return n, er
+		}
+	}
+}
+
+// Seek moves the read position according to whence, see io.Seeker. Returns new offset. The current request, if any,
+// is aborted, and the data from the new position is requested on the next read.
+//
+// The offset may be in range [0, size], where size is the data size reported by the server, or Upload.RemoteSize if
+// the server hasn't reported it yet. If the size is unknown, seeking relative to the end is not possible. On error,
+// the offset is not changed.
+func (ds *DownloadStream) Seek(offset int64, whence int) (int64, error) {
+	size := ds.Size()
+	var newOffset int64
+	switch whence {
+	case io.SeekStart:
+		newOffset = offset
+	case io.SeekCurrent:
+		newOffset = ds.offset + offset
+	case io.SeekEnd:
+		if size == SizeUnknown {
+			return 0, errors.New("cannot seek relative to the end, since data size is unknown")
+		}
+		newOffset = size + offset
+	default:
+		return 0, fmt.Errorf("invalid whence value %d", whence)
+	}
+	if newOffset < 0 {
+		return 0, fmt.Errorf("offset %d is negative", newOffset)
+	}
+	if size != SizeUnknown && newOffset > size {
+		return 0, fmt.Errorf("offset %d exceeds the data size %d bytes", newOffset, size)
+	}
+	if newOffset != ds.offset {
+		_ = ds.Close()
+		ds.offset = newOffset
+		ds.endErr = nil
+	}
+	return newOffset, nil
+}
+
+// Tell returns the offset of the data to be read next
+func (ds *DownloadStream) Tell() int64 {
+	return ds.offset
+}
+
+// Size returns the data size reported by the server, or Upload.RemoteSize if the server hasn't reported it yet
+func (ds *DownloadStream) Size() int64 {
+	if ds.size != SizeUnknown {
+		return ds.size
+	}
+	return ds.Upload.RemoteSize
+}
+
+// Close aborts the current request, if any. The stream may be used afterwards, the next read continues from the
+// same offset by a new request.
+func (ds *DownloadStream) Close() error {
+	if ds.body == nil {
+		return nil
+	}
+	err := ds.body.Close()
+	ds.body = nil
+	return err
+}
+
+// open sends the GET request for the data from the current offset
+func (ds *DownloadStream) open() (err error) {
+	var loc *url.URL
+	if loc, err = url.Parse(ds.Upload.Location); err != nil {
+		return
+	}
+	ref := ds.client.BaseURL.ResolveReference(loc).String()
+
+	var req *http.Request
+	if req, err = ds.client.GetRequest(http.MethodGet, ref, nil, ds.client, ds.client.client); err != nil {
+		return
+	}
+	if ds.offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", ds.offset))
+	}
+	var response *http.Response
+	if response, err = ds.client.tusRequest(ds.ctx, req); err != nil {
+		return
+	}
+	ds.LastResponse = response
+
+	switch response.StatusCode {
+	case http.StatusOK:
+		if response.ContentLength >= 0 {
+			ds.size = response.ContentLength
+		}
+		// The server has ignored the range, so skip the data already read
+		if _, err = io.CopyN(io.Discard, response.Body, ds.offset); err != nil {
+			_ = response.Body.Close()
+			if errors.Is(err, io.EOF) {
+				err = ds.client.protocolError(response, fmt.Errorf("response data ends before offset %d", ds.offset))
+			}
+			return
+		}
+	case http.StatusPartialContent:
+		v := response.Header.Get("Content-Range")
+		if !strings.HasPrefix(v, "bytes "+strconv.FormatInt(ds.offset, 10)+"-") {
+			defer ds.client.closeResponse(response)
+			return ds.client.protocolError(response, fmt.Errorf("unexpected Content-Range %q, requested from offset %d", v, ds.offset))
+		}
+		if _, total, ok := strings.Cut(v, "/"); ok {
+			if size, e := strconv.ParseInt(total, 10, 64); e == nil {
+				ds.size = size
+			}
+		}
+	case http.StatusRequestedRangeNotSatisfiable: // The offset is at the end of data
+		ds.client.closeResponse(response)
+		ds.body = http.NoBody
+		return
+	case http.StatusNotFound, http.StatusGone:
+		defer ds.client.closeResponse(response) // Read the body excerpt first
+		return ds.client.notExistError(ds.Upload, response)
+	default:
+		defer ds.client.closeResponse(response)
+		return ds.client.withResponse(ErrUnexpectedResponse, response)
+	}
+	ds.body = response.Body
+	return
+}
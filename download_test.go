@@ -0,0 +1,267 @@
+package tusgo
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("DownloadStream", func() {
+	var testSrv *httptest.Server
+	var testClient *Client
+	var handlers []http.HandlerFunc
+	var ranges []string
+	var data []byte
+
+	// serveFrom responds the data from the requested range. If limit is not negative, the connection is broken after
+	// limit bytes of body are sent
+	serveFrom := func(ignoreRange bool, limit int) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			offset := 0
+			if v := r.Header.Get("Range"); v != "" && !ignoreRange {
+				offset, _ = strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(v, "bytes="), "-"))
+				if offset >= len(data) {
+					w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+					return
+				}
+				w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", offset, len(data)-1, len(data)))
+				w.Header().Set("Content-Length", strconv.Itoa(len(data)-offset))
+				w.WriteHeader(http.StatusPartialContent)
+			} else {
+				w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+			}
+			body := data[offset:]
+			if limit >= 0 {
+				_, _ = w.Write(body[:limit])
+				w.(http.Flusher).Flush()
+				conn, _, _ := w.(http.Hijacker).Hijack()
+				_ = conn.Close()
+				return
+			}
+			_, _ = w.Write(body)
+		}
+	}
+
+	BeforeEach(func() {
+		handlers = nil
+		ranges = nil
+		data, _ = io.ReadAll(io.LimitReader(rand.New(rand.NewSource(time.Now().UnixNano())), 100000))
+		testSrv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			defer GinkgoRecover()
+			Ω(r.Method).Should(Equal(http.MethodGet))
+			Ω(r.URL.Path).Should(Equal("/files/foo"))
+			ranges = append(ranges, r.Header.Get("Range"))
+			Ω(handlers).ShouldNot(BeEmpty())
+			h := handlers[0]
+			handlers = handlers[1:]
+			h(w, r)
+		}))
+		u, _ := url.Parse(testSrv.URL + "/files/")
+		testClient = NewClient(testSrv.Client(), u)
+	})
+	AfterEach(func() {
+		testSrv.Close()
+		Ω(handlers).Should(BeEmpty())
+	})
+
+	DescribeTable("should read the whole data",
+		func(copyCb func(ds *DownloadStream) ([]byte, error)) {
+			handlers = []http.HandlerFunc{serveFrom(false, -1)}
+			ds := NewDownloadStream(testClient, &Upload{Location: "foo"})
+
+			Ω(copyCb(ds)).Should(Equal(data))
+			Ω(ds.Tell()).Should(BeEquivalentTo(len(data)))
+			Ω(ds.LastResponse.StatusCode).Should(Equal(http.StatusOK))
+			Ω(ranges).Should(Equal([]string{""}))
+		},
+		Entry("Read", func(ds *DownloadStream) ([]byte, error) { return io.ReadAll(ds) }),
+		Entry("WriteTo", func(ds *DownloadStream) ([]byte, error) {
+			buf := bytes.NewBuffer(nil)
+			n, err := ds.WriteTo(buf)
+			Ω(n).Should(BeEquivalentTo(buf.Len()))
+			return buf.Bytes(), err
+		}),
+	)
+	It("should request the rest of data after interrupt", func() {
+		handlers = []http.HandlerFunc{serveFrom(false, 1000), serveFrom(false, 2000), serveFrom(false, -1)}
+		ds := NewDownloadStream(testClient, &Upload{Location: "foo"})
+		ds.RetryDelay = 0
+
+		Ω(io.ReadAll(ds)).Should(Equal(data))
+		Ω(ranges).Should(Equal([]string{"", "bytes=1000-", "bytes=3000-"}))
+		Ω(ds.LastResponse.StatusCode).Should(Equal(http.StatusPartialContent))
+	})
+	It("should skip the data already read if server ignores the range", func() {
+		handlers = []http.HandlerFunc{serveFrom(false, 1000), serveFrom(true, -1)}
+		ds := NewDownloadStream(testClient, &Upload{Location: "foo"})
+		ds.RetryDelay = 0
+
+		Ω(io.ReadAll(ds)).Should(Equal(data))
+		Ω(ranges).Should(Equal([]string{"", "bytes=1000-"}))
+	})
+	It("should give up after MaxAttempts in a row", func() {
+		handlers = []http.HandlerFunc{serveFrom(false, 1000), serveFrom(false, 0)}
+		ds := NewDownloadStream(testClient, &Upload{Location: "foo"})
+		ds.RetryDelay = 0
+		ds.MaxAttempts = 2
+
+		res, err := io.ReadAll(ds)
+		Ω(err).Should(MatchError(io.ErrUnexpectedEOF))
+		Ω(res).Should(Equal(data[:1000]))
+		Ω(ds.Tell()).Should(BeEquivalentTo(1000))
+	})
+	It("should return ErrUploadDoesNotExist on 404", func() {
+		handlers = []http.HandlerFunc{func(w http.ResponseWriter, _ *http.Request) { w.WriteHeader(http.StatusNotFound) }}
+		ds := NewDownloadStream(testClient, &Upload{Location: "foo"})
+
+		_, err := ds.Read(make([]byte, 10))
+		Ω(err).Should(MatchError(ErrUploadDoesNotExist))
+		Ω(ds.LastResponse.StatusCode).Should(Equal(http.StatusNotFound))
+	})
+	It("should keep the response body excerpt in error details", func() {
+		handlers = []http.HandlerFunc{func(w http.ResponseWriter, _ *http.Request) {
+			w.WriteHeader(http.StatusForbidden)
+			_, _ = w.Write([]byte("access denied"))
+		}}
+		ds := NewDownloadStream(testClient, &Upload{Location: "foo"})
+
+		_, err := ds.Read(make([]byte, 10))
+		Ω(err).Should(MatchError(ErrUnexpectedResponse))
+		var details ErrorDetails
+		Ω(errors.As(err, &details)).Should(BeTrue())
+		Ω(string(details.Body)).Should(Equal("access denied"))
+	})
+	It("should return ErrProtocol on unexpected Content-Range", func() {
+		handlers = []http.HandlerFunc{serveFrom(false, 1000), func(w http.ResponseWriter, _ *http.Request) {
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes 0-%d/%d", len(data)-1, len(data)))
+			w.WriteHeader(http.StatusPartialContent)
+			_, _ = w.Write(data)
+		}}
+		ds := NewDownloadStream(testClient, &Upload{Location: "foo"})
+		ds.RetryDelay = 0
+
+		_, err := io.ReadAll(ds)
+		Ω(err).Should(MatchError(ErrProtocol))
+	})
+	It("should stop waiting for retry when context is done", func() {
+		handlers = []http.HandlerFunc{func(w http.ResponseWriter, _ *http.Request) { w.WriteHeader(http.StatusServiceUnavailable) }}
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		ds := NewDownloadStream(testClient, &Upload{Location: "foo"}).WithContext(ctx)
+
+		_, err := ds.Read(make([]byte, 10))
+		Ω(err).Should(MatchError(context.DeadlineExceeded))
+	})
+	Context("Seek", func() {
+		It("should read from the new position", func() {
+			handlers = []http.HandlerFunc{serveFrom(false, -1), serveFrom(false, -1)}
+			ds := NewDownloadStream(testClient, &Upload{Location: "foo", RemoteSize: SizeUnknown})
+
+			Ω(ds.Read(make([]byte, 10))).Should(Equal(10))
+			Ω(ds.Size()).Should(BeEquivalentTo(len(data)))
+			Ω(ds.Seek(-500, io.SeekEnd)).Should(BeEquivalentTo(len(data) - 500))
+			Ω(io.ReadAll(ds)).Should(Equal(data[len(data)-500:]))
+			Ω(ranges).Should(Equal([]string{"", fmt.Sprintf("bytes=%d-", len(data)-500)}))
+		})
+		It("should return EOF at the end of data", func() {
+			handlers = []http.HandlerFunc{serveFrom(false, -1)}
+			ds := NewDownloadStream(testClient, &Upload{Location: "foo", RemoteSize: int64(len(data))})
+
+			Ω(ds.Seek(0, io.SeekEnd)).Should(BeEquivalentTo(len(data)))
+			_, err := ds.Read(make([]byte, 10))
+			Ω(err).Should(MatchError(io.EOF))
+		})
+		DescribeTable("should return error on invalid offset",
+			func(offset int64, whence int) {
+				ds := NewDownloadStream(testClient, &Upload{Location: "foo", RemoteSize: 1024})
+				_, err := ds.Seek(offset, whence)
+				Ω(err).Should(HaveOccurred())
+				Ω(ds.Tell()).Should(BeEquivalentTo(0))
+			},
+			Entry("negative", int64(-1), io.SeekStart),
+			Entry("beyond size", int64(1), io.SeekEnd),
+			Entry("invalid whence", int64(0), 10),
+		)
+		It("should not seek relative to the end if size is unknown", func() {
+			ds := NewDownloadStream(testClient, &Upload{Location: "foo", RemoteSize: SizeUnknown})
+			_, err := ds.Seek(0, io.SeekEnd)
+			Ω(err).Should(HaveOccurred())
+		})
+	})
+	Context("integrity verification", func() {
+		It("should calculate digest of data read", func() {
+			handlers = []http.HandlerFunc{serveFrom(false, 1000), serveFrom(false, -1)}
+			ds := NewDownloadStream(testClient, &Upload{Location: "foo"}).WithChecksumAlgorithm("sha1")
+			ds.RetryDelay = 0
+
+			Ω(io.ReadAll(ds)).Should(Equal(data))
+			sum := sha1.Sum(data)
+			Ω(ds.Digest()).Should(Equal(sum[:]))
+		})
+		It("should not return digest if data has been read not contiguously", func() {
+			handlers = []http.HandlerFunc{serveFrom(false, -1)}
+			ds := NewDownloadStream(testClient, &Upload{Location: "foo", RemoteSize: int64(len(data))}).WithChecksumAlgorithm("sha1")
+
+			Ω(ds.Seek(100, io.SeekStart)).Should(BeEquivalentTo(100))
+			Ω(io.ReadAll(ds)).Should(Equal(data[100:]))
+			Ω(ds.Digest()).Should(BeNil())
+		})
+		It("should pass data to OnData and return its error", func() {
+			handlers = []http.HandlerFunc{serveFrom(false, -1)}
+			ds := NewDownloadStream(testClient, &Upload{Location: "foo"})
+			testErr := errors.New("test error")
+			var offsets []int64
+			ds.OnData = func(offset int64, p []byte) error {
+				offsets = append(offsets, offset)
+				if offset > 0 {
+					return testErr
+				}
+				return nil
+			}
+
+			Ω(ds.Read(make([]byte, 10))).Should(Equal(10))
+			_, err := ds.Read(make([]byte, 10))
+			Ω(err).Should(MatchError(testErr))
+			Ω(offsets).Should(Equal([]int64{0, 10}))
+			Ω(ds.Tell()).Should(BeEquivalentTo(10))
+		})
+		It("should succeed if checksum matches the expected one", func() {
+			handlers = []http.HandlerFunc{serveFrom(false, 1000), serveFrom(false, -1)}
+			sum := sha1.Sum(data)
+			u := Upload{Location: "foo", Metadata: NewMetadata().SetChecksum("sha1", sum[:])}
+			ds, err := NewDownloadStream(testClient, &u).WithMetadataChecksum()
+			Ω(err).Should(Succeed())
+			ds.RetryDelay = 0
+
+			Ω(io.ReadAll(ds)).Should(Equal(data))
+		})
+		It("should return ErrChecksumMismatch if checksum differs from the expected one", func() {
+			handlers = []http.HandlerFunc{serveFrom(false, -1)}
+			ds := NewDownloadStream(testClient, &Upload{Location: "foo"}).WithExpectedChecksum("sha1", make([]byte, 20))
+			ds.RetryDelay = 0
+
+			res, err := io.ReadAll(ds)
+			Ω(err).Should(MatchError(ErrChecksumMismatch))
+			Ω(res).Should(Equal(data))
+			_, err = ds.Read(make([]byte, 10))
+			Ω(err).Should(MatchError(ErrChecksumMismatch))
+		})
+		It("should return error if metadata has no checksum", func() {
+			_, err := NewDownloadStream(testClient, &Upload{Location: "foo"}).WithMetadataChecksum()
+			Ω(err).Should(HaveOccurred())
+		})
+	})
+})
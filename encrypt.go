@@ -0,0 +1,400 @@
+package tusgo
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const (
+	// EncryptionAES256GCM is AES-GCM with 256-bit key, the only supported encryption algorithm
+	EncryptionAES256GCM = "AES-256-GCM"
+
+	// EncryptionNonceCounter is the nonce strategy, where the nonce of a segment is its 64-bit big-endian index
+	// prefixed by four zero bytes. This is safe since every upload has its own key derived from a random salt.
+	EncryptionNonceCounter = "counter"
+
+	// DefaultEncryptionSegmentSize is the default plaintext size of an encrypted segment
+	DefaultEncryptionSegmentSize = 64 * 1024
+)
+
+// encryptionKeyInfo is HKDF info to derive the upload key
+const encryptionKeyInfo = "tusgo " + EncryptionAES256GCM
+
+// EncryptionParams are the parameters of client-side encryption, which are needed to decrypt the data besides the
+// key. They are not secret and are normally kept in upload metadata, see Metadata.SetEncryption.
+//
+// The data is split into segments of SegmentSize bytes, each one is encrypted and authenticated separately, so
+// the encrypted data can be uploaded and downloaded from any segment boundary. Every segment but the last one is
+// full, the last one is shorter and may be empty. The last segment is marked in the authenticated data, so
+// the truncated data fails to decrypt.
+type EncryptionParams struct {
+	// Algorithm is the encryption algorithm, only EncryptionAES256GCM is supported
+	Algorithm string
+
+	// Nonce is the nonce strategy, only EncryptionNonceCounter is supported
+	Nonce string
+
+	// SegmentSize is the plaintext size of a segment
+	SegmentSize int
+
+	// Salt is mixed with the key by HKDF-SHA256 to derive the upload key
+	Salt []byte
+}
+
+// NewEncryptionParams returns the default encryption parameters with random salt
+func NewEncryptionParams() (EncryptionParams, error) {
+	p := EncryptionParams{
+		Algorithm:   EncryptionAES256GCM,
+		Nonce:       EncryptionNonceCounter,
+		SegmentSize: DefaultEncryptionSegmentSize,
+		Salt:        make([]byte, 16),
+	}
+	if _, err := rand.Read(p.Salt); err != nil {
+		return p, fmt.Errorf("cannot generate salt: %w", err)
+	}
+	return p, nil
+}
+
+// Validate checks if the parameters are supported
+func (p EncryptionParams) Validate() error {
+	switch {
+	case p.Algorithm != EncryptionAES256GCM:
+		return fmt.Errorf("unsupported encryption algorithm %q", p.Algorithm)
+	case p.Nonce != EncryptionNonceCounter:
+		return fmt.Errorf("unsupported nonce strategy %q", p.Nonce)
+	case p.SegmentSize <= 0:
+		return fmt.Errorf("segment size must be positive, got %d", p.SegmentSize)
+	case len(p.Salt) == 0:
+		return errors.New("salt is empty")
+	}
+	return nil
+}
+
+// EncryptedSize returns the size of encrypted data by the plaintext size. Use it as the upload size.
+func (p EncryptionParams) EncryptedSize(plainSize int64) int64 {
+	return plainSize + int64(gcmOverhead)*(plainSize/int64(p.SegmentSize)+1)
+}
+
+// PlainSize returns the plaintext size by the encrypted data size. Returns error if the size is not valid.
+func (p EncryptionParams) PlainSize(encryptedSize int64) (int64, error) {
+	full := encryptedSize / int64(p.SegmentSize+gcmOverhead)
+	rem := encryptedSize % int64(p.SegmentSize+gcmOverhead)
+	if encryptedSize < 0 || rem < gcmOverhead {
+		return 0, fmt.Errorf("bad encrypted data size %d", encryptedSize)
+	}
+	return full*int64(p.SegmentSize) + rem - gcmOverhead, nil
+}
+
+func (p EncryptionParams) newAEAD(key []byte) (cipher.AEAD, error) {
+	if err := p.Validate(); err != nil {
+		return nil, err
+	}
+	if len(key) != 32 {
+		return nil, fmt.Errorf("key must be 32 bytes long for %s, got %d", p.Algorithm, len(key))
+	}
+	// HKDF-SHA256 with one output block
+	extract := hmac.New(sha256.New, p.Salt)
+	extract.Write(key)
+	expand := hmac.New(sha256.New, extract.Sum(nil))
+	expand.Write([]byte(encryptionKeyInfo))
+	expand.Write([]byte{1})
+
+	block, err := aes.NewCipher(expand.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// gcmOverhead is the authentication tag size appended to every segment
+const gcmOverhead = 16
+
+// segmentCipher encrypts and decrypts the segments by their index
+type segmentCipher struct {
+	aead  cipher.AEAD
+	nonce [12]byte
+}
+
+func (sc *segmentCipher) seal(dst []byte, index uint64, plain []byte, last bool) []byte {
+	binary.BigEndian.PutUint64(sc.nonce[4:], index)
+	return sc.aead.Seal(dst, sc.nonce[:], plain, segmentAD(last))
+}
+
+func (sc *segmentCipher) open(dst []byte, index uint64, encrypted []byte, last bool) ([]byte, error) {
+	binary.BigEndian.PutUint64(sc.nonce[4:], index)
+	res, err := sc.aead.Open(dst, sc.nonce[:], encrypted, segmentAD(last))
+	if err != nil {
+		return nil, fmt.Errorf("cannot decrypt segment %d: %w", index, err)
+	}
+	return res, nil
+}
+
+func segmentAD(last bool) []byte {
+	if last {
+		return []byte{1}
+	}
+	return []byte{0}
+}
+
+// EncryptReader reads the plaintext from the source and returns it encrypted by segments, see EncryptionParams.
+// It is io.ReadSeeker if the source is io.Seeker, so it can be passed to UploadStream.UploadAll and resumed from any
+// offset: the segments are encrypted deterministically, so the data is the same on every attempt.
+//
+// Typical usage:
+//
+//	params, err := tusgo.NewEncryptionParams()
+//	meta := tusgo.NewMetadata().SetEncryption(params)
+//	_, err = client.CreateUpload(&u, params.EncryptedSize(fileSize), false, meta)
+//	src, err := tusgo.NewEncryptReader(file, key, params)
+//	_, err = tusgo.NewUploadStream(client, &u).UploadAll(ctx, src)
+type EncryptReader struct {
+	src     io.Reader
+	params  EncryptionParams
+	cipher  segmentCipher
+	plain   []byte
+	out     []byte
+	pos     int
+	segment uint64
+	last    bool
+	offset  int64
+	err     error
+}
+
+// NewEncryptReader constructs a new EncryptReader. The key must be 32 bytes long.
+func NewEncryptReader(src io.Reader, key []byte, params EncryptionParams) (*EncryptReader, error) {
+	aead, err := params.newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	return &EncryptReader{
+		src:    src,
+		params: params,
+		cipher: segmentCipher{aead: aead},
+		plain:  make([]byte, params.SegmentSize),
+	}, nil
+}
+
+// Read reads the encrypted data. The error is returned on every further call until Seek is called.
+func (er *EncryptReader) Read(p []byte) (n int, err error) {
+	for er.pos == len(er.out) {
+		switch {
+		case er.err != nil:
+			return 0, er.err
+		case er.last:
+			return 0, io.EOF
+		}
+		er.err = er.nextSegment()
+	}
+	n = copy(p, er.out[er.pos:])
+	er.pos += n
+	er.offset += int64(n)
+	return
+}
+
+// Seek moves to the given offset of encrypted data according to whence, see io.Seeker. The source must be
+// io.Seeker, the segment containing the offset is read and encrypted again. If Seek fails after the source has been
+// moved, the error is returned by further Read calls.
+func (er *EncryptReader) Seek(offset int64, whence int) (res int64, err error) {
+	sk, ok := er.src.(io.Seeker)
+	if !ok {
+		return er.offset, errors.New("source is not seekable")
+	}
+	if whence == io.SeekCurrent && offset == 0 {
+		return er.offset, nil
+	}
+	defer func() {
+		if err != nil {
+			er.err = err
+		}
+	}()
+	plainSize, err := sk.Seek(0, io.SeekEnd)
+	if err != nil {
+		return er.offset, err
+	}
+	size := er.params.EncryptedSize(plainSize)
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += er.offset
+	case io.SeekEnd:
+		offset += size
+	default:
+		return er.offset, fmt.Errorf("invalid whence %d", whence)
+	}
+	if offset < 0 || offset > size {
+		return er.offset, fmt.Errorf("offset %d is out of range [0, %d]", offset, size)
+	}
+
+	segLen := int64(er.params.SegmentSize + gcmOverhead)
+	if _, err = sk.Seek(offset/segLen*int64(er.params.SegmentSize), io.SeekStart); err != nil {
+		return er.offset, err
+	}
+	er.segment, er.out, er.pos, er.last, er.err = uint64(offset/segLen), er.out[:0], 0, false, nil
+	if within := int(offset % segLen); within > 0 {
+		if err = er.nextSegment(); err != nil {
+			return er.offset, err
+		}
+		er.pos = within
+	}
+	er.offset = offset
+	return offset, nil
+}
+
+// Tell returns the current offset of encrypted data
+func (er *EncryptReader) Tell() int64 {
+	return er.offset
+}
+
+func (er *EncryptReader) nextSegment() error {
+	n, err := io.ReadFull(er.src, er.plain)
+	switch {
+	case errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF):
+		er.last = true
+	case err != nil:
+		return err
+	}
+	er.out = er.cipher.seal(er.out[:0], er.segment, er.plain[:n], er.last)
+	er.pos = 0
+	er.segment++
+	return nil
+}
+
+// DecryptReader reads the data encrypted by EncryptReader from the source and returns it decrypted. It is io.ReadSeeker
+// if the source is io.Seeker, e.g. DownloadStream. Returns error if the data has been tampered with or truncated.
+//
+// Typical usage:
+//
+//	params, err := tusgo.Metadata(u.Metadata).Encryption()
+//	rd, err := tusgo.NewDecryptReader(tusgo.NewDownloadStream(client, &u), key, params)
+//	_, err = io.Copy(file, rd)
+type DecryptReader struct {
+	src     io.Reader
+	params  EncryptionParams
+	cipher  segmentCipher
+	in      []byte
+	out     []byte
+	pos     int
+	segment uint64
+	last    bool
+	offset  int64
+	err     error
+}
+
+// NewDecryptReader constructs a new DecryptReader. The key must be 32 bytes long.
+func NewDecryptReader(src io.Reader, key []byte, params EncryptionParams) (*DecryptReader, error) {
+	aead, err := params.newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	return &DecryptReader{
+		src:    src,
+		params: params,
+		cipher: segmentCipher{aead: aead},
+		in:     make([]byte, params.SegmentSize+gcmOverhead),
+	}, nil
+}
+
+// Read reads the decrypted data. The data is returned only after its segment has been authenticated. The error is
+// returned on every further call until Seek is called.
+func (dr *DecryptReader) Read(p []byte) (n int, err error) {
+	for dr.pos == len(dr.out) {
+		switch {
+		case dr.err != nil:
+			return 0, dr.err
+		case dr.last:
+			return 0, io.EOF
+		}
+		dr.err = dr.nextSegment()
+	}
+	n = copy(p, dr.out[dr.pos:])
+	dr.pos += n
+	dr.offset += int64(n)
+	return
+}
+
+// Seek moves to the given offset of decrypted data according to whence, see io.Seeker. The source must be
+// io.Seeker, the segment containing the offset is read and decrypted again. If Seek fails after the source has been
+// moved, the error is returned by further Read calls.
+func (dr *DecryptReader) Seek(offset int64, whence int) (res int64, err error) {
+	sk, ok := dr.src.(io.Seeker)
+	if !ok {
+		return dr.offset, errors.New("source is not seekable")
+	}
+	if whence == io.SeekCurrent && offset == 0 {
+		return dr.offset, nil
+	}
+	defer func() {
+		if err != nil {
+			dr.err = err
+		}
+	}()
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += dr.offset
+	case io.SeekEnd:
+		size, err := sk.Seek(0, io.SeekEnd)
+		if err != nil {
+			return dr.offset, err
+		}
+		plainSize, err := dr.params.PlainSize(size)
+		if err != nil {
+			return dr.offset, err
+		}
+		offset += plainSize
+	default:
+		return dr.offset, fmt.Errorf("invalid whence %d", whence)
+	}
+	if offset < 0 {
+		return dr.offset, fmt.Errorf("negative offset %d", offset)
+	}
+
+	segLen := int64(dr.params.SegmentSize)
+	if _, err := sk.Seek(offset/segLen*(segLen+gcmOverhead), io.SeekStart); err != nil {
+		return dr.offset, err
+	}
+	dr.segment, dr.out, dr.pos, dr.last, dr.err = uint64(offset/segLen), dr.out[:0], 0, false, nil
+	if within := int(offset % segLen); within > 0 {
+		if err := dr.nextSegment(); err != nil {
+			return dr.offset, err
+		}
+		if within > len(dr.out) {
+			return dr.offset, fmt.Errorf("offset %d is beyond the end of data", offset)
+		}
+		dr.pos = within
+	}
+	dr.offset = offset
+	return offset, nil
+}
+
+// Tell returns the current offset of decrypted data
+func (dr *DecryptReader) Tell() int64 {
+	return dr.offset
+}
+
+func (dr *DecryptReader) nextSegment() error {
+	n, err := io.ReadFull(dr.src, dr.in)
+	switch {
+	case errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF):
+		if n < gcmOverhead {
+			return fmt.Errorf("encrypted data is truncated at segment %d: %w", dr.segment, io.ErrUnexpectedEOF)
+		}
+		dr.last = true
+	case err != nil:
+		return err
+	}
+	out, err := dr.cipher.open(dr.out[:0], dr.segment, dr.in[:n], dr.last)
+	if err != nil {
+		return err
+	}
+	dr.out, dr.pos = out, 0
+	dr.segment++
+	return nil
+}
@@ -0,0 +1,179 @@
+package tusgo
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Encryption", func() {
+	var key []byte
+	var params EncryptionParams
+
+	encrypt := func(data []byte) []byte {
+		er, err := NewEncryptReader(bytes.NewReader(data), key, params)
+		Ω(err).Should(Succeed())
+		res, err := io.ReadAll(er)
+		Ω(err).Should(Succeed())
+		return res
+	}
+
+	BeforeEach(func() {
+		key = bytes.Repeat([]byte{42}, 32)
+		var err error
+		params, err = NewEncryptionParams()
+		Ω(err).Should(Succeed())
+		params.SegmentSize = 64
+	})
+
+	DescribeTable("should decrypt the encrypted data",
+		func(size int) {
+			data, _ := io.ReadAll(io.LimitReader(rand.New(rand.NewSource(time.Now().UnixNano())), int64(size)))
+			enc := encrypt(data)
+			Ω(enc).Should(HaveLen(int(params.EncryptedSize(int64(size)))))
+			Ω(params.PlainSize(int64(len(enc)))).Should(BeEquivalentTo(size))
+
+			dr, err := NewDecryptReader(bytes.NewReader(enc), key, params)
+			Ω(err).Should(Succeed())
+			Ω(io.ReadAll(dr)).Should(Equal(data))
+		},
+		Entry("empty", 0),
+		Entry("one short segment", 10),
+		Entry("segment size multiple", 128),
+		Entry("several segments", 1000),
+	)
+	It("should produce different data for different salts", func() {
+		data := bytes.Repeat([]byte{1}, 100)
+		enc := encrypt(data)
+		params.Salt = []byte("another salt")
+		Ω(encrypt(data)).ShouldNot(Equal(enc))
+	})
+	It("should seek encrypted data to any offset", func() {
+		data, _ := io.ReadAll(io.LimitReader(rand.New(rand.NewSource(time.Now().UnixNano())), 1000))
+		enc := encrypt(data)
+		er, err := NewEncryptReader(bytes.NewReader(data), key, params)
+		Ω(err).Should(Succeed())
+
+		for _, off := range []int64{500, 80, 0, 1, int64(len(enc)) - 1, int64(len(enc))} {
+			Ω(er.Seek(off, io.SeekStart)).Should(Equal(off))
+			Ω(io.ReadAll(er)).Should(Equal(enc[off:]), "offset %d", off)
+		}
+		Ω(er.Seek(-20, io.SeekEnd)).Should(BeEquivalentTo(len(enc) - 20))
+		_, err = er.Seek(1, io.SeekEnd)
+		Ω(err).Should(HaveOccurred())
+	})
+	It("should seek decrypted data to any offset", func() {
+		data, _ := io.ReadAll(io.LimitReader(rand.New(rand.NewSource(time.Now().UnixNano())), 1000))
+		dr, err := NewDecryptReader(bytes.NewReader(encrypt(data)), key, params)
+		Ω(err).Should(Succeed())
+
+		for _, off := range []int64{500, 64, 0, 1, 999, 1000} {
+			Ω(dr.Seek(off, io.SeekStart)).Should(Equal(off))
+			Ω(io.ReadAll(dr)).Should(Equal(data[off:]), "offset %d", off)
+		}
+		Ω(dr.Seek(-10, io.SeekEnd)).Should(BeEquivalentTo(990))
+		Ω(io.ReadAll(dr)).Should(Equal(data[990:]))
+	})
+	DescribeTable("should return error if data is corrupted",
+		func(corrupt func(enc []byte) []byte) {
+			enc := encrypt(bytes.Repeat([]byte{1}, 200))
+			dr, err := NewDecryptReader(bytes.NewReader(corrupt(enc)), key, params)
+			Ω(err).Should(Succeed())
+			_, err = io.ReadAll(dr)
+			Ω(err).Should(HaveOccurred())
+			_, err = dr.Read(make([]byte, 10))
+			Ω(err).Should(HaveOccurred())
+		},
+		Entry("modified byte", func(enc []byte) []byte { enc[100] ^= 1; return enc }),
+		Entry("truncated at segment boundary", func(enc []byte) []byte { return enc[:80] }),
+		Entry("last segment is dropped", func(enc []byte) []byte { return enc[:3*80] }),
+		Entry("segments are reordered", func(enc []byte) []byte {
+			return append(append(append([]byte{}, enc[80:160]...), enc[:80]...), enc[160:]...)
+		}),
+	)
+	It("should not decrypt with another key", func() {
+		enc := encrypt([]byte("secret"))
+		dr, err := NewDecryptReader(bytes.NewReader(enc), bytes.Repeat([]byte{1}, 32), params)
+		Ω(err).Should(Succeed())
+		_, err = io.ReadAll(dr)
+		Ω(err).Should(HaveOccurred())
+	})
+	DescribeTable("should return error on bad parameters",
+		func(modify func()) {
+			modify()
+			_, err := NewEncryptReader(bytes.NewReader(nil), key, params)
+			Ω(err).Should(HaveOccurred())
+		},
+		Entry("short key", func() { key = key[:16] }),
+		Entry("unknown algorithm", func() { params.Algorithm = "AES-128-CBC" }),
+		Entry("unknown nonce strategy", func() { params.Nonce = "random" }),
+		Entry("zero segment size", func() { params.SegmentSize = 0 }),
+		Entry("empty salt", func() { params.Salt = nil }),
+	)
+	It("should keep parameters in metadata", func() {
+		m := NewMetadata().SetFilename("file.txt").SetEncryption(params)
+		Ω(m.Validate()).Should(Succeed())
+		Ω(m.Encryption()).Should(Equal(params))
+
+		m[MetadataEncryptionSegmentSize] = "foo"
+		Ω(m.Validate()).ShouldNot(Succeed())
+		_, err := NewMetadata().Encryption()
+		Ω(err).Should(HaveOccurred())
+	})
+	It("should upload encrypted data and download it decrypted", func() {
+		var mu sync.Mutex
+		stored := bytes.NewBuffer(nil)
+		patchFailures := 1
+		testSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			defer mu.Unlock()
+			w.Header().Set("Tus-Resumable", "1.0.0")
+			switch r.Method {
+			case http.MethodHead:
+				w.Header().Set("Upload-Offset", strconv.Itoa(stored.Len()))
+			case http.MethodPatch:
+				if patchFailures > 0 {
+					patchFailures--
+					w.WriteHeader(http.StatusInternalServerError)
+					return
+				}
+				_, _ = io.Copy(stored, r.Body)
+				w.Header().Set("Upload-Offset", strconv.Itoa(stored.Len()))
+				w.WriteHeader(http.StatusNoContent)
+			case http.MethodGet:
+				http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(stored.Bytes()))
+			}
+		}))
+		defer testSrv.Close()
+		u, _ := url.Parse(testSrv.URL + "/files/")
+		testClient := NewClient(testSrv.Client(), u)
+		testClient.AssumeCapabilities(ServerCapabilities{ProtocolVersions: []string{"1.0.0"}})
+		data, _ := io.ReadAll(io.LimitReader(rand.New(rand.NewSource(time.Now().UnixNano())), 1000))
+
+		up := Upload{Location: "foo", RemoteSize: params.EncryptedSize(int64(len(data))), Metadata: NewMetadata().SetEncryption(params)}
+		src, err := NewEncryptReader(bytes.NewReader(data), key, params)
+		Ω(err).Should(Succeed())
+		us := NewUploadStream(testClient, &up)
+		us.ChunkSize = 300
+		us.RetryDelay = time.Millisecond
+		_, err = us.UploadAll(context.Background(), src)
+		Ω(err).Should(Succeed())
+		Ω(stored.Len()).Should(BeEquivalentTo(up.RemoteSize))
+
+		p, err := Metadata(up.Metadata).Encryption()
+		Ω(err).Should(Succeed())
+		dr, err := NewDecryptReader(NewDownloadStream(testClient, &up), key, p)
+		Ω(err).Should(Succeed())
+		Ω(io.ReadAll(dr)).Should(Equal(data))
+	})
+})
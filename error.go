@@ -1,9 +1,12 @@
 package tusgo
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 )
 
@@ -14,6 +17,9 @@ type TusError struct {
 }
 
 func (te TusError) Error() string {
+	if te.inner == nil {
+		return te.msg
+	}
 	return fmt.Sprintf("%s: %s", te.msg, te.inner)
 }
 
@@ -36,32 +42,195 @@ func (te TusError) WithText(s string) TusError {
 	return te
 }
 
+// WithResponse returns a copy of error with ErrorDetails filled from the response. The response body is read
+// partially, no more than errorBodyExcerptLen bytes.
 func (te TusError) WithResponse(r *http.Response) TusError {
 	if r == nil {
 		te.inner = fmt.Errorf("response is nil")
 		return te
 	}
 
-	b := make([]byte, 256)
-	if l, err := io.ReadFull(r.Body, b); err == nil || err == io.EOF {
+	te.inner = newErrorDetails(r)
+	return te
+}
+
+func newErrorDetails(r *http.Response) ErrorDetails {
+	d := ErrorDetails{StatusCode: r.StatusCode, Header: make(http.Header)}
+	for _, h := range errorDetailsHeaders {
+		if v := r.Header.Values(h); len(v) > 0 {
+			d.Header[h] = append([]string(nil), v...)
+		}
+	}
+	if r.Body != nil {
+		b := make([]byte, errorBodyExcerptLen)
+		l, _ := io.ReadFull(r.Body, b) // Read errors mean that the body is shorter, that's ok for an excerpt
 		if l > 0 {
-			te.inner = fmt.Errorf("HTTP %d: <no body>", r.StatusCode)
-		} else {
-			te.inner = fmt.Errorf("HTTP %d: %s", r.StatusCode, b[:l])
+			d.Body = b[:l]
 		}
-	} else {
-		panic(err)
 	}
-	return te
+	return d
+}
+
+// errorBodyExcerptLen is the maximum response body size kept in ErrorDetails
+const errorBodyExcerptLen = 256
+
+// errorDetailsHeaders are the response headers kept in ErrorDetails
+var errorDetailsHeaders = []string{
+	"Content-Type", "Retry-After", "Tus-Resumable", "Tus-Version", "Upload-Offset", "Upload-Length", "X-Request-Id",
+}
+
+// ErrorDetails contains the details of the server response an error was caused by. It's returned wrapped in TusError
+// and can be retrieved by errors.As:
+//
+//	var details tusgo.ErrorDetails
+//	if errors.As(err, &details) {
+//		log.Printf("status %d, body %q", details.StatusCode, details.Body)
+//	}
+type ErrorDetails struct {
+	// StatusCode is the response status code
+	StatusCode int
+
+	// Header contains the selected response headers, such as Content-Type, Retry-After, Upload-Offset, X-Request-Id
+	Header http.Header
+
+	// Body is the beginning of response body, no more than 256 bytes
+	Body []byte
+
+	// Code is the server error code, parsed from Body by Client.ErrorBodyParser
+	Code string
+
+	// Message is the server error message, parsed from Body by Client.ErrorBodyParser
+	Message string
+}
+
+func (e ErrorDetails) Error() string {
+	switch {
+	case e.Code != "" || e.Message != "":
+		return fmt.Sprintf("HTTP %d: %s: %s", e.StatusCode, e.Code, e.Message)
+	case len(e.Body) == 0:
+		return fmt.Sprintf("HTTP %d: <no body>", e.StatusCode)
+	}
+	return fmt.Sprintf("HTTP %d: %s", e.StatusCode, e.Body)
+}
+
+// ErrorBodyParser extracts the server error code and message from the beginning of error response body. Returns
+// ok == false if the body has unknown format.
+type ErrorBodyParser func(body []byte) (code, message string, ok bool)
+
+// TusdErrorBodyParser is ErrorBodyParser for JSON error bodies returned by tusd and compatible servers. Both
+// {"error": {"code": "...", "message": "..."}} and {"code": "...", "message": "..."} forms are supported.
+func TusdErrorBodyParser(body []byte) (code, message string, ok bool) {
+	type tusdError struct {
+		Code    string `json:"code"`
+		Message string `json:"message"`
+	}
+	var v struct {
+		tusdError
+		Error *tusdError `json:"error"`
+	}
+	if err := json.Unmarshal(body, &v); err != nil {
+		return "", "", false
+	}
+	e := v.tusdError
+	if v.Error != nil {
+		e = *v.Error
+	}
+	return e.Code, e.Message, e.Code != "" || e.Message != ""
+}
+
+// MetadataSizeError is returned wrapped in ErrMetadataTooLarge and contains the size of encoded metadata
+type MetadataSizeError struct {
+	// Size is the size of encoded Upload-Metadata header value
+	Size int
+	// Limit is the Client.MaxMetadataSize value
+	Limit int
+}
+
+func (e MetadataSizeError) Error() string {
+	return fmt.Sprintf("encoded metadata size is %d bytes, limit is %d bytes", e.Size, e.Limit)
+}
+
+// UploadSizeError is returned wrapped in ErrUploadTooLarge if the requested upload size exceeds the server limit
+type UploadSizeError struct {
+	// Size is the requested upload size
+	Size int64
+	// Limit is the ServerCapabilities.MaxSize value
+	Limit int64
+}
+
+func (e UploadSizeError) Error() string {
+	return fmt.Sprintf("upload size is %d bytes, server limit is %d bytes", e.Size, e.Limit)
+}
+
+// OffsetsError is returned wrapped in ErrOffsetsNotSynced and contains both stream and server offsets, so the caller
+// can decide between Sync and restart without an extra request
+type OffsetsError struct {
+	// LocalOffset is the stream offset
+	LocalOffset int64
+	// RemoteOffset is the server offset, OffsetUnknown if the server has not sent it
+	RemoteOffset int64
+
+	details error
+}
+
+func (e OffsetsError) Error() string {
+	res := fmt.Sprintf("stream offset %d, server offset %d", e.LocalOffset, e.RemoteOffset)
+	if e.RemoteOffset == OffsetUnknown {
+		res = fmt.Sprintf("stream offset %d, server offset is unknown", e.LocalOffset)
+	}
+	if e.details != nil {
+		res += ": " + e.details.Error()
+	}
+	return res
+}
+
+// Unwrap returns ErrorDetails if the error was caused by a server response
+func (e OffsetsError) Unwrap() error {
+	return e.details
 }
 
 var (
-	ErrUnsupportedFeature = TusError{msg: "unsupported feature"}
-	ErrUploadTooLarge     = TusError{msg: "upload is too large"}
-	ErrUploadDoesNotExist = TusError{msg: "upload does not exist"}
-	ErrOffsetsNotSynced   = TusError{msg: "client stream and server offsets are not synced"}
-	ErrChecksumMismatch   = TusError{msg: "checksum mismatch"}
-	ErrProtocol           = TusError{msg: "protocol error"}
-	ErrCannotUpload       = TusError{msg: "can not upload"}
-	ErrUnexpectedResponse = TusError{msg: "unexpected HTTP response code"}
+	ErrUnsupportedFeature    = TusError{msg: "unsupported feature"}
+	ErrUploadTooLarge        = TusError{msg: "upload is too large"}
+	ErrUploadDoesNotExist    = TusError{msg: "upload does not exist"}
+	ErrUploadExpired         = TusError{msg: "upload has expired"}
+	ErrOffsetsNotSynced      = TusError{msg: "client stream and server offsets are not synced"}
+	ErrChecksumMismatch      = TusError{msg: "checksum mismatch"}
+	ErrProtocol              = TusError{msg: "protocol error"}
+	ErrCannotUpload          = TusError{msg: "can not upload"}
+	ErrUploadAlreadyComplete = TusError{msg: "upload is already complete"}
+	ErrUnexpectedResponse    = TusError{msg: "unexpected HTTP response code"}
+	ErrMetadataTooLarge      = TusError{msg: "metadata is too large"}
+	ErrInvariantViolation    = TusError{msg: "invariant violation"}
+	ErrRequestTimeout        = TusError{msg: "request timed out"}
+	ErrCircuitOpen           = TusError{msg: "circuit breaker is open"}
+	ErrRetryBudgetExhausted  = TusError{msg: "retry budget exhausted"}
 )
+
+// IsTransientError reports whether the upload failed with err may succeed if we try again later. Such errors are
+// network errors, data corruption, offsets conflict, server errors (5xx) and rate limiting (429). The context
+// cancellation is not transient, but the request timeout (see UploadStream.ChunkTimeout) and the open circuit breaker
+// are.
+func IsTransientError(err error) bool {
+	if errors.Is(err, ErrRetryBudgetExhausted) {
+		return false
+	}
+	if errors.Is(err, ErrRequestTimeout) || errors.Is(err, ErrCircuitOpen) {
+		return true
+	}
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	if errors.Is(err, ErrChecksumMismatch) || errors.Is(err, ErrOffsetsNotSynced) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return true
+	}
+	var ne net.Error
+	if errors.As(err, &ne) {
+		return true
+	}
+	var ed ErrorDetails
+	if errors.Is(err, ErrUnexpectedResponse) && errors.As(err, &ed) {
+		return ed.StatusCode >= http.StatusInternalServerError || ed.StatusCode == http.StatusTooManyRequests
+	}
+	return false
+}
@@ -0,0 +1,97 @@
+package tusgo
+
+import (
+	"bytes"
+	"errors"
+	"hash"
+	"io"
+)
+
+// hashPipeline reads the source by chunks one chunk ahead and hashes them in a separate goroutine, so the hashing of
+// the next chunk overlaps with the uploading of the current one. The source must not be touched while a chunk is
+// being prefetched.
+type hashPipeline struct {
+	req      chan int
+	res      chan hashedChunk
+	current  *hashedChunk
+	fetching bool // A chunk is being prefetched
+	bufs     [2]*[]byte
+	pool     *bufferPool
+}
+
+// hashedChunk is a chunk of source data along with its precalculated hash sum
+type hashedChunk struct {
+	*bytes.Reader
+	data []byte
+	sum  []byte
+	err  error
+}
+
+// newHashPipeline starts the goroutine reading chunks up to chunkSize bytes from r and hashing them by h, if not nil.
+// The buffers are taken from pool. Call close to stop the pipeline and return them.
+func newHashPipeline(r io.Reader, h hash.Hash, chunkSize int64, pool *bufferPool) *hashPipeline {
+	p := &hashPipeline{req: make(chan int), res: make(chan hashedChunk), pool: pool}
+	// The chunk is read to one buffer while the previous one is being consumed from another
+	p.bufs = [2]*[]byte{pool.get(int(chunkSize)), pool.get(int(chunkSize))}
+	bufs := [2][]byte{*p.bufs[0], *p.bufs[1]}
+	go func() {
+		defer close(p.res)
+		for i := 0; ; i++ {
+			n, ok := <-p.req
+			if !ok {
+				return
+			}
+			buf := bufs[i%2][:min(n, len(bufs[i%2]))]
+			t, err := io.ReadFull(r, buf)
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				err = nil
+			}
+			var sum []byte
+			if h != nil {
+				h.Reset()
+				h.Write(buf[:t])
+				sum = h.Sum(nil)
+			}
+			p.res <- hashedChunk{data: buf[:t], sum: sum, err: err}
+		}
+	}()
+	return p
+}
+
+// prefetch starts reading and hashing the next chunk of n bytes
+func (p *hashPipeline) prefetch(n int64) {
+	p.req <- int(n)
+	p.fetching = true
+}
+
+// next waits for the prefetched chunk and returns it. The previously returned chunk becomes invalid.
+func (p *hashPipeline) next() *hashedChunk {
+	c := <-p.res
+	p.fetching = false
+	c.Reader = bytes.NewReader(c.data)
+	p.current = &c
+	return p.current
+}
+
+// drain waits for the prefetched chunk and discards it along with the current one. Returns the number of discarded
+// bytes, which have been read from source, but have not been consumed.
+func (p *hashPipeline) drain() (unread int64) {
+	if p.current != nil {
+		unread = int64(p.current.Len())
+	}
+	if p.fetching {
+		unread += int64(len(p.next().data))
+	}
+	p.current = nil
+	return
+}
+
+// close drains the pipeline and stops its goroutine. Returns the number of unconsumed bytes, see drain.
+func (p *hashPipeline) close() (unread int64) {
+	unread = p.drain()
+	close(p.req)
+	for _, b := range p.bufs { // The goroutine is idle, so it doesn't touch the buffers anymore
+		p.pool.put(b)
+	}
+	return
+}
@@ -0,0 +1,50 @@
+package tusgo
+
+import "fmt"
+
+// InvariantMode determines what UploadStream does if the offsets invariants are broken. These are: server offset never
+// decreases, never exceeds the upload size, and the server never acknowledges more bytes than we have sent.
+type InvariantMode int
+
+const (
+	// InvariantsOff disables the invariants checking. This is default
+	InvariantsOff InvariantMode = iota
+
+	// InvariantsError makes the stream to return ErrInvariantViolation if invariant is broken. Suitable for production.
+	InvariantsError
+
+	// InvariantsPanic makes the stream to panic if invariant is broken. Suitable for development to catch the
+	// integration bugs early.
+	InvariantsPanic
+)
+
+// checkOffsetInvariants checks the offset received from server after sending a chunk of `sent` bytes. Negative
+// `sent` means that sent bytes count is unknown.
+func (us *UploadStream) checkOffsetInvariants(sent, newOffset int64) error {
+	prev := us.Upload.RemoteOffset
+	switch {
+	case newOffset < prev:
+		return us.invariantViolation("server offset %d is less than the previous one", newOffset)
+	case us.Upload.RemoteSize != SizeUnknown && newOffset > us.Upload.RemoteSize:
+		return us.invariantViolation("server offset %d exceeds the upload size", newOffset)
+	case sent >= 0 && newOffset-prev > sent:
+		return us.invariantViolation("server acknowledged %d bytes, but %d bytes have been sent", newOffset-prev, sent)
+	}
+	return nil
+}
+
+// invariantViolation handles the broken invariant according to Invariants. Call it only if the invariant is broken,
+// so the arguments are not boxed on every chunk
+func (us *UploadStream) invariantViolation(format string, args ...any) error {
+	if us.Invariants == InvariantsOff {
+		return nil
+	}
+	err := ErrInvariantViolation.WithText(fmt.Sprintf(
+		"upload %q, offset %d, size %d, chunk size %d: %s",
+		us.Upload.Location, us.Upload.RemoteOffset, us.Upload.RemoteSize, us.ChunkSize, fmt.Sprintf(format, args...),
+	))
+	if us.Invariants == InvariantsPanic {
+		panic(err.Error())
+	}
+	return err
+}
@@ -0,0 +1,119 @@
+package tusgo
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// JobRecord is the persistent state of UploadManager job
+type JobRecord struct {
+	// SourceID identifies the job source, see UploadJob.SourceID
+	SourceID string
+
+	// State is the job state. The records of done and canceled jobs are removed from the store.
+	State JobState
+
+	// Upload is the upload of the job. Location is empty if the upload has not been created yet
+	Upload Upload
+
+	// Size and Metadata are the parameters of upload to create
+	Size     int64
+	Metadata map[string]string
+
+	// Diagnostics are the last upload exchanges of the failed job, see UploadManager.DiagnosticsSize
+	Diagnostics []Exchange
+}
+
+// JobStore persists the UploadManager jobs, so they can be resumed after restart, see UploadManager.Resume.
+// Implementations must be safe for concurrent use.
+type JobStore interface {
+	// Put saves the record, replacing the one with the same SourceID
+	Put(rec JobRecord) error
+
+	// Remove deletes the record by SourceID. Removing the absent record is not an error
+	Remove(sourceID string) error
+
+	// List returns all records
+	List() ([]JobRecord, error)
+}
+
+// NewDirJobStore constructs a new DirJobStore keeping the records in dir. The directory is created if not exists.
+func NewDirJobStore(dir string) (*DirJobStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &DirJobStore{dir: dir}, nil
+}
+
+// DirJobStore is JobStore, that keeps every record in a separate JSON file in a directory. The file is replaced
+// atomically, so the record is never left half-written after crash.
+type DirJobStore struct {
+	dir string
+}
+
+// Put saves the record to file
+func (ds *DirJobStore) Put(rec JobRecord) error {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(ds.dir, ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name()) // No-op after successful rename
+	if _, err = f.Write(data); err == nil {
+		err = f.Sync()
+	}
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		return fmt.Errorf("cannot write job record: %w", err)
+	}
+	return os.Rename(f.Name(), ds.path(rec.SourceID))
+}
+
+// Remove deletes the record file
+func (ds *DirJobStore) Remove(sourceID string) error {
+	if err := os.Remove(ds.path(sourceID)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// List reads all record files
+func (ds *DirJobStore) List() (res []JobRecord, err error) {
+	entries, err := os.ReadDir(ds.dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), ".json") {
+			continue
+		}
+		var data []byte
+		if data, err = os.ReadFile(filepath.Join(ds.dir, e.Name())); err != nil {
+			return nil, err
+		}
+		var rec JobRecord
+		if err = json.Unmarshal(data, &rec); err != nil {
+			return nil, fmt.Errorf("cannot decode job record %s: %w", e.Name(), err)
+		}
+		res = append(res, rec)
+	}
+	return
+}
+
+// path returns the record file path. SourceID is hashed, since it may contain any characters
+func (ds *DirJobStore) path(sourceID string) string {
+	sum := sha256.Sum256([]byte(sourceID))
+	return filepath.Join(ds.dir, hex.EncodeToString(sum[:])+".json")
+}
@@ -0,0 +1,94 @@
+package tusgo
+
+import (
+	"context"
+	"fmt"
+	"hash"
+	"io"
+
+	"github.com/bdragon300/tusgo/checksum"
+)
+
+// PartsLedger records the partial uploads the final upload was concatenated from, so that the final upload could be
+// verified after concatenation. See ParallelUploader.OnVerified.
+type PartsLedger struct {
+	// ChecksumAlgorithm is the algorithm of digests. Empty if digests were not calculated
+	ChecksumAlgorithm string
+
+	// Parts are the partial uploads in concatenation order
+	Parts []PartRecord
+
+	// Size is the total size of parts
+	Size int64
+
+	// Digest is the checksum of the whole data, i.e. of all parts in order
+	Digest []byte
+}
+
+// PartRecord is a partial upload record in PartsLedger
+type PartRecord struct {
+	Location string
+	Size     int64
+	Digest   []byte
+}
+
+// Verify checks the final upload at location against the ledger, see Client.VerifyUpload. We check that the upload
+// size is equal to the total size of parts, and that the server has concatenated the parts we have sent, if it reports
+// them. If ledger has the digest, the final upload data is downloaded and compared with it, where the server allows it.
+func (pl PartsLedger) Verify(ctx context.Context, c *Client, location string) (VerificationReport, error) {
+	opts := VerifyOptions{ExpectedSize: pl.Size, ChecksumAlgorithm: pl.ChecksumAlgorithm, ExpectedChecksum: pl.Digest}
+	for _, p := range pl.Parts {
+		opts.ExpectedParts = append(opts.ExpectedParts, p.Location)
+	}
+	return c.VerifyUpload(ctx, location, opts)
+}
+
+// ledgerWriter builds a PartsLedger by hashing the parts data in order
+type ledgerWriter struct {
+	ledger  PartsLedger
+	newHash func() hash.Hash
+	whole   hash.Hash
+}
+
+// newLedgerWriter returns a new ledgerWriter. Empty algorithm means that only sizes are recorded
+func newLedgerWriter(algorithm string) *ledgerWriter {
+	lw := &ledgerWriter{ledger: PartsLedger{ChecksumAlgorithm: algorithm}}
+	if algorithm != "" {
+		alg, ok := checksum.GetAlgorithm(algorithm)
+		if !ok {
+			panic(fmt.Sprintf("checksum algorithm %q does not supported", algorithm))
+		}
+		lw.newHash = checksum.Algorithms[alg]
+		lw.whole = lw.newHash()
+	}
+	return lw
+}
+
+// addPart records the next part, reading its data from r
+func (lw *ledgerWriter) addPart(r io.Reader) (err error) {
+	rec := PartRecord{}
+	if lw.newHash == nil {
+		rec.Size, err = io.Copy(io.Discard, r)
+	} else {
+		h := lw.newHash()
+		rec.Size, err = io.Copy(io.MultiWriter(h, lw.whole), r)
+		rec.Digest = h.Sum(nil)
+	}
+	if err != nil {
+		return fmt.Errorf("cannot read source: %w", err)
+	}
+	lw.ledger.Parts = append(lw.ledger.Parts, rec)
+	lw.ledger.Size += rec.Size
+	return
+}
+
+// finish fills the parts locations in and returns the ledger
+func (lw *ledgerWriter) finish(partials []Upload) PartsLedger {
+	for i := range lw.ledger.Parts {
+		lw.ledger.Parts[i].Location = partials[i].Location
+	}
+	if lw.whole != nil {
+		lw.ledger.Digest = lw.whole.Sum(nil)
+	}
+	return lw.ledger
+}
@@ -0,0 +1,570 @@
+package tusgo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// JobState is the state of UploadManager job
+type JobState int
+
+const (
+	// JobQueued means the job waits for a free worker
+	JobQueued JobState = iota
+	// JobRunning means the job data is being uploaded
+	JobRunning
+	// JobDone means the job data has been uploaded
+	JobDone
+	// JobFailed means the job has failed, see JobStatus.Err
+	JobFailed
+	// JobCanceled means the job has been canceled before completion
+	JobCanceled
+)
+
+func (s JobState) String() string {
+	switch s {
+	case JobQueued:
+		return "queued"
+	case JobRunning:
+		return "running"
+	case JobDone:
+		return "done"
+	case JobFailed:
+		return "failed"
+	case JobCanceled:
+		return "canceled"
+	}
+	return fmt.Sprintf("JobState(%d)", int(s))
+}
+
+// UploadJob is the data to upload by UploadManager
+type UploadJob struct {
+	// Source is the data to upload, its beginning corresponds to the upload offset 0
+	Source io.ReadSeeker
+
+	// Location is the existing upload to resume. If empty, a new upload is created with Size and Metadata
+	Location string
+
+	// Size is the size of upload to create
+	Size int64
+
+	// Metadata is the metadata of upload to create
+	Metadata map[string]string
+
+	// SourceID identifies the Source in UploadManager.Store, e.g. a file path. Required if the store is set, must be
+	// unique among the jobs.
+	SourceID string
+}
+
+// JobStatus is the state of a job. The Upload is filled once the job has created or obtained it.
+type JobStatus struct {
+	ID       int
+	State    JobState
+	Upload   Upload
+	Progress Progress
+
+	// Attempts is the number of upload attempts made, see UploadStream.UploadAll
+	Attempts int
+
+	// Stats are the transfer statistics of the job upload, see UploadStream.Stats
+	Stats TransferStats
+
+	// Err is the job error if the job is failed or canceled
+	Err error
+}
+
+// ManagerStatus is the aggregate status of all jobs of UploadManager
+type ManagerStatus struct {
+	Queued, Running, Done, Failed, Canceled int
+
+	// BytesAcked is the number of bytes the server has acknowledged, over all jobs
+	BytesAcked int64
+
+	// BytesTotal is the total size of all jobs, whose size is known
+	BytesTotal int64
+}
+
+// ManagerProgress is the combined progress of all jobs of UploadManager, see UploadManager.OnProgress
+type ManagerProgress struct {
+	ManagerStatus
+
+	// Jobs are the statuses of all jobs, ordered by id
+	Jobs []JobStatus
+
+	// Elapsed is the time since the first job has started
+	Elapsed time.Duration
+
+	// ETA is the estimated time left to upload the rest of data, based on the average throughput since the first
+	// job has started. Zero if it can't be estimated yet.
+	ETA time.Duration
+}
+
+// Percent returns the share of data acknowledged by the server, from 0 to 100
+func (p ManagerProgress) Percent() float64 {
+	if p.BytesTotal <= 0 {
+		if len(p.Jobs) > 0 && p.Queued+p.Running == 0 {
+			return 100
+		}
+		return 0
+	}
+	return float64(p.BytesAcked) * 100 / float64(p.BytesTotal)
+}
+
+// NewUploadManager constructs a new UploadManager, which runs at most concurrency jobs at a time. The jobs are
+// stopped when ctx is done.
+func NewUploadManager(ctx context.Context, client *Client, concurrency int) *UploadManager {
+	if concurrency <= 0 {
+		panic("concurrency must be positive")
+	}
+	return &UploadManager{
+		MaxAttempts: 10,
+		RetryDelay:  5 * time.Second,
+		client:      client,
+		ctx:         ctx,
+		concurrency: concurrency,
+	}
+}
+
+// UploadManager uploads many jobs by a bounded pool of workers sharing one Client. Jobs run in order they have been
+// added. Every job is uploaded by UploadStream.UploadAll, which retries transient errors, so the job source must
+// be seekable. If the Store is set, the jobs are persisted, so after crash or restart they can be resumed by Resume.
+//
+// The manager fields must be set before adding the first job. UploadManager methods are safe for concurrent use.
+type UploadManager struct {
+	// ChunkSize is the upload chunk size of every job, see UploadStream.ChunkSize. Zero means the stream default
+	ChunkSize int64
+
+	// MaxAttempts is the maximum number of upload attempts of a job. Default is 10
+	MaxAttempts int
+
+	// RetryDelay is the delay between attempts of a job. Default is 5 seconds
+	RetryDelay time.Duration
+
+	// OnProgress, if set, is called with the combined progress when a job changes its state or uploads the data.
+	// The calls are serialized. See also ProgressChan.
+	OnProgress func(p ManagerProgress)
+
+	// ProgressInterval is the minimum interval between progress reports caused by the data upload. The reports
+	// caused by job state changes are never skipped. Zero means reporting on every upload progress.
+	ProgressInterval time.Duration
+
+	// Store, if set, persists the jobs, so they can be resumed after restart by Resume
+	Store JobStore
+
+	// DiagnosticsSize, if positive, is the number of last upload exchanges every job keeps, see DiagnosticsRing.
+	// The exchanges of a failed job are saved to the Store with it, so they can be examined by Describe after restart.
+	DiagnosticsSize int
+
+	// OnJobFinished, if set, is called once a job is done, failed or canceled. The call is made from the job goroutine,
+	// or from Cancel for the queued job. Wait returns after all calls have returned.
+	OnJobFinished func(status JobStatus)
+
+	client      *Client
+	ctx         context.Context
+	concurrency int
+
+	mu           sync.Mutex
+	jobs         []*managerJob
+	queue        []*managerJob
+	running      int
+	wg           sync.WaitGroup
+	started      time.Time // When the first job has started
+	baseAcked    int64     // Bytes acknowledged before the jobs have started, e.g. of resumed uploads
+	lastProgress time.Time
+
+	progressMu sync.Mutex // Serializes the progress reports
+	progressCh chan ManagerProgress
+}
+
+type managerJob struct {
+	UploadJob
+	status JobStatus
+	ctx    context.Context
+	cancel context.CancelFunc
+	diag   *DiagnosticsRing // Nil if DiagnosticsSize is not set
+}
+
+// Add enqueues a job and returns its id. The job starts immediately if there is a free worker. If the Store is set,
+// the job is saved to it, and it fails if the saving has failed.
+func (m *UploadManager) Add(job UploadJob) (id int) {
+	return m.add(m.ctx, job, nil)
+}
+
+// Resume loads the jobs from Store and adds the unfinished ones, e.g. after crash or restart. The jobs continue from
+// the server offset of their uploads, the uploads not created yet are created. open returns the job source by
+// its UploadJob.SourceID, the job fails if open has failed. Returns the ids of resumed jobs.
+//
+// Resumed jobs are stopped when ctx is done instead of the manager context.
+func (m *UploadManager) Resume(ctx context.Context, open func(sourceID string) (io.ReadSeeker, error)) (ids []int, err error) {
+	if m.Store == nil {
+		panic("store is not set")
+	}
+	recs, err := m.Store.List()
+	if err != nil {
+		return nil, fmt.Errorf("cannot load jobs: %w", err)
+	}
+	for _, rec := range recs {
+		job := UploadJob{Location: rec.Upload.Location, Size: rec.Size, Metadata: rec.Metadata, SourceID: rec.SourceID}
+		var openErr error
+		if job.Source, openErr = open(rec.SourceID); openErr != nil {
+			openErr = fmt.Errorf("cannot open source %q: %w", rec.SourceID, openErr)
+		}
+		ids = append(ids, m.add(ctx, job, openErr))
+	}
+	return
+}
+
+// add enqueues a job with given context, or makes it failed with a given error
+func (m *UploadManager) add(ctx context.Context, job UploadJob, err error) (id int) {
+	if job.Source == nil && err == nil {
+		panic("job source is nil")
+	}
+	if m.Store != nil && job.SourceID == "" {
+		panic("job source id is empty")
+	}
+	if err == nil && m.Store != nil {
+		err = m.Store.Put(JobRecord{SourceID: job.SourceID, State: JobQueued, Upload: Upload{Location: job.Location}, Size: job.Size, Metadata: job.Metadata})
+		if err != nil {
+			err = fmt.Errorf("cannot save job: %w", err)
+		}
+	}
+
+	m.mu.Lock()
+	j := &managerJob{UploadJob: job, status: JobStatus{ID: len(m.jobs), State: JobQueued}, ctx: ctx}
+	if m.DiagnosticsSize > 0 {
+		j.diag = NewDiagnosticsRing(m.DiagnosticsSize)
+	}
+	j.status.Upload.RemoteSize, j.status.Progress.Total = job.Size, job.Size
+	if job.Location != "" {
+		j.status.Upload.Location = job.Location
+		j.status.Upload.RemoteSize, j.status.Progress.Total = SizeUnknown, SizeUnknown // Unknown until obtained
+	}
+	m.jobs = append(m.jobs, j)
+	m.wg.Add(1)
+	if err != nil {
+		status := m.finishLocked(j, err)
+		m.mu.Unlock()
+		m.reportProgress(true)
+		m.finished(status)
+		return status.ID
+	}
+	m.queue = append(m.queue, j)
+	m.dispatchLocked()
+	id = j.status.ID
+	m.mu.Unlock()
+	m.reportProgress(true)
+	return
+}
+
+// Cancel cancels a job by id. The queued job is not started, the running one is interrupted. Does nothing if the job
+// has been finished.
+func (m *UploadManager) Cancel(id int) {
+	m.mu.Lock()
+	if id < 0 || id >= len(m.jobs) {
+		m.mu.Unlock()
+		return
+	}
+	j := m.jobs[id]
+	switch j.status.State {
+	case JobQueued:
+		for i, q := range m.queue {
+			if q == j {
+				m.queue = append(m.queue[:i], m.queue[i+1:]...)
+				break
+			}
+		}
+		status := m.finishLocked(j, context.Canceled)
+		m.mu.Unlock()
+		if m.Store != nil {
+			_ = m.Store.Remove(j.SourceID) // The job is canceled anyway
+		}
+		m.reportProgress(true)
+		m.finished(status)
+		return
+	case JobRunning:
+		j.cancel()
+	}
+	m.mu.Unlock()
+}
+
+// Describe returns the last upload exchanges of a failed job saved to the Store, see DiagnosticsSize. Returns nil
+// if there is no such job in the Store, or it has no exchanges. Panics if the Store is not set.
+func (m *UploadManager) Describe(sourceID string) ([]Exchange, error) {
+	if m.Store == nil {
+		panic("store is not set")
+	}
+	recs, err := m.Store.List()
+	if err != nil {
+		return nil, fmt.Errorf("cannot load jobs: %w", err)
+	}
+	for _, rec := range recs {
+		if rec.SourceID == sourceID {
+			return rec.Diagnostics, nil
+		}
+	}
+	return nil, nil
+}
+
+// Wait blocks until all jobs added so far are finished
+func (m *UploadManager) Wait() {
+	m.wg.Wait()
+}
+
+// Status returns the status of a job by id. Returns false if there is no such job.
+func (m *UploadManager) Status(id int) (JobStatus, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if id < 0 || id >= len(m.jobs) {
+		return JobStatus{}, false
+	}
+	return m.jobs[id].status, true
+}
+
+// Statuses returns the statuses of all jobs, ordered by id
+func (m *UploadManager) Statuses() []JobStatus {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	res := make([]JobStatus, len(m.jobs))
+	for i, j := range m.jobs {
+		res[i] = j.status
+	}
+	return res
+}
+
+// Aggregate returns the aggregate status of all jobs
+func (m *UploadManager) Aggregate() ManagerStatus {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.aggregateLocked()
+}
+
+// Progress returns the combined progress of all jobs
+func (m *UploadManager) Progress() ManagerProgress {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.progressLocked()
+}
+
+// ProgressChan returns a channel, which receives the combined progress, the same as OnProgress. The channel is closed
+// when all jobs added so far are finished. buffer is the channel buffer size.
+//
+// The progress is not sent if the channel buffer is full, since the next report supersedes it, so the manager never
+// blocks on the slow reader. Only one channel can be used at a time, the previous one is closed on the repeated call.
+func (m *UploadManager) ProgressChan(buffer int) <-chan ManagerProgress {
+	m.progressMu.Lock()
+	defer m.progressMu.Unlock()
+	if m.progressCh != nil {
+		close(m.progressCh)
+	}
+	m.progressCh = make(chan ManagerProgress, buffer)
+	ch := m.progressCh
+	if s := m.Aggregate(); s.Queued+s.Running == 0 {
+		close(m.progressCh)
+		m.progressCh = nil
+	}
+	return ch
+}
+
+// reportProgress sends the combined progress to OnProgress and the progress channel. Unless force is true, the
+// report is skipped if the previous one has been made less than ProgressInterval ago.
+func (m *UploadManager) reportProgress(force bool) {
+	m.mu.Lock()
+	now := time.Now()
+	if !force && now.Sub(m.lastProgress) < m.ProgressInterval {
+		m.mu.Unlock()
+		return
+	}
+	m.lastProgress = now
+	p := m.progressLocked()
+	m.mu.Unlock()
+
+	m.progressMu.Lock()
+	defer m.progressMu.Unlock()
+	if m.OnProgress != nil {
+		m.OnProgress(p)
+	}
+	if m.progressCh != nil {
+		select {
+		case m.progressCh <- p:
+		default:
+		}
+		if p.Queued+p.Running == 0 {
+			close(m.progressCh)
+			m.progressCh = nil
+		}
+	}
+}
+
+func (m *UploadManager) progressLocked() ManagerProgress {
+	p := ManagerProgress{ManagerStatus: m.aggregateLocked(), Jobs: make([]JobStatus, len(m.jobs))}
+	for i, j := range m.jobs {
+		p.Jobs[i] = j.status
+	}
+	if m.started.IsZero() {
+		return p
+	}
+	p.Elapsed = time.Since(m.started)
+	if uploaded := p.BytesAcked - m.baseAcked; uploaded > 0 && p.BytesTotal > p.BytesAcked {
+		rate := float64(uploaded) / p.Elapsed.Seconds()
+		p.ETA = time.Duration(float64(p.BytesTotal-p.BytesAcked) / rate * float64(time.Second))
+	}
+	return p
+}
+
+func (m *UploadManager) aggregateLocked() (res ManagerStatus) {
+	for _, j := range m.jobs {
+		switch j.status.State {
+		case JobQueued:
+			res.Queued++
+		case JobRunning:
+			res.Running++
+		case JobDone:
+			res.Done++
+		case JobFailed:
+			res.Failed++
+		case JobCanceled:
+			res.Canceled++
+		}
+		res.BytesAcked += j.status.Progress.BytesAcked
+		if j.status.Progress.Total != SizeUnknown {
+			res.BytesTotal += j.status.Progress.Total
+		}
+	}
+	return
+}
+
+// dispatchLocked starts the queued jobs while there are free workers
+func (m *UploadManager) dispatchLocked() {
+	for m.running < m.concurrency && len(m.queue) > 0 {
+		j := m.queue[0]
+		m.queue = m.queue[1:]
+		var ctx context.Context
+		ctx, j.cancel = context.WithCancel(j.ctx)
+		j.status.State = JobRunning
+		m.running++
+		if m.started.IsZero() {
+			m.started = time.Now()
+		}
+		go func() {
+			err := m.run(ctx, j)
+			j.cancel()
+			if e := m.saveFinished(j, err); e != nil && err == nil {
+				err = e
+			}
+			m.mu.Lock()
+			m.running--
+			status := m.finishLocked(j, err)
+			m.dispatchLocked()
+			m.mu.Unlock()
+			m.reportProgress(true)
+			m.finished(status)
+		}()
+	}
+}
+
+// finishLocked sets the final job state by its error and returns the job status
+func (m *UploadManager) finishLocked(j *managerJob, err error) JobStatus {
+	j.status.State = finalJobState(err)
+	j.status.Err = err
+	return j.status
+}
+
+// saveFinished removes the done or canceled job from the Store, and saves the failed one to resume it later
+func (m *UploadManager) saveFinished(j *managerJob, err error) error {
+	if m.Store == nil {
+		return nil
+	}
+	state := finalJobState(err)
+	if state != JobFailed {
+		err = m.Store.Remove(j.SourceID)
+	} else {
+		m.mu.Lock()
+		u := j.status.Upload
+		m.mu.Unlock()
+		rec := JobRecord{SourceID: j.SourceID, State: state, Upload: u, Size: j.Size, Metadata: j.Metadata}
+		if j.diag != nil {
+			rec.Diagnostics = j.diag.Describe(u.Location)
+		}
+		err = m.Store.Put(rec)
+	}
+	if err != nil {
+		return fmt.Errorf("cannot save job: %w", err)
+	}
+	return nil
+}
+
+// finalJobState returns the state of finished job by its error
+func finalJobState(err error) JobState {
+	switch {
+	case err == nil:
+		return JobDone
+	case errors.Is(err, context.Canceled):
+		return JobCanceled
+	default:
+		return JobFailed
+	}
+}
+
+// finished calls OnJobFinished hook and marks the job finished for Wait
+func (m *UploadManager) finished(status JobStatus) {
+	defer m.wg.Done()
+	if m.OnJobFinished != nil {
+		m.OnJobFinished(status)
+	}
+}
+
+// run uploads the job data
+func (m *UploadManager) run(ctx context.Context, j *managerJob) (err error) {
+	cl := m.client.WithContext(ctx)
+	u := Upload{}
+	if j.Location != "" {
+		_, err = cl.GetUpload(&u, j.Location)
+	} else {
+		_, err = cl.CreateUpload(&u, j.Size, false, j.Metadata)
+	}
+	if err != nil {
+		return
+	}
+	m.mu.Lock()
+	j.status.Upload = u
+	j.status.Progress = Progress{BytesAcked: u.RemoteOffset, Total: u.RemoteSize}
+	m.baseAcked += u.RemoteOffset
+	m.mu.Unlock()
+	m.reportProgress(true)
+	if m.Store != nil && j.Location == "" {
+		// Save the location of created upload, so we don't create it again after restart
+		rec := JobRecord{SourceID: j.SourceID, State: JobRunning, Upload: u, Size: j.Size, Metadata: j.Metadata}
+		if err = m.Store.Put(rec); err != nil {
+			return fmt.Errorf("cannot save job: %w", err)
+		}
+	}
+
+	s := NewUploadStream(cl, &u)
+	if m.ChunkSize > 0 {
+		s.ChunkSize = m.ChunkSize
+	}
+	s.MaxAttempts, s.RetryDelay = m.MaxAttempts, m.RetryDelay
+	if j.diag != nil {
+		s.Diagnostics = j.diag
+	}
+	s.OnProgress = func(p Progress) {
+		m.mu.Lock()
+		j.status.Progress = p
+		j.status.Upload = u
+		m.mu.Unlock()
+		m.reportProgress(false)
+	}
+	stats, err := s.UploadAll(ctx, j.Source)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	j.status.Upload = u
+	j.status.Progress.BytesAcked = u.RemoteOffset
+	j.status.Attempts = stats.Attempts
+	j.status.Stats = stats.TransferStats
+	return
+}
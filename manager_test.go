@@ -0,0 +1,335 @@
+package tusgo
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("UploadManager", func() {
+	var testSrv *httptest.Server
+	var testClient *Client
+	var mu sync.Mutex
+	var stored map[string]*bytes.Buffer
+	var lengths map[string]string
+	var patchFailures map[string]int
+	var active, maxActive int
+	var patchDelay time.Duration
+
+	BeforeEach(func() {
+		stored = make(map[string]*bytes.Buffer)
+		lengths = make(map[string]string)
+		patchFailures = make(map[string]int)
+		active, maxActive = 0, 0
+		patchDelay = 0
+		testSrv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			defer mu.Unlock()
+			w.Header().Set("Tus-Resumable", "1.0.0")
+			switch {
+			case r.Method == http.MethodPost:
+				loc := "/files/" + strconv.Itoa(len(stored))
+				stored[loc] = bytes.NewBuffer(nil)
+				lengths[loc] = r.Header.Get("Upload-Length")
+				w.Header().Set("Location", loc)
+				w.WriteHeader(http.StatusCreated)
+			case r.Method == http.MethodHead && stored[r.URL.Path] != nil:
+				w.Header().Set("Upload-Length", lengths[r.URL.Path])
+				w.Header().Set("Upload-Offset", strconv.Itoa(stored[r.URL.Path].Len()))
+			case r.Method == http.MethodPatch && stored[r.URL.Path] != nil:
+				if patchFailures[r.URL.Path] > 0 {
+					patchFailures[r.URL.Path]--
+					w.WriteHeader(http.StatusServiceUnavailable)
+					return
+				}
+				active++
+				maxActive = max(maxActive, active)
+				mu.Unlock()
+				time.Sleep(patchDelay)
+				mu.Lock()
+				active--
+				_, _ = io.Copy(stored[r.URL.Path], r.Body)
+				w.Header().Set("Upload-Offset", strconv.Itoa(stored[r.URL.Path].Len()))
+				w.WriteHeader(http.StatusNoContent)
+			default:
+				w.WriteHeader(http.StatusNotFound)
+			}
+		}))
+		u, _ := url.Parse(testSrv.URL + "/files/")
+		testClient = NewClient(testSrv.Client(), u)
+		testClient.AssumeCapabilities(ServerCapabilities{ProtocolVersions: []string{"1.0.0"}, Extensions: []string{"creation"}})
+	})
+	AfterEach(func() {
+		testSrv.Close()
+	})
+
+	It("should upload all jobs running no more than given number at a time", func() {
+		patchDelay = 20 * time.Millisecond
+		m := NewUploadManager(context.Background(), testClient, 2)
+		var finished []int
+		finishedStats := make(map[int]TransferStats)
+		var finishedMu sync.Mutex
+		m.OnJobFinished = func(status JobStatus) {
+			finishedMu.Lock()
+			defer finishedMu.Unlock()
+			finished = append(finished, status.ID)
+			finishedStats[status.ID] = status.Stats
+		}
+		data := make([][]byte, 5)
+		for i := range data {
+			data[i] = bytes.Repeat([]byte{byte(i)}, 100*(i+1))
+			Ω(m.Add(UploadJob{Source: bytes.NewReader(data[i]), Size: int64(len(data[i]))})).Should(Equal(i))
+		}
+		m.Wait()
+
+		Ω(maxActive).Should(Equal(2))
+		Ω(finished).Should(ConsistOf(0, 1, 2, 3, 4))
+		for i, s := range m.Statuses() {
+			Ω(s.ID).Should(Equal(i))
+			Ω(s.State).Should(Equal(JobDone))
+			Ω(s.Err).Should(Succeed())
+			Ω(s.Upload.IsComplete()).Should(BeTrue())
+			Ω(s.Progress.BytesAcked).Should(BeEquivalentTo(len(data[i])))
+			Ω(s.Stats.BytesUploaded).Should(BeEquivalentTo(len(data[i])))
+			Ω(finishedStats[i]).Should(Equal(s.Stats))
+			Ω(stored[s.Upload.Location].Bytes()).Should(Equal(data[i]))
+		}
+		Ω(m.Aggregate()).Should(Equal(ManagerStatus{Done: 5, BytesAcked: 1500, BytesTotal: 1500}))
+	})
+	It("should retry the job on transient errors", func() {
+		patchFailures["/files/0"] = 1
+		m := NewUploadManager(context.Background(), testClient, 1)
+		m.RetryDelay = time.Millisecond
+		id := m.Add(UploadJob{Source: bytes.NewReader([]byte("hello")), Size: 5})
+		m.Wait()
+
+		s, ok := m.Status(id)
+		Ω(ok).Should(BeTrue())
+		Ω(s.State).Should(Equal(JobDone))
+		Ω(s.Attempts).Should(Equal(2))
+		Ω(s.Stats.BytesUploaded).Should(BeEquivalentTo(5))
+		Ω(s.Stats.Requests).Should(Equal(2))
+		Ω(s.Stats.Stalls).Should(Equal(1))
+	})
+	It("should fail the job after MaxAttempts", func() {
+		patchFailures["/files/0"] = 100
+		m := NewUploadManager(context.Background(), testClient, 1)
+		m.RetryDelay, m.MaxAttempts = time.Millisecond, 2
+		m.Add(UploadJob{Source: bytes.NewReader([]byte("hello")), Size: 5})
+		m.Add(UploadJob{Source: bytes.NewReader([]byte("world")), Size: 5})
+		m.Wait()
+
+		statuses := m.Statuses()
+		Ω(statuses[0].State).Should(Equal(JobFailed))
+		Ω(statuses[0].Err).Should(MatchError(ErrUnexpectedResponse))
+		Ω(statuses[0].Upload.Location).Should(Equal("/files/0"))
+		Ω(statuses[1].State).Should(Equal(JobDone))
+		Ω(m.Aggregate()).Should(Equal(ManagerStatus{Done: 1, Failed: 1, BytesAcked: 5, BytesTotal: 10}))
+	})
+	It("should resume the existing upload", func() {
+		stored["/files/foo"] = bytes.NewBufferString("hello")
+		lengths["/files/foo"] = "11"
+		m := NewUploadManager(context.Background(), testClient, 1)
+		id := m.Add(UploadJob{Source: bytes.NewReader([]byte("hello world")), Location: "foo"})
+		m.Wait()
+
+		s, _ := m.Status(id)
+		Ω(s.State).Should(Equal(JobDone))
+		Ω(s.Upload.RemoteSize).Should(BeEquivalentTo(11))
+		Ω(stored["/files/foo"].String()).Should(Equal("hello world"))
+	})
+	It("should cancel the queued and running jobs", func() {
+		patchDelay = 100 * time.Millisecond
+		m := NewUploadManager(context.Background(), testClient, 1)
+		running := m.Add(UploadJob{Source: bytes.NewReader([]byte("hello")), Size: 5})
+		queued := m.Add(UploadJob{Source: bytes.NewReader([]byte("world")), Size: 5})
+		Eventually(func() int { mu.Lock(); defer mu.Unlock(); return active }).Should(Equal(1))
+		m.Cancel(queued)
+		m.Cancel(running)
+		m.Wait()
+
+		Ω(m.Aggregate()).Should(Equal(ManagerStatus{Canceled: 2, BytesTotal: 10}))
+		s, _ := m.Status(queued)
+		Ω(s.Err).Should(MatchError(context.Canceled))
+		_, ok := m.Status(100)
+		Ω(ok).Should(BeFalse())
+	})
+	Context("progress", func() {
+		It("should report the combined progress to callback", func() {
+			patchDelay = 10 * time.Millisecond
+			m := NewUploadManager(context.Background(), testClient, 2)
+			m.ChunkSize = 100
+			var reports []ManagerProgress
+			m.OnProgress = func(p ManagerProgress) { reports = append(reports, p) }
+			for i := 0; i < 3; i++ {
+				m.Add(UploadJob{Source: bytes.NewReader(make([]byte, 300)), Size: 300})
+			}
+			m.Wait()
+
+			Ω(reports).ShouldNot(BeEmpty())
+			var etaSeen bool
+			for i, p := range reports {
+				Ω(p.Jobs).ShouldNot(BeEmpty())
+				Ω(p.ETA).Should(BeNumerically(">=", 0))
+				etaSeen = etaSeen || p.ETA > 0
+				if i > 0 {
+					Ω(p.BytesAcked).Should(BeNumerically(">=", reports[i-1].BytesAcked))
+				}
+			}
+			Ω(etaSeen).Should(BeTrue())
+			last := reports[len(reports)-1]
+			Ω(last.ManagerStatus).Should(Equal(ManagerStatus{Done: 3, BytesAcked: 900, BytesTotal: 900}))
+			Ω(last.Percent()).Should(BeEquivalentTo(100))
+			Ω(last.ETA).Should(BeZero())
+			Ω(last.Elapsed).Should(BeNumerically(">", 0))
+			for _, js := range last.Jobs {
+				Ω(js.Progress.BytesAcked).Should(BeEquivalentTo(300))
+			}
+			Ω(m.Progress().ManagerStatus).Should(Equal(last.ManagerStatus))
+		})
+		It("should skip upload reports more often than ProgressInterval", func() {
+			m := NewUploadManager(context.Background(), testClient, 1)
+			m.ChunkSize = 10
+			m.ProgressInterval = time.Hour
+			var reports []ManagerProgress
+			m.OnProgress = func(p ManagerProgress) { reports = append(reports, p) }
+			m.Add(UploadJob{Source: bytes.NewReader(make([]byte, 100)), Size: 100})
+			m.Wait()
+
+			// Added, upload created, finished
+			Ω(reports).Should(HaveLen(3))
+			Ω(reports[2].Done).Should(Equal(1))
+		})
+		It("should send progress to channel and close it after all jobs are finished", func() {
+			patchDelay = 10 * time.Millisecond
+			m := NewUploadManager(context.Background(), testClient, 1)
+			m.Add(UploadJob{Source: bytes.NewReader(make([]byte, 100)), Size: 100})
+			ch := m.ProgressChan(100)
+			m.Add(UploadJob{Source: bytes.NewReader(make([]byte, 100)), Size: 100})
+
+			var last ManagerProgress
+			for p := range ch {
+				last = p
+			}
+			Ω(last.Done).Should(Equal(2))
+			Ω(last.Percent()).Should(BeEquivalentTo(100))
+			m.Wait()
+			_, ok := <-m.ProgressChan(1)
+			Ω(ok).Should(BeFalse())
+		})
+	})
+	Context("Store", func() {
+		var store *DirJobStore
+		sources := map[string][]byte{"a": []byte("hello"), "b": []byte("world!")}
+		open := func(id string) (io.ReadSeeker, error) {
+			if data, ok := sources[id]; ok {
+				return bytes.NewReader(data), nil
+			}
+			return nil, errors.New("no such source")
+		}
+
+		BeforeEach(func() {
+			var err error
+			store, err = NewDirJobStore(GinkgoT().TempDir())
+			Ω(err).Should(Succeed())
+		})
+
+		It("should remove the done jobs from store", func() {
+			m := NewUploadManager(context.Background(), testClient, 2)
+			m.Store = store
+			for id, data := range sources {
+				m.Add(UploadJob{Source: bytes.NewReader(data), Size: int64(len(data)), SourceID: id})
+			}
+			m.Wait()
+
+			Ω(m.Aggregate().Done).Should(Equal(2))
+			Ω(store.List()).Should(BeEmpty())
+		})
+		It("should keep the failed job and resume it from server offset", func() {
+			patchFailures["/files/0"] = 100
+			m := NewUploadManager(context.Background(), testClient, 1)
+			m.Store = store
+			m.RetryDelay, m.MaxAttempts = time.Millisecond, 1
+			m.Add(UploadJob{Source: bytes.NewReader(sources["a"]), Size: 5, Metadata: map[string]string{"k": "v"}, SourceID: "a"})
+			m.Wait()
+			Ω(m.Aggregate().Failed).Should(Equal(1))
+			recs, err := store.List()
+			Ω(err).Should(Succeed())
+			Ω(recs).Should(HaveLen(1))
+			Ω(recs[0].State).Should(Equal(JobFailed))
+			Ω(recs[0].Upload.Location).Should(Equal("/files/0"))
+			Ω(recs[0].Metadata).Should(Equal(map[string]string{"k": "v"}))
+
+			patchFailures["/files/0"] = 0
+			stored["/files/0"].WriteString("he")
+			m = NewUploadManager(context.Background(), testClient, 1)
+			m.Store = store
+			ids, err := m.Resume(context.Background(), open)
+			Ω(err).Should(Succeed())
+			m.Wait()
+
+			Ω(ids).Should(Equal([]int{0}))
+			s, _ := m.Status(0)
+			Ω(s.State).Should(Equal(JobDone))
+			Ω(stored).Should(HaveLen(1))
+			Ω(stored["/files/0"].String()).Should(Equal("hello"))
+			Ω(store.List()).Should(BeEmpty())
+		})
+		It("should save the diagnostics of failed job and describe them", func() {
+			patchFailures["/files/0"] = 100
+			m := NewUploadManager(context.Background(), testClient, 1)
+			m.Store = store
+			m.RetryDelay, m.MaxAttempts, m.DiagnosticsSize = time.Millisecond, 3, 2
+			m.Add(UploadJob{Source: bytes.NewReader(sources["a"]), Size: 5, SourceID: "a"})
+			m.Wait()
+			Ω(m.Aggregate().Failed).Should(Equal(1))
+
+			m = NewUploadManager(context.Background(), testClient, 1) // As after restart
+			m.Store = store
+			res, err := m.Describe("a")
+			Ω(err).Should(Succeed())
+			Ω(res).Should(HaveLen(2))
+			for _, e := range res {
+				Ω(e.Method).Should(Equal(http.MethodPatch))
+				Ω(e.URL).Should(HaveSuffix("/files/0"))
+				Ω(e.StatusCode).Should(Equal(http.StatusServiceUnavailable))
+			}
+			Ω(m.Describe("b")).Should(BeNil())
+		})
+		It("should not save the diagnostics if DiagnosticsSize is not set", func() {
+			patchFailures["/files/0"] = 100
+			m := NewUploadManager(context.Background(), testClient, 1)
+			m.Store = store
+			m.RetryDelay, m.MaxAttempts = time.Millisecond, 1
+			m.Add(UploadJob{Source: bytes.NewReader(sources["a"]), Size: 5, SourceID: "a"})
+			m.Wait()
+
+			Ω(m.Describe("a")).Should(BeNil())
+		})
+		It("should create the upload of job interrupted before creation", func() {
+			Ω(store.Put(JobRecord{SourceID: "b", State: JobQueued, Size: 6})).Should(Succeed())
+			Ω(store.Put(JobRecord{SourceID: "c", State: JobQueued, Size: 1})).Should(Succeed())
+			m := NewUploadManager(context.Background(), testClient, 1)
+			m.Store = store
+			ids, err := m.Resume(context.Background(), open)
+			Ω(err).Should(Succeed())
+			m.Wait()
+
+			Ω(ids).Should(HaveLen(2))
+			Ω(m.Aggregate()).Should(Equal(ManagerStatus{Done: 1, Failed: 1, BytesAcked: 6, BytesTotal: 7}))
+			Ω(stored["/files/0"].String()).Should(Equal("world!"))
+			recs, _ := store.List()
+			Ω(recs).Should(HaveLen(1)) // Source "c" can't be opened, so the job is kept as is
+		})
+	})
+})
@@ -0,0 +1,232 @@
+package tusgo
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/bdragon300/tusgo/checksum"
+)
+
+// Well-known metadata keys. "filename" and "filetype" are set by tus-js-client and are recognized by most servers.
+const (
+	MetadataFilename = "filename"
+	MetadataFiletype = "filetype"
+	MetadataChecksum = "checksum"
+)
+
+// Metadata keys of client-side encryption parameters, see EncryptionParams
+const (
+	MetadataEncryption            = "encryption"
+	MetadataEncryptionNonce       = "encryption-nonce"
+	MetadataEncryptionSegmentSize = "encryption-segment-size"
+	MetadataEncryptionSalt        = "encryption-salt"
+)
+
+// sniffLen is the maximum data size http.DetectContentType considers
+const sniffLen = 512
+
+// encodeBufPool keeps the scratch buffers for base64 encoding
+var encodeBufPool = sync.Pool{New: func() any {
+	b := make([]byte, 0, 512)
+	return &b
+}}
+
+// Metadata is the upload metadata with typed setters for well-known keys. Since it's just a map, it may be passed
+// directly to Client methods.
+//
+// Setters modify the metadata in place and return it, so the calls can be chained:
+//
+//	meta := NewMetadata().SetFilename("file.txt").SetFiletype("text/plain")
+type Metadata map[string]string
+
+// NewMetadata returns a new empty Metadata
+func NewMetadata() Metadata {
+	return make(Metadata)
+}
+
+// MetadataFromMap returns a Metadata filled with a copy of the raw map
+func MetadataFromMap(raw map[string]string) Metadata {
+	m := make(Metadata, len(raw))
+	for k, v := range raw {
+		m[k] = v
+	}
+	return m
+}
+
+// SetFilename sets the "filename" key
+func (m Metadata) SetFilename(name string) Metadata {
+	m[MetadataFilename] = name
+	return m
+}
+
+// SetFiletype sets the "filetype" key to a MIME type, e.g. "text/plain"
+func (m Metadata) SetFiletype(mimeType string) Metadata {
+	m[MetadataFiletype] = mimeType
+	return m
+}
+
+// SetChecksum sets the "checksum" key with checksum of the whole upload data. Value has the same format as
+// Upload-Checksum header: algorithm name and base64-encoded sum separated by space
+func (m Metadata) SetChecksum(algorithm string, sum []byte) Metadata {
+	m[MetadataChecksum] = formatChecksum(algorithm, sum)
+	return m
+}
+
+// SetEncryption sets the "encryption*" keys with client-side encryption parameters, the salt is base64-encoded
+func (m Metadata) SetEncryption(params EncryptionParams) Metadata {
+	m[MetadataEncryption] = params.Algorithm
+	m[MetadataEncryptionNonce] = params.Nonce
+	m[MetadataEncryptionSegmentSize] = strconv.Itoa(params.SegmentSize)
+	m[MetadataEncryptionSalt] = base64.StdEncoding.EncodeToString(params.Salt)
+	return m
+}
+
+// SetCustom sets an arbitrary key
+func (m Metadata) SetCustom(key, value string) Metadata {
+	m[key] = value
+	return m
+}
+
+// Map returns the metadata copy as raw map
+func (m Metadata) Map() map[string]string {
+	return MetadataFromMap(m)
+}
+
+// Validate checks the keys format and the values of well-known keys
+func (m Metadata) Validate() error {
+	for k := range m {
+		if err := validateMetadataKey(k); err != nil {
+			return err
+		}
+	}
+	if v, ok := m[MetadataFiletype]; ok {
+		if _, _, err := mime.ParseMediaType(v); err != nil {
+			return fmt.Errorf("bad %q value %q: %w", MetadataFiletype, v, err)
+		}
+	}
+	if _, ok := m[MetadataChecksum]; ok {
+		if _, _, err := m.Checksum(); err != nil {
+			return err
+		}
+	}
+	if _, ok := m[MetadataEncryption]; ok {
+		if _, err := m.Encryption(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Checksum parses the "checksum" key, see SetChecksum. Returns error if the key is absent or malformed.
+func (m Metadata) Checksum() (algorithm string, sum []byte, err error) {
+	v, ok := m[MetadataChecksum]
+	if !ok {
+		return "", nil, fmt.Errorf("no %q key in metadata", MetadataChecksum)
+	}
+	kv := strings.SplitN(v, " ", 2)
+	if len(kv) != 2 {
+		return "", nil, fmt.Errorf("bad %q value %q: must be algorithm and sum separated by space", MetadataChecksum, v)
+	}
+	if _, ok = checksum.GetAlgorithm(kv[0]); !ok {
+		return "", nil, fmt.Errorf("bad %q value %q: unknown algorithm %q", MetadataChecksum, v, kv[0])
+	}
+	if sum, err = base64.StdEncoding.DecodeString(kv[1]); err != nil {
+		return "", nil, fmt.Errorf("bad %q value %q: %w", MetadataChecksum, v, err)
+	}
+	return kv[0], sum, nil
+}
+
+// Encryption parses the "encryption*" keys, see SetEncryption. Returns error if the keys are absent, malformed or
+// the parameters are not supported.
+func (m Metadata) Encryption() (params EncryptionParams, err error) {
+	for _, k := range []string{MetadataEncryption, MetadataEncryptionNonce, MetadataEncryptionSegmentSize, MetadataEncryptionSalt} {
+		if _, ok := m[k]; !ok {
+			return params, fmt.Errorf("no %q key in metadata", k)
+		}
+	}
+	params.Algorithm, params.Nonce = m[MetadataEncryption], m[MetadataEncryptionNonce]
+	if params.SegmentSize, err = strconv.Atoi(m[MetadataEncryptionSegmentSize]); err != nil {
+		return params, fmt.Errorf("bad %q value: %w", MetadataEncryptionSegmentSize, err)
+	}
+	if params.Salt, err = base64.StdEncoding.DecodeString(m[MetadataEncryptionSalt]); err != nil {
+		return params, fmt.Errorf("bad %q value: %w", MetadataEncryptionSalt, err)
+	}
+	return params, params.Validate()
+}
+
+// DetectFiletype returns the MIME type of file data. Firstly, we try to guess the type by extension of a given file
+// name. If it's unknown, we sniff the first bytes of data from r. After sniffing, r position is restored.
+//
+// The result contains only media type without parameters, e.g. "text/plain", as tus-js-client does.
+func DetectFiletype(name string, r io.ReadSeeker) (string, error) {
+	if t := mime.TypeByExtension(filepath.Ext(name)); t != "" {
+		if mt, _, err := mime.ParseMediaType(t); err == nil {
+			return mt, nil
+		}
+	}
+
+	pos, err := r.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return "", err
+	}
+	buf := make([]byte, sniffLen)
+	n, err := io.ReadFull(r, buf)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return "", err
+	}
+	if _, err = r.Seek(pos, io.SeekStart); err != nil {
+		return "", err
+	}
+
+	mt, _, err := mime.ParseMediaType(http.DetectContentType(buf[:n]))
+	return mt, err
+}
+
+// FileMetadata returns upload metadata for a given file with "filename" and "filetype" keys filled in. These keys are
+// set the same way as tus-js-client does, so the server-side consumers see the consistent metadata.
+func FileMetadata(f *os.File) (Metadata, error) {
+	finfo, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	t, err := DetectFiletype(finfo.Name(), f)
+	if err != nil {
+		return nil, fmt.Errorf("cannot detect file type: %w", err)
+	}
+	return NewMetadata().SetFilename(finfo.Name()).SetFiletype(t), nil
+}
+
+// formatChecksum returns the checksum in format of Upload-Checksum header: algorithm name and base64-encoded sum
+// separated by space
+func formatChecksum(algorithm string, sum []byte) string {
+	bufp := encodeBufPool.Get().(*[]byte)
+	defer encodeBufPool.Put(bufp)
+	b := strings.Builder{}
+	b.Grow(len(algorithm) + 1 + base64.StdEncoding.EncodedLen(len(sum)))
+	b.WriteString(algorithm)
+	b.WriteByte(' ')
+	*bufp = base64.StdEncoding.AppendEncode((*bufp)[:0], sum)
+	b.Write(*bufp)
+	return b.String()
+}
+
+func validateMetadataKey(k string) error {
+	switch {
+	case k == "":
+		return errors.New("key is empty")
+	case strings.Contains(k, " "):
+		return fmt.Errorf("key %q contains spaces", k)
+	case strings.Contains(k, ","):
+		return fmt.Errorf("key %q contains commas", k)
+	}
+	return nil
+}
@@ -0,0 +1,161 @@
+package tusgo
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var pngHeader = []byte("\x89PNG\x0D\x0A\x1A\x0A\x00\x00\x00\x0DIHDR")
+
+var _ = Describe("DetectFiletype", func() {
+	DescribeTable("should detect the type",
+		func(name string, data []byte, expect string) {
+			rd := bytes.NewReader(data)
+			_, _ = rd.Seek(2, io.SeekStart)
+
+			Ω(DetectFiletype(name, rd)).Should(Equal(expect))
+			Ω(rd.Seek(0, io.SeekCurrent)).Should(BeEquivalentTo(2))
+		},
+		Entry("by extension", "image.png", []byte("some text"), "image/png"),
+		Entry("by extension with parameters", "file.txt", []byte("some text"), "text/plain"),
+		Entry("by content", "image", append([]byte("  "), pngHeader...), "image/png"),
+		Entry("by text content", "file", []byte("  some text"), "text/plain"),
+		Entry("empty data", "file", []byte("  "), "text/plain"),
+	)
+})
+
+var _ = Describe("FileMetadata", func() {
+	It("should fill filename and filetype", func() {
+		name := filepath.Join(GinkgoT().TempDir(), "image")
+		Ω(os.WriteFile(name, pngHeader, 0o600)).Should(Succeed())
+		f, err := os.Open(name)
+		Ω(err).Should(Succeed())
+		defer f.Close()
+
+		Ω(FileMetadata(f)).Should(Equal(Metadata{"filename": "image", "filetype": "image/png"}))
+		Ω(f.Seek(0, io.SeekCurrent)).Should(BeEquivalentTo(0))
+	})
+})
+
+var _ = Describe("Metadata", func() {
+	It("should set well-known keys", func() {
+		m := NewMetadata().
+			SetFilename("file.txt").
+			SetFiletype("text/plain").
+			SetChecksum("sha1", []byte("asdf")).
+			SetCustom("key1", "value1")
+
+		Ω(m.Validate()).Should(Succeed())
+		Ω(m.Map()).Should(Equal(map[string]string{
+			"filename": "file.txt",
+			"filetype": "text/plain",
+			"checksum": "sha1 YXNkZg==",
+			"key1":     "value1",
+		}))
+	})
+	It("should parse checksum", func() {
+		m := NewMetadata().SetChecksum("sha1", []byte("asdf"))
+
+		algorithm, sum, err := m.Checksum()
+		Ω(err).Should(Succeed())
+		Ω(algorithm).Should(Equal("sha1"))
+		Ω(sum).Should(Equal([]byte("asdf")))
+		_, _, err = NewMetadata().Checksum()
+		Ω(err).Should(HaveOccurred())
+	})
+	It("should be convertible from raw map", func() {
+		raw := map[string]string{"key1": "value1"}
+		m := MetadataFromMap(raw).SetFilename("file.txt")
+
+		Ω(m).Should(Equal(Metadata{"key1": "value1", "filename": "file.txt"}))
+		Ω(raw).Should(Equal(map[string]string{"key1": "value1"}))
+	})
+	DescribeTable("should validate",
+		func(m Metadata, expect string) {
+			Ω(m.Validate()).Should(MatchError(ContainSubstring(expect)))
+		},
+		Entry("key with space", Metadata{"key 1": ""}, "contains spaces"),
+		Entry("key with comma", Metadata{"key,1": ""}, "contains commas"),
+		Entry("empty key", Metadata{"": "value"}, "key is empty"),
+		Entry("bad filetype", Metadata{"filetype": "text/"}, "bad \"filetype\" value"),
+		Entry("checksum without sum", Metadata{"checksum": "sha1"}, "must be algorithm and sum separated by space"),
+		Entry("checksum unknown algorithm", Metadata{"checksum": "foo YXNkZg=="}, "unknown algorithm \"foo\""),
+		Entry("checksum bad base64", Metadata{"checksum": "sha1 !!!"}, "bad \"checksum\" value"),
+	)
+})
+
+var _ = Describe("EncodeMetadata", func() {
+	It("should encode key with empty value as bare key", func() {
+		Ω(EncodeMetadata(map[string]string{"key1": ""})).Should(Equal("key1"))
+	})
+	It("should encode key with value", func() {
+		Ω(EncodeMetadata(map[string]string{"key1": "value1"})).Should(Equal("key1 dmFsdWUx"))
+	})
+	It("should encode keys in sorted order", func() {
+		meta := map[string]string{"key3": "", "key1": "value1", "key2": "&^%$\"\t", "a": "b"}
+		for i := 0; i < 10; i++ {
+			Ω(EncodeMetadata(meta)).Should(Equal("a Yg==,key1 dmFsdWUx,key2 Jl4lJCIJ,key3"))
+		}
+	})
+	It("should return empty string for empty metadata", func() {
+		Ω(EncodeMetadata(nil)).Should(BeEmpty())
+	})
+	It("should return error if key contains spaces", func() {
+		_, err := EncodeMetadata(map[string]string{"key 1": "value1"})
+		Ω(err).Should(MatchError(ContainSubstring("contains spaces")))
+	})
+})
+
+var _ = Describe("formatChecksum", func() {
+	It("should format algorithm and base64 sum", func() {
+		Ω(formatChecksum("sha1", []byte("asdf"))).Should(Equal("sha1 YXNkZg=="))
+	})
+})
+
+var _ = Describe("DecodeMetadata", func() {
+	DescribeTable("should decode",
+		func(raw string, expect map[string]string) {
+			Ω(DecodeMetadata(raw)).Should(Equal(expect))
+		},
+		Entry("keys with values", "key1 dmFsdWUx,key2 Jl4lJCIJ", map[string]string{"key1": "value1", "key2": "&^%$\"\t"}),
+		Entry("bare keys", "key1,key2 dmFsdWUx,key3", map[string]string{"key1": "", "key2": "value1", "key3": ""}),
+		Entry("spaces around items", "key1 dmFsdWUx, key2", map[string]string{"key1": "value1", "key2": ""}),
+	)
+	DescribeTable("should return error",
+		func(raw string) {
+			_, err := DecodeMetadata(raw)
+			Ω(err).Should(HaveOccurred())
+		},
+		Entry("empty item", "key1 dmFsdWUx,,key2"),
+		Entry("bad base64", "key1 !!!"),
+	)
+})
+
+func BenchmarkEncodeMetadata(b *testing.B) {
+	meta := map[string]string{
+		"filename": "document.pdf",
+		"filetype": "application/pdf",
+		"tenant":   "3f2b1c9e-5a3d-4e8f-9b7a-1c2d3e4f5a6b",
+		"empty":    "",
+	}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := EncodeMetadata(meta); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkFormatChecksum(b *testing.B) {
+	sum := []byte("0123456789abcdefghij")
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		formatChecksum("sha1", sum)
+	}
+}
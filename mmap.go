@@ -0,0 +1,116 @@
+package tusgo
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+)
+
+// OpenMmap opens the file and maps it to memory read-only. The data is uploaded right from the page cache, with no
+// read syscalls to user buffers. MmapFile is io.ReaderAt and io.Seeker, so UploadStream.ReadFrom and UploadAll send
+// the chunks right from the mapping.
+//
+// Mapping is supported on Linux and BSD-like systems, on other ones errors.ErrUnsupported is returned.
+func OpenMmap(name string) (*MmapFile, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close() // The mapping stays valid after the file is closed
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if !fi.Mode().IsRegular() {
+		return nil, fmt.Errorf("%s is not a regular file", name)
+	}
+	if fi.Size() > math.MaxInt {
+		return nil, fmt.Errorf("file %s is too large to map", name)
+	}
+	res := &MmapFile{}
+	if fi.Size() > 0 { // Empty file can't be mapped
+		if res.data, err = mmap(f, int(fi.Size())); err != nil {
+			return nil, fmt.Errorf("cannot map %s: %w", name, err)
+		}
+	}
+	return res, nil
+}
+
+// MmapFile is a file mapped to memory, see OpenMmap. It is not safe for concurrent use, except ReadAt.
+//
+// The file must not be truncated while mapped, otherwise accessing the mapping may crash the program with SIGBUS.
+type MmapFile struct {
+	data   []byte
+	pos    int64
+	closed bool
+}
+
+// Size returns the mapped file size
+func (m *MmapFile) Size() int64 {
+	return int64(len(m.data))
+}
+
+// Bytes returns the mapped file contents. The slice is valid until Close and must not be modified.
+func (m *MmapFile) Bytes() []byte {
+	return m.data
+}
+
+func (m *MmapFile) Read(p []byte) (n int, err error) {
+	if n, err = m.ReadAt(p, m.pos); errors.Is(err, io.EOF) && n > 0 {
+		err = nil
+	}
+	m.pos += int64(n)
+	return
+}
+
+func (m *MmapFile) ReadAt(p []byte, off int64) (n int, err error) {
+	if m.closed {
+		return 0, os.ErrClosed
+	}
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	if off >= int64(len(m.data)) {
+		return 0, io.EOF
+	}
+	if n = copy(p, m.data[off:]); n < len(p) {
+		err = io.EOF
+	}
+	return
+}
+
+func (m *MmapFile) Seek(offset int64, whence int) (int64, error) {
+	if m.closed {
+		return 0, os.ErrClosed
+	}
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += m.pos
+	case io.SeekEnd:
+		offset += int64(len(m.data))
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	m.pos = offset
+	return offset, nil
+}
+
+// Close unmaps the file. Any use of the slices returned by Bytes is invalid after that.
+func (m *MmapFile) Close() error {
+	if m.closed {
+		return os.ErrClosed
+	}
+	m.closed = true
+	if m.data == nil {
+		return nil
+	}
+	data := m.data
+	m.data = nil
+	return munmap(data)
+}
@@ -0,0 +1,16 @@
+//go:build !(linux || darwin || freebsd || openbsd || netbsd || dragonfly)
+
+package tusgo
+
+import (
+	"errors"
+	"os"
+)
+
+func mmap(_ *os.File, _ int) ([]byte, error) {
+	return nil, errors.ErrUnsupported
+}
+
+func munmap(_ []byte) error {
+	return errors.ErrUnsupported
+}
@@ -0,0 +1,98 @@
+//go:build linux || darwin || freebsd || openbsd || netbsd || dragonfly
+
+package tusgo
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("MmapFile", func() {
+	var data []byte
+	var name string
+
+	BeforeEach(func() {
+		data = make([]byte, 10000)
+		rand.New(rand.NewSource(1)).Read(data)
+		name = filepath.Join(GinkgoT().TempDir(), "file")
+		Ω(os.WriteFile(name, data, 0o644)).Should(Succeed())
+	})
+
+	It("should read the file", func() {
+		m, err := OpenMmap(name)
+		Ω(err).Should(Succeed())
+		defer m.Close()
+		Ω(m.Size()).Should(BeEquivalentTo(10000))
+		Ω(m.Bytes()).Should(Equal(data))
+
+		Ω(m.Seek(9000, io.SeekStart)).Should(BeEquivalentTo(9000))
+		Ω(io.ReadAll(m)).Should(Equal(data[9000:]))
+		p := make([]byte, 100)
+		n, err := m.ReadAt(p, 9950)
+		Ω(err).Should(MatchError(io.EOF))
+		Ω(p[:n]).Should(Equal(data[9950:]))
+	})
+	It("should map an empty file", func() {
+		Ω(os.WriteFile(name, nil, 0o644)).Should(Succeed())
+		m, err := OpenMmap(name)
+		Ω(err).Should(Succeed())
+		Ω(io.ReadAll(m)).Should(BeEmpty())
+		Ω(m.Close()).Should(Succeed())
+	})
+	It("should fail after Close", func() {
+		m, err := OpenMmap(name)
+		Ω(err).Should(Succeed())
+		Ω(m.Close()).Should(Succeed())
+		_, err = m.Read(make([]byte, 1))
+		Ω(err).Should(MatchError(os.ErrClosed))
+		Ω(m.Close()).Should(MatchError(os.ErrClosed))
+	})
+	It("should return error for a directory", func() {
+		_, err := OpenMmap(filepath.Dir(name))
+		Ω(err).Should(HaveOccurred())
+	})
+	It("should be uploaded by UploadAll", func() {
+		var mu sync.Mutex
+		stored := bytes.NewBuffer(nil)
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			defer mu.Unlock()
+			w.Header().Set("Tus-Resumable", "1.0.0")
+			w.Header().Set("Upload-Length", "10000")
+			switch r.Method {
+			case http.MethodHead:
+				w.Header().Set("Upload-Offset", strconv.Itoa(stored.Len()))
+			case http.MethodPatch:
+				_, _ = io.Copy(stored, r.Body)
+				w.Header().Set("Upload-Offset", strconv.Itoa(stored.Len()))
+				w.WriteHeader(http.StatusNoContent)
+			}
+		}))
+		defer srv.Close()
+		u, _ := url.Parse(srv.URL)
+		cl := NewClient(srv.Client(), u)
+		cl.AssumeCapabilities(ServerCapabilities{ProtocolVersions: []string{"1.0.0"}})
+
+		m, err := OpenMmap(name)
+		Ω(err).Should(Succeed())
+		defer m.Close()
+		up := Upload{Location: "/files/1", RemoteSize: 10000}
+		s := NewUploadStream(cl, &up)
+		s.ChunkSize = 4096
+		_, err = s.UploadAll(context.Background(), m)
+		Ω(err).Should(Succeed())
+		Ω(stored.Bytes()).Should(Equal(data))
+	})
+})
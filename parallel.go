@@ -0,0 +1,335 @@
+package tusgo
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// NewParallelUploader constructs a new ParallelUploader, which uploads the data by a given number of partial uploads
+func NewParallelUploader(client *Client, parts int) *ParallelUploader {
+	if parts <= 0 {
+		panic("parts must be positive")
+	}
+	return &ParallelUploader{
+		MaxAttempts: 10,
+		RetryDelay:  5 * time.Second,
+		client:      client,
+		parts:       parts,
+	}
+}
+
+// ParallelUploader uploads the data of known size by splitting it into several ranges, uploading every range as
+// a partial upload concurrently over its own UploadStream, and concatenating them into a final upload then. This
+// speeds up the large uploads, if the link throughput per connection is limited.
+//
+// Server must support "concatenation" extension. See also Client.UploadLarge, which uploads the parts one by one.
+type ParallelUploader struct {
+	// MinPartSize is the minimum size of a part. If the data is too small to split it into a given number of parts,
+	// fewer parts are uploaded. Zero means no minimum
+	MinPartSize int64
+
+	// ChunkSize is the upload chunk size of every part, see UploadStream.ChunkSize. Zero means the stream default
+	ChunkSize int64
+
+	// MaxAttempts is the maximum number of upload attempts of every part. Default is 10
+	MaxAttempts int
+
+	// RetryDelay is the delay between attempts. Default is 5 seconds
+	RetryDelay time.Duration
+
+	// SegmentSize is the part size UploadReader cuts the data into. Default is 16 MiB
+	SegmentSize int64
+
+	// OnProgress, if set, is called with the total progress of all parts. Calls are serialized
+	OnProgress func(p Progress)
+
+	// ChecksumAlgorithm is the algorithm of digests recorded in PartsLedger, see OnVerified. Empty means that only
+	// the sizes are recorded
+	ChecksumAlgorithm string
+
+	// OnVerified, if set, makes the uploader record every part in PartsLedger and verify the final upload against
+	// it after concatenation, see PartsLedger.Verify. The callback gets the ledger and the verification report. Failed
+	// checks are not an error, see VerificationReport.Passed.
+	//
+	// Upload reads the data once again to calculate the digests. UploadReader calculates them while reading.
+	OnVerified func(ledger PartsLedger, report VerificationReport)
+
+	client *Client
+	parts  int
+}
+
+// Upload uploads size bytes from r and fills final with the final upload created. meta is the final upload metadata.
+//
+// Returns the partial uploads, which is useful on error: the failed upload can be continued by Resume, or the
+// partial uploads can be deleted. If any part fails, the rest ones are stopped, and the error is returned.
+func (pu *ParallelUploader) Upload(ctx context.Context, final *Upload, r io.ReaderAt, size int64, meta map[string]string) (partials []Upload, err error) {
+	if size < 0 {
+		panic("size must not be negative")
+	}
+	n := int64(pu.parts)
+	if pu.MinPartSize > 0 {
+		n = min(n, size/pu.MinPartSize)
+	}
+	n = max(min(n, size), 1)
+	partSize := size / n
+	for i := int64(0); i < n; i++ {
+		p := Upload{RemoteSize: partSize, Partial: true}
+		if i < size%n { // Spread the remainder
+			p.RemoteSize++
+		}
+		partials = append(partials, p)
+	}
+	err = pu.upload(ctx, final, r, partials, meta)
+	return
+}
+
+// Resume continues the upload failed before. partials are the ones returned by Upload, r must have the same data.
+func (pu *ParallelUploader) Resume(ctx context.Context, final *Upload, r io.ReaderAt, partials []Upload, meta map[string]string) error {
+	if len(partials) == 0 {
+		panic("must be at least one partial upload to resume")
+	}
+	return pu.upload(ctx, final, r, partials, meta)
+}
+
+func (pu *ParallelUploader) upload(ctx context.Context, final *Upload, r io.ReaderAt, partials []Upload, meta map[string]string) (err error) {
+	cl := pu.client.WithContext(ctx)
+	if err = cl.ensureExtension(ExtensionConcatenation); err != nil {
+		return
+	}
+
+	var lw *ledgerWriter
+	if pu.OnVerified != nil {
+		lw = newLedgerWriter(pu.ChecksumAlgorithm)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var total int64
+	for _, p := range partials {
+		total += p.RemoteSize
+	}
+	progress := &partsProgress{total: total, on: pu.OnProgress}
+	errOnce := sync.Once{}
+	wg := sync.WaitGroup{}
+	var offset int64
+	for i := range partials {
+		src := io.NewSectionReader(r, offset, partials[i].RemoteSize)
+		offset += partials[i].RemoteSize
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if e := pu.uploadPart(cl.WithContext(ctx), &partials[i], src, progress.callback(i)); e != nil {
+				// The first error is the cause, the rest parts get ctx error after cancel
+				errOnce.Do(func() { err = fmt.Errorf("part %d: %w", i, e) })
+				cancel()
+			}
+		}(i)
+	}
+	wg.Wait()
+	if err != nil {
+		return
+	}
+
+	if lw != nil {
+		offset = 0
+		for _, p := range partials {
+			if err = lw.addPart(io.NewSectionReader(r, offset, p.RemoteSize)); err != nil {
+				return
+			}
+			offset += p.RemoteSize
+		}
+	}
+	if _, err = cl.ConcatenateUploads(final, partials, meta); err != nil {
+		return
+	}
+	return pu.verify(cl, final, partials, lw)
+}
+
+// UploadReader uploads the data from r, which can't be read again, e.g. a network stream. The data is cut into
+// segments of SegmentSize, which are uploaded as consecutive partial uploads concurrently while the next segments are
+// being read, and then concatenated into final. At most parts segments are kept in memory at once, the reading
+// waits until a segment upload finishes.
+//
+// Returns the partial uploads created. Unlike Upload, the failed upload can't be resumed, since the data consumed
+// from r is lost, so the partial uploads should be deleted.
+func (pu *ParallelUploader) UploadReader(ctx context.Context, final *Upload, r io.Reader, meta map[string]string) (partials []Upload, err error) {
+	cl := pu.client.WithContext(ctx)
+	if err = cl.ensureExtension(ExtensionConcatenation); err != nil {
+		return
+	}
+	segmentSize := pu.SegmentSize
+	if segmentSize <= 0 {
+		segmentSize = 16 * 1024 * 1024
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	progress := &partsProgress{total: SizeUnknown, on: pu.OnProgress}
+	mu := sync.Mutex{} // Guards partials and err
+	fail := func(e error) {
+		mu.Lock()
+		if err == nil {
+			err = e
+		}
+		mu.Unlock()
+		cancel()
+	}
+	var lw *ledgerWriter
+	if pu.OnVerified != nil {
+		lw = newLedgerWriter(pu.ChecksumAlgorithm)
+	}
+	sem := make(chan struct{}, pu.parts)
+	wg := sync.WaitGroup{}
+	var total int64
+	for i := 0; ctx.Err() == nil; i++ { // On failure, ctx is canceled
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			continue
+		}
+		if ctx.Err() != nil { // The slot has been freed by a failed part
+			<-sem
+			break
+		}
+		buf := cl.buffers().get(int(segmentSize))
+		n, e := io.ReadFull(r, *buf)
+		if e != nil && !errors.Is(e, io.ErrUnexpectedEOF) && (!errors.Is(e, io.EOF) || i > 0) {
+			cl.buffers().put(buf)
+			<-sem
+			if !errors.Is(e, io.EOF) {
+				fail(fmt.Errorf("cannot read source: %w", e))
+			}
+			break
+		}
+		total += int64(n)
+		if lw != nil {
+			_ = lw.addPart(bytes.NewReader((*buf)[:n])) // Never fails on memory
+		}
+		mu.Lock()
+		partials = append(partials, Upload{RemoteSize: int64(n), Partial: true})
+		mu.Unlock()
+
+		wg.Add(1)
+		go func(i int, data []byte) {
+			defer func() {
+				cl.buffers().put(buf)
+				<-sem
+				wg.Done()
+			}()
+			p := Upload{RemoteSize: int64(len(data)), Partial: true}
+			e := pu.uploadPart(cl.WithContext(ctx), &p, bytes.NewReader(data), progress.callback(i))
+			mu.Lock()
+			partials[i] = p
+			mu.Unlock()
+			if e != nil {
+				fail(fmt.Errorf("part %d: %w", i, e))
+			}
+		}(i, (*buf)[:n])
+		if int64(n) < segmentSize {
+			break // Source has ended
+		}
+	}
+	if ctx.Err() == nil {
+		progress.setTotal(total)
+	}
+	wg.Wait()
+	if err == nil {
+		err = ctx.Err() // Parent context is done
+	}
+	if err != nil {
+		return
+	}
+
+	if _, err = cl.ConcatenateUploads(final, partials, meta); err != nil {
+		return
+	}
+	err = pu.verify(cl, final, partials, lw)
+	return
+}
+
+// verify checks the final upload against the ledger and calls OnVerified. Does nothing if lw is nil
+func (pu *ParallelUploader) verify(c *Client, final *Upload, partials []Upload, lw *ledgerWriter) error {
+	if lw == nil {
+		return nil
+	}
+	ledger := lw.finish(partials)
+	report, err := ledger.Verify(c.ctx, c, final.Location)
+	if err != nil {
+		return fmt.Errorf("cannot verify final upload: %w", err)
+	}
+	pu.OnVerified(ledger, report)
+	return nil
+}
+
+// uploadPart creates the partial upload, if not created yet, and uploads src to it
+func (pu *ParallelUploader) uploadPart(c *Client, p *Upload, src io.ReadSeeker, onProgress func(Progress)) (err error) {
+	if p.Location == "" {
+		u := Upload{}
+		if _, err = c.CreateUpload(&u, p.RemoteSize, true, nil); err != nil {
+			return fmt.Errorf("cannot create upload: %w", err)
+		}
+		*p = u
+	}
+	if p.RemoteSize == 0 {
+		return nil
+	}
+	s := NewUploadStream(c, p)
+	if pu.ChunkSize > 0 {
+		s.ChunkSize = pu.ChunkSize
+	}
+	s.MaxAttempts = pu.MaxAttempts
+	s.RetryDelay = pu.RetryDelay
+	s.OnProgress = onProgress
+	if _, err = s.UploadAll(c.ctx, src); err == nil && !p.IsComplete() {
+		err = io.ErrShortWrite // Source has ended early
+	}
+	return
+}
+
+// partsProgress sums up the progress of parts being uploaded concurrently, see ParallelUploader.OnProgress
+type partsProgress struct {
+	mu    sync.Mutex
+	parts []Progress
+	total int64
+	on    func(p Progress)
+}
+
+// callback returns the UploadStream.OnProgress callback of part i, nil if reporting is off
+func (pp *partsProgress) callback(i int) func(p Progress) {
+	if pp.on == nil {
+		return nil
+	}
+	return func(p Progress) {
+		pp.mu.Lock()
+		defer pp.mu.Unlock()
+		for len(pp.parts) <= i {
+			pp.parts = append(pp.parts, Progress{})
+		}
+		pp.parts[i] = p
+		pp.reportLocked()
+	}
+}
+
+// setTotal sets the total size, once it has become known, and reports it
+func (pp *partsProgress) setTotal(total int64) {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+	pp.total = total
+	if pp.on != nil {
+		pp.reportLocked()
+	}
+}
+
+func (pp *partsProgress) reportLocked() {
+	sum := Progress{Total: pp.total}
+	for _, v := range pp.parts {
+		sum.BytesSent += v.BytesSent
+		sum.BytesAcked += v.BytesAcked
+	}
+	pp.on(sum)
+}
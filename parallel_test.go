@@ -0,0 +1,282 @@
+package tusgo
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing/iotest"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("ParallelUploader", func() {
+	var testSrv *httptest.Server
+	var testClient *Client
+	var mu sync.Mutex
+	var stored map[string]*bytes.Buffer
+	var lengths map[string]int
+	var finalParts []string
+	var failPatch map[string]int // Location -> number of PATCH requests to fail
+	var data []byte
+	var corruptFinal bool
+
+	// concatenated returns the data of final upload
+	concatenated := func() []byte {
+		var res []byte
+		for _, loc := range finalParts {
+			res = append(res, stored[loc].Bytes()...)
+		}
+		return res
+	}
+
+	BeforeEach(func() {
+		corruptFinal = false
+		stored = make(map[string]*bytes.Buffer)
+		lengths = make(map[string]int)
+		finalParts = nil
+		failPatch = make(map[string]int)
+		data = make([]byte, 10000)
+		rand.New(rand.NewSource(time.Now().UnixNano())).Read(data)
+		testSrv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			defer mu.Unlock()
+			w.Header().Set("Tus-Resumable", "1.0.0")
+			switch {
+			case r.Method == http.MethodPost && strings.HasPrefix(r.Header.Get("Upload-Concat"), "final;"):
+				finalParts = strings.Fields(strings.TrimPrefix(r.Header.Get("Upload-Concat"), "final;"))
+				w.Header().Set("Location", "/files/final")
+				w.WriteHeader(http.StatusCreated)
+			case r.Method == http.MethodPost:
+				Ω(r.Header.Get("Upload-Concat")).Should(Equal("partial"))
+				loc := "/files/" + strconv.Itoa(len(stored))
+				stored[loc] = bytes.NewBuffer(nil)
+				lengths[loc], _ = strconv.Atoi(r.Header.Get("Upload-Length"))
+				w.Header().Set("Location", loc)
+				w.WriteHeader(http.StatusCreated)
+			case r.URL.Path == "/files/final" && finalParts != nil:
+				res := concatenated()
+				if corruptFinal {
+					res[0]++
+				}
+				if r.Method == http.MethodGet {
+					http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(res))
+					return
+				}
+				w.Header().Set("Cache-Control", "no-store")
+				w.Header().Set("Upload-Concat", "final;"+strings.Join(finalParts, " "))
+				w.Header().Set("Upload-Length", strconv.Itoa(len(res)))
+				w.Header().Set("Upload-Offset", strconv.Itoa(len(res)))
+			case r.Method == http.MethodHead && stored[r.URL.Path] != nil:
+				w.Header().Set("Upload-Length", strconv.Itoa(lengths[r.URL.Path]))
+				w.Header().Set("Upload-Offset", strconv.Itoa(stored[r.URL.Path].Len()))
+			case r.Method == http.MethodPatch && failPatch[r.URL.Path] > 0:
+				failPatch[r.URL.Path]--
+				w.WriteHeader(http.StatusForbidden)
+			case r.Method == http.MethodPatch && stored[r.URL.Path] != nil:
+				_, _ = io.Copy(stored[r.URL.Path], r.Body)
+				w.Header().Set("Upload-Offset", strconv.Itoa(stored[r.URL.Path].Len()))
+				w.WriteHeader(http.StatusNoContent)
+			default:
+				w.WriteHeader(http.StatusNotFound)
+			}
+		}))
+		u, _ := url.Parse(testSrv.URL + "/files/")
+		testClient = NewClient(testSrv.Client(), u)
+		testClient.AssumeCapabilities(ServerCapabilities{
+			ProtocolVersions: []string{"1.0.0"},
+			Extensions:       []string{"creation", "concatenation"},
+		})
+	})
+	AfterEach(func() {
+		testSrv.Close()
+	})
+
+	It("should upload the parts concurrently and concatenate them", func() {
+		pu := NewParallelUploader(testClient, 3)
+		pu.ChunkSize = 1024
+		var last Progress
+		pu.OnProgress = func(p Progress) { last = p }
+		final := Upload{}
+		partials, err := pu.Upload(context.Background(), &final, bytes.NewReader(data), 10000, map[string]string{"name": "foo"})
+		Ω(err).Should(Succeed())
+		Ω(final.Location).Should(Equal("/files/final"))
+		Ω(final.Metadata).Should(HaveKeyWithValue("name", "foo"))
+		Ω(partials).Should(HaveLen(3))
+		Ω([]int64{partials[0].RemoteSize, partials[1].RemoteSize, partials[2].RemoteSize}).Should(Equal([]int64{3334, 3333, 3333}))
+		for _, p := range partials {
+			Ω(p.Partial).Should(BeTrue())
+			Ω(p.IsComplete()).Should(BeTrue())
+		}
+		Ω(concatenated()).Should(Equal(data))
+		Ω(last).Should(Equal(Progress{BytesSent: 10000, BytesAcked: 10000, Total: 10000}))
+	})
+	It("should upload fewer parts than MinPartSize allows", func() {
+		pu := NewParallelUploader(testClient, 8)
+		pu.MinPartSize = 4000
+		final := Upload{}
+		partials, err := pu.Upload(context.Background(), &final, bytes.NewReader(data), 10000, nil)
+		Ω(err).Should(Succeed())
+		Ω(partials).Should(HaveLen(2))
+		Ω(concatenated()).Should(Equal(data))
+	})
+	It("should upload empty data", func() {
+		final := Upload{}
+		partials, err := NewParallelUploader(testClient, 4).Upload(context.Background(), &final, bytes.NewReader(nil), 0, nil)
+		Ω(err).Should(Succeed())
+		Ω(partials).Should(HaveLen(1))
+		Ω(concatenated()).Should(BeEmpty())
+	})
+	It("should return the failed part error and resume then", func() {
+		failPatch["/files/1"] = 1
+		pu := NewParallelUploader(testClient, 2)
+		pu.ChunkSize = 1000
+		final := Upload{}
+		partials, err := pu.Upload(context.Background(), &final, bytes.NewReader(data), 10000, nil)
+		Ω(err).Should(MatchError(ErrCannotUpload))
+		Ω(err.Error()).Should(HavePrefix("part "))
+		Ω(final.Location).Should(BeEmpty())
+		Ω(partials).Should(HaveLen(2))
+
+		Ω(pu.Resume(context.Background(), &final, bytes.NewReader(data), partials, nil)).Should(Succeed())
+		Ω(final.Location).Should(Equal("/files/final"))
+		Ω(concatenated()).Should(Equal(data))
+	})
+	Context("OnVerified", func() {
+		It("should record the parts and verify the final upload", func() {
+			pu := NewParallelUploader(testClient, 3)
+			pu.ChecksumAlgorithm = "sha1"
+			var ledger PartsLedger
+			var report VerificationReport
+			pu.OnVerified = func(l PartsLedger, r VerificationReport) { ledger, report = l, r }
+			final := Upload{}
+			partials, err := pu.Upload(context.Background(), &final, bytes.NewReader(data), 10000, nil)
+			Ω(err).Should(Succeed())
+			Ω(report.Location).Should(Equal("/files/final"))
+			Ω(report.Passed()).Should(BeTrue(), "%v", report.Problems)
+			Ω(report.DigestChecked).Should(BeTrue())
+
+			sum := sha1.Sum(data)
+			Ω(ledger.Digest).Should(Equal(sum[:]))
+			Ω(ledger.Size).Should(BeEquivalentTo(10000))
+			Ω(ledger.Parts).Should(HaveLen(3))
+			var offset int64
+			for i, p := range ledger.Parts {
+				Ω(p.Location).Should(Equal(partials[i].Location))
+				Ω(p.Size).Should(Equal(partials[i].RemoteSize))
+				partSum := sha1.Sum(data[offset : offset+p.Size])
+				Ω(p.Digest).Should(Equal(partSum[:]))
+				offset += p.Size
+			}
+		})
+		It("should report the digest mismatch", func() {
+			corruptFinal = true
+			pu := NewParallelUploader(testClient, 2)
+			pu.ChecksumAlgorithm = "sha1"
+			var report VerificationReport
+			pu.OnVerified = func(_ PartsLedger, r VerificationReport) { report = r }
+			final := Upload{}
+			_, err := pu.UploadReader(context.Background(), &final, io.MultiReader(bytes.NewReader(data)), nil)
+			Ω(err).Should(Succeed())
+			Ω(report.Passed()).Should(BeFalse())
+			Ω(report.Problems).Should(HaveLen(1))
+			Ω(report.Problems[0]).Should(HavePrefix("data checksum"))
+		})
+		It("should verify only the size without checksum algorithm", func() {
+			pu := NewParallelUploader(testClient, 2)
+			pu.SegmentSize = 3000
+			var ledger PartsLedger
+			var report VerificationReport
+			pu.OnVerified = func(l PartsLedger, r VerificationReport) { ledger, report = l, r }
+			final := Upload{}
+			_, err := pu.UploadReader(context.Background(), &final, io.MultiReader(bytes.NewReader(data)), nil)
+			Ω(err).Should(Succeed())
+			Ω(report.Passed()).Should(BeTrue(), "%v", report.Problems)
+			Ω(report.DigestChecked).Should(BeFalse())
+			Ω(ledger.Parts).Should(HaveLen(4))
+			Ω(ledger.Size).Should(BeEquivalentTo(10000))
+			Ω(ledger.Digest).Should(BeNil())
+		})
+		It("should report the parts mismatch", func() {
+			ledger := PartsLedger{Size: 10000, Parts: []PartRecord{{Location: "/files/0", Size: 10000}}}
+			final := Upload{}
+			_, err := NewParallelUploader(testClient, 2).Upload(context.Background(), &final, bytes.NewReader(data), 10000, nil)
+			Ω(err).Should(Succeed())
+
+			report, err := ledger.Verify(context.Background(), testClient, final.Location)
+			Ω(err).Should(Succeed())
+			Ω(report.Problems).Should(ConsistOf(HavePrefix("upload is concatenated from")))
+		})
+	})
+	It("should return error if source is shorter than size", func() {
+		final := Upload{}
+		_, err := NewParallelUploader(testClient, 2).Upload(context.Background(), &final, bytes.NewReader(data[:9000]), 10000, nil)
+		Ω(err).Should(MatchError(io.ErrShortWrite))
+	})
+	It("should return error if server does not support concatenation", func() {
+		modifyCapabilities(testClient, func(caps *ServerCapabilities) { caps.Extensions = []string{"creation"} })
+		final := Upload{}
+		_, err := NewParallelUploader(testClient, 2).Upload(context.Background(), &final, bytes.NewReader(data), 10000, nil)
+		Ω(err).Should(MatchError(ErrUnsupportedFeature))
+	})
+	Context("UploadReader", func() {
+		It("should cut the data into segments and concatenate them", func() {
+			pu := NewParallelUploader(testClient, 2)
+			pu.SegmentSize = 3000
+			var last Progress
+			pu.OnProgress = func(p Progress) { last = p }
+			final := Upload{}
+			partials, err := pu.UploadReader(context.Background(), &final, io.MultiReader(bytes.NewReader(data)), nil)
+			Ω(err).Should(Succeed())
+			Ω(final.Location).Should(Equal("/files/final"))
+			Ω(partials).Should(HaveLen(4))
+			Ω(partials[3].RemoteSize).Should(BeEquivalentTo(1000))
+			Ω(finalParts).Should(Equal([]string{partials[0].Location, partials[1].Location, partials[2].Location, partials[3].Location}))
+			Ω(concatenated()).Should(Equal(data))
+			Ω(last).Should(Equal(Progress{BytesSent: 10000, BytesAcked: 10000, Total: 10000}))
+		})
+		It("should upload the data of exactly segment size", func() {
+			pu := NewParallelUploader(testClient, 2)
+			pu.SegmentSize = 5000
+			final := Upload{}
+			partials, err := pu.UploadReader(context.Background(), &final, io.MultiReader(bytes.NewReader(data)), nil)
+			Ω(err).Should(Succeed())
+			Ω(partials).Should(HaveLen(2))
+			Ω(concatenated()).Should(Equal(data))
+		})
+		It("should upload empty data", func() {
+			final := Upload{}
+			partials, err := NewParallelUploader(testClient, 2).UploadReader(context.Background(), &final, io.MultiReader(), nil)
+			Ω(err).Should(Succeed())
+			Ω(partials).Should(HaveLen(1))
+			Ω(final.Location).Should(Equal("/files/final"))
+		})
+		It("should stop reading on part error", func() {
+			failPatch["/files/0"] = 100
+			pu := NewParallelUploader(testClient, 1)
+			pu.SegmentSize = 1000
+			pu.MaxAttempts = 1
+			rd := bytes.NewReader(data)
+			final := Upload{}
+			_, err := pu.UploadReader(context.Background(), &final, io.MultiReader(rd), nil)
+			Ω(err).Should(MatchError(ErrCannotUpload))
+			Ω(rd.Len()).Should(Equal(9000)) // The next segment is not read after failure
+			Ω(final.Location).Should(BeEmpty())
+		})
+		It("should return the source error", func() {
+			final := Upload{}
+			rd := io.MultiReader(bytes.NewReader(data[:100]), iotest.ErrReader(io.ErrClosedPipe))
+			_, err := NewParallelUploader(testClient, 2).UploadReader(context.Background(), &final, rd, nil)
+			Ω(err).Should(MatchError(io.ErrClosedPipe))
+		})
+	})
+})
@@ -0,0 +1,115 @@
+package tusgo
+
+import (
+	"bufio"
+	"errors"
+	"io"
+)
+
+// NewPipeWriter returns a PipeWriter, which uploads the data written to it using the stream s. The uploading is
+// performed by a background goroutine, which is started here.
+//
+// The upload may be created beforehand or lazily, see UploadStream.CreateOnWrite. If its size is SizeUnknown (i.e.
+// the upload has deferred length), we send the size along with the last chunk once the writer is closed.
+// The stream must not be used by anyone else until the writer is closed.
+func NewPipeWriter(s *UploadStream) *PipeWriter {
+	pr, pw := io.Pipe()
+	p := &PipeWriter{pw: pw, done: make(chan struct{})}
+	go func() {
+		defer close(p.done)
+		p.n, p.err = s.uploadUnseekable(pr)
+		pr.CloseWithError(p.err) // Fail the pending and further writes
+	}()
+	return p
+}
+
+// PipeWriter is io.WriteCloser, which writes are streamed to an upload in background. This allows to use the stream
+// encoders, such as gzip.Writer or tar.Writer, to write directly to the upload.
+//
+// Since the written data can't be read again, we keep the current chunk in memory until the server acknowledges it,
+// and retry it on transient errors, see UploadStream.MaxAttempts and UploadStream.RetryDelay. The upload error is
+// returned by Write and Close.
+type PipeWriter struct {
+	pw   *io.PipeWriter
+	done chan struct{}
+	n    int64
+	err  error
+}
+
+// Write writes b to the upload. It blocks until the data is consumed by the background goroutine. If the uploading
+// has failed, the upload error is returned.
+func (p *PipeWriter) Write(b []byte) (n int, err error) {
+	return p.pw.Write(b)
+}
+
+// Close finishes the data, waits until all data is uploaded and returns the upload error, if any
+func (p *PipeWriter) Close() error {
+	return p.CloseWithError(nil)
+}
+
+// CloseWithError interrupts the uploading with a given error, e.g. if the producer has failed. Waits until
+// the background goroutine exits and returns the upload error. Nil err is the same as Close.
+func (p *PipeWriter) CloseWithError(err error) error {
+	_ = p.pw.CloseWithError(err) // Always returns nil
+	<-p.done
+	return p.err
+}
+
+// Uploaded returns the number of bytes uploaded by the writer. Call it after Close.
+func (p *PipeWriter) Uploaded() int64 {
+	<-p.done
+	return p.n
+}
+
+// uploadUnseekable uploads the data from r, which can't be read again, by chunks. We keep a chunk in memory until
+// the server acknowledges it and retry it on transient errors up to MaxAttempts times. If the upload size is unknown,
+// we declare it along with the last chunk.
+func (us *UploadStream) uploadUnseekable(r io.Reader) (uploadedBytes int64, err error) {
+	chunkSize := us.ChunkSize
+	if chunkSize == NoChunked {
+		chunkSize = 2 * 1024 * 1024
+	}
+	br := bufio.NewReader(r)
+	bufp := us.client.buffers().get(int(chunkSize))
+	defer us.client.buffers().put(bufp)
+	buf := *bufp
+	for {
+		n, e := io.ReadFull(br, buf)
+		if errors.Is(e, io.EOF) {
+			return
+		}
+		if e != nil && !errors.Is(e, io.ErrUnexpectedEOF) {
+			return uploadedBytes, e
+		}
+		if us.Upload.RemoteSize == SizeUnknown {
+			if _, e = br.Peek(1); errors.Is(e, io.EOF) { // This is the last chunk
+				if err = us.DeclareSize(us.Upload.RemoteOffset + int64(n)); err != nil {
+					return
+				}
+			}
+		}
+		var written int64
+		written, err = us.writeRetrying(buf[:n])
+		uploadedBytes += written
+		if err != nil {
+			return
+		}
+	}
+}
+
+// writeRetrying writes p to the stream, retrying on transient errors up to MaxAttempts times
+func (us *UploadStream) writeRetrying(p []byte) (n int64, err error) {
+	for attempt := 1; ; attempt++ {
+		var written int
+		written, err = us.write(p[n:])
+		n += int64(written)
+		if err == nil || !IsTransientError(err) || attempt >= us.MaxAttempts {
+			return
+		}
+		if err = sleepContext(us.ctx, us.RetryDelay); err != nil {
+			return
+		}
+		us.stats.Retries++
+		us.chunkRetries++
+	}
+}
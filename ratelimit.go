@@ -0,0 +1,85 @@
+package tusgo
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+// maxRateLimitBurst is the maximum number of bytes the RateLimiter allows to transfer at once
+const maxRateLimitBurst = 32 * 1024
+
+// NewRateLimiter constructs a new RateLimiter, which allows bytesPerSec bytes per second
+func NewRateLimiter(bytesPerSec int64) *RateLimiter {
+	if bytesPerSec <= 0 {
+		panic("bytesPerSec must be positive")
+	}
+	burst := int64(maxRateLimitBurst)
+	if bytesPerSec < burst {
+		burst = bytesPerSec
+	}
+	return &RateLimiter{rate: float64(bytesPerSec), burst: int(burst)}
+}
+
+// RateLimiter paces the data transfer to a given number of bytes per second. It is safe for concurrent use.
+//
+// Being shared between several streams, it limits their total bandwidth. Every stream reserves the bandwidth in small
+// portions, no more than 32 KiB, one after another, so the concurrent streams share the bandwidth fairly.
+type RateLimiter struct {
+	mu    sync.Mutex
+	rate  float64 // Bytes per second
+	burst int
+	tat   time.Time // Theoretical arrival time of the next byte
+}
+
+// wait blocks until n transferred bytes fit into the rate limit, or until ctx is done
+func (rl *RateLimiter) wait(ctx context.Context, n int) error {
+	rl.mu.Lock()
+	now := time.Now()
+	if rl.tat.Before(now) {
+		rl.tat = now
+	}
+	rl.tat = rl.tat.Add(time.Duration(float64(n) / rl.rate * float64(time.Second)))
+	delay := rl.tat.Sub(now) - time.Duration(float64(rl.burst)/rl.rate*float64(time.Second))
+	rl.mu.Unlock()
+
+	if delay <= 0 {
+		return nil
+	}
+	t := time.NewTimer(delay)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// rateLimitedReader is reader that paces reading from underlying reader by the rate limiters
+type rateLimitedReader struct {
+	Rd       io.Reader
+	Limiters []*RateLimiter
+	Ctx      context.Context
+}
+
+func (r *rateLimitedReader) Read(p []byte) (n int, err error) {
+	for _, l := range r.Limiters {
+		if len(p) > l.burst {
+			p = p[:l.burst]
+		}
+	}
+	if n, err = r.Rd.Read(p); n > 0 {
+		ctx := r.Ctx
+		if ctx == nil {
+			ctx = context.Background()
+		}
+		for _, l := range r.Limiters {
+			if e := l.wait(ctx, n); e != nil {
+				return n, e
+			}
+		}
+	}
+	return
+}
@@ -0,0 +1,166 @@
+package tusgo
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// NewSafeUploadStream wraps the stream into SafeUploadStream. The stream must not be used directly afterwards.
+func NewSafeUploadStream(us *UploadStream) *SafeUploadStream {
+	if us == nil {
+		panic("us is nil")
+	}
+	return &SafeUploadStream{us: us}
+}
+
+// SafeUploadStream is UploadStream wrapper, which is safe for concurrent use by multiple goroutines. For example, one
+// goroutine may write the data, while another one calls Sync or Stats. The calls are serialized by a mutex, so
+// a method blocks until the running Write or ReadFrom returns. Pause and Resume are not serialized, so they take
+// effect while the data is being uploaded.
+//
+// The wrapper owns the wrapped stream and its Upload object. Use the Upload method to get the upload state, and don't
+// read or modify the Upload object directly while the stream is in use.
+type SafeUploadStream struct {
+	mu sync.Mutex
+	us *UploadStream
+}
+
+// ReadFrom calls UploadStream.ReadFrom
+func (s *SafeUploadStream) ReadFrom(r io.Reader) (n int64, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.us.ReadFrom(r)
+}
+
+// Write calls UploadStream.Write
+func (s *SafeUploadStream) Write(p []byte) (n int, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.us.Write(p)
+}
+
+// Sync calls UploadStream.Sync
+func (s *SafeUploadStream) Sync() (response *http.Response, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.us.Sync()
+}
+
+// Preflight calls UploadStream.Preflight
+func (s *SafeUploadStream) Preflight() (response *http.Response, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.us.Preflight()
+}
+
+// KeepAlive calls UploadStream.KeepAlive
+func (s *SafeUploadStream) KeepAlive() (response *http.Response, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.us.KeepAlive()
+}
+
+// RunKeepAlive calls KeepAlive every interval until ctx is done or KeepAlive fails. Unlike
+// UploadStream.RunKeepAlive, the stream may be used by other goroutines while this method is running.
+func (s *SafeUploadStream) RunKeepAlive(ctx context.Context, interval time.Duration) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+			if _, err := s.KeepAlive(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// Seek calls UploadStream.Seek
+func (s *SafeUploadStream) Seek(offset int64, whence int) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.us.Seek(offset, whence)
+}
+
+// Tell calls UploadStream.Tell
+func (s *SafeUploadStream) Tell() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.us.Tell()
+}
+
+// Len calls UploadStream.Len
+func (s *SafeUploadStream) Len() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.us.Len()
+}
+
+// Stats calls UploadStream.Stats
+func (s *SafeUploadStream) Stats() TransferStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.us.Stats()
+}
+
+// Dirty calls UploadStream.Dirty
+func (s *SafeUploadStream) Dirty() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.us.Dirty()
+}
+
+// ForceClean calls UploadStream.ForceClean
+func (s *SafeUploadStream) ForceClean() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.us.ForceClean()
+}
+
+// Flush calls UploadStream.Flush
+func (s *SafeUploadStream) Flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.us.Flush()
+}
+
+// Close calls UploadStream.Close
+func (s *SafeUploadStream) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.us.Close()
+}
+
+// Buffered calls UploadStream.Buffered
+func (s *SafeUploadStream) Buffered() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.us.Buffered()
+}
+
+// Upload returns a copy of the upload state
+func (s *SafeUploadStream) Upload() Upload {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return *s.us.Upload
+}
+
+// Pause calls UploadStream.Pause without waiting for the running upload
+func (s *SafeUploadStream) Pause() {
+	s.us.Pause()
+}
+
+// Resume calls UploadStream.Resume without waiting for the running upload
+func (s *SafeUploadStream) Resume() {
+	s.us.Resume()
+}
+
+// Paused calls UploadStream.Paused
+func (s *SafeUploadStream) Paused() bool {
+	return s.us.Paused()
+}
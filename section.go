@@ -0,0 +1,73 @@
+package tusgo
+
+import (
+	"errors"
+	"io"
+)
+
+// readAtSeeker is a source ReadFrom may send the chunks from with no copying
+type readAtSeeker interface {
+	io.ReaderAt
+	io.Seeker
+}
+
+// sectionSource is reader over io.ReaderAt, which hands out the chunks as io.SectionReader. It keeps its own
+// position, the position of underlying reader is not changed.
+type sectionSource struct {
+	ra   io.ReaderAt
+	pos  int64
+	size int64 // Source size, measured at start
+}
+
+// next returns the section of up to n bytes at the current position and moves the position after it
+func (s *sectionSource) next(n int64) *io.SectionReader {
+	n = max(min(n, s.size-s.pos), 0)
+	if n > 0 && !s.readable(s.pos+n-1) {
+		// The source is shorter than its Seek has reported, e.g. the file has been truncated. Since the body length
+		// must be exact, find out where the source actually ends
+		n, _ = io.Copy(io.Discard, io.NewSectionReader(s.ra, s.pos, n))
+		s.size = s.pos + n
+	}
+	sr := io.NewSectionReader(s.ra, s.pos, n)
+	s.pos += n
+	return sr
+}
+
+// readable reports whether the byte at offset off can be read
+func (s *sectionSource) readable(off int64) bool {
+	var b [1]byte
+	n, _ := s.ra.ReadAt(b[:], off)
+	return n == 1
+}
+
+func (s *sectionSource) Read(p []byte) (n int, err error) {
+	if s.pos >= s.size {
+		return 0, io.EOF
+	}
+	if rest := s.size - s.pos; int64(len(p)) > rest {
+		p = p[:rest]
+	}
+	n, err = s.ra.ReadAt(p, s.pos)
+	s.pos += int64(n)
+	if errors.Is(err, io.EOF) && n > 0 {
+		err = nil
+	}
+	return
+}
+
+func (s *sectionSource) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += s.pos
+	case io.SeekEnd:
+		offset += s.size
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	s.pos = offset
+	return offset, nil
+}
@@ -0,0 +1,113 @@
+package tusgo
+
+import "time"
+
+// TransferStats contains the transfer quality metrics collected by UploadStream while uploading the data
+type TransferStats struct {
+	// BytesUploaded is the number of bytes the server has accepted
+	BytesUploaded int64
+
+	// BytesSent is the number of bytes written to the connection, including the bytes sent again on retries and
+	// the bytes the server has not accepted
+	BytesSent int64
+
+	// BytesRetransmitted is the number of bytes sent again when retrying the failed chunks, it's a part of BytesSent
+	BytesRetransmitted int64
+
+	// Requests is the number of upload requests made, including the failed ones
+	Requests int
+
+	// Duration is the wall-clock time spent in data upload requests
+	Duration time.Duration
+
+	// PeakThroughput is the highest throughput of a single upload request, in bytes per second
+	PeakThroughput float64
+
+	// Retries is the number of times the failed chunk was sent again, e.g. from the dirty buffer
+	Retries int
+
+	// Stalls is the number of upload requests that were failed or did not move the server offset forward
+	Stalls int
+}
+
+// Progress is the upload progress reported by UploadStream.OnProgress
+type Progress struct {
+	// BytesSent is the number of bytes the stream has written to the connection. This value grows as the request
+	// body is being sent, but the data is not durable until the server acknowledges it.
+	BytesSent int64
+
+	// BytesAcked is the server offset, i.e. the number of upload bytes the server has acknowledged to be stored
+	BytesAcked int64
+
+	// Total is the upload size, SizeUnknown if the size is deferred
+	Total int64
+}
+
+// ChunkProgress is the progress event sent to the channel returned by UploadStream.ProgressChan after every upload
+// request the server has acknowledged
+type ChunkProgress struct {
+	Progress
+
+	// Offset is the server offset after the request
+	Offset int64
+
+	// ChunkSize is the number of bytes the server has accepted in this request
+	ChunkSize int64
+
+	// Duration of the request
+	Duration time.Duration
+
+	// Attempt is the attempt number of uploading this chunk, starting from 1. It's greater than 1 if the failed
+	// chunk kept in the dirty buffer has been sent again
+	Attempt int
+}
+
+// UploadAllStats is the result of UploadStream.UploadAll
+type UploadAllStats struct {
+	// TransferStats are the stream statistics after the call
+	TransferStats
+
+	// Attempts is the number of upload attempts made, starting from 1
+	Attempts int
+
+	// ChecksumMismatches is the number of attempts failed because the server has detected data corruption
+	ChecksumMismatches int
+
+	// OffsetConflicts is the number of attempts failed because the stream offset did not match the server one
+	OffsetConflicts int
+
+	// Errors are the transient errors the failed attempts returned, in order
+	Errors []error
+}
+
+// AverageThroughput returns the average throughput of upload requests in bytes per second
+func (ts TransferStats) AverageThroughput() float64 {
+	if ts.Duration <= 0 {
+		return 0
+	}
+	return float64(ts.BytesUploaded) / ts.Duration.Seconds()
+}
+
+// RetransmissionRatio returns the share of retransmitted bytes in all bytes sent. Large values mean a lossy link,
+// so a smaller ChunkSize may reduce the overhead.
+func (ts TransferStats) RetransmissionRatio() float64 {
+	if ts.BytesSent <= 0 {
+		return 0
+	}
+	return float64(ts.BytesRetransmitted) / float64(ts.BytesSent)
+}
+
+func (ts *TransferStats) addRequest(duration time.Duration, bytesUploaded int64) {
+	ts.Requests++
+	ts.Duration += duration
+	ts.BytesUploaded += bytesUploaded
+	if bytesUploaded <= 0 {
+		ts.Stalls++
+		return
+	}
+	if duration > 0 {
+		if v := float64(bytesUploaded) / duration.Seconds(); v > ts.PeakThroughput {
+			ts.PeakThroughput = v
+		}
+	}
+}
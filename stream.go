@@ -2,15 +2,18 @@ package tusgo
 
 import (
 	"bytes"
+	"compress/gzip"
 	"context"
-	"encoding/base64"
+	"encoding"
 	"errors"
 	"fmt"
 	"hash"
 	"io"
+	"net"
 	"net/http"
 	"net/url"
 	"strconv"
+	"sync"
 	"time"
 
 	"github.com/bdragon300/tusgo/checksum"
@@ -24,22 +27,33 @@ func NewUploadStream(client *Client, upload *Upload) *UploadStream {
 	}
 	const chunkSize = 2 * 1024 * 1024
 	return &UploadStream{
-		ChunkSize:    chunkSize,
-		Upload:       upload,
-		client:       client,
-		uploadMethod: http.MethodPatch,
-		ctx:          client.ctx,
+		ChunkSize:      chunkSize,
+		MaxAttempts:    10,
+		RetryDelay:     5 * time.Second,
+		NetworkRetries: 3,
+		Upload:         upload,
+		client:         client,
+		uploadMethod:   http.MethodPatch,
+		ctx:            client.ctx,
+		pause:          &pauseState{},
 	}
 }
 
 // NoChunked assigned to UploadStream.ChunkSize makes the uploading process not to use chunking
 const NoChunked = 0
 
+// CloudflareChunkAlign is the UploadStream.ChunkAlign value for Cloudflare Stream, which requires the chunks to be
+// multiple of 256 KiB
+const CloudflareChunkAlign = 256 * 1024
+
 // UploadStream is write-only stream with TUS requests as underlying implementation. During creation, the UploadStream
 // receives a pointer to Upload object, where it holds the current server offset to write data to. This offset is
 // continuously updated during uploading data to the server. Note, that stream takes ownership of upload, so the upload
 // available for read only.
 //
+// UploadStream is not safe for concurrent use, except Pause and Resume methods. To drive a stream from multiple
+// goroutines, wrap it into SafeUploadStream.
+//
 // By default, we upload data in chunks, which size is defined in ChunkSize field. To disable chunking, set it to
 // NoChunked -- dirty buffer will not be used, and the data will be written to the request body directly.
 //
@@ -64,7 +78,8 @@ const NoChunked = 0
 // set SetUploadSize field to true. Generally, when using "Deferred length" feature, we create an upload with
 // unknown size, and the server expects that we will tell it the size on the first upload request.
 // So the very first write to UploadStream for a concrete upload (i.e. when RemoteOffset == 0) generates a request
-// with the upload size included.
+// with the upload size included. If the size becomes known only after the data transfer has been started, upload
+// the data with Upload.RemoteSize set to SizeUnknown and call DeclareSize once the size is known.
 //
 // Errors, which the stream methods may return, along with the Client methods, are:
 //
@@ -74,11 +89,86 @@ const NoChunked = 0
 //
 //   - ErrCannotUpload -- unable to write the data to the existing upload. Generally, it means that the upload is full,
 //     or this upload is concatenated upload, or it does not accept the data by some reason
+//
+//   - ErrInvariantViolation -- server offsets broke the invariants, if Invariants is set to InvariantsError
+//
+//   - ErrRequestTimeout -- the request has not completed in ChunkTimeout. Wraps the transport error
+//
+//   - ErrUploadAlreadyComplete -- the upload is full, no more data can be written. If the server has refused the data,
+//     the error wraps ErrCannotUpload
 type UploadStream struct {
 	// ChunkSize determines the chunk size and dirty buffer size for chunking uploading. You can set
 	// this value to NoChunked to disable chunking which prevents using dirty buffer. Default is 2MiB
 	ChunkSize int64
 
+	// ChunkAlign, if positive, makes the ChunkSize multiple of this value, for servers that require it (the last chunk
+	// may be smaller). Before uploading we clamp ChunkSize to the ServerCapabilities.MaxSize, if it's known, and then
+	// round it down to ChunkAlign, but not less than ChunkAlign. See CloudflareChunkAlign
+	ChunkAlign int64
+
+	// BufferWrites makes Write accumulate the data until ChunkSize bytes are collected before sending, so many small
+	// writes (e.g. from an encoder) don't produce a request each. Call Flush or Close to upload the rest of data.
+	// Seek and Sync don't take the buffered data into account, so flush the stream before calling them. Ignored if
+	// ChunkSize is NoChunked.
+	BufferWrites bool
+
+	// AutoSync makes the stream resolve the offsets conflict (409 response) automatically: we set the stream offset
+	// to the server one, reposition the source and retry, instead of returning ErrOffsetsNotSynced. The source must
+	// be seekable, i.e. the data passed to Write or the io.Seeker passed to ReadFrom, otherwise the error is returned
+	// as usual. If the server offset is not in the 409 response, we request it by HEAD request.
+	AutoSync bool
+
+	// MaxAttempts is the maximum number of upload attempts UploadAll makes. Default is 10
+	MaxAttempts int
+
+	// RetryDelay is the delay between attempts in UploadAll. Default is 5 seconds
+	RetryDelay time.Duration
+
+	// RetryBudget, if set, limits the total number of retries UploadAll makes for the upload, whereas MaxAttempts
+	// limits a single call. Pass the same budget to every UploadAll call for the upload, so a pathological server
+	// doesn't make the caller retry forever. When the budget is exhausted, UploadAll returns ErrRetryBudgetExhausted
+	// wrapping the last error.
+	RetryBudget *RetryBudget
+
+	// CreateOnWrite makes the stream create the upload on the first Write or ReadFrom if Upload.Location is empty. The
+	// upload is created with Upload.RemoteSize, Upload.Partial and Upload.Metadata. If the server supports
+	// "creation-with-upload" extension, the first chunk is sent in the creation request.
+	CreateOnWrite bool
+
+	// UploadMethod overrides the HTTP method of data upload requests for servers or gateways that require PUT or
+	// a custom verb instead of PATCH. The protocol headers are sent as usual. Empty value means PATCH. Creation
+	// requests are not affected.
+	UploadMethod string
+
+	// FullChecksumHeader, if set, is the header name we put the checksum of all upload data to, in addition to
+	// the per-chunk Upload-Checksum. The header is sent on the request, which completes the upload, for servers that
+	// verify the whole upload. The format is the same as Upload-Checksum has. It's sent only in chunked mode with
+	// checksum algorithm set, and only if the stream has uploaded all data from offset 0, see Digest.
+	FullChecksumHeader string
+
+	// PipelineHashing makes the stream read and hash the next chunk in a separate goroutine while the current chunk
+	// is being uploaded, so the hashing doesn't stall the transfer. Works only in chunked mode with checksum algorithm
+	// set and with seekable source, i.e. the data passed to Write or the io.Seeker passed to ReadFrom. The source is
+	// read one chunk ahead, and we move its position back to the first byte not uploaded before return.
+	PipelineHashing bool
+
+	// ReadAhead makes the stream read the next chunk in a separate goroutine while the current chunk is being
+	// uploaded, so the reading from a slow source, e.g. disk, overlaps with the network transfer. Works only in chunked
+	// mode and with seekable source, the same as PipelineHashing does. It costs two more chunk buffers, and ZeroCopy
+	// is ignored in this mode.
+	ReadAhead bool
+
+	// GzipChunks makes the stream compress the chunk bodies by gzip and send them with "Content-Encoding: gzip"
+	// header, for servers or proxies which decompress them. This saves the bandwidth for highly compressible data,
+	// such as logs. Offsets and checksums are still calculated on uncompressed data, but TransferStats.BytesSent
+	// counts the compressed bytes. Ignored if ChunkSize is NoChunked.
+	GzipChunks bool
+
+	// ZeroCopy makes ReadFrom send the chunks right from the source if it's io.ReaderAt and io.Seeker, such as
+	// *os.File, with no copying to the dirty buffer. ReadFrom returns the number of bytes the server has acknowledged
+	// in this mode, see ReadFrom. Ignored if checksum, GzipChunks or ReadAhead is used, or ChunkSize is NoChunked.
+	ZeroCopy bool
+
 	// LastResponse is read-only field that contains the last response from server was received by this UploadStream.
 	// This is useful, for example, if it's needed to get the response that caused an error.
 	LastResponse *http.Response
@@ -87,16 +177,73 @@ type UploadStream struct {
 	// with unknown size, and the server expects that we will tell it the size on the first upload request.
 	//
 	// If SetUploadSize is true, then the very first request for an upload (i.e. when RemoteOffset == 0) will also
-	// contain the upload size, which is taken from Upload.RemoteSize field.
+	// contain the upload size, which is taken from Upload.RemoteSize field. If Upload.DeferredLength is true, the size
+	// is sent on the next request regardless of the offset, and the flag is cleared after the server has accepted it.
+	// See also DeclareSize.
 	SetUploadSize bool
 
+	// ChunkTimeout, if positive, limits the time of every request the stream makes: the upload request including
+	// the chunk data transfer, and the HEAD request for the server offset. The request deadline is derived from the
+	// stream context. A stalled request fails with ErrRequestTimeout, which is transient, so UploadAll retries it
+	// instead of hanging until the stream context is done. The timeout should be enough to send ChunkSize bytes over
+	// the slowest link expected.
+	ChunkTimeout time.Duration
+
+	// NetworkRetries is the number of times the stream sends the chunk again right away, if its request has failed
+	// on the connection level, e.g. by connection reset, unexpected EOF or ChunkTimeout. The chunk is kept in the
+	// dirty buffer, so the source is not read again. If the dirty buffer is not used (see ChunkSize and ZeroCopy),
+	// we read the chunk from the source again, which must be seekable in this case, and checksum must not be used.
+	// Before every retry we wait a bit and request the server offset by HEAD request, so only the data the server has
+	// not received is sent. Zero makes such errors be returned to the caller. Default is 3
+	NetworkRetries int
+
+	// PreflightAfter enables the pre-flight check before resuming a stream that has been idle for a long time. If the
+	// time passed since the last request made by this stream exceeds this value, then before uploading the next chunk
+	// we call Preflight. Zero value disables the check.
+	PreflightAfter time.Duration
+
+	// Diagnostics, if set, receives the summary of every upload request this stream makes and the response on it.
+	// See also DiagnosticsRing.
+	Diagnostics DiagnosticsStore
+
+	// Invariants enables the checking of offsets invariants, which helps to catch the integration bugs early.
+	// See InvariantMode for details. Default is InvariantsOff.
+	Invariants InvariantMode
+
+	// OnProgress, if set, is called when the data is written to the connection and when the server acknowledges it
+	// by moving its offset. These values may diverge significantly on the flaky links, see Progress for details.
+	OnProgress func(p Progress)
+
 	checksumHash        hash.Hash
+	checksumSum         []byte // Reused for chunk checksums
 	rawChecksumHashName string
 	Upload              *Upload
 	client              *Client
 	dirtyBuffer         []byte
+	dirtyOffset         int64       // Upload offset the dirty buffer data starts from
+	held                heldBuffer  // Buffer the dirty buffer is sliced from
+	resolvedURL         resolvedURL // Cached upload URL
 	uploadMethod        string
 	ctx                 context.Context
+	lastRequestTime     time.Time
+	stats               TransferStats
+	chunkRetries        int
+	progressCh          chan ChunkProgress
+	rateLimiter         *RateLimiter
+	pause               *pauseState      // Shared between stream copies
+	pending             []byte           // Data accumulated by Write if BufferWrites is set
+	digest              hash.Hash        // Checksum of the acknowledged data
+	newDigest           func() hash.Hash // Digest hash constructor
+	digestStart         int64            // Upload offset the digest data starts from
+	digestEnd           int64            // Upload offset the digest data ends on
+	digestBroken        bool             // The digest doesn't cover the uploaded data contiguously
+}
+
+// pauseState is the pause flag of UploadStream
+type pauseState struct {
+	mu     sync.Mutex
+	paused bool
+	resume chan struct{} // Closed on resume
 }
 
 // WithContext assigns a given context to the copy of stream and returns it
@@ -104,6 +251,8 @@ func (us *UploadStream) WithContext(ctx context.Context) *UploadStream {
 	res := *us
 	res.LastResponse = nil
 	res.dirtyBuffer = nil
+	res.held = heldBuffer{}
+	res.pending = nil
 	res.ctx = ctx
 	return &res
 }
@@ -113,18 +262,57 @@ func (us *UploadStream) WithChecksumAlgorithm(name string) *UploadStream {
 	res := *us
 	res.LastResponse = nil
 	res.dirtyBuffer = nil
+	res.held = heldBuffer{}
+	res.pending = nil
 
 	if alg, ok := checksum.GetAlgorithm(name); !ok {
 		panic(fmt.Sprintf("checksum algorithm %q does not supported", name))
 	} else {
 		f := checksum.Algorithms[alg]
 		res.checksumHash = f()
+		res.newDigest = f
+		if _, err := checksum.NewResumableHash(alg); err == nil {
+			// Make the digest state serializable, see DigestState
+			res.newDigest = func() hash.Hash {
+				h, _ := checksum.NewResumableHash(alg)
+				return h
+			}
+		}
+		res.digest = res.newDigest()
+		res.digestEnd = OffsetUnknown
+		res.digestBroken = false
 	}
 	res.rawChecksumHashName = name
 
 	return &res
 }
 
+// WithRateLimit sets the upload bandwidth limit in bytes per second to the copy of stream and returns it. We pace
+// the reading of request body, so a background upload doesn't saturate the uplink. Zero value removes the limit.
+func (us *UploadStream) WithRateLimit(bytesPerSec int64) *UploadStream {
+	res := *us
+	res.LastResponse = nil
+	res.dirtyBuffer = nil
+	res.held = heldBuffer{}
+	res.pending = nil
+	res.rateLimiter = nil
+	if bytesPerSec > 0 {
+		res.rateLimiter = NewRateLimiter(bytesPerSec)
+	}
+	return &res
+}
+
+// rateLimiters returns the stream and client rate limiters, if set
+func (us *UploadStream) rateLimiters() (res []*RateLimiter) {
+	if us.rateLimiter != nil {
+		res = append(res, us.rateLimiter)
+	}
+	if us.client.RateLimiter != nil {
+		res = append(res, us.client.RateLimiter)
+	}
+	return
+}
+
 // ReadFrom uploads the data read from r, starting from offset Upload.RemoteOffset. Uploading stops when r
 // will be fully drawn out or the upload becomes full, whichever comes first. The Upload.RemoteOffset is continuously
 // updated with current offset during the process.
@@ -137,29 +325,81 @@ func (us *UploadStream) WithChecksumAlgorithm(name string) *UploadStream {
 //
 // After the uploading has finished successfully, we clear the dirty buffer, and the stream becomes "clean".
 //
+// If the upload is already full before the call and the stream is "clean", we return ErrUploadAlreadyComplete, so
+// the upload loop can terminate.
+//
 // If ChunkSize is set to NoChunked, we copy data from r directly to the request body. We don't use the dirty buffer
 // in this case, so the stream never becomes "dirty". Also, if checksum feature is used in this case, we put the hash
 // to the HTTP trailer, so the "checksum-trailer" server extension is required.
+//
+// If ZeroCopy is set and r is io.ReaderAt and io.Seeker, we send the chunks right from r with no copying to the dirty
+// buffer, so the stream never becomes "dirty" either. In this case n is the number of bytes the server has
+// acknowledged, and r is positioned right after them on return, even on error.
 func (us *UploadStream) ReadFrom(r io.Reader) (n int64, err error) {
 	if err = us.validate(); err != nil {
 		return
 	}
+	if us.dirtyBuffer == nil && us.full(us.Upload.RemoteOffset) {
+		err = ErrUploadAlreadyComplete
+		return
+	}
+	if err = us.preflightIfIdle(); err != nil {
+		return
+	}
 
-	if us.dirtyBuffer != nil {
-		if _, err = us.uploadChunked(bytes.NewReader(us.dirtyBuffer)); err != nil {
-			return
-		}
+	if err = us.uploadDirtyBuffer(); err != nil {
+		return
+	}
+	if rs, ok := r.(readAtSeeker); ok && us.zeroCopyAllowed() {
+		return us.readFromSections(rs)
+	}
+	if err = us.setupDirtyBuffer(); err != nil {
+		return
 	}
-	us.setupDirtyBuffer()
 
 	counterRd := &counterReader{Rd: r}
-	if _, err = us.uploadChunked(counterRd); err != nil {
+	var rd io.Reader = counterRd
+	if len(us.pending) > 0 { // Buffered data goes first
+		rd = io.MultiReader(bytes.NewReader(us.pending), counterRd)
+		us.pending = nil
+	}
+	var seeker io.Seeker
+	if sk, ok := r.(io.Seeker); ok && rd == counterRd {
+		seeker = &counterSeeker{Counter: counterRd, Sk: sk}
+	}
+	if _, err = us.uploadChunked(rd, seeker); err != nil {
 		return counterRd.BytesRead, err
 	}
-	us.dirtyBuffer = nil // Mark stream as clean if the whole data has been uploaded successfully
+	us.cleanDirtyBuffer() // Mark stream as clean if the whole data has been uploaded successfully
 	return counterRd.BytesRead, err
 }
 
+// zeroCopyAllowed reports whether ReadFrom may send the chunks right from the source, see ReadFrom
+func (us *UploadStream) zeroCopyAllowed() bool {
+	// The checksum and compression need the whole chunk in memory
+	return us.ZeroCopy && us.ChunkSize != NoChunked && us.checksumHash == nil && !us.GzipChunks && !us.ReadAhead && len(us.pending) == 0
+}
+
+// readFromSections uploads the data from r by chunks without copying them to the dirty buffer, see ReadFrom
+func (us *UploadStream) readFromSections(r readAtSeeker) (n int64, err error) {
+	src := &sectionSource{ra: r}
+	if src.pos, err = r.Seek(0, io.SeekCurrent); err != nil {
+		return
+	}
+	if src.size, err = r.Seek(0, io.SeekEnd); err != nil {
+		return
+	}
+	start, startOffset := src.pos, us.Upload.RemoteOffset
+	_, err = us.uploadChunked(src, src)
+
+	// The source position corresponds to the stream offset, so skip the data sent, but not acknowledged
+	n = us.Upload.RemoteOffset - startOffset
+	if _, e := r.Seek(start+n, io.SeekStart); e != nil && err == nil {
+		err = e
+	}
+	return
+}
+
 // Write uploads a bytes starting from offset Upload.RemoteOffset. The Upload.RemoteOffset is continuously
 // updated with current offset during the process. The return value n is the number of bytes successfully uploaded
 // to the server.
@@ -173,16 +413,59 @@ func (us *UploadStream) ReadFrom(r io.Reader) (n int64, err error) {
 // to the HTTP trailer, so the "checksum-trailer" server extension is required.
 //
 // If the bytes to be uploaded doesn't fit to space left in the upload, we upload the data we can and return io.ErrShortWrite.
+// If the upload is already full before the call, we return ErrUploadAlreadyComplete.
+//
+// If BufferWrites is set, we accumulate the data until ChunkSize bytes are collected and upload only the whole chunks.
+// The return value n is the number of bytes accepted to the buffer in this case. On error the data is kept in the
+// buffer to be uploaded by the next Write or Flush.
 func (us *UploadStream) Write(p []byte) (n int, err error) {
+	if us.BufferWrites && us.ChunkSize != NoChunked {
+		return us.writeBuffered(p)
+	}
+	return us.write(p)
+}
+
+func (us *UploadStream) writeBuffered(p []byte) (n int, err error) {
+	if len(p) > 0 && us.full(us.Upload.RemoteOffset+int64(len(us.pending))) {
+		err = ErrUploadAlreadyComplete
+		return
+	}
+	us.pending = append(us.pending, p...)
+	if l := int64(len(us.pending)); l >= us.ChunkSize {
+		err = us.flushPending(l - l%us.ChunkSize)
+	}
+	return len(p), err
+}
+
+// flushPending uploads the first n bytes of buffered data
+func (us *UploadStream) flushPending(n int64) error {
+	uploaded, err := us.write(us.pending[:n])
+	us.pending = append(us.pending[:0], us.pending[uploaded:]...)
+	if len(us.pending) == 0 {
+		us.pending = nil
+	}
+	return err
+}
+
+func (us *UploadStream) write(p []byte) (n int, err error) {
 	if err = us.validate(); err != nil {
 		return
 	}
-	us.setupDirtyBuffer()
-	defer func() { us.dirtyBuffer = nil }() // Always mark stream as clean, since p is seekable
-	var rd io.Reader = bytes.NewReader(p)
+	if len(p) > 0 && us.full(us.Upload.RemoteOffset) {
+		err = ErrUploadAlreadyComplete
+		return
+	}
+	if err = us.preflightIfIdle(); err != nil {
+		return
+	}
+	if err = us.setupDirtyBuffer(); err != nil {
+		return
+	}
+	defer us.cleanDirtyBuffer() // Always mark stream as clean, since p is seekable
+	rd := bytes.NewReader(p)
 
 	var uploaded int64
-	if uploaded, err = us.uploadChunked(rd); err == nil {
+	if uploaded, err = us.uploadChunked(rd, rd); err == nil {
 		if uploaded != int64(len(p)) {
 			err = io.ErrShortWrite
 		}
@@ -194,14 +477,84 @@ func (us *UploadStream) Write(p []byte) (n int, err error) {
 // starting the transfer, or when an ErrOffsetsNotSynced error was returned by UploadStream
 func (us *UploadStream) Sync() (response *http.Response, err error) {
 	f := Upload{}
-	if response, err = us.client.GetUpload(&f, us.Upload.Location); err == nil {
+	if response, err = us.getUpload(&f); err == nil {
 		us.Upload.RemoteOffset = f.RemoteOffset
 	}
 	us.LastResponse = response
+	us.lastRequestTime = time.Now()
 	return
 }
 
-// Seek moves Upload.RemoteOffset to the requested position. Returns new offset
+// Preflight checks the upload on the server before resuming the stream that has been idle for a while. We make a HEAD
+// request, so a stale pooled connection is detected and replaced, and DNS resolving and TCP/TLS handshakes are done
+// before the data transfer. Other connections of http client, which may be shared, are left intact.
+// Returns http response from server (with closed body) and error (if any).
+//
+// This method returns ErrUploadDoesNotExist (or ErrUploadExpired) if the upload has vanished on the server while the
+// stream was idle, and ErrOffsetsNotSynced if the server offset is not equal to the stream offset.
+func (us *UploadStream) Preflight() (response *http.Response, err error) {
+	f := Upload{UploadExpired: us.Upload.UploadExpired} // Let GetUpload know the upload expiration
+	response, err = us.getUpload(&f)
+	us.LastResponse = response
+	us.lastRequestTime = time.Now()
+	if err == nil && f.RemoteOffset != us.Upload.RemoteOffset {
+		err = ErrOffsetsNotSynced.WithErr(OffsetsError{LocalOffset: us.Upload.RemoteOffset, RemoteOffset: f.RemoteOffset})
+	}
+	return
+}
+
+// KeepAlive sends a PATCH request without data at the current offset. Many servers extend the upload expiration on
+// any successful PATCH, so this prevents a paused upload from expiring. Upload.UploadExpired is updated with the new
+// expiration time if the server has sent it. Returns http response from server (with closed body) and error (if any).
+//
+// This method returns ErrOffsetsNotSynced if the server offset is not equal to the stream offset.
+func (us *UploadStream) KeepAlive() (response *http.Response, err error) {
+	var u string
+	if u, err = us.uploadURL(); err != nil {
+		return
+	}
+	// Use the copy with no checksum and no chunking to make a request with empty body. Also, the stats of keep-alive
+	// requests must not be mixed with data transfer ones
+	ka := *us
+	ka.ChunkSize = NoChunked
+	ka.checksumHash = nil
+	ka.digest = nil
+	ka.dirtyBuffer = nil
+	ka.held = heldBuffer{}
+	var offset int64
+	_, offset, response, err = ka.uploadChunkImpl(u, bytes.NewReader(nil), nil)
+	if response != nil {
+		us.LastResponse = response
+		us.lastRequestTime = time.Now()
+	}
+	if err == nil && offset != us.Upload.RemoteOffset {
+		err = ErrOffsetsNotSynced.WithErr(OffsetsError{LocalOffset: us.Upload.RemoteOffset, RemoteOffset: offset})
+	}
+	return
+}
+
+// RunKeepAlive calls KeepAlive every interval until ctx is done or KeepAlive fails. Returns the error KeepAlive
+// has failed with or ctx error. Intended to run in a separate goroutine for an upload paused for a long time. The stream
+// must not be used by other goroutines while this method is running.
+func (us *UploadStream) RunKeepAlive(ctx context.Context, interval time.Duration) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+			if _, err := us.KeepAlive(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// Seek moves Upload.RemoteOffset to the requested position according to whence, see io.Seeker. Returns new offset.
+//
+// The offset may be in range [0, Upload.RemoteSize], where Upload.RemoteSize is the end of upload. If the upload size
+// is unknown, seeking relative to the end is not possible. On error, the offset is not changed.
 func (us *UploadStream) Seek(offset int64, whence int) (int64, error) {
 	var newOffset int64
 	switch whence {
@@ -210,15 +563,18 @@ func (us *UploadStream) Seek(offset int64, whence int) (int64, error) {
 	case io.SeekCurrent:
 		newOffset = us.Upload.RemoteOffset + offset
 	case io.SeekEnd:
-		newOffset = us.Upload.RemoteSize - 1 + offset
+		if us.Upload.RemoteSize == SizeUnknown {
+			return 0, errors.New("cannot seek relative to the end, since upload size is unknown")
+		}
+		newOffset = us.Upload.RemoteSize + offset
 	default:
-		panic("unknown whence value")
+		return 0, fmt.Errorf("invalid whence value %d", whence)
 	}
-	if offset >= us.Upload.RemoteSize {
-		return newOffset, fmt.Errorf("offset %d exceeds the upload size %d bytes", newOffset, us.Upload.RemoteSize)
+	if newOffset < 0 {
+		return 0, fmt.Errorf("offset %d is negative", newOffset)
 	}
-	if offset < 0 {
-		return newOffset, fmt.Errorf("offset %d is negative", newOffset)
+	if us.Upload.RemoteSize != SizeUnknown && newOffset > us.Upload.RemoteSize {
+		return 0, fmt.Errorf("offset %d exceeds the upload size %d bytes", newOffset, us.Upload.RemoteSize)
 	}
 	us.Upload.RemoteOffset = newOffset
 	return newOffset, nil
@@ -234,6 +590,314 @@ func (us *UploadStream) Len() int64 {
 	return us.Upload.RemoteSize
 }
 
+// Stats returns the transfer quality metrics collected by this stream
+func (us *UploadStream) Stats() TransferStats {
+	return us.stats
+}
+
+func (us *UploadStream) addBytesSent(n int) {
+	us.stats.BytesSent += int64(n)
+	if us.chunkRetries > 0 {
+		us.stats.BytesRetransmitted += int64(n)
+	}
+	us.reportProgress()
+}
+
+func (us *UploadStream) reportProgress() {
+	if us.OnProgress != nil {
+		us.OnProgress(Progress{BytesSent: us.stats.BytesSent, BytesAcked: us.Upload.RemoteOffset, Total: us.Upload.RemoteSize})
+	}
+}
+
+// ProgressChan returns a channel, which receives the progress after every upload request the server has
+// acknowledged. The channel is closed when the upload becomes complete or fails with a non-transient error (see
+// IsTransientError). UploadAll also closes it when it gives up. buffer is the channel buffer size.
+//
+// The stream blocks on sending to the channel until the stream context is done, so the caller must read it
+// continuously, e.g. in a select loop. Only one channel can be used at a time, the previous one is closed on
+// the repeated call.
+func (us *UploadStream) ProgressChan(buffer int) <-chan ChunkProgress {
+	us.closeProgress()
+	us.progressCh = make(chan ChunkProgress, buffer)
+	ch := us.progressCh
+	if us.Upload.RemoteSize != SizeUnknown && us.Upload.RemoteOffset >= us.Upload.RemoteSize {
+		us.closeProgress()
+	}
+	return ch
+}
+
+func (us *UploadStream) sendChunkProgress(chunkSize int64, duration time.Duration) {
+	if us.progressCh == nil {
+		return
+	}
+	var done <-chan struct{}
+	if us.ctx != nil {
+		done = us.ctx.Done()
+	}
+	select {
+	case us.progressCh <- ChunkProgress{
+		Progress:  Progress{BytesSent: us.stats.BytesSent, BytesAcked: us.Upload.RemoteOffset, Total: us.Upload.RemoteSize},
+		Offset:    us.Upload.RemoteOffset,
+		ChunkSize: chunkSize,
+		Duration:  duration,
+		Attempt:   us.chunkRetries + 1,
+	}:
+	case <-done:
+		return // The error the stream is about to return closes the channel
+	}
+	if us.full(us.Upload.RemoteOffset) {
+		us.closeProgress()
+	}
+}
+
+// closeProgress closes the channel returned by ProgressChan, if any
+func (us *UploadStream) closeProgress() {
+	if us.progressCh != nil {
+		close(us.progressCh)
+		us.progressCh = nil
+	}
+}
+
+// Pause makes the stream stop issuing new upload requests at the next chunk boundary. The uploading method that is
+// running at the moment blocks until Resume is called or the stream context is done, then it continues from the same
+// offset. The dirty buffer is preserved. This method may be called from another goroutine.
+func (us *UploadStream) Pause() {
+	us.pause.mu.Lock()
+	defer us.pause.mu.Unlock()
+
+	if !us.pause.paused {
+		us.pause.paused = true
+		us.pause.resume = make(chan struct{})
+	}
+}
+
+// Resume continues the uploading paused by Pause. This method may be called from another goroutine.
+func (us *UploadStream) Resume() {
+	us.pause.mu.Lock()
+	defer us.pause.mu.Unlock()
+
+	if us.pause.paused {
+		us.pause.paused = false
+		close(us.pause.resume)
+	}
+}
+
+// Paused returns true if the stream has been paused
+func (us *UploadStream) Paused() bool {
+	if us.pause == nil {
+		return false
+	}
+	us.pause.mu.Lock()
+	defer us.pause.mu.Unlock()
+
+	return us.pause.paused
+}
+
+// waitResume blocks while the stream is paused
+func (us *UploadStream) waitResume() error {
+	if us.pause == nil {
+		return nil
+	}
+	us.pause.mu.Lock()
+	paused, resume := us.pause.paused, us.pause.resume
+	us.pause.mu.Unlock()
+	if !paused {
+		return nil
+	}
+
+	ctx := us.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	select {
+	case <-resume:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Flush uploads the data chunk kept in the dirty buffer, if any, and then the data accumulated by Write if
+// BufferWrites is set. The stream becomes "clean" on success, otherwise it remains "dirty" and the dirty buffer is
+// kept as it was.
+func (us *UploadStream) Flush() (err error) {
+	if us.dirtyBuffer != nil {
+		if err = us.validate(); err != nil {
+			return
+		}
+		if err = us.preflightIfIdle(); err != nil {
+			return
+		}
+		if err = us.uploadDirtyBuffer(); err != nil {
+			return
+		}
+		us.cleanDirtyBuffer()
+	}
+	if len(us.pending) > 0 {
+		err = us.flushPending(int64(len(us.pending)))
+	}
+	return
+}
+
+// Close flushes the stream and releases its buffers. If Flush fails, the stream remains "dirty", so Close may be
+// called again. This method makes UploadStream usable as io.WriteCloser.
+func (us *UploadStream) Close() error {
+	if err := us.Flush(); err != nil {
+		return err
+	}
+	us.releaseDirtyBuffer()
+	us.pending = nil
+	return nil
+}
+
+// Buffered returns the number of bytes accumulated by Write, but not uploaded yet. See BufferWrites
+func (us *UploadStream) Buffered() int {
+	return len(us.pending)
+}
+
+// uploadDirtyBuffer uploads again the failed chunk kept in the dirty buffer, if any
+func (us *UploadStream) uploadDirtyBuffer() (err error) {
+	if us.dirtyBuffer == nil {
+		return
+	}
+	// The stream offset may have been moved since the failure, e.g. by Sync. So upload only the data after it
+	skip := us.Upload.RemoteOffset - us.dirtyOffset
+	if skip < 0 || skip >= int64(len(us.dirtyBuffer)) {
+		us.cleanDirtyBuffer() // The data has been acknowledged already or doesn't relate to the current offset
+		return
+	}
+	us.dirtyBuffer = us.dirtyBuffer[skip:]
+	us.stats.Retries++
+	us.chunkRetries++
+	_, err = us.uploadChunked(bytes.NewReader(us.dirtyBuffer), nil)
+	return
+}
+
+// Digest returns the checksum of the data the server has acknowledged through this stream, so it can be compared
+// with the checksum of the local file after the upload has finished. The checksum is calculated by the algorithm set
+// by WithChecksumAlgorithm and covers the data starting from the offset of the first upload request, so start from
+// offset 0 to get the whole upload checksum.
+//
+// Returns nil if the checksum algorithm is not set, if the data has been uploaded not contiguously (e.g. the offset
+// has been moved by Seek), or if any data has been uploaded with NoChunked ChunkSize.
+func (us *UploadStream) Digest() []byte {
+	if us.digest == nil || us.digestBroken || us.digestEnd == OffsetUnknown {
+		return nil
+	}
+	return us.digest.Sum(nil)
+}
+
+// DigestState returns the serialized state of digest, so the checksum calculation can be continued by ResumeDigest
+// after process restart without re-reading the uploaded data. Returns error if the checksum algorithm is not set,
+// its state can't be serialized, or the digest doesn't cover the data from offset 0 (see Digest).
+func (us *UploadStream) DigestState() ([]byte, error) {
+	if us.digest == nil {
+		return nil, errors.New("checksum algorithm is not set")
+	}
+	if us.digestBroken || us.digestEnd != OffsetUnknown && us.digestStart != 0 {
+		return nil, errors.New("digest does not cover the data from offset 0")
+	}
+	h, ok := us.digest.(*checksum.ResumableHash)
+	if !ok {
+		return nil, fmt.Errorf("checksum algorithm %q state can't be serialized", us.rawChecksumHashName)
+	}
+	return h.MarshalBinary()
+}
+
+// ResumeDigest restores the digest state returned by DigestState. The state covers the data up to the offset it was
+// taken at, so the upload should be continued from this offset, otherwise the digest gets broken.
+func (us *UploadStream) ResumeDigest(state []byte) error {
+	if us.digest == nil {
+		return errors.New("checksum algorithm is not set")
+	}
+	h, ok := us.newDigest().(*checksum.ResumableHash)
+	if !ok {
+		return fmt.Errorf("checksum algorithm %q state can't be serialized", us.rawChecksumHashName)
+	}
+	algo := h.Algorithm()
+	if err := h.UnmarshalBinary(state); err != nil {
+		return err
+	}
+	if h.Algorithm() != algo {
+		return fmt.Errorf("digest state algorithm %q differs from the stream's one %q", h.Algorithm(), algo)
+	}
+	us.digest = h
+	us.digestStart = 0
+	us.digestEnd = h.Offset()
+	us.digestBroken = false
+	return nil
+}
+
+// updateDigest adds the data acknowledged by the server at a given offset to the digest
+func (us *UploadStream) updateDigest(offset int64, data []byte) {
+	if us.digest == nil || us.digestBroken {
+		return
+	}
+	if data == nil || us.digestEnd != OffsetUnknown && us.digestEnd != offset {
+		us.digestBroken = true
+		return
+	}
+	if us.digestEnd == OffsetUnknown {
+		us.digestStart = offset
+	}
+	us.digest.Write(data)
+	us.digestEnd = offset + int64(len(data))
+}
+
+// fullChecksum returns the Upload-Checksum formatted checksum of the whole upload, which the final chunk at a given
+// offset completes. Returns empty string if the digest doesn't cover all data before the chunk.
+func (us *UploadStream) fullChecksum(offset int64, chunk []byte) string {
+	if us.digest == nil || us.digestBroken {
+		return ""
+	}
+	var h hash.Hash
+	switch {
+	case us.digestEnd == OffsetUnknown && offset == 0:
+		h = us.newDigest()
+	case us.digestStart == 0 && us.digestEnd == offset:
+		// Clone the digest, since the chunk may not be acknowledged
+		m, ok := us.digest.(encoding.BinaryMarshaler)
+		if !ok {
+			return ""
+		}
+		state, err := m.MarshalBinary()
+		if err != nil {
+			return ""
+		}
+		h = us.newDigest()
+		if err = h.(encoding.BinaryUnmarshaler).UnmarshalBinary(state); err != nil {
+			return ""
+		}
+	default:
+		return ""
+	}
+	h.Write(chunk)
+	return formatChecksum(us.rawChecksumHashName, h.Sum(nil))
+}
+
+// DeclareSize sets the upload size of deferred length upload, whose data is being uploaded with unknown size. The size
+// is sent on the next upload request, after that the stream doesn't accept data beyond it. Returns error if the size
+// is less than the stream offset.
+//
+// The server must support "creation-defer-length" extension.
+func (us *UploadStream) DeclareSize(size int64) error {
+	if size < 0 {
+		panic(fmt.Sprintf("upload size is negative %d", size))
+	}
+	if size < us.Upload.RemoteOffset {
+		return fmt.Errorf("upload size %d is less than offset %d", size, us.Upload.RemoteOffset)
+	}
+	us.Upload.RemoteSize = size
+	us.Upload.DeferredLength = true
+	us.SetUploadSize = true
+	return nil
+}
+
+// full reports whether the upload has no space left for the data at a given offset
+func (us *UploadStream) full(offset int64) bool {
+	return us.Upload.RemoteSize != SizeUnknown && offset >= us.Upload.RemoteSize
+}
+
 // Dirty returns true if stream has been marked "dirty". This means it contains the data chunk, which was failed
 // to upload to the server.
 func (us *UploadStream) Dirty() bool {
@@ -242,41 +906,478 @@ func (us *UploadStream) Dirty() bool {
 
 // ForceClean marks the stream as "clean". It erases the data from the dirty buffer.
 func (us *UploadStream) ForceClean() {
-	us.dirtyBuffer = nil
+	us.cleanDirtyBuffer()
 }
 
-func (us *UploadStream) uploadChunked(r io.Reader) (uploadedBytes int64, err error) {
-	var loc *url.URL
+// uploadChunked uploads the data from r by chunks. seeker, if not nil, is used to reposition r if offsets conflict
+// has been resolved by AutoSync. It must change the position of r.
+func (us *UploadStream) uploadChunked(r io.Reader, seeker io.Seeker) (uploadedBytes int64, err error) {
+	var u string
 	var offset int64
 	var lastResponse *http.Response
 
-	if loc, err = url.Parse(us.Upload.Location); err != nil {
-		return
+	creating := us.Upload.Location == "" && us.CreateOnWrite
+	if creating {
+		if caps := us.client.CurrentCapabilities(); caps == nil || !caps.HasExtension(ExtensionCreationWithUpload) {
+			if err = us.createUpload(); err != nil {
+				return
+			}
+			creating = false
+		}
+	}
+	if !creating {
+		if u, err = us.uploadURL(); err != nil {
+			return
+		}
 	}
-	u := us.client.BaseURL.ResolveReference(loc).String()
+
+	startOffset := us.Upload.RemoteOffset
+	defer func() {
+		if moved := us.Upload.RemoteOffset - startOffset; err == nil && moved != uploadedBytes {
+			err = us.invariantViolation("uploaded %d bytes, but offset has moved by %d", uploadedBytes, moved)
+		}
+		if err != nil && !IsTransientError(err) {
+			us.closeProgress() // No more progress is expected
+		}
+	}()
+
+	var pipe *hashPipeline
+	hashing := us.PipelineHashing && us.checksumHash != nil
+	if (hashing || us.ReadAhead) && seeker != nil && us.ChunkSize != NoChunked {
+		var h hash.Hash
+		if hashing {
+			h = us.newDigest()
+		}
+		pipe = newHashPipeline(r, h, us.ChunkSize, us.client.buffers())
+		defer func() {
+			// Return the source position to the first byte not uploaded
+			if unread := pipe.close(); unread > 0 {
+				if _, e := seeker.Seek(-unread, io.SeekCurrent); e != nil && err == nil {
+					err = e
+				}
+			}
+		}()
+	}
+
+	_, zeroCopy := r.(*sectionSource)
+	// Without the dirty buffer, the failed data is read from the source again, see NetworkRetries
+	retryFromSource := seeker != nil && pipe == nil && us.checksumHash == nil && (zeroCopy || us.ChunkSize == NoChunked)
 
 	uploaded := us.ChunkSize
+	synced := false
 	for uploaded == us.ChunkSize {
-		uploaded, offset, lastResponse, err = us.uploadChunkImpl(u, r, nil)
+		if err = us.waitResume(); err != nil {
+			return
+		}
+		rd := r
+		var chunk *hashedChunk
+		if pipe != nil {
+			if !pipe.fetching {
+				pipe.prefetch(us.nextChunkSize(us.Upload.RemoteOffset))
+			}
+			if chunk = pipe.next(); chunk.err != nil {
+				err = chunk.err
+				return
+			}
+			rd = chunk
+		}
+		var pos int64
+		if seeker != nil && (us.AutoSync || retryFromSource && us.NetworkRetries > 0) {
+			if pos, err = seeker.Seek(0, io.SeekCurrent); err != nil {
+				return
+			}
+			if chunk != nil {
+				pos -= int64(len(chunk.data))
+			}
+		}
+		if chunk != nil && int64(len(chunk.data)) == us.ChunkSize {
+			if n := us.nextChunkSize(us.Upload.RemoteOffset + us.ChunkSize); n > 0 {
+				pipe.prefetch(n)
+			}
+		}
+		started := time.Now()
+		if creating {
+			uploaded, offset, lastResponse, err = us.createWithUpload(rd)
+		} else {
+			uploaded, offset, lastResponse, err = us.uploadChunkImpl(u, rd, nil)
+		}
 		if lastResponse != nil {
 			us.LastResponse = lastResponse
+			us.lastRequestTime = time.Now()
+		}
+		if creating && err == nil {
+			if lastResponse == nil { // Nothing to upload, so the upload has not been created
+				if err = us.createUpload(); err != nil {
+					return
+				}
+			}
+			if u, err = us.uploadURL(); err != nil {
+				return
+			}
+			creating = false
+		}
+		if err != nil && us.AutoSync && seeker != nil && !synced && errors.Is(err, ErrOffsetsNotSynced) {
+			// Sync only once in a row, so we don't loop forever if the server keeps responding 409
+			prev := us.Upload.RemoteOffset
+			if pipe != nil {
+				pipe.drain() // The source will be repositioned
+			}
+			if err = us.autoSync(err, seeker, pos); err != nil {
+				return
+			}
+			uploadedBytes += us.Upload.RemoteOffset - prev
+			uploaded = us.ChunkSize
+			synced = true
+			continue
+		}
+		if err != nil && !creating && us.canRetryChunk(retryFromSource, err) {
+			prev := us.Upload.RemoteOffset
+			var src io.Seeker
+			if retryFromSource {
+				src = seeker
+			}
+			if uploaded, offset, err = us.retryChunk(u, r, src, pos, err); err != nil {
+				uploadedBytes += us.Upload.RemoteOffset - prev // The server may have received a part of chunk
+			}
 		}
 		if err != nil {
 			return
 		}
 		us.Upload.RemoteOffset = offset
 		uploadedBytes += uploaded
+		us.reportProgress()
+		if lastResponse != nil {
+			us.sendChunkProgress(uploaded, time.Since(started))
+		}
+		us.chunkRetries = 0
+		synced = false
 	}
 
 	return
 }
 
-func (us *UploadStream) setupDirtyBuffer() {
-	if int64(len(us.dirtyBuffer)) != us.ChunkSize {
+// networkRetryDelay is the delay before the first chunk retry, see UploadStream.NetworkRetries. It doubles on
+// every next retry
+const networkRetryDelay = 100 * time.Millisecond
+
+// canRetryChunk reports whether the chunk, which request has failed with err, may be sent again. The chunk is taken
+// either from the dirty buffer, or from the source again if fromSource is true
+func (us *UploadStream) canRetryChunk(fromSource bool, err error) bool {
+	if us.NetworkRetries <= 0 || !isConnectionError(err) {
+		return false
+	}
+	return fromSource || us.dirtyBuffer != nil && us.dirtyOffset == us.Upload.RemoteOffset
+}
+
+// retryChunk sends again the chunk after its request has failed by connection error, at most NetworkRetries times.
+// Before every retry we set the stream offset to the server one, so only the chunk data the server has not received
+// is sent. If seeker is nil, the chunk is kept in the dirty buffer. Otherwise, we seek r to the data not received,
+// pos is the r position where the chunk starts. Returns the chunk size and the new offset on success, or the last
+// error.
+func (us *UploadStream) retryChunk(requestURL string, r io.Reader, seeker io.Seeker, pos int64, cause error) (bytesUploaded int64, offset int64, err error) {
+	chunk, start := us.dirtyBuffer, us.dirtyOffset
+	size := int64(len(chunk))
+	if seeker != nil {
+		start, size = us.Upload.RemoteOffset, -1 // The request body length is not known in NoChunked mode
+		if src, ok := r.(*sectionSource); ok {
+			// Don't let the retried chunk grab the data after the original one
+			end := src.size
+			src.size, size = src.pos, src.pos-pos
+			defer func() { src.size = end }()
+		}
+	}
+	delay := networkRetryDelay
+	err = cause
+	for i := 0; i < us.NetworkRetries && isConnectionError(err); i++ {
+		if e := sleepContext(us.ctx, delay); e != nil {
+			return 0, 0, e
+		}
+		delay *= 2
+
+		f := Upload{}
+		var response *http.Response
+		response, err = us.getUpload(&f)
+		us.LastResponse = response
+		us.lastRequestTime = time.Now()
+		if err != nil {
+			continue
+		}
+		received := f.RemoteOffset - start
+		if received < 0 || size >= 0 && received > size {
+			return 0, 0, cause // The server offset doesn't relate to the chunk
+		}
+		if received > 0 && seeker == nil {
+			us.updateDigest(start, chunk[:received])
+		}
+		us.Upload.RemoteOffset = f.RemoteOffset
+		if size < 0 || received < size {
+			body := r
+			if seeker == nil {
+				us.dirtyBuffer = chunk[received:]
+				body = bytes.NewReader(us.dirtyBuffer)
+			} else if _, err = seeker.Seek(pos+received, io.SeekStart); err != nil {
+				return
+			}
+			us.stats.Retries++
+			us.chunkRetries++
+			if _, offset, response, err = us.uploadChunkImpl(requestURL, body, nil); response != nil {
+				us.LastResponse = response
+				us.lastRequestTime = time.Now()
+			}
+			if err != nil {
+				continue
+			}
+		} else {
+			offset = f.RemoteOffset
+		}
+		if seeker == nil {
+			// The next chunk is read to the whole buffer
+			us.dirtyBuffer, us.dirtyOffset = chunk, start
+		}
+		return offset - start, offset, nil
+	}
+	return
+}
+
+// headerSetter sets the request headers taking the value slices from a single array, whereas http.Header.Set
+// allocates a slice per header. Keys must be in canonical form
+type headerSetter struct {
+	h    http.Header
+	vals []string
+}
+
+func (hs *headerSetter) set(key, value string) {
+	if len(hs.vals) == cap(hs.vals) {
+		hs.vals = make([]string, 0, 4)
+	}
+	hs.vals = append(hs.vals, value)
+	n := len(hs.vals)
+	hs.h[key] = hs.vals[n-1 : n : n] // Full slice, so appending to it doesn't overwrite the next value
+}
+
+// isConnectionError reports whether the request has failed on the connection level, e.g. by connection reset, EOF or
+// timeout, so it may be sent again. The context cancellation is not such error, but ErrRequestTimeout is
+func isConnectionError(err error) bool {
+	if errors.Is(err, ErrRequestTimeout) {
+		return true
+	}
+	var ue *url.Error
+	if !errors.As(err, &ue) || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var ne net.Error
+	return errors.As(ue.Err, &ne) || errors.Is(ue.Err, io.EOF) || errors.Is(ue.Err, io.ErrUnexpectedEOF)
+}
+
+// nextChunkSize returns the size of chunk to be uploaded at a given offset
+func (us *UploadStream) nextChunkSize(offset int64) int64 {
+	if us.Upload.RemoteSize != SizeUnknown {
+		return max(min(us.ChunkSize, us.Upload.RemoteSize-offset), 0)
+	}
+	return us.ChunkSize
+}
+
+// requestContext returns the context of a single request derived from parent and limited by ChunkTimeout. Nil parent
+// is returned as is if there is no timeout
+func (us *UploadStream) requestContext(parent context.Context) (context.Context, context.CancelFunc) {
+	if us.ChunkTimeout <= 0 {
+		return parent, func() {}
+	}
+	if parent == nil {
+		parent = context.Background()
+	}
+	return context.WithTimeout(parent, us.ChunkTimeout)
+}
+
+// timeoutError returns ErrRequestTimeout wrapping err if the request has failed since ctx, obtained by requestContext,
+// has exceeded ChunkTimeout, while parent is still alive. Otherwise, err is returned as is
+func (us *UploadStream) timeoutError(parent, ctx context.Context, err error) error {
+	if err == nil || us.ChunkTimeout <= 0 || !errors.Is(ctx.Err(), context.DeadlineExceeded) ||
+		parent != nil && parent.Err() != nil {
+		return err
+	}
+	return ErrRequestTimeout.WithErr(err)
+}
+
+// getUpload requests the upload info by HEAD request, limited by ChunkTimeout
+func (us *UploadStream) getUpload(f *Upload) (response *http.Response, err error) {
+	if us.ChunkTimeout <= 0 {
+		return us.client.GetUpload(f, us.Upload.Location)
+	}
+	ctx, cancel := us.requestContext(us.client.ctx)
+	defer cancel()
+	response, err = us.client.WithContext(ctx).GetUpload(f, us.Upload.Location)
+	return response, us.timeoutError(us.client.ctx, ctx, err)
+}
+
+// uploadURL returns Upload.Location resolved against the client BaseURL. The result is cached until any of them
+// changes, so we don't parse the location on every request.
+func (us *UploadStream) uploadURL() (string, error) {
+	c := &us.resolvedURL
+	if c.url != "" && c.location == us.Upload.Location && c.base == us.client.BaseURL {
+		return c.url, nil
+	}
+	loc, err := url.Parse(us.Upload.Location)
+	if err != nil {
+		return "", err
+	}
+	*c = resolvedURL{location: us.Upload.Location, base: us.client.BaseURL, url: us.client.BaseURL.ResolveReference(loc).String()}
+	return c.url, nil
+}
+
+// resolvedURL is the cached result of UploadStream.uploadURL
+type resolvedURL struct {
+	location string
+	base     *url.URL
+	url      string
+}
+
+// createUpload creates the upload for CreateOnWrite
+func (us *UploadStream) createUpload() (err error) {
+	u := Upload{}
+	us.LastResponse, err = us.client.CreateUpload(&u, us.Upload.RemoteSize, us.Upload.Partial, us.Upload.Metadata)
+	us.lastRequestTime = time.Now()
+	if err == nil {
+		*us.Upload = u
+	}
+	return
+}
+
+// createWithUpload creates the upload for CreateOnWrite and sends the first chunk from r in the same request
+func (us *UploadStream) createWithUpload(r io.Reader) (bytesUploaded int64, offset int64, response *http.Response, err error) {
+	if err = us.client.checkUploadSize(us.Upload.RemoteSize); err != nil {
+		return
+	}
+	meta := us.client.mergeMetadata(us.Upload.Metadata)
+	var headers map[string]string
+	if headers, err = us.client.creationWithUploadHeaders(us.Upload.RemoteSize, us.Upload.Partial, meta); err != nil {
+		return
+	}
+
+	us.Upload.DeferredLength = us.Upload.RemoteSize == SizeUnknown
+	method := us.uploadMethod
+	us.uploadMethod = http.MethodPost
+	defer func() { us.uploadMethod = method }()
+	bytesUploaded, offset, response, err = us.uploadChunkImpl(us.client.BaseURL.String(), r, headers)
+	if err == nil && response != nil {
+		us.Upload.Location = response.Header.Get("Location")
+		us.Upload.Metadata = meta
+		us.Upload.Extra = extraHeaders(response.Header)
+	}
+	return
+}
+
+// autoSync sets the stream offset to the server one after the offsets conflict, and moves the source position
+// accordingly. pos is the source position, which corresponds to the current stream offset.
+func (us *UploadStream) autoSync(cause error, seeker io.Seeker, pos int64) error {
+	serverOffset := int64(OffsetUnknown)
+	var oe OffsetsError
+	if errors.As(cause, &oe) {
+		serverOffset = oe.RemoteOffset
+	}
+	if serverOffset == OffsetUnknown {
+		f := Upload{}
+		response, err := us.getUpload(&f)
+		us.LastResponse = response
+		us.lastRequestTime = time.Now()
+		if err != nil {
+			return err
+		}
+		serverOffset = f.RemoteOffset
+	}
+
+	newPos := pos + serverOffset - us.Upload.RemoteOffset
+	if newPos < 0 {
+		return cause // The server offset is before the beginning of source
+	}
+	if _, err := seeker.Seek(newPos, io.SeekStart); err != nil {
+		return err
+	}
+	us.Upload.RemoteOffset = serverOffset
+	if us.dirtyBuffer == nil {
+		return nil // The data is sent with no buffering
+	}
+	return us.setupDirtyBuffer() // The chunk will be read again from the new position
+}
+
+func (us *UploadStream) preflightIfIdle() error {
+	if us.PreflightAfter > 0 && !us.lastRequestTime.IsZero() && time.Since(us.lastRequestTime) > us.PreflightAfter {
+		_, err := us.Preflight()
+		return err
+	}
+	return nil
+}
+
+// setupDirtyBuffer sets up the dirty buffer of ChunkSize. The buffer is kept by stream between calls, otherwise it is
+// taken from the client pool, reserving the memory in client MemoryBudget if set
+func (us *UploadStream) setupDirtyBuffer() error {
+	us.adjustChunkSize()
+	if us.held.buf != nil && int64(len(*us.held.buf)) != us.ChunkSize {
+		us.releaseDirtyBuffer()
+	}
+	if us.ChunkSize == NoChunked {
 		us.dirtyBuffer = nil
+		return nil
+	}
+	if us.held.buf == nil {
+		if mb := us.client.MemoryBudget; mb != nil {
+			ctx := us.ctx
+			if ctx == nil {
+				ctx = context.Background()
+			}
+			if err := mb.acquire(ctx, us.ChunkSize); err != nil {
+				return err
+			}
+			us.held.budget = mb
+		}
+		us.held.buf = us.client.buffers().get(int(us.ChunkSize))
+	}
+	us.dirtyBuffer = *us.held.buf
+	return nil
+}
+
+// cleanDirtyBuffer marks stream as "clean". The buffer is kept for the next calls, unless its memory is reserved in
+// MemoryBudget, which other streams may wait for
+func (us *UploadStream) cleanDirtyBuffer() {
+	us.dirtyBuffer = nil
+	if us.held.budget != nil {
+		us.releaseDirtyBuffer()
+	}
+}
+
+// releaseDirtyBuffer drops the dirty buffer and returns its memory to the pool and to the budget
+func (us *UploadStream) releaseDirtyBuffer() {
+	us.dirtyBuffer = nil
+	if us.held.buf == nil {
+		return
+	}
+	if us.held.budget != nil {
+		us.held.budget.release(int64(len(*us.held.buf)))
+	}
+	us.client.buffers().put(us.held.buf)
+	us.held = heldBuffer{}
+}
+
+// heldBuffer is the chunk buffer held by UploadStream
+type heldBuffer struct {
+	buf    *[]byte
+	budget *MemoryBudget // Budget the buffer memory is reserved in, if any
+}
+
+// adjustChunkSize clamps ChunkSize to the server limit and aligns it to ChunkAlign
+func (us *UploadStream) adjustChunkSize() {
+	if us.ChunkSize == NoChunked {
+		return
+	}
+	if caps := us.client.CurrentCapabilities(); caps != nil && caps.MaxSize > 0 && us.ChunkSize > caps.MaxSize {
+		us.ChunkSize = caps.MaxSize
 	}
-	if len(us.dirtyBuffer) == 0 && us.ChunkSize != NoChunked {
-		us.dirtyBuffer = make([]byte, us.ChunkSize)
+	if us.ChunkAlign > 0 {
+		if us.ChunkSize < us.ChunkAlign {
+			us.ChunkSize = us.ChunkAlign
+		} else {
+			us.ChunkSize -= us.ChunkSize % us.ChunkAlign
+		}
 	}
 }
 
@@ -289,33 +1390,55 @@ func (us *UploadStream) uploadChunkImpl(requestURL string, data io.Reader, extra
 	}
 
 	bytesToUpload := unknownSize
+	sections, zeroCopy := data.(*sectionSource)
 	if chunking {
 		if int64(len(us.dirtyBuffer)) > us.ChunkSize {
 			panic("programming error: dirty buffer is larger than ChunkSize")
 		}
 		bytesToUpload = int64(len(us.dirtyBuffer))
+		if zeroCopy {
+			bytesToUpload = us.ChunkSize
+		}
 		remoteBytesLeft := us.Upload.RemoteSize - offset
-		if bytesToUpload > remoteBytesLeft { // Buffer size is larger than the space left in the remote upload
+		if us.Upload.RemoteSize != SizeUnknown && bytesToUpload > remoteBytesLeft { // Buffer size is larger than the space left in the remote upload
 			bytesToUpload = remoteBytesLeft
-			us.dirtyBuffer = us.dirtyBuffer[:bytesToUpload]
+			if !zeroCopy {
+				us.dirtyBuffer = us.dirtyBuffer[:bytesToUpload]
+			}
 		}
 		if bytesToUpload == 0 {
 			return
 		}
+	} else if us.checksumHash == nil {
+		// Trailers can't be sent with known Content-Length, so set it only without checksum
+		bytesToUpload = readerLen(data)
 	}
 
 	// Perform actions that can generate an error before invoking a reader
 	if us.checksumHash != nil && !chunking {
-		if err = us.client.ensureExtension("checksum-trailer"); err != nil {
+		if err = us.client.ensureExtension(ExtensionChecksumTrailer); err != nil {
 			return
 		}
 	}
 	var req *http.Request
-	if req, err = us.client.GetRequest(us.uploadMethod, requestURL, nil, us.client, us.client.client); err != nil {
+	method := us.uploadMethod
+	if method == http.MethodPatch && us.UploadMethod != "" {
+		method = us.UploadMethod
+	}
+	if req, err = us.client.GetRequest(method, requestURL, nil, us.client, us.client.client); err != nil {
 		return
 	}
+	headers := headerSetter{h: req.Header}
 
-	if chunking {
+	var precalculated []byte
+	if zeroCopy && chunking {
+		sr := sections.next(bytesToUpload)
+		if bytesToUpload = sr.Size(); bytesToUpload == 0 { // Reader is empty
+			return
+		}
+		data = sr
+	} else if chunking {
+		hc, _ := data.(*hashedChunk)
 		t, e := io.ReadAtLeast(data, us.dirtyBuffer, int(bytesToUpload))
 		switch {
 		case errors.Is(e, io.EOF): // Reader is empty
@@ -329,30 +1452,65 @@ func (us *UploadStream) uploadChunkImpl(requestURL string, data io.Reader, extra
 				return
 			}
 		}
-		data = bytes.NewReader(us.dirtyBuffer)
+		if hc != nil && hc.Len() == 0 && len(hc.data) == len(us.dirtyBuffer) {
+			precalculated = hc.sum // The chunk has been hashed by pipeline
+		}
+		body := newBufferReader(us.dirtyBuffer)
+		defer body.detach() // The buffer may go back to the pool after return
+		data = body
+		us.dirtyOffset = offset
 	}
 
 	if us.checksumHash != nil {
 		us.checksumHash.Reset()
 		if chunking {
-			us.checksumHash.Write(us.dirtyBuffer)
-			sum := us.checksumHash.Sum(make([]byte, 0))
-			req.Header.Set("Upload-Checksum", fmt.Sprintf("%s %s", us.rawChecksumHashName, base64.StdEncoding.EncodeToString(sum)))
+			sum := precalculated
+			if sum == nil {
+				us.checksumHash.Write(us.dirtyBuffer)
+				us.checksumSum = us.checksumHash.Sum(us.checksumSum[:0])
+				sum = us.checksumSum
+			}
+			headers.set("Upload-Checksum", formatChecksum(us.rawChecksumHashName, sum))
+			if us.FullChecksumHeader != "" && us.Upload.RemoteSize != SizeUnknown && offset+bytesToUpload == us.Upload.RemoteSize {
+				if v := us.fullChecksum(offset, us.dirtyBuffer); v != "" {
+					req.Header.Set(us.FullChecksumHeader, v)
+				}
+			}
 		} else {
 			trailers := map[string]io.Reader{"Upload-Checksum": checksum.NewHashBase64ReadWriter(us.checksumHash, us.rawChecksumHashName+" ")}
 			data = checksum.NewDeferTrailerReader(io.TeeReader(data, us.checksumHash), trailers, req)
 		}
 	}
 
-	req.Body = io.NopCloser(data)
-	if bytesToUpload != unknownSize {
-		req.ContentLength = bytesToUpload
+	contentLength := bytesToUpload
+	gzipped := chunking && us.GzipChunks && bytesToUpload > 0
+	if gzipped {
+		var compressed []byte
+		if compressed, err = gzipData(us.dirtyBuffer); err != nil {
+			return
+		}
+		data = bytes.NewReader(compressed)
+		contentLength = int64(len(compressed))
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+
+	if limiters := us.rateLimiters(); len(limiters) > 0 {
+		data = &rateLimitedReader{Rd: data, Limiters: limiters, Ctx: us.ctx}
+	}
+	sent := &requestBody{Rd: data, Stream: us}
+	req.Body = sent
+	if contentLength != unknownSize {
+		req.ContentLength = contentLength
 	}
-	req.Header.Set("Content-Type", "application/offset+octet-stream")
-	req.Header.Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	if bytesToUpload == 0 {
+		req.Body = http.NoBody // Otherwise, the zero ContentLength is treated as unknown
+	}
+	headers.set("Content-Type", "application/offset+octet-stream")
+	headers.set("Upload-Offset", strconv.FormatInt(offset, 10))
 
-	if us.SetUploadSize && offset == 0 {
-		req.Header.Set("Upload-Length", strconv.FormatInt(us.Upload.RemoteSize, 10))
+	sendSize := us.SetUploadSize && us.Upload.RemoteSize != SizeUnknown && (offset == 0 || us.Upload.DeferredLength)
+	if sendSize {
+		headers.set("Upload-Length", strconv.FormatInt(us.Upload.RemoteSize, 10))
 	}
 
 	if len(extraHeaders) > 0 {
@@ -365,72 +1523,179 @@ func (us *UploadStream) uploadChunkImpl(requestURL string, data io.Reader, extra
 		}
 	}
 
-	if us.ctx != nil {
-		req = req.WithContext(us.ctx)
+	ctx, cancel := us.requestContext(us.ctx)
+	defer cancel() // After the response has been closed
+	if ctx != nil {
+		req = req.WithContext(ctx)
 	}
-	if response, err = us.client.tusRequest(us.ctx, req); err != nil {
+	started := time.Now()
+	defer func() {
+		us.stats.addRequest(time.Since(started), bytesUploaded)
+		if us.Diagnostics != nil {
+			loc := us.Upload.Location
+			if loc == "" && response != nil {
+				loc = response.Header.Get("Location")
+			}
+			us.Diagnostics.Record(loc, newExchange(started, req, response, err))
+		}
+	}()
+	if response, err = us.client.tusRequest(ctx, req); err != nil {
+		err = us.timeoutError(us.ctx, ctx, err)
 		return
 	}
-	defer response.Body.Close()
+	defer us.client.closeResponse(response)
 
 	switch response.StatusCode {
 	case http.StatusCreated: // For "Creation With Upload" feature
 		if us.uploadMethod != http.MethodPost {
-			err = ErrUnexpectedResponse
+			err = us.client.withResponse(ErrUnexpectedResponse, response)
 			return
 		}
 		fallthrough
-	case http.StatusNoContent:
-		if offset, err = strconv.ParseInt(response.Header.Get("Upload-Offset"), 10, 64); err != nil {
-			err = ErrProtocol.WithErr(fmt.Errorf("cannot parse Upload-Offset header %q: %w", response.Header.Get("Upload-Offset"), err))
+	case http.StatusNoContent, http.StatusOK:
+		if response.StatusCode == http.StatusOK && (!us.client.Lenient || us.uploadMethod != http.MethodPatch) {
+			err = us.client.withResponse(ErrUnexpectedResponse, response)
+			return
+		}
+		if response.StatusCode == http.StatusOK {
+			us.client.recordDeviation(response, "response status code 200 instead of 204 on PATCH")
+		}
+		if err = us.client.checkResumable(response); err != nil {
 			return
 		}
+		uploadOffset := response.Header.Get("Upload-Offset")
+		if uploadOffset == "" && us.client.Lenient && us.uploadMethod == http.MethodPost {
+			us.client.recordDeviation(response, "lack of Upload-Offset header in creation response")
+			accepted := sent.BytesRead
+			if gzipped {
+				accepted = bytesToUpload
+			}
+			uploadOffset = strconv.FormatInt(us.Upload.RemoteOffset+accepted, 10) // Assume all data has been accepted
+		}
+		if offset, err = strconv.ParseInt(uploadOffset, 10, 64); err != nil {
+			err = us.client.protocolError(response, fmt.Errorf("cannot parse Upload-Offset header %q: %w", uploadOffset, err))
+			return
+		}
+		if err = us.checkOffsetInvariants(bytesToUpload, offset); err != nil {
+			return
+		}
+		if sendSize {
+			us.Upload.DeferredLength = false
+		}
 		bytesUploaded = offset - us.Upload.RemoteOffset
 		if bytesUploaded < 0 {
 			bytesUploaded = 0
 		}
+		if bytesUploaded > 0 {
+			var acked []byte // Unknown in non-chunked mode
+			if chunking {
+				acked = us.dirtyBuffer[:min(bytesUploaded, int64(len(us.dirtyBuffer)))]
+			}
+			us.updateDigest(us.Upload.RemoteOffset, acked)
+		}
 		if v := response.Header.Get("Upload-Expires"); v != "" {
 			var t time.Time
 			if t, err = time.Parse(time.RFC1123, v); err != nil {
-				err = ErrProtocol.WithErr(fmt.Errorf("cannot parse Upload-Expires RFC1123 header %q: %w", v, err))
+				err = us.client.protocolError(response, fmt.Errorf("cannot parse Upload-Expires RFC1123 header %q: %w", v, err))
 				return
 			}
 			us.Upload.UploadExpired = &t
 		}
 	case http.StatusConflict:
-		err = ErrOffsetsNotSynced.WithResponse(response)
+		oe := OffsetsError{LocalOffset: us.Upload.RemoteOffset, RemoteOffset: OffsetUnknown}
+		if v, e := strconv.ParseInt(response.Header.Get("Upload-Offset"), 10, 64); e == nil {
+			oe.RemoteOffset = v
+		}
+		oe.details = us.client.errorDetails(response)
+		err = ErrOffsetsNotSynced.WithErr(oe)
 	case http.StatusForbidden:
-		err = ErrCannotUpload.WithResponse(response)
+		err = us.client.withResponse(ErrCannotUpload, response)
+		if response.Header.Get("Upload-Offset") == strconv.FormatInt(us.Upload.RemoteSize, 10) {
+			err = ErrUploadAlreadyComplete.WithErr(err) // Server refuses the data because the upload is full
+		}
 	case http.StatusNotFound, http.StatusGone:
-		err = ErrUploadDoesNotExist.WithResponse(response)
+		err = us.client.notExistError(us.Upload, response)
 	case http.StatusRequestEntityTooLarge:
-		err = ErrUploadTooLarge.WithResponse(response)
+		err = us.client.withResponse(ErrUploadTooLarge, response)
 	case 460: // Non-standard HTTP code '460 Checksum Mismatch'
 		if us.checksumHash != nil {
-			err = ErrChecksumMismatch.WithResponse(response)
+			err = us.client.withResponse(ErrChecksumMismatch, response)
 			return
 		}
 		fallthrough
 	default:
-		err = ErrUnexpectedResponse
+		err = us.client.withResponse(ErrUnexpectedResponse, response)
+	}
+	return
+}
+
+// gzipWriterPool keeps the gzip writers for GzipChunks, since they are expensive to allocate
+var gzipWriterPool = sync.Pool{New: func() any { return gzip.NewWriter(nil) }}
+
+// gzipData returns the data compressed by gzip
+func gzipData(data []byte) ([]byte, error) {
+	buf := bytes.NewBuffer(make([]byte, 0, len(data)/2))
+	w := gzipWriterPool.Get().(*gzip.Writer)
+	defer gzipWriterPool.Put(w)
+	w.Reset(buf)
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// readerLen returns the data size of readers with size known beforehand, or -1 otherwise. This is similar to
+// what http.NewRequest does to determine a body length.
+func readerLen(r io.Reader) int64 {
+	switch v := r.(type) {
+	case interface{ Len() int }:
+		return int64(v.Len())
+	case *exactReader:
+		return v.N
+	}
+	return -1
+}
+
+// exactReader reads exactly N bytes from R. Unlike io.LimitedReader, it returns io.ErrUnexpectedEOF if R ends earlier,
+// so N can be sent as a request body length.
+type exactReader struct {
+	R io.Reader
+	N int64
+}
+
+func (e *exactReader) Read(p []byte) (n int, err error) {
+	if e.N <= 0 {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > e.N {
+		p = p[:e.N]
+	}
+	n, err = e.R.Read(p)
+	e.N -= int64(n)
+	if errors.Is(err, io.EOF) && e.N > 0 {
+		err = io.ErrUnexpectedEOF
 	}
 	return
 }
 
 func (us *UploadStream) validate() error {
-	if us.Upload.RemoteSize == SizeUnknown {
+	creating := us.CreateOnWrite && us.Upload.Location == ""
+	if us.Upload.RemoteSize == SizeUnknown && !us.Upload.DeferredLength && !creating {
 		panic("upload must have size before start the uploading")
 	}
-	if us.Upload.RemoteSize < 0 {
+	if us.Upload.RemoteSize < 0 && us.Upload.RemoteSize != SizeUnknown {
 		panic(fmt.Sprintf("upload size is negative %d", us.Upload.RemoteSize))
 	}
 	if us.SetUploadSize {
-		if err := us.client.ensureExtension("creation-defer-length"); err != nil {
+		if err := us.client.ensureExtension(ExtensionCreationDeferLength); err != nil {
 			return err
 		}
 	}
 	if us.checksumHash != nil {
-		if err := us.client.ensureExtension("checksum"); err != nil {
+		if err := us.client.ensureExtension(ExtensionChecksum); err != nil {
 			return err
 		}
 	}
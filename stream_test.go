@@ -2,14 +2,24 @@ package tusgo
 
 import (
 	"bytes"
+	"compress/gzip"
 	"context"
 	"crypto/sha1"
 	"encoding/base64"
+	"errors"
+	"fmt"
 	"io"
 	"math/rand"
+	"net"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
+	"os"
+	"path/filepath"
 	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
 	"time"
 
 	"github.com/vitorsalgado/mocha/v3/expect"
@@ -78,9 +88,9 @@ var _ = Describe("UploadStream", func() {
 		srvMock.Start()
 		testURL, _ = url.Parse(srvMock.URL())
 		testClient = NewClient(http.DefaultClient, testURL)
-		testClient.Capabilities = &ServerCapabilities{
+		testClient.AssumeCapabilities(ServerCapabilities{
 			ProtocolVersions: []string{"1.0.0"},
-		}
+		})
 		emptyHeaders = []string{"Upload-Concat", "Upload-Defer-Length", "Upload-Length", "Upload-Metadata", "Upload-Checksum"}
 	})
 	AfterEach(func() {
@@ -98,6 +108,9 @@ var _ = Describe("UploadStream", func() {
 
 				Ω(*s).Should(Equal(UploadStream{
 					ChunkSize:           2 * 1024 * 1024,
+					MaxAttempts:         10,
+					RetryDelay:          5 * time.Second,
+					NetworkRetries:      3,
 					LastResponse:        nil,
 					SetUploadSize:       false,
 					checksumHash:        nil,
@@ -107,6 +120,7 @@ var _ = Describe("UploadStream", func() {
 					dirtyBuffer:         nil,
 					uploadMethod:        http.MethodPatch,
 					ctx:                 testClient.ctx,
+					pause:               &pauseState{},
 				}))
 				Ω(s.Upload).Should(BeIdenticalTo(u))
 			})
@@ -167,6 +181,9 @@ var _ = Describe("UploadStream", func() {
 					u := Upload{Location: "/foo/bar", RemoteSize: 1024}
 					s := NewUploadStream(testClient, &u)
 					s.ChunkSize = 256
+					var progress Progress
+					s.OnProgress = func(p Progress) { progress = p }
+					progressCh := s.ProgressChan(8)
 					data, _ := io.ReadAll(io.LimitReader(rand.New(rand.NewSource(time.Now().UnixNano())), 1024))
 					rd := bytes.NewReader(data)
 
@@ -174,6 +191,7 @@ var _ = Describe("UploadStream", func() {
 					copied, err := s.ReadFrom(rd)
 					Ω(err).Should(MatchError(ErrUnexpectedResponse))
 					Ω(copied).Should(BeEquivalentTo(768))
+					Ω(progress).Should(Equal(Progress{BytesSent: 768, BytesAcked: 512, Total: 1024}))
 					Ω(s.LastResponse.StatusCode).Should(Equal(http.StatusInternalServerError))
 					Ω(s.Dirty()).Should(BeTrue())
 					Ω(u).Should(Equal(Upload{Location: "/foo/bar", RemoteSize: 1024, RemoteOffset: 512}))
@@ -185,6 +203,54 @@ var _ = Describe("UploadStream", func() {
 					Ω(u).Should(Equal(Upload{Location: "/foo/bar", RemoteSize: 1024, RemoteOffset: 1024}))
 
 					Ω(data).Should(Equal(up.buf.Bytes()))
+					stats := s.Stats()
+					Ω(progress).Should(Equal(Progress{BytesSent: 1280, BytesAcked: 1024, Total: 1024}))
+					Ω(stats.BytesUploaded).Should(BeEquivalentTo(1024))
+					Ω(stats.BytesSent).Should(BeEquivalentTo(1280))
+					Ω(stats.Retries).Should(Equal(1))
+					Ω(stats.BytesRetransmitted).Should(BeEquivalentTo(256))
+					Ω(stats.Requests).Should(Equal(5))
+					Ω(stats.RetransmissionRatio()).Should(Equal(0.2))
+					Ω(stats.Stalls).Should(Equal(1))
+					Ω(stats.Duration).Should(BeNumerically(">", 0))
+					Ω(stats.PeakThroughput).Should(BeNumerically(">=", stats.AverageThroughput()))
+
+					var events []ChunkProgress
+					for e := range progressCh {
+						Ω(e.ChunkSize).Should(BeEquivalentTo(256))
+						Ω(e.Duration).Should(BeNumerically(">", 0))
+						Ω(e.BytesAcked).Should(Equal(e.Offset))
+						events = append(events, e)
+					}
+					Ω(events).Should(HaveLen(4))
+					Ω([]int64{events[0].Offset, events[1].Offset, events[2].Offset, events[3].Offset}).Should(Equal([]int64{256, 512, 768, 1024}))
+					Ω([]int{events[0].Attempt, events[1].Attempt, events[2].Attempt, events[3].Attempt}).Should(Equal([]int{1, 1, 2, 1}))
+				})
+			})
+			When("ReadFrom, error in the middle, then Close", func() {
+				It("should upload the dirty buffer", func() {
+					replies := []*reply.StdReply{
+						tReply(reply.NoContent()), reply.InternalServerError(), tReply(reply.NoContent()),
+					}
+					up := mockTusUploader{replies: replies, buf: bytes.NewBuffer(make([]byte, 0))}
+					srvMock.AddMocks(up.makeRequest(http.MethodPatch, "/foo/bar", emptyHeaders).ReplyFunction(up.handler()))
+
+					u := Upload{Location: "/foo/bar", RemoteSize: 1024}
+					s := NewUploadStream(testClient, &u)
+					s.ChunkSize = 256
+					data, _ := io.ReadAll(io.LimitReader(rand.New(rand.NewSource(time.Now().UnixNano())), 512))
+
+					var wc io.WriteCloser = s
+					_, err := s.ReadFrom(bytes.NewReader(data))
+					Ω(err).Should(MatchError(ErrUnexpectedResponse))
+					Ω(s.Dirty()).Should(BeTrue())
+
+					Ω(wc.Close()).Should(Succeed())
+					Ω(s.Dirty()).Should(BeFalse())
+					Ω(u.RemoteOffset).Should(BeEquivalentTo(512))
+					Ω(data).Should(Equal(up.buf.Bytes()))
+					Ω(s.Stats().Retries).Should(Equal(1))
+					Ω(s.Flush()).Should(Succeed()) // Nothing to flush
 				})
 			})
 			When("ReadFrom, error at the end, data is not aligned", func() {
@@ -319,7 +385,7 @@ var _ = Describe("UploadStream", func() {
 		)
 		DescribeTable("upload data with defer length",
 			func(copyCb func(s *UploadStream, data []byte) (int64, error)) {
-				testClient.Capabilities.Extensions = append(testClient.Capabilities.Extensions, "creation-defer-length")
+				assumeExtensions(testClient, "creation-defer-length")
 				replies := []*reply.StdReply{
 					tReply(reply.NoContent()), tReply(reply.NoContent()), tReply(reply.NoContent()), tReply(reply.NoContent()),
 				}
@@ -347,10 +413,55 @@ var _ = Describe("UploadStream", func() {
 			Entry("ReadFrom", func(s *UploadStream, data []byte) (int64, error) { return s.ReadFrom(bytes.NewReader(data)) }),
 			Entry("Write", func(s *UploadStream, data []byte) (int64, error) { n, e := s.Write(data); return int64(n), e }),
 		)
+		When("resume upload with deferred length", func() {
+			It("should send the size on the first request and clear the flag", func() {
+				assumeExtensions(testClient, "creation-defer-length")
+				replies := []*reply.StdReply{tReply(reply.NoContent()), tReply(reply.NoContent()), tReply(reply.NoContent())}
+				data, _ := io.ReadAll(io.LimitReader(rand.New(rand.NewSource(time.Now().UnixNano())), 1024))
+				up := mockTusUploader{replies: replies, buf: bytes.NewBuffer(append([]byte(nil), data[:256]...))}
+				srvMock.AddMocks(up.makeRequest(http.MethodPatch, "/foo/bar", nil).ReplyFunction(up.handler()))
+
+				u := Upload{Location: "/foo/bar", RemoteSize: 1024, RemoteOffset: 256, DeferredLength: true}
+				s := NewUploadStream(testClient, &u)
+				s.ChunkSize = 256
+				s.SetUploadSize = true
+
+				Ω(s.Write(data[256:])).Should(Equal(768))
+				Ω(u).Should(Equal(Upload{Location: "/foo/bar", RemoteSize: 1024, RemoteOffset: 1024}))
+				Ω(data).Should(Equal(up.buf.Bytes()))
+				Ω(up.requests[0].Header.Get("Upload-Length")).Should(Equal("1024"))
+				for _, v := range up.requests[1:] {
+					Ω(v.Header.Get("Upload-Length")).Should(BeEmpty())
+				}
+			})
+		})
+		When("upload size becomes known in the middle of transfer", func() {
+			It("should send the declared size on the next request", func() {
+				assumeExtensions(testClient, "creation-defer-length")
+				replies := []*reply.StdReply{tReply(reply.NoContent()), tReply(reply.NoContent()), tReply(reply.NoContent())}
+				data, _ := io.ReadAll(io.LimitReader(rand.New(rand.NewSource(time.Now().UnixNano())), 768))
+				up := mockTusUploader{replies: replies, buf: bytes.NewBuffer(make([]byte, 0))}
+				srvMock.AddMocks(up.makeRequest(http.MethodPatch, "/foo/bar", nil).ReplyFunction(up.handler()))
+
+				u := Upload{Location: "/foo/bar", RemoteSize: SizeUnknown, DeferredLength: true}
+				s := NewUploadStream(testClient, &u)
+				s.ChunkSize = 256
+
+				Ω(s.Write(data[:512])).Should(Equal(512))
+				Ω(s.DeclareSize(500)).ShouldNot(Succeed())
+				Ω(s.DeclareSize(768)).Should(Succeed())
+				Ω(s.Write(data[512:])).Should(Equal(256))
+				Ω(u).Should(Equal(Upload{Location: "/foo/bar", RemoteSize: 768, RemoteOffset: 768}))
+				Ω(data).Should(Equal(up.buf.Bytes()))
+				Ω(up.requests[0].Header.Get("Upload-Length")).Should(BeEmpty())
+				Ω(up.requests[1].Header.Get("Upload-Length")).Should(BeEmpty())
+				Ω(up.requests[2].Header.Get("Upload-Length")).Should(Equal("768"))
+			})
+		})
 		Context("upload data by chunks with checksum", func() {
 			DescribeTable("should set checksum in request header",
 				func(copyCb func(s *UploadStream, data []byte) (int64, error)) {
-					testClient.Capabilities.Extensions = append(testClient.Capabilities.Extensions, "checksum")
+					assumeExtensions(testClient, "checksum")
 					replies := []*reply.StdReply{
 						tReply(reply.NoContent()), tReply(reply.NoContent()), tReply(reply.NoContent()), tReply(reply.NoContent()),
 					}
@@ -373,15 +484,176 @@ var _ = Describe("UploadStream", func() {
 						b64sum := base64.StdEncoding.EncodeToString(sum[:])
 						Ω(r.Header.Get("Upload-Checksum")).Should(Equal("sha1 " + b64sum))
 					}
+					sum := sha1.Sum(data)
+					Ω(s.Digest()).Should(Equal(sum[:]))
 				},
 				Entry("ReadFrom", func(s *UploadStream, data []byte) (int64, error) { return s.ReadFrom(bytes.NewReader(data)) }),
 				Entry("Write", func(s *UploadStream, data []byte) (int64, error) { n, e := s.Write(data); return int64(n), e }),
+				Entry("ReadFrom with PipelineHashing", func(s *UploadStream, data []byte) (int64, error) {
+					s.PipelineHashing = true
+					return s.ReadFrom(bytes.NewReader(data))
+				}),
+				Entry("Write with PipelineHashing", func(s *UploadStream, data []byte) (int64, error) {
+					s.PipelineHashing = true
+					n, e := s.Write(data)
+					return int64(n), e
+				}),
 			)
+			It("should move source back to the first byte not uploaded if PipelineHashing is set", func() {
+				assumeExtensions(testClient, "checksum")
+				replies := []*reply.StdReply{
+					tReply(reply.NoContent()), tReply(reply.Status(460)), tReply(reply.NoContent()), tReply(reply.NoContent()),
+				}
+				up := mockTusUploader{replies: replies, buf: bytes.NewBuffer(make([]byte, 0))}
+				srvMock.AddMocks(up.makeRequest(http.MethodPatch, "/foo/bar", nil).ReplyFunction(up.handler()))
+
+				u := Upload{Location: "/foo/bar", RemoteSize: 768}
+				s := NewUploadStream(testClient, &u).WithChecksumAlgorithm("sha1")
+				s.ChunkSize = 256
+				s.PipelineHashing = true
+				data, _ := io.ReadAll(io.LimitReader(rand.New(rand.NewSource(time.Now().UnixNano())), 768))
+				rd := bytes.NewReader(data)
+
+				n, err := s.ReadFrom(rd)
+				Ω(err).Should(MatchError(ErrChecksumMismatch))
+				Ω(n).Should(BeEquivalentTo(512))
+				Ω(rd.Len()).Should(Equal(256))
+				Ω(s.ReadFrom(rd)).Should(BeEquivalentTo(256))
+				Ω(up.buf.Bytes()).Should(Equal(data))
+				for i, r := range up.requests {
+					off, _ := strconv.Atoi(r.Header.Get("Upload-Offset"))
+					sum := sha1.Sum(data[off : off+256])
+					Ω(r.Header.Get("Upload-Checksum")).Should(Equal("sha1 "+base64.StdEncoding.EncodeToString(sum[:])), "request %d", i)
+				}
+			})
+			It("should recompute checksum for the chunk retried from dirty buffer", func() {
+				assumeExtensions(testClient, "checksum")
+				replies := []*reply.StdReply{
+					tReply(reply.NoContent()), tReply(reply.Status(460)), tReply(reply.NoContent()), tReply(reply.NoContent()),
+				}
+				up := mockTusUploader{replies: replies, buf: bytes.NewBuffer(make([]byte, 0))}
+				srvMock.AddMocks(up.makeRequest(http.MethodPatch, "/foo/bar", nil).ReplyFunction(up.handler()))
+
+				u := Upload{Location: "/foo/bar", RemoteSize: 768}
+				s := NewUploadStream(testClient, &u).WithChecksumAlgorithm("sha1")
+				s.ChunkSize = 256
+				data, _ := io.ReadAll(io.LimitReader(rand.New(rand.NewSource(time.Now().UnixNano())), 768))
+				rd := bytes.NewReader(data)
+
+				_, err := s.ReadFrom(rd)
+				Ω(err).Should(MatchError(ErrChecksumMismatch))
+				Ω(s.ReadFrom(rd)).Should(BeEquivalentTo(256))
+				Ω(up.buf.Bytes()).Should(Equal(data))
+				sum := sha1.Sum(data[256:512])
+				Ω(up.requests[1].Header.Get("Upload-Checksum")).Should(Equal("sha1 " + base64.StdEncoding.EncodeToString(sum[:])))
+				Ω(up.requests[2].Header.Get("Upload-Checksum")).Should(Equal(up.requests[1].Header.Get("Upload-Checksum")))
+				sum = sha1.Sum(data)
+				Ω(s.Digest()).Should(Equal(sum[:]))
+			})
+			It("should send the whole upload checksum on the final request", func() {
+				assumeExtensions(testClient, "checksum")
+				replies := []*reply.StdReply{
+					tReply(reply.NoContent()), tReply(reply.NoContent()), tReply(reply.Status(460)), tReply(reply.NoContent()),
+				}
+				up := mockTusUploader{replies: replies, buf: bytes.NewBuffer(make([]byte, 0))}
+				srvMock.AddMocks(up.makeRequest(http.MethodPatch, "/foo/bar", nil).ReplyFunction(up.handler()))
+
+				u := Upload{Location: "/foo/bar", RemoteSize: 768}
+				s := NewUploadStream(testClient, &u).WithChecksumAlgorithm("sha1")
+				s.ChunkSize = 256
+				s.FullChecksumHeader = "Upload-Checksum-Full"
+				data, _ := io.ReadAll(io.LimitReader(rand.New(rand.NewSource(time.Now().UnixNano())), 768))
+
+				_, err := s.Write(data)
+				Ω(err).Should(MatchError(ErrChecksumMismatch))
+				Ω(s.Write(data[512:])).Should(Equal(256))
+				sum := sha1.Sum(data)
+				expectSum := "sha1 " + base64.StdEncoding.EncodeToString(sum[:])
+				Ω(up.requests[0].Header.Get("Upload-Checksum-Full")).Should(BeEmpty())
+				Ω(up.requests[1].Header.Get("Upload-Checksum-Full")).Should(BeEmpty())
+				Ω(up.requests[2].Header.Get("Upload-Checksum-Full")).Should(Equal(expectSum))
+				Ω(up.requests[3].Header.Get("Upload-Checksum-Full")).Should(Equal(expectSum))
+			})
+			It("should upload only the unacknowledged part of dirty buffer after Sync", func() {
+				assumeExtensions(testClient, "checksum")
+				data, _ := io.ReadAll(io.LimitReader(rand.New(rand.NewSource(time.Now().UnixNano())), 512))
+				sum := sha1.Sum(data[128:256])
+				srvMock.AddMocks(
+					tRequest(http.MethodPatch, "/foo/bar", nil).Header("Upload-Offset", expect.ToEqual("0")).
+						Reply(tReply(reply.InternalServerError())),
+					tRequest(http.MethodHead, "/foo/bar", nil).
+						Reply(tReply(reply.OK()).Header("Upload-Offset", "128")),
+					tRequest(http.MethodPatch, "/foo/bar", nil).Header("Upload-Offset", expect.ToEqual("128")).
+						Header("Upload-Checksum", expect.ToEqual("sha1 "+base64.StdEncoding.EncodeToString(sum[:]))).
+						Body(expect.ToEqual(data[128:256])).
+						Reply(tReply(reply.NoContent()).Header("Upload-Offset", "256")),
+					tRequest(http.MethodPatch, "/foo/bar", nil).Header("Upload-Offset", expect.ToEqual("256")).
+						Body(expect.ToEqual(data[256:])).
+						Reply(tReply(reply.NoContent()).Header("Upload-Offset", "512")),
+				)
+
+				u := Upload{Location: "/foo/bar", RemoteSize: 512}
+				s := NewUploadStream(testClient, &u).WithChecksumAlgorithm("sha1")
+				s.ChunkSize = 256
+				rd := bytes.NewReader(data)
+
+				_, err := s.ReadFrom(rd)
+				Ω(err).Should(MatchError(ErrUnexpectedResponse))
+				Ω(s.Sync()).ShouldNot(BeNil())
+				Ω(s.ReadFrom(rd)).Should(BeEquivalentTo(256))
+				Ω(u.RemoteOffset).Should(BeEquivalentTo(512))
+				sum = sha1.Sum(data[128:])
+				Ω(s.Digest()).Should(Equal(sum[:]))
+			})
+			It("should not return digest if data has been uploaded not contiguously", func() {
+				replies := []*reply.StdReply{tReply(reply.NoContent()), tReply(reply.NoContent())}
+				up := mockTusUploader{replies: replies, buf: bytes.NewBuffer(make([]byte, 0))}
+				srvMock.AddMocks(up.makeRequest(http.MethodPatch, "/foo/bar", nil).ReplyFunction(up.handler()))
+				assumeExtensions(testClient, "checksum")
+				u := Upload{Location: "/foo/bar", RemoteSize: 1024}
+				s := NewUploadStream(testClient, &u).WithChecksumAlgorithm("sha1")
+				Ω(s.Digest()).Should(BeNil())
+
+				Ω(s.Write(make([]byte, 256))).Should(Equal(256))
+				Ω(s.Digest()).ShouldNot(BeNil())
+				_, _ = up.buf.Write(make([]byte, 256))
+				Ω(s.Seek(512, io.SeekStart)).Should(BeEquivalentTo(512))
+				Ω(s.Write(make([]byte, 256))).Should(Equal(256))
+				Ω(s.Digest()).Should(BeNil())
+			})
+			It("should continue digest from state after restart", func() {
+				replies := []*reply.StdReply{tReply(reply.NoContent()), tReply(reply.NoContent())}
+				up := mockTusUploader{replies: replies, buf: bytes.NewBuffer(make([]byte, 0))}
+				srvMock.AddMocks(up.makeRequest(http.MethodPatch, "/foo/bar", nil).ReplyFunction(up.handler()))
+				assumeExtensions(testClient, "checksum")
+				data, _ := io.ReadAll(io.LimitReader(rand.New(rand.NewSource(time.Now().UnixNano())), 512))
+
+				u := Upload{Location: "/foo/bar", RemoteSize: 512}
+				s := NewUploadStream(testClient, &u).WithChecksumAlgorithm("sha1")
+				Ω(s.Write(data[:256])).Should(Equal(256))
+				state, err := s.DigestState()
+				Ω(err).Should(Succeed())
+
+				s = NewUploadStream(testClient, &u).WithChecksumAlgorithm("sha1")
+				Ω(s.ResumeDigest(state)).Should(Succeed())
+				Ω(s.Write(data[256:])).Should(Equal(256))
+				sum := sha1.Sum(data)
+				Ω(s.Digest()).Should(Equal(sum[:]))
+			})
+			It("should not resume digest from state of another algorithm", func() {
+				u := Upload{Location: "/foo/bar", RemoteSize: 512}
+				state, err := NewUploadStream(testClient, &u).WithChecksumAlgorithm("md5").DigestState()
+				Ω(err).Should(Succeed())
+
+				s := NewUploadStream(testClient, &u).WithChecksumAlgorithm("sha1")
+				Ω(s.ResumeDigest(state)).ShouldNot(Succeed())
+				Ω(s.DigestState()).ShouldNot(BeNil())
+			})
 		})
 		Context("upload data no chunked with checksum", func() {
 			DescribeTable("should upload in one shot and set checksum in request trailer",
 				func(copyCb func(s *UploadStream, data []byte) (int64, error)) {
-					testClient.Capabilities.Extensions = append(testClient.Capabilities.Extensions, "checksum", "checksum-trailer")
+					assumeExtensions(testClient, "checksum", "checksum-trailer")
 					replies := []*reply.StdReply{tReply(reply.NoContent())}
 					up := mockTusUploader{replies: replies, buf: bytes.NewBuffer(make([]byte, 0))}
 					srvMock.AddMocks(up.makeRequest(http.MethodPatch, "/foo/bar", emptyHeaders).ReplyFunction(up.handler()))
@@ -407,7 +679,7 @@ var _ = Describe("UploadStream", func() {
 		Context("expired upload", func() {
 			DescribeTable("should set UploadExpired",
 				func(copyCb func(s *UploadStream, data []byte) (int64, error)) {
-					testClient.Capabilities.Extensions = append(testClient.Capabilities.Extensions, "expiration")
+					assumeExtensions(testClient, "expiration")
 					rpl := tReply(reply.NoContent()).Header("Upload-Expires", "Wed, 25 Jun 2014 16:00:00 GMT")
 					replies := []*reply.StdReply{rpl, rpl, rpl, rpl}
 					up := mockTusUploader{replies: replies, buf: bytes.NewBuffer(make([]byte, 0))}
@@ -449,6 +721,686 @@ var _ = Describe("UploadStream", func() {
 				Ω(s.Dirty()).Should(BeFalse())
 			})
 		})
+		Context("Preflight", func() {
+			It("should check the upload on server", func() {
+				eh := []string{"Upload-Concat", "Upload-Defer-Length", "Upload-Length", "Upload-Metadata", "Upload-Checksum", "Upload-Offset"}
+				srvMock.AddMocks(tRequest(http.MethodHead, "/foo/bar", eh).
+					Reply(tReply(reply.Status(http.StatusOK)).Header("Upload-Offset", "512")),
+				)
+				u := Upload{Location: "/foo/bar", RemoteSize: 1024, RemoteOffset: 512}
+				s := NewUploadStream(testClient, &u)
+				Ω(s.Preflight()).ShouldNot(BeNil())
+				Ω(u).Should(Equal(Upload{Location: "/foo/bar", RemoteSize: 1024, RemoteOffset: 512}))
+				Ω(s.LastResponse.StatusCode).Should(Equal(http.StatusOK))
+			})
+			It("should be made before the first chunk after the stream was idle", func() {
+				eh := []string{"Upload-Concat", "Upload-Defer-Length", "Upload-Length", "Upload-Metadata", "Upload-Checksum", "Upload-Offset"}
+				srvMock.AddMocks(tRequest(http.MethodHead, "/foo/bar", eh).
+					Reply(tReply(reply.Status(http.StatusOK)).Header("Upload-Offset", "0")),
+				)
+				replies := []*reply.StdReply{tReply(reply.NoContent()), tReply(reply.NoContent())}
+				up := mockTusUploader{replies: replies, buf: bytes.NewBuffer(make([]byte, 0))}
+				srvMock.AddMocks(up.makeRequest(http.MethodPatch, "/foo/bar", emptyHeaders).ReplyFunction(up.handler()))
+
+				u := Upload{Location: "/foo/bar", RemoteSize: 512}
+				s := NewUploadStream(testClient, &u)
+				s.ChunkSize = 256
+				s.PreflightAfter = time.Minute
+				s.lastRequestTime = time.Now().Add(-time.Hour)
+				data, _ := io.ReadAll(io.LimitReader(rand.New(rand.NewSource(time.Now().UnixNano())), 512))
+
+				Ω(s.Write(data)).Should(Equal(512))
+				Ω(data).Should(Equal(up.buf.Bytes()))
+			})
+		})
+		Context("KeepAlive", func() {
+			It("should send empty PATCH and update expiration", func() {
+				dt := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+				srvMock.AddMocks(tRequest(http.MethodPatch, "/foo/bar", []string{"Upload-Checksum", "Upload-Length"}).
+					Header("Upload-Offset", expect.ToEqual("512")).
+					Header("Content-Length", expect.ToEqual("0")).
+					Reply(tReply(reply.NoContent()).
+						Header("Upload-Offset", "512").
+						Header("Upload-Expires", dt.Format(time.RFC1123))),
+				)
+				u := Upload{Location: "/foo/bar", RemoteSize: 1024, RemoteOffset: 512}
+				s := NewUploadStream(testClient, &u)
+				s.ChunkSize = 256
+
+				Ω(s.KeepAlive()).ShouldNot(BeNil())
+				Ω(dt.Equal(*u.UploadExpired)).Should(BeTrue())
+				Ω(u.RemoteOffset).Should(BeEquivalentTo(512))
+				Ω(s.LastResponse.StatusCode).Should(Equal(http.StatusNoContent))
+				Ω(s.Stats()).Should(Equal(TransferStats{}))
+			})
+			It("should return error if offsets differ", func() {
+				srvMock.AddMocks(tRequest(http.MethodPatch, "/foo/bar", nil).
+					Reply(tReply(reply.NoContent()).Header("Upload-Offset", "768")),
+				)
+				u := Upload{Location: "/foo/bar", RemoteSize: 1024, RemoteOffset: 512}
+				s := NewUploadStream(testClient, &u)
+
+				_, err := s.KeepAlive()
+				Ω(err).Should(MatchError(ErrOffsetsNotSynced))
+			})
+		})
+		DescribeTable("ChunkSize adjustment",
+			func(chunkSize, chunkAlign, maxSize, expectChunkSize int64) {
+				modifyCapabilities(testClient, func(caps *ServerCapabilities) { caps.MaxSize = maxSize })
+				replies := []*reply.StdReply{tReply(reply.NoContent())}
+				up := mockTusUploader{replies: replies, buf: bytes.NewBuffer(make([]byte, 0))}
+				srvMock.AddMocks(up.makeRequest(http.MethodPatch, "/foo/bar", emptyHeaders).ReplyFunction(up.handler()))
+				u := Upload{Location: "/foo/bar", RemoteSize: 100}
+				s := NewUploadStream(testClient, &u)
+				s.ChunkSize = chunkSize
+				s.ChunkAlign = chunkAlign
+
+				Ω(s.Write(make([]byte, 100))).Should(Equal(100))
+				Ω(s.ChunkSize).Should(Equal(expectChunkSize))
+			},
+			Entry("no adjustment", int64(1000), int64(0), int64(0), int64(1000)),
+			Entry("align down", int64(1000), int64(256), int64(0), int64(768)),
+			Entry("align up", int64(100), int64(256), int64(0), int64(256)),
+			Entry("clamp to max size", int64(1000), int64(0), int64(600), int64(600)),
+			Entry("clamp to max size and align", int64(1000), int64(256), int64(600), int64(512)),
+		)
+		Context("Pause and Resume", func() {
+			It("should stop at chunk boundary and continue after resume", func() {
+				replies := []*reply.StdReply{
+					tReply(reply.NoContent()), tReply(reply.NoContent()), tReply(reply.NoContent()), tReply(reply.NoContent()),
+				}
+				up := mockTusUploader{replies: replies, buf: bytes.NewBuffer(make([]byte, 0))}
+				srvMock.AddMocks(up.makeRequest(http.MethodPatch, "/foo/bar", emptyHeaders).ReplyFunction(up.handler()))
+
+				u := Upload{Location: "/foo/bar", RemoteSize: 1024}
+				s := NewUploadStream(testClient, &u)
+				s.ChunkSize = 256
+				s.OnProgress = func(p Progress) {
+					if p.BytesAcked == 512 && p.BytesSent == 512 {
+						s.Pause()
+					}
+				}
+				progressCh := s.ProgressChan(4)
+				data, _ := io.ReadAll(io.LimitReader(rand.New(rand.NewSource(time.Now().UnixNano())), 1024))
+
+				done := make(chan struct{})
+				go func() {
+					defer GinkgoRecover()
+					defer close(done)
+					Ω(s.ReadFrom(bytes.NewReader(data))).Should(BeEquivalentTo(1024))
+				}()
+				Ω((<-progressCh).Offset).Should(BeEquivalentTo(256))
+				Ω((<-progressCh).Offset).Should(BeEquivalentTo(512))
+				Consistently(progressCh, 100*time.Millisecond).ShouldNot(Receive())
+				Ω(s.Paused()).Should(BeTrue())
+
+				s.Resume()
+				Ω(s.Paused()).Should(BeFalse())
+				Ω((<-progressCh).Offset).Should(BeEquivalentTo(768))
+				Ω((<-progressCh).Offset).Should(BeEquivalentTo(1024))
+				Eventually(done).Should(BeClosed())
+				Ω(data).Should(Equal(up.buf.Bytes()))
+			})
+			It("should return error if context is done while paused", func() {
+				ctx, cancel := context.WithCancel(context.Background())
+				u := Upload{Location: "/foo/bar", RemoteSize: 1024}
+				s := NewUploadStream(testClient, &u).WithContext(ctx)
+				s.Pause()
+				cancel()
+
+				n, err := s.Write(make([]byte, 256))
+				Ω(n).Should(Equal(0))
+				Ω(err).Should(MatchError(context.Canceled))
+			})
+		})
+		Context("ProgressChan", func() {
+			It("should not block on the channel nobody reads after context is done", func() {
+				replies := []*reply.StdReply{tReply(reply.NoContent()), tReply(reply.NoContent())}
+				up := mockTusUploader{replies: replies, buf: bytes.NewBuffer(make([]byte, 0))}
+				srvMock.AddMocks(up.makeRequest(http.MethodPatch, "/foo/bar", emptyHeaders).ReplyFunction(up.handler()))
+				ctx, cancel := context.WithCancel(context.Background())
+				u := Upload{Location: "/foo/bar", RemoteSize: 1024}
+				s := NewUploadStream(testClient, &u).WithContext(ctx)
+				s.ChunkSize = 256
+				progressCh := s.ProgressChan(0)
+
+				done := make(chan error, 1)
+				go func() {
+					_, err := s.Write(make([]byte, 1024))
+					done <- err
+				}()
+				Consistently(done, 100*time.Millisecond).ShouldNot(Receive())
+				cancel()
+				Eventually(done).Should(Receive(MatchError(context.Canceled)))
+				Ω(progressCh).Should(BeClosed())
+			})
+			It("should close the channel on non-transient error", func() {
+				replies := []*reply.StdReply{tReply(reply.NoContent()), tReply(reply.Status(http.StatusForbidden))}
+				up := mockTusUploader{replies: replies, buf: bytes.NewBuffer(make([]byte, 0))}
+				srvMock.AddMocks(up.makeRequest(http.MethodPatch, "/foo/bar", emptyHeaders).ReplyFunction(up.handler()))
+				u := Upload{Location: "/foo/bar", RemoteSize: 1024}
+				s := NewUploadStream(testClient, &u)
+				s.ChunkSize = 256
+				progressCh := s.ProgressChan(4)
+
+				_, err := s.Write(make([]byte, 1024))
+				Ω(err).Should(MatchError(ErrCannotUpload))
+				Ω((<-progressCh).Offset).Should(BeEquivalentTo(256))
+				Ω(progressCh).Should(BeClosed())
+			})
+		})
+		When("UploadMethod is set", func() {
+			It("should upload data with a given method", func() {
+				replies := []*reply.StdReply{tReply(reply.NoContent()), tReply(reply.NoContent())}
+				up := mockTusUploader{replies: replies, buf: bytes.NewBuffer(make([]byte, 0))}
+				srvMock.AddMocks(up.makeRequest(http.MethodPut, "/foo/bar", emptyHeaders).ReplyFunction(up.handler()))
+				data, _ := io.ReadAll(io.LimitReader(rand.New(rand.NewSource(time.Now().UnixNano())), 512))
+				u := Upload{Location: "/foo/bar", RemoteSize: 1024}
+				s := NewUploadStream(testClient, &u)
+				s.ChunkSize = 256
+				s.UploadMethod = http.MethodPut
+
+				Ω(s.Write(data)).Should(Equal(512))
+				Ω(up.buf.Bytes()).Should(Equal(data))
+				Ω(up.requests).Should(HaveEach(HaveField("Method", http.MethodPut)))
+			})
+		})
+		Context("CreateOnWrite", func() {
+			It("should create upload with the first chunk", func() {
+				assumeExtensions(testClient, "creation", "creation-with-upload")
+				data, _ := io.ReadAll(io.LimitReader(rand.New(rand.NewSource(time.Now().UnixNano())), 512))
+				srvMock.AddMocks(
+					tRequest(http.MethodPost, "/", []string{"Upload-Offset", "Upload-Concat"}).
+						Header("Upload-Length", expect.ToEqual("512")).
+						Header("Upload-Metadata", expect.ToEqual("key1 dmFsdWUx")).
+						Body(expect.ToEqual(data[:256])).
+						Reply(tReply(reply.Created()).Header("Location", "/foo/bar").Header("Upload-Offset", "256")),
+					tRequest(http.MethodPatch, "/foo/bar", nil).
+						Header("Upload-Offset", expect.ToEqual("256")).
+						Body(expect.ToEqual(data[256:])).
+						Reply(tReply(reply.NoContent()).Header("Upload-Offset", "512")),
+				)
+				u := Upload{RemoteSize: 512, Metadata: map[string]string{"key1": "value1"}}
+				s := NewUploadStream(testClient, &u)
+				s.ChunkSize = 256
+				s.CreateOnWrite = true
+
+				Ω(s.Write(data)).Should(Equal(512))
+				Ω(u).Should(Equal(Upload{
+					Location: "/foo/bar", RemoteSize: 512, RemoteOffset: 512, Metadata: map[string]string{"key1": "value1"},
+				}))
+			})
+			It("should create upload by separate request if creation-with-upload is not supported", func() {
+				assumeExtensions(testClient, "creation")
+				data, _ := io.ReadAll(io.LimitReader(rand.New(rand.NewSource(time.Now().UnixNano())), 512))
+				srvMock.AddMocks(
+					tRequest(http.MethodPost, "/", []string{"Upload-Offset"}).
+						Header("Upload-Length", expect.ToEqual("512")).
+						Header("Upload-Concat", expect.ToEqual("partial")).
+						Reply(tReply(reply.Created()).Header("Location", "/foo/bar")),
+					tRequest(http.MethodPatch, "/foo/bar", nil).
+						Header("Upload-Offset", expect.ToEqual("0")).
+						Body(expect.ToEqual(data)).
+						Reply(tReply(reply.NoContent()).Header("Upload-Offset", "512")),
+				)
+				u := Upload{RemoteSize: 512, Partial: true}
+				s := NewUploadStream(testClient, &u)
+				s.CreateOnWrite = true
+
+				Ω(s.ReadFrom(bytes.NewReader(data))).Should(BeEquivalentTo(512))
+				Ω(u).Should(Equal(Upload{Location: "/foo/bar", RemoteSize: 512, RemoteOffset: 512, Partial: true}))
+			})
+		})
+		Context("AutoSync", func() {
+			It("should sync offset from 409 response and continue", func() {
+				data, _ := io.ReadAll(io.LimitReader(rand.New(rand.NewSource(time.Now().UnixNano())), 1024))
+				srvMock.AddMocks(
+					tRequest(http.MethodPatch, "/foo/bar", nil).Header("Upload-Offset", expect.ToEqual("0")).
+						Body(expect.ToEqual(data[:256])).
+						Reply(tReply(reply.NoContent()).Header("Upload-Offset", "256")),
+					tRequest(http.MethodPatch, "/foo/bar", nil).Header("Upload-Offset", expect.ToEqual("256")).
+						Reply(tReply(reply.Status(http.StatusConflict)).Header("Upload-Offset", "768")),
+					tRequest(http.MethodPatch, "/foo/bar", nil).Header("Upload-Offset", expect.ToEqual("768")).
+						Body(expect.ToEqual(data[768:])).
+						Reply(tReply(reply.NoContent()).Header("Upload-Offset", "1024")),
+				)
+				u := Upload{Location: "/foo/bar", RemoteSize: 1024}
+				s := NewUploadStream(testClient, &u)
+				s.ChunkSize = 256
+				s.AutoSync = true
+
+				Ω(s.Write(data)).Should(Equal(1024))
+				Ω(u.RemoteOffset).Should(BeEquivalentTo(1024))
+			})
+			It("should request server offset if 409 response lacks it", func() {
+				data, _ := io.ReadAll(io.LimitReader(rand.New(rand.NewSource(time.Now().UnixNano())), 512))
+				srvMock.AddMocks(
+					tRequest(http.MethodPatch, "/foo/bar", nil).Header("Upload-Offset", expect.ToEqual("256")).
+						Reply(tReply(reply.Status(http.StatusConflict))),
+					tRequest(http.MethodHead, "/foo/bar", nil).
+						Reply(tReply(reply.OK()).Header("Upload-Offset", "128")),
+					tRequest(http.MethodPatch, "/foo/bar", nil).Header("Upload-Offset", expect.ToEqual("128")).
+						Body(expect.ToEqual(data)).
+						Reply(tReply(reply.NoContent()).Header("Upload-Offset", "640")),
+				)
+				u := Upload{Location: "/foo/bar", RemoteSize: 1024, RemoteOffset: 256}
+				s := NewUploadStream(testClient, &u)
+				s.ChunkSize = 512
+				s.AutoSync = true
+				rd := bytes.NewReader(data)
+				_, _ = rd.Seek(128, io.SeekStart) // Source position 128 corresponds to offset 256
+
+				Ω(s.ReadFrom(rd)).Should(BeEquivalentTo(384))
+				Ω(u.RemoteOffset).Should(BeEquivalentTo(640))
+			})
+			It("should return error if source is not seekable", func() {
+				srvMock.AddMocks(tRequest(http.MethodPatch, "/foo/bar", nil).
+					Reply(tReply(reply.Status(http.StatusConflict)).Header("Upload-Offset", "768")))
+				u := Upload{Location: "/foo/bar", RemoteSize: 1024}
+				s := NewUploadStream(testClient, &u)
+				s.AutoSync = true
+
+				_, err := s.ReadFrom(io.MultiReader(bytes.NewReader(make([]byte, 256))))
+				Ω(err).Should(MatchError(ErrOffsetsNotSynced))
+			})
+		})
+		Context("BufferWrites", func() {
+			It("should accumulate small writes until ChunkSize", func() {
+				replies := []*reply.StdReply{
+					tReply(reply.NoContent()), tReply(reply.NoContent()), tReply(reply.NoContent()), tReply(reply.NoContent()),
+				}
+				up := mockTusUploader{replies: replies, buf: bytes.NewBuffer(make([]byte, 0))}
+				srvMock.AddMocks(up.makeRequest(http.MethodPatch, "/foo/bar", emptyHeaders).ReplyFunction(up.handler()))
+
+				u := Upload{Location: "/foo/bar", RemoteSize: 1024}
+				s := NewUploadStream(testClient, &u)
+				s.ChunkSize = 256
+				s.BufferWrites = true
+				data, _ := io.ReadAll(io.LimitReader(rand.New(rand.NewSource(time.Now().UnixNano())), 1000))
+
+				for i := 0; i < 10; i++ {
+					Ω(s.Write(data[i*100 : (i+1)*100])).Should(Equal(100))
+				}
+				Ω(up.requests).Should(HaveLen(3))
+				Ω(u.RemoteOffset).Should(BeEquivalentTo(768))
+				Ω(s.Buffered()).Should(Equal(232))
+
+				Ω(s.Close()).Should(Succeed())
+				Ω(up.requests).Should(HaveLen(4))
+				Ω(s.Buffered()).Should(Equal(0))
+				Ω(u.RemoteOffset).Should(BeEquivalentTo(1000))
+				Ω(data).Should(Equal(up.buf.Bytes()))
+			})
+			It("should keep the buffered data on error", func() {
+				replies := []*reply.StdReply{reply.InternalServerError(), tReply(reply.NoContent()), tReply(reply.NoContent())}
+				up := mockTusUploader{replies: replies, buf: bytes.NewBuffer(make([]byte, 0))}
+				srvMock.AddMocks(up.makeRequest(http.MethodPatch, "/foo/bar", emptyHeaders).ReplyFunction(up.handler()))
+
+				u := Upload{Location: "/foo/bar", RemoteSize: 1024}
+				s := NewUploadStream(testClient, &u)
+				s.ChunkSize = 256
+				s.BufferWrites = true
+				data, _ := io.ReadAll(io.LimitReader(rand.New(rand.NewSource(time.Now().UnixNano())), 300))
+
+				n, err := s.Write(data)
+				Ω(n).Should(Equal(300))
+				Ω(err).Should(MatchError(ErrUnexpectedResponse))
+				Ω(s.Buffered()).Should(Equal(300))
+
+				Ω(s.ReadFrom(bytes.NewReader(nil))).Should(BeEquivalentTo(0)) // Buffered data goes first
+				Ω(s.Buffered()).Should(Equal(0))
+				Ω(u.RemoteOffset).Should(BeEquivalentTo(300))
+				Ω(data).Should(Equal(up.buf.Bytes()))
+			})
+		})
+		Context("SafeUploadStream", func() {
+			It("should serialize concurrent calls", func() {
+				replies := make([]*reply.StdReply, 0)
+				for i := 0; i < 8; i++ {
+					replies = append(replies, tReply(reply.NoContent()))
+				}
+				up := mockTusUploader{replies: replies, buf: bytes.NewBuffer(make([]byte, 0))}
+				srvMock.AddMocks(up.makeRequest(http.MethodPatch, "/foo/bar", emptyHeaders).ReplyFunction(up.handler()))
+
+				u := Upload{Location: "/foo/bar", RemoteSize: 2048}
+				us := NewUploadStream(testClient, &u)
+				us.ChunkSize = 256
+				s := NewSafeUploadStream(us)
+				data, _ := io.ReadAll(io.LimitReader(rand.New(rand.NewSource(time.Now().UnixNano())), 2048))
+
+				var wg sync.WaitGroup
+				for i := 0; i < 2; i++ {
+					wg.Add(1)
+					go func(p []byte) {
+						defer GinkgoRecover()
+						defer wg.Done()
+						Ω(s.Write(p)).Should(Equal(1024))
+					}(data[i*1024 : (i+1)*1024])
+				}
+				for s.Upload().RemoteOffset < 2048 {
+					Ω(s.Tell()).Should(BeNumerically("<=", 2048))
+					Ω(s.Stats().BytesUploaded % 256).Should(BeEquivalentTo(0))
+				}
+				wg.Wait()
+				Ω(s.Upload()).Should(Equal(Upload{Location: "/foo/bar", RemoteSize: 2048, RemoteOffset: 2048}))
+				Ω(up.buf.Len()).Should(Equal(2048))
+			})
+		})
+		Context("GzipChunks", func() {
+			It("should compress chunks and keep offsets and checksums of uncompressed data", func() {
+				assumeExtensions(testClient, "checksum")
+				replies := []*reply.StdReply{tReply(reply.NoContent()), tReply(reply.NoContent())}
+				up := mockTusUploader{replies: replies, buf: bytes.NewBuffer(make([]byte, 0))}
+				var encodings []string
+				handler := up.handler()
+				srvMock.AddMocks(up.makeRequest(http.MethodPatch, "/foo/bar", nil).ReplyFunction(
+					func(r *http.Request, m reply.M, p params.P) (*reply.Response, error) {
+						encodings = append(encodings, r.Header.Get("Content-Encoding"))
+						zr, err := gzip.NewReader(r.Body)
+						if err != nil {
+							return nil, err
+						}
+						r.Body = zr
+						return handler(r, m, p)
+					},
+				))
+
+				u := Upload{Location: "/foo/bar", RemoteSize: 4096}
+				s := NewUploadStream(testClient, &u).WithChecksumAlgorithm("sha1")
+				s.ChunkSize = 2048
+				s.GzipChunks = true
+				data := bytes.Repeat([]byte("2023-01-01 00:00:00 INFO some log line\n"), 4096/39+1)[:4096]
+
+				Ω(s.Write(data)).Should(Equal(4096))
+				Ω(u.RemoteOffset).Should(BeEquivalentTo(4096))
+				Ω(up.buf.Bytes()).Should(Equal(data))
+				Ω(encodings).Should(Equal([]string{"gzip", "gzip"}))
+				for i, r := range up.requests {
+					sum := sha1.Sum(data[i*2048 : i*2048+2048])
+					Ω(r.Header.Get("Upload-Checksum")).Should(Equal("sha1 " + base64.StdEncoding.EncodeToString(sum[:])))
+				}
+				Ω(s.Stats().BytesSent).Should(BeNumerically("<", 4096))
+			})
+		})
+		Context("WithRateLimit", func() {
+			It("should pace the upload", func() {
+				replies := []*reply.StdReply{tReply(reply.NoContent()), tReply(reply.NoContent()), tReply(reply.NoContent())}
+				up := mockTusUploader{replies: replies, buf: bytes.NewBuffer(make([]byte, 0))}
+				srvMock.AddMocks(up.makeRequest(http.MethodPatch, "/foo/bar", emptyHeaders).ReplyFunction(up.handler()))
+
+				u := Upload{Location: "/foo/bar", RemoteSize: 6144}
+				s := NewUploadStream(testClient, &u).WithRateLimit(4096)
+				s.ChunkSize = 2048
+				data, _ := io.ReadAll(io.LimitReader(rand.New(rand.NewSource(time.Now().UnixNano())), 6144))
+
+				started := time.Now()
+				Ω(s.Write(data)).Should(Equal(6144))
+				Ω(time.Since(started)).Should(BeNumerically(">=", 400*time.Millisecond)) // 2048 bytes above the burst
+				Ω(data).Should(Equal(up.buf.Bytes()))
+			})
+			It("should share the client limiter between streams", func() {
+				testClient.RateLimiter = NewRateLimiter(4096)
+				ups := make([]mockTusUploader, 2)
+				uploads := make([]Upload, 2)
+				for i := range ups {
+					replies := []*reply.StdReply{tReply(reply.NoContent()), tReply(reply.NoContent())}
+					ups[i] = mockTusUploader{replies: replies, buf: bytes.NewBuffer(make([]byte, 0))}
+					loc := "/foo/bar" + strconv.Itoa(i)
+					srvMock.AddMocks(ups[i].makeRequest(http.MethodPatch, loc, emptyHeaders).ReplyFunction(ups[i].handler()))
+					uploads[i] = Upload{Location: loc, RemoteSize: 3072}
+				}
+				data, _ := io.ReadAll(io.LimitReader(rand.New(rand.NewSource(time.Now().UnixNano())), 3072))
+
+				started := time.Now()
+				var wg sync.WaitGroup
+				for i := range uploads {
+					wg.Add(1)
+					go func(u *Upload) {
+						defer GinkgoRecover()
+						defer wg.Done()
+						s := NewUploadStream(testClient, u)
+						s.ChunkSize = 2048
+						Ω(s.Write(data)).Should(Equal(3072))
+					}(&uploads[i])
+				}
+				wg.Wait()
+				Ω(time.Since(started)).Should(BeNumerically(">=", 400*time.Millisecond)) // 2048 bytes above the burst
+				Ω(ups[0].buf.Bytes()).Should(Equal(data))
+				Ω(ups[1].buf.Bytes()).Should(Equal(data))
+			})
+			It("should return a copy of UploadStream", func() {
+				u := Upload{Location: "/foo/bar", RemoteSize: 1024}
+				s := NewUploadStream(testClient, &u)
+				res := s.WithRateLimit(1024)
+
+				Ω(res).ShouldNot(BeIdenticalTo(s))
+				Ω(res.rateLimiter).ShouldNot(BeNil())
+				Ω(s.rateLimiter).Should(BeNil())
+				Ω(res.WithRateLimit(0).rateLimiter).Should(BeNil())
+			})
+		})
+		Context("MemoryBudget", func() {
+			It("should release the memory when stream becomes clean", func() {
+				testClient.MemoryBudget = NewMemoryBudget(2048)
+				replies := []*reply.StdReply{tReply(reply.NoContent()), tReply(reply.NoContent())}
+				up := mockTusUploader{replies: replies, buf: bytes.NewBuffer(make([]byte, 0))}
+				srvMock.AddMocks(up.makeRequest(http.MethodPatch, "/foo/bar", emptyHeaders).ReplyFunction(up.handler()))
+
+				u := Upload{Location: "/foo/bar", RemoteSize: 3072}
+				s := NewUploadStream(testClient, &u)
+				s.ChunkSize = 2048
+				data, _ := io.ReadAll(io.LimitReader(rand.New(rand.NewSource(time.Now().UnixNano())), 3072))
+
+				Ω(s.ReadFrom(bytes.NewReader(data))).Should(BeEquivalentTo(3072))
+				Ω(testClient.MemoryBudget.InUse()).Should(BeZero())
+				Ω(up.buf.Bytes()).Should(Equal(data))
+			})
+			It("should wait for memory held by a dirty stream", func() {
+				testClient.MemoryBudget = NewMemoryBudget(3000)
+				u1 := Upload{Location: "/foo/bar", RemoteSize: 3072}
+				s1 := NewUploadStream(testClient, &u1)
+				s1.ChunkSize = 2048
+				Ω(s1.setupDirtyBuffer()).Should(Succeed())
+				Ω(testClient.MemoryBudget.InUse()).Should(BeEquivalentTo(2048))
+
+				ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+				defer cancel()
+				u2 := Upload{Location: "/foo/baz", RemoteSize: 3072}
+				s2 := NewUploadStream(testClient, &u2).WithContext(ctx)
+				s2.ChunkSize = 2048
+				_, err := s2.Write([]byte("data"))
+				Ω(err).Should(MatchError(context.DeadlineExceeded))
+
+				s1.ForceClean()
+				Ω(testClient.MemoryBudget.InUse()).Should(BeZero())
+				Ω(s2.WithContext(context.Background()).setupDirtyBuffer()).Should(Succeed())
+				Ω(testClient.MemoryBudget.InUse()).Should(BeEquivalentTo(2048))
+			})
+			It("should grant the memory in order of requests", func() {
+				mb := NewMemoryBudget(100)
+				Ω(mb.acquire(context.Background(), 60)).Should(Succeed())
+				order := make(chan int64, 2)
+				for _, n := range []int64{80, 30} {
+					go func(n int64) {
+						defer GinkgoRecover()
+						Ω(mb.acquire(context.Background(), n)).Should(Succeed())
+						order <- n
+						mb.release(n)
+					}(n)
+					time.Sleep(20 * time.Millisecond) // Let the goroutine enqueue
+				}
+				Consistently(order, 50*time.Millisecond).ShouldNot(Receive()) // 30 bytes fit, but 80 is the first
+				mb.release(60)
+				Ω(<-order).Should(BeEquivalentTo(80))
+				Ω(<-order).Should(BeEquivalentTo(30))
+				Eventually(mb.InUse).Should(BeZero())
+			})
+			It("should remove waiter on context cancel", func() {
+				mb := NewMemoryBudget(100)
+				Ω(mb.acquire(context.Background(), 60)).Should(Succeed())
+				ctx, cancel := context.WithCancel(context.Background())
+				cancel()
+				Ω(mb.acquire(ctx, 80)).Should(MatchError(context.Canceled))
+				Ω(mb.acquire(context.Background(), 40)).Should(Succeed())
+				Ω(mb.InUse()).Should(BeEquivalentTo(100))
+			})
+			It("should panic if the request exceeds the budget", func() {
+				Ω(func() { _ = NewMemoryBudget(100).acquire(context.Background(), 101) }).Should(Panic())
+			})
+		})
+		Context("uploadURL", func() {
+			It("should cache the resolved URL until location or base URL changes", func() {
+				u := Upload{Location: "/foo/bar", RemoteSize: 1024}
+				s := NewUploadStream(testClient, &u)
+				Ω(s.uploadURL()).Should(Equal(testURL.ResolveReference(&url.URL{Path: "/foo/bar"}).String()))
+				Ω(s.resolvedURL.location).Should(Equal("/foo/bar"))
+
+				u.Location = "/foo/baz"
+				Ω(s.uploadURL()).Should(HaveSuffix("/foo/baz"))
+
+				s.client = testClient.WithContext(context.Background())
+				s.client.BaseURL, _ = url.Parse("http://example.com/files/")
+				Ω(s.uploadURL()).Should(Equal("http://example.com/foo/baz"))
+			})
+			It("should return error on bad location", func() {
+				u := Upload{Location: ":bad", RemoteSize: 1024}
+				_, err := NewUploadStream(testClient, &u).uploadURL()
+				Ω(err).Should(HaveOccurred())
+			})
+		})
+		Context("ReadFrom io.ReaderAt", func() {
+			It("should send the chunks with no dirty buffer", func() {
+				replies := []*reply.StdReply{tReply(reply.NoContent()), tReply(reply.NoContent()), tReply(reply.NoContent()), tReply(reply.NoContent())}
+				up := mockTusUploader{replies: replies, buf: bytes.NewBuffer(make([]byte, 0))}
+				srvMock.AddMocks(up.makeRequest(http.MethodPatch, "/foo/bar", emptyHeaders).ReplyFunction(up.handler()))
+
+				u := Upload{Location: "/foo/bar", RemoteSize: 1000}
+				s := NewUploadStream(testClient, &u)
+				s.ChunkSize = 256
+				s.ZeroCopy = true
+				data, _ := io.ReadAll(io.LimitReader(rand.New(rand.NewSource(time.Now().UnixNano())), 1000))
+				rd := bytes.NewReader(data)
+
+				Ω(s.ReadFrom(rd)).Should(BeEquivalentTo(1000))
+				Ω(s.held.buf).Should(BeNil())
+				Ω(s.Dirty()).Should(BeFalse())
+				Ω(rd.Len()).Should(BeZero())
+				Ω(up.buf.Bytes()).Should(Equal(data))
+				Ω(up.requests).Should(HaveLen(4))
+				Ω(up.requests[3].ContentLength).Should(BeEquivalentTo(232))
+			})
+			It("should leave source after the acknowledged data on error", func() {
+				replies := []*reply.StdReply{
+					tReply(reply.NoContent()), reply.InternalServerError(), tReply(reply.NoContent()), tReply(reply.NoContent()), tReply(reply.NoContent()),
+				}
+				up := mockTusUploader{replies: replies, buf: bytes.NewBuffer(make([]byte, 0))}
+				srvMock.AddMocks(up.makeRequest(http.MethodPatch, "/foo/bar", emptyHeaders).ReplyFunction(up.handler()))
+
+				u := Upload{Location: "/foo/bar", RemoteSize: 512}
+				s := NewUploadStream(testClient, &u)
+				s.ChunkSize = 128
+				s.ZeroCopy = true
+				data, _ := io.ReadAll(io.LimitReader(rand.New(rand.NewSource(time.Now().UnixNano())), 612))
+				rd := bytes.NewReader(data)
+				_, _ = rd.Seek(100, io.SeekStart)
+
+				n, err := s.ReadFrom(rd)
+				Ω(err).Should(MatchError(ErrUnexpectedResponse))
+				Ω(n).Should(BeEquivalentTo(128))
+				Ω(s.Dirty()).Should(BeFalse())
+				Ω(rd.Seek(0, io.SeekCurrent)).Should(BeEquivalentTo(228))
+
+				Ω(s.ReadFrom(rd)).Should(BeEquivalentTo(384))
+				Ω(u.RemoteOffset).Should(BeEquivalentTo(512))
+				Ω(up.buf.Bytes()).Should(Equal(data[100:]))
+				Ω(rd.Len()).Should(BeZero())
+			})
+		})
+		Context("ReadAhead", func() {
+			DescribeTable("should upload all data",
+				func(upload func(s *UploadStream, data []byte) (int64, error)) {
+					replies := []*reply.StdReply{tReply(reply.NoContent()), tReply(reply.NoContent()), tReply(reply.NoContent()), tReply(reply.NoContent())}
+					up := mockTusUploader{replies: replies, buf: bytes.NewBuffer(make([]byte, 0))}
+					srvMock.AddMocks(up.makeRequest(http.MethodPatch, "/foo/bar", emptyHeaders).ReplyFunction(up.handler()))
+
+					u := Upload{Location: "/foo/bar", RemoteSize: 1000}
+					s := NewUploadStream(testClient, &u)
+					s.ChunkSize = 256
+					s.ReadAhead = true
+					data, _ := io.ReadAll(io.LimitReader(rand.New(rand.NewSource(time.Now().UnixNano())), 1000))
+
+					Ω(upload(s, data)).Should(BeEquivalentTo(1000))
+					Ω(u.RemoteOffset).Should(BeEquivalentTo(1000))
+					Ω(up.buf.Bytes()).Should(Equal(data))
+				},
+				Entry("ReadFrom", func(s *UploadStream, data []byte) (int64, error) { return s.ReadFrom(bytes.NewReader(data)) }),
+				Entry("Write", func(s *UploadStream, data []byte) (int64, error) { n, e := s.Write(data); return int64(n), e }),
+			)
+			It("should move source back to the first byte not uploaded", func() {
+				replies := []*reply.StdReply{
+					tReply(reply.NoContent()), reply.InternalServerError(), tReply(reply.NoContent()), tReply(reply.NoContent()),
+				}
+				up := mockTusUploader{replies: replies, buf: bytes.NewBuffer(make([]byte, 0))}
+				srvMock.AddMocks(up.makeRequest(http.MethodPatch, "/foo/bar", emptyHeaders).ReplyFunction(up.handler()))
+
+				u := Upload{Location: "/foo/bar", RemoteSize: 768}
+				s := NewUploadStream(testClient, &u)
+				s.ChunkSize = 256
+				s.ZeroCopy = true
+				s.ReadAhead = true
+				data, _ := io.ReadAll(io.LimitReader(rand.New(rand.NewSource(time.Now().UnixNano())), 768))
+				rd := bytes.NewReader(data)
+
+				n, err := s.ReadFrom(rd)
+				Ω(err).Should(MatchError(ErrUnexpectedResponse))
+				Ω(n).Should(BeEquivalentTo(512))
+				Ω(rd.Len()).Should(Equal(256)) // The prefetched chunk has been returned
+				Ω(s.Dirty()).Should(BeTrue())
+
+				Ω(s.ReadFrom(rd)).Should(BeEquivalentTo(256))
+				Ω(up.buf.Bytes()).Should(Equal(data))
+			})
+		})
+		Context("buffer pool", func() {
+			It("should keep the chunk buffer between calls and return it to the client pool on Close", func() {
+				replies := []*reply.StdReply{tReply(reply.NoContent()), tReply(reply.NoContent())}
+				up := mockTusUploader{replies: replies, buf: bytes.NewBuffer(make([]byte, 0))}
+				srvMock.AddMocks(up.makeRequest(http.MethodPatch, "/foo/bar", emptyHeaders).ReplyFunction(up.handler()))
+
+				u := Upload{Location: "/foo/bar", RemoteSize: 2048}
+				s := NewUploadStream(testClient, &u)
+				s.ChunkSize = 1024
+				data, _ := io.ReadAll(io.LimitReader(rand.New(rand.NewSource(time.Now().UnixNano())), 2048))
+
+				Ω(s.Write(data[:1024])).Should(Equal(1024))
+				buf := s.held.buf
+				Ω(buf).ShouldNot(BeNil())
+				Ω(s.Dirty()).Should(BeFalse())
+				Ω(s.Write(data[1024:])).Should(Equal(1024))
+				Ω(s.held.buf).Should(BeIdenticalTo(buf))
+				Ω(up.buf.Bytes()).Should(Equal(data))
+
+				Ω(s.Close()).Should(Succeed())
+				Ω(s.held.buf).Should(BeNil())
+				Ω(testClient.state.buffers.pools).Should(HaveKey(1024))
+			})
+			It("should return buffers of requested size", func() {
+				bp := bufferPool{}
+				b := bp.get(100)
+				Ω(*b).Should(HaveLen(100))
+				bp.put(b)
+				Ω(*bp.get(100)).Should(HaveLen(100))
+				Ω(*bp.get(200)).Should(HaveLen(200))
+			})
+			It("should fail reading of detached body", func() {
+				r := newBufferReader([]byte("data"))
+				p := make([]byte, 2)
+				Ω(r.Read(p)).Should(Equal(2))
+				r.detach()
+				_, err := r.Read(p)
+				Ω(err).Should(MatchError(errBufferReleased))
+			})
+		})
 		Context("WithContext", func() {
 			It("should set context and return a copy of UploadStream", func() {
 				ctx := context.Background()
@@ -492,7 +1444,7 @@ var _ = Describe("UploadStream", func() {
 		)
 		When("server returned 460 Checksum Mismatch and checksum is used", func() {
 			It("should return ErrChecksumMismatch", func() {
-				testClient.Capabilities.Extensions = append(testClient.Capabilities.Extensions, "checksum")
+				assumeExtensions(testClient, "checksum")
 				replies := []*reply.StdReply{tReply(reply.Status(460))}
 				up := mockTusUploader{replies: replies, buf: bytes.NewBuffer(make([]byte, 0))}
 				eh := []string{"Upload-Concat", "Upload-Defer-Length", "Upload-Length", "Upload-Metadata"}
@@ -512,6 +1464,139 @@ var _ = Describe("UploadStream", func() {
 				Ω(up.buf.Len()).Should(Equal(0))
 			})
 		})
+		When("upload has vanished while the stream was idle", func() {
+			It("should return error from Preflight", func() {
+				srvMock.AddMocks(tRequest(http.MethodHead, "/foo/bar", nil).Reply(reply.Status(http.StatusNotFound)))
+				u := Upload{Location: "/foo/bar", RemoteSize: 1024, RemoteOffset: 512}
+				s := NewUploadStream(testClient, &u)
+				s.PreflightAfter = time.Minute
+				s.lastRequestTime = time.Now().Add(-time.Hour)
+
+				n, err := s.Write(make([]byte, 256))
+				Ω(n).Should(Equal(0))
+				Ω(err).Should(MatchError(ErrUploadDoesNotExist))
+				Ω(s.LastResponse.StatusCode).Should(Equal(http.StatusNotFound))
+			})
+		})
+		When("server offset differs on Preflight", func() {
+			It("should return ErrOffsetsNotSynced", func() {
+				srvMock.AddMocks(tRequest(http.MethodHead, "/foo/bar", nil).
+					Reply(tReply(reply.Status(http.StatusOK)).Header("Upload-Offset", "256")),
+				)
+				u := Upload{Location: "/foo/bar", RemoteSize: 1024, RemoteOffset: 512}
+				s := NewUploadStream(testClient, &u)
+				_, err := s.Preflight()
+				Ω(err).Should(MatchError(ErrOffsetsNotSynced))
+				Ω(err).Should(MatchError(OffsetsError{LocalOffset: 512, RemoteOffset: 256}))
+				Ω(u.RemoteOffset).Should(BeEquivalentTo(512))
+			})
+		})
+		When("upload is already complete", func() {
+			It("should return ErrUploadAlreadyComplete from Write", func() {
+				u := Upload{Location: "/foo/bar", RemoteSize: 1024, RemoteOffset: 1024}
+				s := NewUploadStream(testClient, &u)
+
+				n, err := s.Write(make([]byte, 256))
+				Ω(n).Should(Equal(0))
+				Ω(err).Should(MatchError(ErrUploadAlreadyComplete))
+			})
+			It("should return ErrUploadAlreadyComplete from ReadFrom", func() {
+				u := Upload{Location: "/foo/bar", RemoteSize: 1024, RemoteOffset: 1024}
+				s := NewUploadStream(testClient, &u)
+
+				n, err := s.ReadFrom(bytes.NewReader(make([]byte, 256)))
+				Ω(n).Should(BeEquivalentTo(0))
+				Ω(err).Should(MatchError(ErrUploadAlreadyComplete))
+			})
+			It("should return ErrUploadAlreadyComplete if server refuses the data because upload is full", func() {
+				srvMock.AddMocks(tRequest(http.MethodPatch, "/foo/bar", nil).
+					Reply(tReply(reply.Status(http.StatusForbidden)).Header("Upload-Offset", "1024")),
+				)
+				u := Upload{Location: "/foo/bar", RemoteSize: 1024, RemoteOffset: 768}
+				s := NewUploadStream(testClient, &u)
+
+				_, err := s.Write(make([]byte, 256))
+				Ω(err).Should(MatchError(ErrUploadAlreadyComplete))
+				Ω(err).Should(MatchError(ErrCannotUpload))
+			})
+		})
+		When("upload has expired", func() {
+			It("should return ErrUploadExpired", func() {
+				srvMock.AddMocks(tRequest(http.MethodPatch, "/foo/bar", nil).Reply(tReply(reply.Status(http.StatusNotFound))))
+				dt := time.Now().Add(-time.Minute)
+				u := Upload{Location: "/foo/bar", RemoteSize: 1024, RemoteOffset: 512, UploadExpired: &dt}
+				s := NewUploadStream(testClient, &u)
+
+				_, err := s.Write(make([]byte, 256))
+				Ω(err).Should(MatchError(ErrUploadExpired))
+				Ω(err).Should(MatchError(ErrUploadDoesNotExist))
+			})
+		})
+		When("server returned 409 Conflict", func() {
+			It("should attach both offsets to error", func() {
+				srvMock.AddMocks(tRequest(http.MethodPatch, "/foo/bar", nil).
+					Reply(tReply(reply.Status(http.StatusConflict)).Header("Upload-Offset", "768")),
+				)
+				u := Upload{Location: "/foo/bar", RemoteSize: 1024, RemoteOffset: 512}
+				s := NewUploadStream(testClient, &u)
+
+				_, err := s.Write(make([]byte, 256))
+				Ω(err).Should(MatchError(ErrOffsetsNotSynced))
+				var oe OffsetsError
+				Ω(errors.As(err, &oe)).Should(BeTrue())
+				Ω(oe.LocalOffset).Should(BeEquivalentTo(512))
+				Ω(oe.RemoteOffset).Should(BeEquivalentTo(768))
+				var details ErrorDetails
+				Ω(errors.As(err, &details)).Should(BeTrue())
+				Ω(details.StatusCode).Should(Equal(http.StatusConflict))
+				Ω(u.RemoteOffset).Should(BeEquivalentTo(512))
+			})
+			It("should set unknown remote offset if server has not sent it", func() {
+				srvMock.AddMocks(tRequest(http.MethodPatch, "/foo/bar", nil).
+					Reply(tReply(reply.Status(http.StatusConflict))),
+				)
+				u := Upload{Location: "/foo/bar", RemoteSize: 1024, RemoteOffset: 512}
+				s := NewUploadStream(testClient, &u)
+
+				_, err := s.Write(make([]byte, 256))
+				var oe OffsetsError
+				Ω(errors.As(err, &oe)).Should(BeTrue())
+				Ω(oe.RemoteOffset).Should(BeEquivalentTo(OffsetUnknown))
+			})
+		})
+		When("server returned offset that exceeds the upload size", func() {
+			BeforeEach(func() {
+				srvMock.AddMocks(tRequest(http.MethodPatch, "/foo/bar", nil).
+					Reply(tReply(reply.NoContent()).Header("Upload-Offset", "2048")))
+			})
+			DescribeTable("should check invariants according to mode",
+				func(mode InvariantMode, expectErr error) {
+					u := Upload{Location: "/foo/bar", RemoteSize: 1024}
+					s := NewUploadStream(testClient, &u)
+					s.ChunkSize = 256
+					s.Invariants = mode
+
+					_, err := s.Write(make([]byte, 256))
+					if expectErr == nil {
+						Ω(err).Should(MatchError(io.ErrShortWrite))
+					} else {
+						Ω(err).Should(MatchError(expectErr))
+						Ω(err).Should(MatchError(ContainSubstring("server offset 2048 exceeds the upload size")))
+						Ω(u.RemoteOffset).Should(BeEquivalentTo(0))
+					}
+				},
+				Entry("off", InvariantsOff, nil),
+				Entry("error", InvariantsError, ErrInvariantViolation),
+			)
+			It("should panic in panic mode", func() {
+				u := Upload{Location: "/foo/bar", RemoteSize: 1024}
+				s := NewUploadStream(testClient, &u)
+				s.ChunkSize = 256
+				s.Invariants = InvariantsPanic
+
+				Ω(func() { _, _ = s.Write(make([]byte, 256)) }).Should(PanicWith(ContainSubstring("server offset 2048 exceeds the upload size")))
+			})
+		})
 		When("upload size is unknown", func() {
 			It("should panic", func() {
 				u := Upload{Location: "/foo/bar", RemoteSize: SizeUnknown}
@@ -549,7 +1634,7 @@ var _ = Describe("UploadStream", func() {
 		})
 		When("upload with checksum and no chunked, but checksum-trailer extension is not active", func() {
 			It("should return error", func() {
-				testClient.Capabilities.Extensions = append(testClient.Capabilities.Extensions, "checksum")
+				assumeExtensions(testClient, "checksum")
 				u := Upload{Location: "/foo/bar", RemoteSize: 1024}
 				s := NewUploadStream(testClient, &u).WithChecksumAlgorithm("sha1")
 				s.ChunkSize = NoChunked
@@ -563,4 +1648,458 @@ var _ = Describe("UploadStream", func() {
 			})
 		})
 	})
+
+	Context("PipeWriter", func() {
+		It("should upload written data with deferred size and retry on transient error", func() {
+			assumeExtensions(testClient, "creation-defer-length")
+			replies := []*reply.StdReply{
+				tReply(reply.NoContent()), tReply(reply.Status(http.StatusServiceUnavailable)),
+				tReply(reply.NoContent()), tReply(reply.NoContent()),
+			}
+			up := mockTusUploader{replies: replies, buf: bytes.NewBuffer(make([]byte, 0))}
+			srvMock.AddMocks(up.makeRequest(http.MethodPatch, "/foo/bar", nil).ReplyFunction(up.handler()))
+			data, _ := io.ReadAll(io.LimitReader(rand.New(rand.NewSource(time.Now().UnixNano())), 600))
+			u := Upload{Location: "/foo/bar", RemoteSize: SizeUnknown, DeferredLength: true}
+			s := NewUploadStream(testClient, &u)
+			s.ChunkSize = 256
+			s.RetryDelay = time.Millisecond
+
+			p := NewPipeWriter(s)
+			for _, part := range [][]byte{data[:100], data[100:500], data[500:]} {
+				Ω(p.Write(part)).Should(Equal(len(part)))
+			}
+			Ω(p.Close()).Should(Succeed())
+			Ω(p.Uploaded()).Should(BeEquivalentTo(600))
+			Ω(up.buf.Bytes()).Should(Equal(data))
+			Ω(u).Should(Equal(Upload{Location: "/foo/bar", RemoteSize: 600, RemoteOffset: 600}))
+			Ω(up.requests[2].Header.Get("Upload-Length")).Should(BeEmpty())
+			Ω(up.requests[3].Header.Get("Upload-Length")).Should(Equal("600"))
+			Ω(s.Stats().Retries).Should(Equal(1))
+			Ω(s.Stats().BytesRetransmitted).Should(BeEquivalentTo(256))
+		})
+		It("should return upload error from Write and Close", func() {
+			replies := []*reply.StdReply{tReply(reply.Status(http.StatusForbidden))}
+			up := mockTusUploader{replies: replies, buf: bytes.NewBuffer(make([]byte, 0))}
+			srvMock.AddMocks(up.makeRequest(http.MethodPatch, "/foo/bar", nil).ReplyFunction(up.handler()))
+			u := Upload{Location: "/foo/bar", RemoteSize: 1024}
+			s := NewUploadStream(testClient, &u)
+			s.ChunkSize = 256
+
+			p := NewPipeWriter(s)
+			Ω(p.Write(make([]byte, 1024))).Should(Equal(1024)) // Consumed before the error
+			_, err := p.Write(make([]byte, 1024))
+			Ω(err).Should(MatchError(ErrCannotUpload))
+			Ω(p.Close()).Should(MatchError(ErrCannotUpload))
+		})
+		It("should interrupt uploading on CloseWithError", func() {
+			u := Upload{Location: "/foo/bar", RemoteSize: 1024}
+			p := NewPipeWriter(NewUploadStream(testClient, &u))
+			producerErr := errors.New("producer error")
+
+			Ω(p.CloseWithError(producerErr)).Should(MatchError(producerErr))
+			Ω(p.Uploaded()).Should(BeEquivalentTo(0))
+		})
+	})
+
+	Context("UploadAll", func() {
+		var up mockTusUploader
+		var data []byte
+		BeforeEach(func() {
+			up = mockTusUploader{buf: bytes.NewBuffer(make([]byte, 0))}
+			data, _ = io.ReadAll(io.LimitReader(rand.New(rand.NewSource(time.Now().UnixNano())), 1024))
+			srvMock.AddMocks(
+				tRequest(http.MethodHead, "/foo/bar", nil).
+					ReplyFunction(func(r *http.Request, m reply.M, p params.P) (*reply.Response, error) {
+						return tReply(reply.OK()).Header("Upload-Offset", strconv.Itoa(up.buf.Len())).Build(r, m, p)
+					}),
+			)
+		})
+		It("should retry on transient error and resume from server offset", func() {
+			up.replies = []*reply.StdReply{
+				tReply(reply.NoContent()), tReply(reply.Status(http.StatusBadGateway)), tReply(reply.NoContent()),
+			}
+			srvMock.AddMocks(up.makeRequest(http.MethodPatch, "/foo/bar", nil).ReplyFunction(up.handler()))
+			u := Upload{Location: "/foo/bar", RemoteSize: 1024}
+			s := NewUploadStream(testClient, &u)
+			s.ChunkSize = 512
+			s.RetryDelay = time.Millisecond
+
+			stats, err := s.UploadAll(context.Background(), bytes.NewReader(data))
+			Ω(err).Should(Succeed())
+			Ω(up.buf.Bytes()).Should(Equal(data))
+			Ω(u.RemoteOffset).Should(BeEquivalentTo(1024))
+			Ω(stats.Attempts).Should(Equal(2))
+			Ω(stats.Errors).Should(HaveLen(1))
+			Ω(stats.Errors[0]).Should(MatchError(ErrUnexpectedResponse))
+			Ω(stats.BytesUploaded).Should(BeEquivalentTo(1024))
+			Ω(s.Stats()).Should(Equal(stats.TransferStats))
+		})
+		// stallOnce makes the first request hang until the client drops it, the rest ones are passed to up handler
+		stallOnce := func() func(r *http.Request, m reply.M, p params.P) (*reply.Response, error) {
+			stalled := atomic.Bool{}
+			h := up.handler()
+			return func(r *http.Request, m reply.M, p params.P) (*reply.Response, error) {
+				if stalled.CompareAndSwap(false, true) {
+					<-r.Context().Done()
+					return tReply(reply.Status(http.StatusBadGateway)).Build(r, m, p)
+				}
+				return h(r, m, p)
+			}
+		}
+		It("should retry the request stalled longer than ChunkTimeout", func() {
+			up.replies = []*reply.StdReply{tReply(reply.NoContent()), tReply(reply.NoContent())}
+			srvMock.AddMocks(up.makeRequest(http.MethodPatch, "/foo/bar", nil).ReplyFunction(stallOnce()))
+			u := Upload{Location: "/foo/bar", RemoteSize: 1024}
+			s := NewUploadStream(testClient, &u)
+			s.ChunkSize = 512
+			s.ChunkTimeout = 50 * time.Millisecond
+			s.RetryDelay = time.Millisecond
+			s.NetworkRetries = 0 // Retry by UploadAll, not inside the stream
+
+			stats, err := s.UploadAll(context.Background(), bytes.NewReader(data))
+			Ω(err).Should(Succeed())
+			Ω(up.buf.Bytes()).Should(Equal(data))
+			Ω(stats.Attempts).Should(Equal(2))
+			Ω(stats.Errors).Should(HaveLen(1))
+			Ω(stats.Errors[0]).Should(MatchError(ErrRequestTimeout))
+			Ω(stats.Errors[0]).Should(MatchError(context.DeadlineExceeded))
+		})
+		It("should give up when the retry budget is exhausted", func() {
+			up.replies = []*reply.StdReply{
+				tReply(reply.Status(http.StatusBadGateway)), tReply(reply.Status(http.StatusBadGateway)),
+				tReply(reply.Status(http.StatusBadGateway)), tReply(reply.Status(http.StatusBadGateway)),
+			}
+			srvMock.AddMocks(up.makeRequest(http.MethodPatch, "/foo/bar", nil).ReplyFunction(up.handler()))
+			u := Upload{Location: "/foo/bar", RemoteSize: 1024}
+			s := NewUploadStream(testClient, &u)
+			s.RetryDelay = time.Millisecond
+			s.RetryBudget = NewRetryBudget(2)
+
+			stats, err := s.UploadAll(context.Background(), bytes.NewReader(data))
+			Ω(err).Should(MatchError(ErrRetryBudgetExhausted))
+			Ω(err).Should(MatchError(ErrUnexpectedResponse))
+			Ω(IsTransientError(err)).Should(BeFalse())
+			Ω(stats.Attempts).Should(Equal(3))
+
+			stats, err = s.UploadAll(context.Background(), bytes.NewReader(data))
+			Ω(err).Should(MatchError(ErrRetryBudgetExhausted)) // The budget is shared between calls
+			Ω(stats.Attempts).Should(Equal(1))
+		})
+		It("should keep the progress channel owned by the stream", func() {
+			up.replies = []*reply.StdReply{tReply(reply.NoContent()), tReply(reply.NoContent())}
+			srvMock.AddMocks(up.makeRequest(http.MethodPatch, "/foo/bar", nil).ReplyFunction(up.handler()))
+			u := Upload{Location: "/foo/bar", RemoteSize: 1024}
+			s := NewUploadStream(testClient, &u)
+			s.ChunkSize = 512
+			progressCh := s.ProgressChan(8)
+
+			_, err := s.UploadAll(context.Background(), bytes.NewReader(data))
+			Ω(err).Should(Succeed())
+			Ω((<-progressCh).Offset).Should(BeEquivalentTo(512))
+			Ω((<-progressCh).Offset).Should(BeEquivalentTo(1024))
+			Ω(progressCh).Should(BeClosed())
+			Ω(func() { s.ProgressChan(1) }).ShouldNot(Panic())
+		})
+		It("should close the progress channel when giving up", func() {
+			up.replies = []*reply.StdReply{tReply(reply.Status(http.StatusBadGateway))}
+			srvMock.AddMocks(up.makeRequest(http.MethodPatch, "/foo/bar", nil).ReplyFunction(up.handler()))
+			u := Upload{Location: "/foo/bar", RemoteSize: 1024}
+			s := NewUploadStream(testClient, &u)
+			s.MaxAttempts = 1
+			progressCh := s.ProgressChan(1)
+
+			_, err := s.UploadAll(context.Background(), bytes.NewReader(data))
+			Ω(err).Should(MatchError(ErrUnexpectedResponse)) // Transient, but UploadAll has given up
+			Ω(progressCh).Should(BeClosed())
+		})
+		It("should return permanent error immediately", func() {
+			up.replies = []*reply.StdReply{tReply(reply.Status(http.StatusForbidden))}
+			srvMock.AddMocks(up.makeRequest(http.MethodPatch, "/foo/bar", nil).ReplyFunction(up.handler()))
+			u := Upload{Location: "/foo/bar", RemoteSize: 1024}
+			s := NewUploadStream(testClient, &u)
+			s.RetryDelay = time.Millisecond
+
+			stats, err := s.UploadAll(context.Background(), bytes.NewReader(data))
+			Ω(err).Should(MatchError(ErrCannotUpload))
+			Ω(stats.Attempts).Should(Equal(1))
+			Ω(stats.Errors).Should(BeEmpty())
+		})
+		It("should give up after MaxAttempts", func() {
+			assumeExtensions(testClient, "checksum")
+			up.replies = []*reply.StdReply{tReply(reply.Status(460)), tReply(reply.Status(460))}
+			srvMock.AddMocks(up.makeRequest(http.MethodPatch, "/foo/bar", nil).ReplyFunction(up.handler()))
+			u := Upload{Location: "/foo/bar", RemoteSize: 1024}
+			s := NewUploadStream(testClient, &u).WithChecksumAlgorithm("sha1")
+			s.MaxAttempts = 2
+			s.RetryDelay = time.Millisecond
+
+			stats, err := s.UploadAll(context.Background(), bytes.NewReader(data))
+			Ω(err).Should(MatchError(ErrChecksumMismatch))
+			Ω(stats.Attempts).Should(Equal(2))
+			Ω(stats.ChecksumMismatches).Should(Equal(2))
+			Ω(stats.Errors).Should(HaveLen(2))
+		})
+		It("should succeed if upload is already complete", func() {
+			_, _ = up.buf.Write(data)
+			u := Upload{Location: "/foo/bar", RemoteSize: 1024}
+			s := NewUploadStream(testClient, &u)
+
+			stats, err := s.UploadAll(context.Background(), bytes.NewReader(data))
+			Ω(err).Should(Succeed())
+			Ω(stats.Attempts).Should(Equal(1))
+			Ω(u.RemoteOffset).Should(BeEquivalentTo(1024))
+		})
+	})
+
+	Context("ChunkTimeout", func() {
+		It("should not treat the stream context deadline as request timeout", func() {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Tus-Resumable", "1.0.0")
+				if r.Method == http.MethodHead {
+					w.Header().Set("Cache-Control", "no-store")
+					w.Header().Set("Upload-Length", "1024")
+					w.Header().Set("Upload-Offset", "0")
+					return
+				}
+				_, _ = io.Copy(io.Discard, r.Body)
+				<-r.Context().Done() // Stall until the client drops the request
+			}))
+			defer srv.Close()
+			baseURL, _ := url.Parse(srv.URL)
+			u := Upload{Location: "/foo/bar", RemoteSize: 1024}
+			s := NewUploadStream(NewClient(srv.Client(), baseURL), &u)
+			s.ChunkTimeout = time.Minute
+			ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+			defer cancel()
+
+			_, err := s.UploadAll(ctx, bytes.NewReader(make([]byte, 1024)))
+			Ω(err).Should(MatchError(context.DeadlineExceeded))
+			Ω(err).ShouldNot(MatchError(ErrRequestTimeout))
+		})
+	})
+
+	Context("NetworkRetries", func() {
+		var stored []byte
+		var drops, patches, heads int
+		var s *UploadStream
+		var u Upload
+		mu := sync.Mutex{} // Guards the server state
+		BeforeEach(func() {
+			stored, drops, patches, heads = nil, 0, 0, 0
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				defer GinkgoRecover()
+				mu.Lock()
+				defer mu.Unlock()
+				w.Header().Set("Tus-Resumable", "1.0.0")
+				if r.Method == http.MethodHead {
+					heads++
+					w.Header().Set("Cache-Control", "no-store")
+					w.Header().Set("Upload-Length", "1024")
+					w.Header().Set("Upload-Offset", strconv.Itoa(len(stored)))
+					return
+				}
+				patches++
+				Ω(r.Header.Get("Upload-Offset")).Should(Equal(strconv.Itoa(len(stored))))
+				body, _ := io.ReadAll(r.Body)
+				if drops > 0 { // Receive a part of chunk and drop the connection
+					drops--
+					stored = append(stored, body[:100]...)
+					conn, _, _ := w.(http.Hijacker).Hijack()
+					_ = conn.Close()
+					return
+				}
+				stored = append(stored, body...)
+				w.Header().Set("Upload-Offset", strconv.Itoa(len(stored)))
+				w.WriteHeader(http.StatusNoContent)
+			}))
+			DeferCleanup(srv.Close)
+			baseURL, _ := url.Parse(srv.URL)
+			cl := NewClient(srv.Client(), baseURL)
+			cl.AssumeCapabilities(ServerCapabilities{ProtocolVersions: []string{"1.0.0"}})
+			u = Upload{Location: "/foo/bar", RemoteSize: 1024}
+			s = NewUploadStream(cl, &u)
+			s.ChunkSize = 512
+		})
+		It("should send the rest of chunk again after the connection has been dropped", func() {
+			drops = 1
+			data, _ := io.ReadAll(io.LimitReader(rand.New(rand.NewSource(time.Now().UnixNano())), 1024))
+
+			Ω(s.Write(data)).Should(Equal(1024))
+			mu.Lock()
+			defer mu.Unlock()
+			Ω(stored).Should(Equal(data))
+			Ω(u.RemoteOffset).Should(BeEquivalentTo(1024))
+			Ω(patches).Should(Equal(3))
+			Ω(heads).Should(Equal(1))
+			Ω(s.Stats().Retries).Should(Equal(1))
+		})
+		It("should read the rest of chunk from the file again in ZeroCopy mode", func() {
+			drops = 1
+			s.ZeroCopy = true
+			data, _ := io.ReadAll(io.LimitReader(rand.New(rand.NewSource(time.Now().UnixNano())), 1024))
+			name := filepath.Join(GinkgoT().TempDir(), "data")
+			Ω(os.WriteFile(name, data, 0o600)).Should(Succeed())
+			f, err := os.Open(name)
+			Ω(err).Should(Succeed())
+			defer f.Close()
+
+			Ω(s.ReadFrom(f)).Should(BeEquivalentTo(1024))
+			Ω(s.Dirty()).Should(BeFalse())
+			Ω(f.Seek(0, io.SeekCurrent)).Should(BeEquivalentTo(1024))
+			mu.Lock()
+			defer mu.Unlock()
+			Ω(stored).Should(Equal(data))
+			Ω(patches).Should(Equal(3))
+			Ω(heads).Should(Equal(1))
+			Ω(s.Stats().Retries).Should(Equal(1))
+		})
+		It("should send the rest of data again in NoChunked mode", func() {
+			drops = 1
+			s.ChunkSize = NoChunked
+			data, _ := io.ReadAll(io.LimitReader(rand.New(rand.NewSource(time.Now().UnixNano())), 1024))
+
+			Ω(s.Write(data)).Should(Equal(1024))
+			mu.Lock()
+			defer mu.Unlock()
+			Ω(stored).Should(Equal(data))
+			Ω(u.RemoteOffset).Should(BeEquivalentTo(1024))
+			Ω(patches).Should(Equal(2))
+			Ω(heads).Should(Equal(1))
+		})
+		It("should return the error when retries are exhausted", func() {
+			drops = 10
+			s.NetworkRetries = 2
+
+			n, err := s.Write(make([]byte, 1024))
+			Ω(err).Should(HaveOccurred())
+			Ω(IsTransientError(err)).Should(BeTrue())
+			mu.Lock()
+			defer mu.Unlock()
+			Ω(stored).Should(HaveLen(300)) // The server has received a part of chunk on every attempt
+			Ω(n).Should(Equal(200))        // The last part is not known until Sync
+			Ω(u.RemoteOffset).Should(BeEquivalentTo(200))
+			Ω(patches).Should(Equal(3))
+			Ω(heads).Should(Equal(2))
+		})
+		It("should return the error at once if retries are disabled", func() {
+			drops = 1
+			s.NetworkRetries = 0
+
+			n, err := s.Write(make([]byte, 1024))
+			Ω(err).Should(HaveOccurred())
+			mu.Lock()
+			defer mu.Unlock()
+			Ω(n).Should(Equal(0))
+			Ω(u.RemoteOffset).Should(BeEquivalentTo(0))
+			Ω(patches).Should(Equal(1))
+			Ω(heads).Should(Equal(0))
+		})
+	})
+
+	DescribeTable("Seek",
+		func(remoteSize, offset int64, whence int, expectOffset int64, expectErr bool) {
+			u := Upload{Location: "/foo/bar", RemoteSize: remoteSize, RemoteOffset: 512}
+			s := NewUploadStream(testClient, &u)
+			res, err := s.Seek(offset, whence)
+			if expectErr {
+				Ω(err).Should(HaveOccurred())
+				Ω(res).Should(BeEquivalentTo(0))
+				Ω(u.RemoteOffset).Should(BeEquivalentTo(512))
+				return
+			}
+			Ω(err).Should(Succeed())
+			Ω(res).Should(Equal(expectOffset))
+			Ω(u.RemoteOffset).Should(Equal(expectOffset))
+		},
+		Entry("start", int64(1024), int64(100), io.SeekStart, int64(100), false),
+		Entry("start, end of upload", int64(1024), int64(1024), io.SeekStart, int64(1024), false),
+		Entry("start, beyond end", int64(1024), int64(1025), io.SeekStart, int64(0), true),
+		Entry("start, negative", int64(1024), int64(-1), io.SeekStart, int64(0), true),
+		Entry("current", int64(1024), int64(-12), io.SeekCurrent, int64(500), false),
+		Entry("current, beyond end", int64(1024), int64(513), io.SeekCurrent, int64(0), true),
+		Entry("end", int64(1024), int64(0), io.SeekEnd, int64(1024), false),
+		Entry("end, backwards", int64(1024), int64(-24), io.SeekEnd, int64(1000), false),
+		Entry("end, beyond end", int64(1024), int64(1), io.SeekEnd, int64(0), true),
+		Entry("end, unknown size", int64(SizeUnknown), int64(0), io.SeekEnd, int64(0), true),
+		Entry("current, unknown size", int64(SizeUnknown), int64(1000), io.SeekCurrent, int64(1512), false),
+		Entry("invalid whence", int64(1024), int64(0), 42, int64(0), true),
+	)
+
+	DescribeTable("IsTransientError",
+		func(err error, transient bool) {
+			Ω(IsTransientError(err)).Should(Equal(transient))
+		},
+		Entry("checksum mismatch", ErrChecksumMismatch, true),
+		Entry("offsets not synced", ErrOffsetsNotSynced.WithErr(OffsetsError{}), true),
+		Entry("network error", &net.OpError{Op: "dial", Err: errors.New("refused")}, true),
+		Entry("server error", ErrUnexpectedResponse.WithErr(ErrorDetails{StatusCode: http.StatusServiceUnavailable}), true),
+		Entry("too many requests", ErrUnexpectedResponse.WithErr(ErrorDetails{StatusCode: http.StatusTooManyRequests}), true),
+		Entry("client error", ErrUnexpectedResponse.WithErr(ErrorDetails{StatusCode: http.StatusUnauthorized}), false),
+		Entry("upload does not exist", ErrUploadDoesNotExist, false),
+		Entry("context canceled", fmt.Errorf("request: %w", context.Canceled), false),
+	)
 })
+
+// benchTransport acknowledges the upload requests without network, so the benchmarks measure the library overhead
+type benchTransport struct {
+	header http.Header
+}
+
+func (t *benchTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	n, err := io.Copy(io.Discard, req.Body)
+	if err != nil {
+		return nil, err
+	}
+	offset, _ := strconv.ParseInt(req.Header.Get("Upload-Offset"), 10, 64)
+	t.header["Upload-Offset"][0] = strconv.FormatInt(offset+n, 10)
+	return &http.Response{StatusCode: http.StatusNoContent, Header: t.header, Body: http.NoBody, Request: req}, nil
+}
+
+// benchChunkSize is the chunk size of streams in benchmarks
+const benchChunkSize = 64 * 1024
+
+// newBenchStream returns a stream uploading to benchTransport
+func newBenchStream() *UploadStream {
+	t := &benchTransport{header: http.Header{"Tus-Resumable": {"1.0.0"}, "Upload-Offset": {""}}}
+	baseURL, _ := url.Parse("http://tus.example.com/files/")
+	cl := NewClient(&http.Client{Transport: t}, baseURL)
+	cl.AssumeCapabilities(ServerCapabilities{ProtocolVersions: []string{"1.0.0"}, Extensions: []string{"checksum"}})
+	s := NewUploadStream(cl, &Upload{Location: "/files/foo", RemoteSize: 1 << 62})
+	s.ChunkSize = benchChunkSize
+	return s
+}
+
+// benchmarkWrite uploads a chunk per iteration by Write
+func benchmarkWrite(b *testing.B, s *UploadStream) {
+	data := make([]byte, benchChunkSize)
+	b.SetBytes(benchChunkSize)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := s.Write(data); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkUploadStreamWrite(b *testing.B) {
+	benchmarkWrite(b, newBenchStream())
+}
+
+func BenchmarkUploadStreamWriteChecksum(b *testing.B) {
+	benchmarkWrite(b, newBenchStream().WithChecksumAlgorithm("sha1"))
+}
+
+func BenchmarkUploadStreamReadFrom(b *testing.B) {
+	s := newBenchStream()
+	s.ZeroCopy = true
+	data := make([]byte, 16*benchChunkSize)
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := s.ReadFrom(bytes.NewReader(data)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package tusgo
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+// TransformReader reads the data transformed by encryption, compression, etc. Since a transform may change the data
+// size, upload offsets don't map 1:1 to source offsets, so the reader must report where it is in the source.
+type TransformReader interface {
+	io.Reader
+
+	// Checkpoint returns the number of source bytes consumed so far and the serialized transform state. Being given
+	// to TransformFunc with source positioned at sourceOffset, the state must produce exactly the rest of output
+	// this reader would produce. Checkpoint is called only between reads, when the output is fully drained, so
+	// the implementation may flush its buffers at this moment (e.g. finish a compression block).
+	Checkpoint() (sourceOffset int64, state []byte, err error)
+}
+
+// TransformFunc creates a TransformReader reading the source data from src. Nil state means the initial state.
+type TransformFunc func(src io.Reader, state []byte) (TransformReader, error)
+
+// TransformCheckpoint binds an upload offset to the source position and transform state to resume from
+type TransformCheckpoint struct {
+	UploadOffset int64
+	SourceOffset int64
+	State        []byte
+}
+
+// TransformedSource is a reader of transformed data, which can be repositioned to a given upload offset after
+// restart. It takes a checkpoint every CheckpointEvery bytes of output, ChunkSize of UploadStream is a good value here.
+// The caller should persist Checkpoints along with the upload and restore them before calling ResumeAt.
+//
+// Typical usage:
+//
+//	src := tusgo.NewTransformedSource(file, gzipTransform, stream.ChunkSize)
+//	src.Checkpoints = loadCheckpoints()
+//	if err := src.ResumeAt(upload.RemoteOffset); err != nil {
+//		return err
+//	}
+//	_, err := stream.ReadFrom(src)
+//	saveCheckpoints(src.Checkpoints)
+type TransformedSource struct {
+	// Checkpoints taken so far, sorted by upload offset
+	Checkpoints []TransformCheckpoint
+
+	// CheckpointEvery is the output interval in bytes between checkpoints
+	CheckpointEvery int64
+
+	source    io.ReadSeeker
+	transform TransformFunc
+	rd        TransformReader
+	offset    int64
+}
+
+// NewTransformedSource constructs a new TransformedSource, which transforms data from source from its beginning
+func NewTransformedSource(source io.ReadSeeker, transform TransformFunc, checkpointEvery int64) *TransformedSource {
+	if checkpointEvery <= 0 {
+		panic("checkpointEvery must be positive")
+	}
+	return &TransformedSource{CheckpointEvery: checkpointEvery, source: source, transform: transform}
+}
+
+// Read reads the transformed data. Reads never cross a checkpoint boundary.
+func (ts *TransformedSource) Read(p []byte) (n int, err error) {
+	if ts.rd == nil {
+		if err = ts.restore(TransformCheckpoint{}); err != nil {
+			return
+		}
+	}
+	if ts.offset%ts.CheckpointEvery == 0 {
+		if err = ts.checkpoint(); err != nil {
+			return
+		}
+	}
+	if l := ts.CheckpointEvery - ts.offset%ts.CheckpointEvery; int64(len(p)) > l {
+		p = p[:l]
+	}
+	n, err = ts.rd.Read(p)
+	ts.offset += int64(n)
+	return
+}
+
+// Offset returns the upload offset, i.e. the number of transformed bytes read so far
+func (ts *TransformedSource) Offset() int64 {
+	return ts.offset
+}
+
+// ResumeAt repositions the source and the transform state to continue reading from a given upload offset. We restore
+// the nearest checkpoint before the offset and skip the transformed data up to it, so the transform must be
+// deterministic.
+func (ts *TransformedSource) ResumeAt(uploadOffset int64) error {
+	var cp TransformCheckpoint
+	for _, c := range ts.Checkpoints {
+		if c.UploadOffset > uploadOffset {
+			break
+		}
+		cp = c
+	}
+	if err := ts.restore(cp); err != nil {
+		return err
+	}
+	if n, err := io.CopyN(io.Discard, ts, uploadOffset-cp.UploadOffset); err != nil {
+		if errors.Is(err, io.EOF) {
+			return fmt.Errorf("transformed data ended at offset %d before %d", ts.offset, uploadOffset)
+		}
+		return fmt.Errorf("cannot skip %d bytes after checkpoint at %d: %w", uploadOffset-cp.UploadOffset-n, cp.UploadOffset, err)
+	}
+	return nil
+}
+
+func (ts *TransformedSource) restore(cp TransformCheckpoint) (err error) {
+	if _, err = ts.source.Seek(cp.SourceOffset, io.SeekStart); err != nil {
+		return
+	}
+	if ts.rd, err = ts.transform(ts.source, cp.State); err != nil {
+		return
+	}
+	ts.offset = cp.UploadOffset
+	return
+}
+
+func (ts *TransformedSource) checkpoint() error {
+	if l := len(ts.Checkpoints); l > 0 && ts.Checkpoints[l-1].UploadOffset >= ts.offset {
+		return nil // Already taken
+	}
+	srcOffset, state, err := ts.rd.Checkpoint()
+	if err != nil {
+		return fmt.Errorf("cannot take transform checkpoint at offset %d: %w", ts.offset, err)
+	}
+	ts.Checkpoints = append(ts.Checkpoints, TransformCheckpoint{UploadOffset: ts.offset, SourceOffset: srcOffset, State: state})
+	return nil
+}
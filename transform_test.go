@@ -0,0 +1,92 @@
+package tusgo
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+// doublingTransform writes every source byte twice xor-ed with a counter, so the output is twice larger than source
+type doublingTransform struct {
+	src      io.Reader
+	consumed int64
+	counter  byte
+	pending  []byte
+}
+
+func newDoublingTransform(src io.Reader, state []byte) (TransformReader, error) {
+	t := &doublingTransform{src: src}
+	if state != nil {
+		t.counter = state[0]
+	}
+	return t, nil
+}
+
+func (d *doublingTransform) Read(p []byte) (n int, err error) {
+	for n < len(p) {
+		if len(d.pending) == 0 {
+			b := make([]byte, 1)
+			if _, err = io.ReadFull(d.src, b); err != nil {
+				if n > 0 {
+					err = nil
+				}
+				return
+			}
+			d.consumed++
+			d.pending = []byte{b[0] ^ d.counter, b[0] ^ d.counter}
+			d.counter++
+		}
+		c := copy(p[n:], d.pending)
+		d.pending = d.pending[c:]
+		n += c
+	}
+	return
+}
+
+func (d *doublingTransform) Checkpoint() (int64, []byte, error) {
+	Ω(d.pending).Should(BeEmpty())
+	return d.consumed, []byte{d.counter}, nil
+}
+
+var _ = Describe("TransformedSource", func() {
+	var data, expect []byte
+
+	BeforeEach(func() {
+		data, _ = io.ReadAll(io.LimitReader(rand.New(rand.NewSource(time.Now().UnixNano())), 1000))
+		expect, _ = io.ReadAll(NewTransformedSource(bytes.NewReader(data), newDoublingTransform, 256))
+		Ω(expect).Should(HaveLen(2000))
+	})
+	It("should take checkpoints every given output interval", func() {
+		ts := NewTransformedSource(bytes.NewReader(data), newDoublingTransform, 256)
+		_, _ = io.ReadAll(ts)
+
+		Ω(ts.Checkpoints).Should(HaveLen(8))
+		Ω(ts.Checkpoints[3]).Should(Equal(TransformCheckpoint{UploadOffset: 768, SourceOffset: 384, State: []byte{128}}))
+	})
+	DescribeTable("should resume from upload offset after restart",
+		func(offset int64) {
+			ts := NewTransformedSource(bytes.NewReader(data), newDoublingTransform, 256)
+			_, _ = io.CopyN(io.Discard, ts, 1100)
+			checkpoints := ts.Checkpoints
+
+			// Restart
+			ts = NewTransformedSource(bytes.NewReader(data), newDoublingTransform, 256)
+			ts.Checkpoints = checkpoints
+			Ω(ts.ResumeAt(offset)).Should(Succeed())
+			Ω(ts.Offset()).Should(Equal(offset))
+			Ω(io.ReadAll(ts)).Should(Equal(expect[offset:]))
+		},
+		Entry("at checkpoint", int64(1024)),
+		Entry("between checkpoints", int64(900)),
+		Entry("after the last checkpoint", int64(1500)),
+		Entry("at the beginning", int64(0)),
+	)
+	It("should return error if offset is beyond data", func() {
+		ts := NewTransformedSource(bytes.NewReader(data), newDoublingTransform, 256)
+		Ω(ts.ResumeAt(3000)).Should(MatchError(ContainSubstring("transformed data ended at offset 2000")))
+	})
+})
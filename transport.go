@@ -0,0 +1,51 @@
+package tusgo
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// uploadWriteBufferSize is the connection write buffer size of NewTransportForUploads. The default 4 KiB buffer makes
+// too many syscalls when sending large chunks
+const uploadWriteBufferSize = 256 * 1024
+
+// NewTransportForUploads returns a new http.Transport tuned for large sequential uploads. The http.DefaultTransport is
+// tuned for small API calls, whereas an upload sends megabytes of data in every request and keeps a few long-living
+// connections per host.
+//
+// The transport has a larger write buffer, keeps more idle connections per host (for parallel uploads), negotiates
+// HTTP/2 on TLS connections, and waits for "100 Continue" response before sending the body of requests with
+// "Expect: 100-continue" header, see Client.ExpectContinue. The timeouts limit connection setup and the server
+// response to the request sent, but not the request body sending, which may take long on a slow link. Use the context
+// to limit the whole request.
+//
+// See also EnableHTTP2PriorKnowledge and NewClientForUploads.
+func NewTransportForUploads() *http.Transport {
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
+	return &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           dialer.DialContext,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          100,
+		MaxIdleConnsPerHost:   16,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 5 * time.Second,
+		// Server may take a while to store the chunk received before responding
+		ResponseHeaderTimeout: 2 * time.Minute,
+		WriteBufferSize:       uploadWriteBufferSize,
+	}
+}
+
+// NewClientForUploads returns a new Client with http client over NewTransportForUploads transport. The client sends
+// "Expect: 100-continue" header with the upload data, see Client.ExpectContinue.
+func NewClientForUploads(baseURL *url.URL) *Client {
+	c := NewClient(&http.Client{Transport: NewTransportForUploads()}, baseURL)
+	c.ExpectContinue = true
+	return c
+}
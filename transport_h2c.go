@@ -0,0 +1,19 @@
+//go:build go1.24
+
+package tusgo
+
+import "net/http"
+
+// EnableHTTP2PriorKnowledge makes the transport use HTTP/2 without negotiation, i.e. HTTP/2 over cleartext TCP
+// connections (h2c) for "http" URLs and HTTP/2 over TLS for "https" URLs. HTTP/1 is disabled, so the server must
+// support HTTP/2. Useful for h2c servers behind a trusted network, where HTTP/2 multiplexes the parallel uploads over
+// a single connection.
+//
+// Returns errors.ErrUnsupported if the library has been built with Go older than 1.24.
+func EnableHTTP2PriorKnowledge(t *http.Transport) error {
+	p := new(http.Protocols)
+	p.SetHTTP2(true)
+	p.SetUnencryptedHTTP2(true)
+	t.Protocols = p
+	return nil
+}
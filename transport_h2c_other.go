@@ -0,0 +1,12 @@
+//go:build !go1.24
+
+package tusgo
+
+import (
+	"errors"
+	"net/http"
+)
+
+func EnableHTTP2PriorKnowledge(_ *http.Transport) error {
+	return errors.ErrUnsupported
+}
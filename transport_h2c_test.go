@@ -0,0 +1,38 @@
+//go:build go1.24
+
+package tusgo
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("EnableHTTP2PriorKnowledge", func() {
+	It("should talk HTTP/2 over cleartext connection", func() {
+		var proto int
+		testSrv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			proto = r.ProtoMajor
+			w.Header().Set("Tus-Resumable", "1.0.0")
+			w.Header().Set("Cache-Control", "no-store")
+			w.Header().Set("Upload-Length", "10")
+			w.Header().Set("Upload-Offset", "0")
+		}))
+		testSrv.Config.Protocols = new(http.Protocols)
+		testSrv.Config.Protocols.SetHTTP1(true)
+		testSrv.Config.Protocols.SetUnencryptedHTTP2(true)
+		testSrv.Start()
+		defer testSrv.Close()
+
+		t := NewTransportForUploads()
+		Ω(EnableHTTP2PriorKnowledge(t)).Should(Succeed())
+		u, _ := url.Parse(testSrv.URL + "/files/")
+		c := NewClient(&http.Client{Transport: t}, u)
+		_, err := c.GetUpload(&Upload{}, "/files/foo")
+		Ω(err).Should(Succeed())
+		Ω(proto).Should(Equal(2))
+	})
+})
@@ -0,0 +1,74 @@
+package tusgo
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"sync"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("NewClientForUploads", func() {
+	var testSrv *httptest.Server
+	var testClient *Client
+	var mu sync.Mutex
+	var expects map[string]string // Method -> Expect header
+	var stored *bytes.Buffer
+
+	BeforeEach(func() {
+		expects = make(map[string]string)
+		stored = bytes.NewBuffer(nil)
+		testSrv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			defer mu.Unlock()
+			expects[r.Method] = r.Header.Get("Expect")
+			w.Header().Set("Tus-Resumable", "1.0.0")
+			switch r.Method {
+			case http.MethodHead:
+				w.Header().Set("Cache-Control", "no-store")
+				w.Header().Set("Upload-Length", "1000")
+				w.Header().Set("Upload-Offset", strconv.Itoa(stored.Len()))
+			case http.MethodPatch:
+				_, _ = io.Copy(stored, r.Body)
+				w.Header().Set("Upload-Offset", strconv.Itoa(stored.Len()))
+				w.WriteHeader(http.StatusNoContent)
+			}
+		}))
+		u, _ := url.Parse(testSrv.URL + "/files/")
+		testClient = NewClientForUploads(u)
+	})
+	AfterEach(func() {
+		testSrv.Close()
+	})
+
+	It("should send Expect header with upload data only", func() {
+		data := bytes.Repeat([]byte("x"), 1000)
+		u := Upload{Location: "/files/foo", RemoteSize: 1000}
+		s := NewUploadStream(testClient, &u)
+		_, err := s.UploadAll(context.Background(), bytes.NewReader(data))
+		Ω(err).Should(Succeed())
+		Ω(stored.Bytes()).Should(Equal(data))
+		Ω(expects).Should(HaveKeyWithValue(http.MethodPatch, "100-continue"))
+		Ω(expects).Should(HaveKeyWithValue(http.MethodHead, ""))
+	})
+	It("should not send Expect header if turned off", func() {
+		testClient.ExpectContinue = false
+		u := Upload{Location: "/files/foo", RemoteSize: 1000}
+		_, err := NewUploadStream(testClient, &u).Write(make([]byte, 1000))
+		Ω(err).Should(Succeed())
+		Ω(expects).Should(HaveKeyWithValue(http.MethodPatch, ""))
+	})
+	It("should make a transport tuned for uploads", func() {
+		t := NewTransportForUploads()
+		Ω(t.ForceAttemptHTTP2).Should(BeTrue())
+		Ω(t.ExpectContinueTimeout).Should(BeNumerically(">", 0))
+		Ω(t.WriteBufferSize).Should(Equal(uploadWriteBufferSize))
+		Ω(t.Proxy).ShouldNot(BeNil())
+	})
+})
@@ -1,6 +1,7 @@
 package tusgo_test
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
@@ -47,8 +48,14 @@ func CreateUploadFromFile(file *os.File, cl *tusgo.Client, partial bool) *tusgo.
 		panic(err)
 	}
 
+	// Set "filename" and "filetype" metadata the same way as tus-js-client does
+	meta, err := tusgo.FileMetadata(file)
+	if err != nil {
+		panic(err)
+	}
+
 	u := tusgo.Upload{}
-	if _, err := cl.CreateUpload(&u, finfo.Size(), partial, nil); err != nil {
+	if _, err := cl.CreateUpload(&u, finfo.Size(), partial, meta); err != nil {
 		panic(err)
 	}
 	fmt.Printf("Location: %s\n", u.Location)
@@ -123,19 +130,10 @@ func ExampleClient_ConcatenateUploads_withCreation() {
 
 	fmt.Printf("Final upload location: %s\n", final.Location)
 
-	// Get file info
-	u := tusgo.Upload{RemoteOffset: tusgo.OffsetUnknown}
-	for {
-		if _, err = cl.GetUpload(&u, final.Location); err != nil {
-			panic(err)
-		}
-		// When concatenation still in progress the offset can be either OffsetUnknown or a value less than size
-		// depending on server implementation
-		if u.RemoteOffset != tusgo.OffsetUnknown && u.RemoteOffset == u.RemoteSize {
-			break
-		}
-		fmt.Println("Waiting concatenation to be finished")
-		time.Sleep(2 * time.Second)
+	// Wait for concatenation to be finished
+	u := tusgo.Upload{Location: final.Location}
+	if err = cl.WaitForConcatenation(context.Background(), &u, tusgo.PollOptions{Interval: 2 * time.Second}); err != nil {
+		panic(err)
 	}
 
 	fmt.Printf("Concatenation finished. Offset: %d, Size: %d\n", u.RemoteOffset, u.RemoteSize)
@@ -1,6 +1,11 @@
 package tusgo
 
-import "time"
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+)
 
 const (
 	// SizeUnknown value passed to `remoteSize` parameter in Client.CreateUpload means, that an upload size will be
@@ -36,4 +41,142 @@ type Upload struct {
 
 	// Partial true value denotes that the upload is "partial" and meant to be concatenated into a "final" upload further.
 	Partial bool
+
+	// Final true value denotes that the upload is "final", i.e. it was concatenated from partial uploads. Filled by
+	// Client.GetUpload.
+	Final bool
+
+	// FinalParts are the locations of partial uploads the final upload was concatenated from, as the server reported.
+	// Filled by Client.GetUpload.
+	FinalParts []string
+
+	// DeferredLength true value means that the upload was created with deferred size, and the server still doesn't
+	// know it. The size must be provided on upload, see UploadStream.SetUploadSize.
+	DeferredLength bool
+
+	// Extra contains the non-standard headers of the server response, e.g. X-Request-Id or server-specific upload
+	// identifiers. Filled by Client.GetUpload and Client.CreateUpload. Nil if there are no such headers.
+	Extra http.Header
+}
+
+// IsComplete returns true if all upload data has been transferred to the server, i.e. both size and offset are known
+// and equal
+func (u *Upload) IsComplete() bool {
+	return u.RemoteSize != SizeUnknown && u.RemoteOffset != OffsetUnknown && u.RemoteOffset == u.RemoteSize
+}
+
+// BytesRemaining returns the number of bytes left to upload, or -1 if either size or offset is unknown
+func (u *Upload) BytesRemaining() int64 {
+	if u.RemoteSize == SizeUnknown || u.RemoteOffset == OffsetUnknown {
+		return -1
+	}
+	return u.RemoteSize - u.RemoteOffset
+}
+
+// Expired returns true if the upload has expired on the server at the moment `now`. Upload without expiration time
+// never expires.
+func (u *Upload) Expired(now time.Time) bool {
+	return u.UploadExpired != nil && !now.Before(*u.UploadExpired)
+}
+
+// Reset clears the upload state, making it equal to the zero value
+func (u *Upload) Reset() {
+	*u = Upload{}
+}
+
+// standardHeaders are the Tus protocol and common HTTP response headers, which are not copied to Upload.Extra
+var standardHeaders = map[string]struct{}{
+	"Tus-Resumable": {}, "Tus-Version": {}, "Tus-Extension": {}, "Tus-Max-Size": {}, "Tus-Checksum-Algorithm": {},
+	"Upload-Offset": {}, "Upload-Length": {}, "Upload-Defer-Length": {}, "Upload-Metadata": {}, "Upload-Concat": {},
+	"Upload-Expires": {}, "Upload-Checksum": {},
+	"Location": {}, "Cache-Control": {}, "Connection": {}, "Content-Length": {}, "Content-Type": {},
+	"Content-Encoding": {}, "Date": {}, "Keep-Alive": {}, "Server": {}, "Transfer-Encoding": {}, "Vary": {},
+}
+
+// extraHeaders returns a copy of non-standard headers, or nil if there are none
+func extraHeaders(h http.Header) http.Header {
+	var res http.Header
+	for k, v := range h {
+		if _, ok := standardHeaders[k]; ok || strings.HasPrefix(k, "Access-Control-") {
+			continue
+		}
+		if res == nil {
+			res = make(http.Header)
+		}
+		res[k] = append([]string(nil), v...)
+	}
+	return res
+}
+
+// uploadJSON is the JSON representation of Upload. Unknown size and offset are represented as null.
+type uploadJSON struct {
+	Location       string            `json:"location"`
+	RemoteSize     *int64            `json:"remote_size"`
+	RemoteOffset   *int64            `json:"remote_offset"`
+	Metadata       map[string]string `json:"metadata,omitempty"`
+	UploadExpired  *time.Time        `json:"upload_expired,omitempty"`
+	Partial        bool              `json:"partial,omitempty"`
+	Final          bool              `json:"final,omitempty"`
+	FinalParts     []string          `json:"final_parts,omitempty"`
+	DeferredLength bool              `json:"deferred_length,omitempty"`
+	Extra          http.Header       `json:"extra,omitempty"`
+}
+
+// MarshalJSON encodes the upload to JSON, so it can be persisted and restored later. SizeUnknown and OffsetUnknown
+// values are encoded as null, expiration time is encoded in RFC3339 format.
+func (u Upload) MarshalJSON() ([]byte, error) {
+	v := uploadJSON{
+		Location:       u.Location,
+		Metadata:       u.Metadata,
+		UploadExpired:  u.UploadExpired,
+		Partial:        u.Partial,
+		Final:          u.Final,
+		FinalParts:     u.FinalParts,
+		DeferredLength: u.DeferredLength,
+		Extra:          u.Extra,
+	}
+	if u.RemoteSize != SizeUnknown {
+		v.RemoteSize = &u.RemoteSize
+	}
+	if u.RemoteOffset != OffsetUnknown {
+		v.RemoteOffset = &u.RemoteOffset
+	}
+	return json.Marshal(v)
+}
+
+// UnmarshalJSON decodes the upload encoded by MarshalJSON
+func (u *Upload) UnmarshalJSON(data []byte) error {
+	var v uploadJSON
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	*u = Upload{
+		Location:       v.Location,
+		RemoteSize:     SizeUnknown,
+		RemoteOffset:   OffsetUnknown,
+		Metadata:       v.Metadata,
+		UploadExpired:  v.UploadExpired,
+		Partial:        v.Partial,
+		Final:          v.Final,
+		FinalParts:     v.FinalParts,
+		DeferredLength: v.DeferredLength,
+		Extra:          v.Extra,
+	}
+	if v.RemoteSize != nil {
+		u.RemoteSize = *v.RemoteSize
+	}
+	if v.RemoteOffset != nil {
+		u.RemoteOffset = *v.RemoteOffset
+	}
+	return nil
+}
+
+// MarshalText encodes the upload the same way as MarshalJSON. Useful for storages which accept the text values.
+func (u Upload) MarshalText() ([]byte, error) {
+	return u.MarshalJSON()
+}
+
+// UnmarshalText decodes the upload encoded by MarshalText
+func (u *Upload) UnmarshalText(data []byte) error {
+	return u.UnmarshalJSON(data)
 }
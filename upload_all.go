@@ -0,0 +1,96 @@
+package tusgo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// UploadAll uploads the whole src to the upload, resuming from the server offset. The src position must match the
+// upload offset, i.e. the src beginning corresponds to the upload offset 0.
+//
+// Every attempt we sync the stream with the server, seek src to the stream offset and upload the rest of data. If the
+// attempt fails with a transient error (see IsTransientError), such as a network error, checksum mismatch or offsets
+// conflict, we wait RetryDelay and try again, no more than MaxAttempts times in total. Other errors are returned
+// immediately. The dirty buffer is dropped before every attempt, since the data is read from src again. If the
+// client circuit breaker is open, we wait until it lets a probe request through. See also RetryBudget.
+//
+// Returns the statistics of the process, they are filled on error as well.
+func (us *UploadStream) UploadAll(ctx context.Context, src io.ReadSeeker) (stats UploadAllStats, err error) {
+	s := us.WithContext(ctx)
+	defer func() {
+		if err != nil || s.full(s.Upload.RemoteOffset) {
+			s.closeProgress()
+		}
+		us.progressCh = s.progressCh // The channel is owned by the original stream
+		us.LastResponse = s.LastResponse
+		us.lastRequestTime = s.lastRequestTime
+		us.stats = s.stats
+		us.digestStart, us.digestEnd, us.digestBroken = s.digestStart, s.digestEnd, s.digestBroken
+		stats.TransferStats = s.stats
+	}()
+
+	for {
+		stats.Attempts++
+		if err = s.uploadAttempt(src); err == nil || errors.Is(err, ErrUploadAlreadyComplete) {
+			return stats, nil
+		}
+		if !IsTransientError(err) {
+			return
+		}
+		stats.Errors = append(stats.Errors, err)
+		switch {
+		case errors.Is(err, ErrChecksumMismatch):
+			stats.ChecksumMismatches++
+		case errors.Is(err, ErrOffsetsNotSynced):
+			stats.OffsetConflicts++
+		}
+		if stats.Attempts >= s.MaxAttempts {
+			err = fmt.Errorf("giving up after %d attempts: %w", stats.Attempts, err)
+			return
+		}
+		if s.RetryBudget != nil && !s.RetryBudget.take() {
+			err = ErrRetryBudgetExhausted.WithErr(err)
+			return
+		}
+
+		delay := s.RetryDelay
+		var coe CircuitOpenError
+		if errors.As(err, &coe) && coe.RetryAfter > delay {
+			delay = coe.RetryAfter // No sense to try before the breaker lets a request through
+		}
+		if err = sleepContext(ctx, delay); err != nil {
+			return
+		}
+	}
+}
+
+func (us *UploadStream) uploadAttempt(src io.ReadSeeker) (err error) {
+	us.ForceClean()
+	us.pending = nil
+	if _, err = us.Sync(); err != nil {
+		return
+	}
+	if _, err = src.Seek(us.Tell(), io.SeekStart); err != nil {
+		return
+	}
+	_, err = us.ReadFrom(src)
+	return
+}
+
+// sleepContext waits for duration d or until ctx is done. Nil ctx is never done.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,207 @@
+package tusgo
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MetadataRelativePath is the metadata key with the file path relative to the uploaded directory, the same as
+// Uppy sets
+const MetadataRelativePath = "relativePath"
+
+// DirUploadOptions set up the UploadDir. Zero values mean the defaults.
+type DirUploadOptions struct {
+	// Include, if not empty, are the glob patterns (see path.Match) of files to upload, other files are skipped.
+	// A pattern without slash is matched against the file name, otherwise against the path relative to the directory.
+	Include []string
+
+	// Exclude are the glob patterns of files and directories to skip, in the same format as Include. Exclude takes
+	// precedence over Include. A directory matching a pattern is skipped with all its contents.
+	Exclude []string
+
+	// Concurrency is the number of files uploaded simultaneously. Default is 1
+	Concurrency int
+
+	// ChunkSize is the upload chunk size, see UploadStream.ChunkSize
+	ChunkSize int64
+
+	// MaxAttempts is the maximum number of attempts to upload a file, see UploadStream.MaxAttempts
+	MaxAttempts int
+
+	// RetryDelay is the delay between attempts, see UploadStream.RetryDelay
+	RetryDelay time.Duration
+
+	// Metadata, if set, is merged into metadata of every upload
+	Metadata map[string]string
+}
+
+// FileUploadResult is the result of uploading a file by UploadDir
+type FileUploadResult struct {
+	// Path is the file path relative to the uploaded directory, slash-separated
+	Path string
+
+	// Size is the file size
+	Size int64
+
+	// Upload is the upload created for the file. If the file has failed to upload, but Upload.Location is set, the
+	// upload may be deleted or resumed later.
+	Upload Upload
+
+	// Err is the error occurred while uploading the file, nil on success
+	Err error
+}
+
+// UploadDir walks the directory dir in fsys (use os.DirFS for local directory) and creates one upload per file,
+// uploading the files concurrently. Every upload has "filename", "filetype" (see FileMetadata) and "relativePath"
+// keys in metadata. The files are filtered by include and exclude patterns, see DirUploadOptions.
+//
+// Returns the results of all matching files in walk order, i.e. lexical one. The error is returned if the walking
+// itself has failed, or the options are invalid. The file upload errors are reported in results only. If ctx is done,
+// the files not uploaded yet get ctx error.
+func (c *Client) UploadDir(ctx context.Context, fsys fs.FS, dir string, opts DirUploadOptions) (results []FileUploadResult, err error) {
+	for _, p := range append(append([]string{}, opts.Include...), opts.Exclude...) {
+		if _, err = path.Match(p, ""); err != nil {
+			return nil, fmt.Errorf("bad pattern %q: %w", p, err)
+		}
+	}
+	if opts.Concurrency <= 0 {
+		opts.Concurrency = 1
+	}
+	cl := c.WithContext(ctx)
+	if err = cl.ensureExtension(ExtensionCreation); err != nil {
+		return
+	}
+
+	err = fs.WalkDir(fsys, dir, func(p string, d fs.DirEntry, e error) error {
+		rel := relPath(dir, p)
+		switch {
+		case e != nil && p == dir:
+			return e
+		case e != nil:
+			results = append(results, FileUploadResult{Path: rel, Err: e})
+			return nil
+		case rel != "." && matchAny(opts.Exclude, rel):
+			if d.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		case !d.Type().IsRegular():
+			return nil
+		case len(opts.Include) > 0 && !matchAny(opts.Include, rel):
+			return nil
+		}
+		results = append(results, FileUploadResult{Path: rel})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	wg := sync.WaitGroup{}
+	sem := make(chan struct{}, opts.Concurrency)
+	for i := range results {
+		if results[i].Err != nil {
+			continue
+		}
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(r *FileUploadResult) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			if r.Err = ctx.Err(); r.Err == nil {
+				r.Err = cl.uploadDirFile(fsys, path.Join(dir, r.Path), r, opts)
+			}
+		}(&results[i])
+	}
+	wg.Wait()
+
+	return
+}
+
+// uploadDirFile creates an upload for a file and uploads it, filling in the result
+func (c *Client) uploadDirFile(fsys fs.FS, name string, r *FileUploadResult, opts DirUploadOptions) error {
+	f, err := fsys.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	finfo, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	r.Size = finfo.Size()
+
+	meta := MetadataFromMap(opts.Metadata).SetFilename(path.Base(name)).SetCustom(MetadataRelativePath, r.Path)
+	rs, seekable := f.(io.ReadSeeker)
+	if seekable {
+		t, e := DetectFiletype(name, rs)
+		if e != nil {
+			return fmt.Errorf("cannot detect file type: %w", e)
+		}
+		meta.SetFiletype(t)
+	} else if t := mime.TypeByExtension(path.Ext(name)); t != "" {
+		if mt, _, e := mime.ParseMediaType(t); e == nil {
+			meta.SetFiletype(mt)
+		}
+	}
+
+	if _, err = c.CreateUpload(&r.Upload, r.Size, false, meta); err != nil {
+		return fmt.Errorf("cannot create upload: %w", err)
+	}
+	if r.Size == 0 {
+		return nil
+	}
+	s := NewUploadStream(c, &r.Upload)
+	if opts.ChunkSize > 0 {
+		s.ChunkSize = opts.ChunkSize
+	}
+	if opts.MaxAttempts > 0 {
+		s.MaxAttempts = opts.MaxAttempts
+	}
+	if opts.RetryDelay > 0 {
+		s.RetryDelay = opts.RetryDelay
+	}
+	if seekable {
+		_, err = s.UploadAll(c.ctx, rs)
+	} else {
+		_, err = s.uploadUnseekable(f)
+	}
+	if err == nil && !r.Upload.IsComplete() {
+		err = io.ErrShortWrite // File has been truncated while uploading
+	}
+	return err
+}
+
+// relPath returns the slash path p relative to dir, where p is dir or inside it
+func relPath(dir, p string) string {
+	if p == dir {
+		return "."
+	}
+	if dir == "." {
+		return p
+	}
+	return p[len(dir)+1:]
+}
+
+// matchAny reports whether the slash path p matches any of patterns, see DirUploadOptions.Include
+func matchAny(patterns []string, p string) bool {
+	for _, pat := range patterns {
+		name := p
+		if !strings.Contains(pat, "/") {
+			name = path.Base(p)
+		}
+		if ok, _ := path.Match(pat, name); ok {
+			return true
+		}
+	}
+	return false
+}
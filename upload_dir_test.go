@@ -0,0 +1,144 @@
+package tusgo
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing/fstest"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("UploadDir", func() {
+	var testSrv *httptest.Server
+	var testClient *Client
+	var mu sync.Mutex
+	var stored map[string]*bytes.Buffer
+	var metas map[string]map[string]string
+	var lengths map[string]string
+	var testFS fstest.MapFS
+
+	BeforeEach(func() {
+		stored = make(map[string]*bytes.Buffer)
+		metas = make(map[string]map[string]string)
+		lengths = make(map[string]string)
+		testFS = fstest.MapFS{
+			"root/a.txt":             {Data: []byte("hello")},
+			"root/b.log":             {Data: bytes.Repeat([]byte("log line\n"), 100)},
+			"root/empty.txt":         {Data: nil},
+			"root/sub/c.txt":         {Data: []byte("nested")},
+			"root/sub/deep/d.csv":    {Data: []byte("a,b\n1,2\n")},
+			"root/node_modules/x.js": {Data: []byte("ignored")},
+		}
+		testSrv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			defer mu.Unlock()
+			w.Header().Set("Tus-Resumable", "1.0.0")
+			switch {
+			case r.Method == http.MethodPost:
+				loc := "/files/" + strconv.Itoa(len(stored))
+				stored[loc] = bytes.NewBuffer(nil)
+				metas[loc], _ = DecodeMetadata(r.Header.Get("Upload-Metadata"))
+				lengths[loc] = r.Header.Get("Upload-Length")
+				w.Header().Set("Location", loc)
+				w.WriteHeader(http.StatusCreated)
+			case r.Method == http.MethodHead && stored[r.URL.Path] != nil:
+				w.Header().Set("Upload-Length", lengths[r.URL.Path])
+				w.Header().Set("Upload-Offset", strconv.Itoa(stored[r.URL.Path].Len()))
+			case r.Method == http.MethodPatch && stored[r.URL.Path] != nil:
+				_, _ = io.Copy(stored[r.URL.Path], r.Body)
+				w.Header().Set("Upload-Offset", strconv.Itoa(stored[r.URL.Path].Len()))
+				w.WriteHeader(http.StatusNoContent)
+			default:
+				w.WriteHeader(http.StatusNotFound)
+			}
+		}))
+		u, _ := url.Parse(testSrv.URL + "/files/")
+		testClient = NewClient(testSrv.Client(), u)
+		testClient.AssumeCapabilities(ServerCapabilities{ProtocolVersions: []string{"1.0.0"}, Extensions: []string{"creation"}})
+	})
+	AfterEach(func() {
+		testSrv.Close()
+	})
+
+	// uploaded returns the data uploaded for every relative path
+	uploaded := func() map[string]string {
+		res := make(map[string]string)
+		for loc, m := range metas {
+			res[m[MetadataRelativePath]] = stored[loc].String()
+		}
+		return res
+	}
+
+	It("should upload all files with path metadata", func() {
+		results, err := testClient.UploadDir(context.Background(), testFS, "root", DirUploadOptions{Concurrency: 3, ChunkSize: 256})
+		Ω(err).Should(Succeed())
+		paths := make([]string, 0, len(results))
+		for _, r := range results {
+			Ω(r.Err).Should(Succeed(), r.Path)
+			Ω(r.Upload.IsComplete()).Should(BeTrue(), r.Path)
+			Ω(r.Size).Should(BeEquivalentTo(len(testFS["root/"+r.Path].Data)))
+			paths = append(paths, r.Path)
+		}
+		Ω(paths).Should(Equal([]string{"a.txt", "b.log", "empty.txt", "node_modules/x.js", "sub/c.txt", "sub/deep/d.csv"}))
+		Ω(uploaded()).Should(HaveLen(6))
+		for p, data := range uploaded() {
+			Ω(data).Should(Equal(string(testFS["root/"+p].Data)))
+		}
+		for _, m := range metas {
+			Ω(m[MetadataFilename]).Should(Equal(m[MetadataRelativePath][strings.LastIndex(m[MetadataRelativePath], "/")+1:]))
+			if m[MetadataFilename] == "a.txt" {
+				Ω(m[MetadataFiletype]).Should(Equal("text/plain"))
+			}
+		}
+	})
+	It("should honor include and exclude patterns", func() {
+		opts := DirUploadOptions{Include: []string{"*.txt", "sub/deep/*"}, Exclude: []string{"node_modules", "empty.*"}}
+		results, err := testClient.UploadDir(context.Background(), testFS, "root", opts)
+		Ω(err).Should(Succeed())
+		Ω(results).Should(HaveLen(3))
+		Ω(uploaded()).Should(Equal(map[string]string{"a.txt": "hello", "sub/c.txt": "nested", "sub/deep/d.csv": "a,b\n1,2\n"}))
+	})
+	It("should put the common metadata to every upload", func() {
+		opts := DirUploadOptions{Include: []string{"a.txt"}, Metadata: map[string]string{"tenant": "foo"}}
+		_, err := testClient.UploadDir(context.Background(), testFS, "root", opts)
+		Ω(err).Should(Succeed())
+		for _, m := range metas {
+			Ω(m).Should(HaveKeyWithValue("tenant", "foo"))
+		}
+	})
+	It("should report per-file errors", func() {
+		testSrv.Close()
+		results, err := testClient.UploadDir(context.Background(), testFS, "root", DirUploadOptions{Include: []string{"*.txt"}})
+		Ω(err).Should(Succeed())
+		Ω(results).Should(HaveLen(3))
+		for _, r := range results {
+			Ω(r.Err).Should(HaveOccurred())
+		}
+	})
+	It("should return ctx error for files not uploaded", func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		results, err := testClient.UploadDir(ctx, testFS, "root", DirUploadOptions{})
+		Ω(err).Should(Succeed())
+		for _, r := range results {
+			Ω(r.Err).Should(MatchError(context.Canceled))
+		}
+		Ω(stored).Should(BeEmpty())
+	})
+	It("should return error on bad pattern", func() {
+		_, err := testClient.UploadDir(context.Background(), testFS, "root", DirUploadOptions{Exclude: []string{"["}})
+		Ω(err).Should(HaveOccurred())
+	})
+	It("should return error if directory does not exist", func() {
+		_, err := testClient.UploadDir(context.Background(), testFS, "missing", DirUploadOptions{})
+		Ω(err).Should(HaveOccurred())
+	})
+})
@@ -0,0 +1,78 @@
+package tusgo
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Upload", func() {
+	Context("JSON", func() {
+		It("should encode and decode all fields", func() {
+			dt := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+			u := Upload{
+				Location:      "/foo/bar",
+				RemoteSize:    1024,
+				RemoteOffset:  512,
+				Metadata:      map[string]string{"key1": "value1"},
+				UploadExpired: &dt,
+				Partial:       true,
+				Extra:         http.Header{"X-Request-Id": {"abc"}},
+			}
+
+			data, err := json.Marshal(u)
+			Ω(err).Should(Succeed())
+			Ω(data).Should(MatchJSON(`{
+				"location": "/foo/bar",
+				"remote_size": 1024,
+				"remote_offset": 512,
+				"metadata": {"key1": "value1"},
+				"upload_expired": "2030-01-01T00:00:00Z",
+				"partial": true,
+				"extra": {"X-Request-Id": ["abc"]}
+			}`))
+			var res Upload
+			Ω(json.Unmarshal(data, &res)).Should(Succeed())
+			Ω(res).Should(Equal(u))
+		})
+		It("should encode unknown size and offset as null", func() {
+			u := Upload{Location: "/foo/bar", RemoteSize: SizeUnknown, RemoteOffset: OffsetUnknown, Final: true}
+
+			data, err := json.Marshal(u)
+			Ω(err).Should(Succeed())
+			Ω(data).Should(MatchJSON(`{"location": "/foo/bar", "remote_size": null, "remote_offset": null, "final": true}`))
+			var res Upload
+			Ω(json.Unmarshal(data, &res)).Should(Succeed())
+			Ω(res).Should(Equal(u))
+		})
+		It("should be used as text", func() {
+			u := Upload{Location: "/foo/bar", RemoteSize: 1024}
+			data, err := u.MarshalText()
+			Ω(err).Should(Succeed())
+			var res Upload
+			Ω(res.UnmarshalText(data)).Should(Succeed())
+			Ω(res).Should(Equal(u))
+		})
+	})
+	DescribeTable("IsComplete and BytesRemaining",
+		func(u Upload, complete bool, remaining int64) {
+			Ω(u.IsComplete()).Should(Equal(complete))
+			Ω(u.BytesRemaining()).Should(Equal(remaining))
+		},
+		Entry("in progress", Upload{RemoteSize: 1024, RemoteOffset: 256}, false, int64(768)),
+		Entry("complete", Upload{RemoteSize: 1024, RemoteOffset: 1024}, true, int64(0)),
+		Entry("size unknown", Upload{RemoteSize: SizeUnknown, RemoteOffset: 256}, false, int64(-1)),
+		Entry("offset unknown", Upload{RemoteSize: 1024, RemoteOffset: OffsetUnknown}, false, int64(-1)),
+		Entry("both unknown", Upload{RemoteSize: SizeUnknown, RemoteOffset: OffsetUnknown}, false, int64(-1)),
+	)
+	It("Expired", func() {
+		now := time.Now()
+		exp := now.Add(time.Hour)
+		Ω((&Upload{}).Expired(now)).Should(BeFalse())
+		Ω((&Upload{UploadExpired: &exp}).Expired(now)).Should(BeFalse())
+		Ω((&Upload{UploadExpired: &exp}).Expired(exp)).Should(BeTrue())
+	})
+})
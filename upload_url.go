@@ -0,0 +1,153 @@
+package tusgo
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// URLUploadOptions set up the UploadFromURL. Zero values mean the stream defaults.
+type URLUploadOptions struct {
+	// HTTPClient is used to fetch the source object. Default is http.DefaultClient
+	HTTPClient *http.Client
+
+	// Header is set to every source request, e.g. the authorization header. Client.DefaultHeaders are not sent to
+	// the source.
+	Header http.Header
+
+	// ChunkSize is the upload chunk size, see UploadStream.ChunkSize
+	ChunkSize int64
+
+	// MaxAttempts is the maximum number of attempts of both downloading and uploading, see UploadStream.MaxAttempts
+	// and DownloadStream.MaxAttempts
+	MaxAttempts int
+
+	// RetryDelay is the delay between attempts, see UploadStream.RetryDelay and DownloadStream.RetryDelay
+	RetryDelay time.Duration
+
+	// OnProgress, if set, is called on the upload progress, see UploadStream.OnProgress
+	OnProgress func(p Progress)
+}
+
+// UploadFromURL creates a new upload and fills it with the object fetched from sourceURL by GET request. The object
+// is streamed to the upload without storing it locally. Upload object u is filled with the created upload. If the
+// uploading has failed, u is filled anyway, so the upload may be deleted or resumed later.
+//
+// We discover the object size by HEAD request. If the size is unknown (the server doesn't respond to HEAD or doesn't
+// report Content-Length), we create the upload with deferred length and declare the size along with the last chunk,
+// the server must support "creation-defer-length" extension in this case.
+//
+// The fetching interrupted by a transient error is resumed by a GET request with Range header, see DownloadStream.
+// If the size is known, the transient upload errors are retried from the server offset, see UploadStream.UploadAll.
+// Otherwise, we keep the current chunk in memory until the server acknowledges it, see Client.UploadFromReader.
+//
+// Source responses are handled by the same rules as DownloadStream ones, e.g. ErrUploadDoesNotExist is returned if
+// the source object is not found.
+func (c *Client) UploadFromURL(ctx context.Context, u *Upload, sourceURL string, meta map[string]string, opts URLUploadOptions) (err error) {
+	if u == nil {
+		panic("u is nil")
+	}
+	src := newURLSourceClient(opts).WithContext(ctx)
+	size, err := src.sourceSize(sourceURL)
+	if err != nil {
+		return fmt.Errorf("cannot get source size: %w", err)
+	}
+
+	ds := NewDownloadStream(src, &Upload{Location: sourceURL, RemoteSize: size})
+	if opts.MaxAttempts > 0 {
+		ds.MaxAttempts = opts.MaxAttempts
+	}
+	if opts.RetryDelay > 0 {
+		ds.RetryDelay = opts.RetryDelay
+	}
+	defer ds.Close()
+
+	cl := c.WithContext(ctx)
+	us := NewUploadStream(cl, u)
+	if opts.ChunkSize > 0 {
+		us.ChunkSize = opts.ChunkSize
+	}
+	if opts.MaxAttempts > 0 {
+		us.MaxAttempts = opts.MaxAttempts
+	}
+	if opts.RetryDelay > 0 {
+		us.RetryDelay = opts.RetryDelay
+	}
+	us.OnProgress = opts.OnProgress
+
+	if size == SizeUnknown {
+		if err = cl.ensureExtension(ExtensionCreationDeferLength); err != nil {
+			return
+		}
+		br := bufio.NewReader(ds)
+		if _, err = br.Peek(1); errors.Is(err, io.EOF) {
+			if _, err = cl.CreateUpload(u, 0, false, meta); err != nil { // Nothing to upload
+				err = fmt.Errorf("cannot create upload: %w", err)
+			}
+			return
+		} else if err != nil {
+			return fmt.Errorf("cannot fetch %s: %w", sourceURL, err)
+		}
+		if _, err = cl.CreateUpload(u, SizeUnknown, false, meta); err != nil {
+			return fmt.Errorf("cannot create upload: %w", err)
+		}
+		_, err = us.uploadUnseekable(br)
+	} else {
+		if _, err = cl.CreateUpload(u, size, false, meta); err != nil {
+			return fmt.Errorf("cannot create upload: %w", err)
+		}
+		_, err = us.UploadAll(ctx, ds)
+	}
+	if err != nil {
+		err = fmt.Errorf("cannot upload data from %s: %w", sourceURL, err)
+	}
+	return
+}
+
+// newURLSourceClient returns a Client making plain http requests to the source server
+func newURLSourceClient(opts URLUploadOptions) *Client {
+	src := NewClient(opts.HTTPClient, nil)
+	src.DefaultHeaders = opts.Header
+	src.Middlewares = []Middleware{func(next DoFunc) DoFunc {
+		return func(req *http.Request) (*http.Response, error) {
+			req.Header.Del("Tus-Resumable")
+			// Otherwise the transport may request compressed data, whose size differs from the object size
+			if req.Header.Get("Accept-Encoding") == "" {
+				req.Header.Set("Accept-Encoding", "identity")
+			}
+			return next(req)
+		}
+	}}
+	return src
+}
+
+// sourceSize returns the size of object by HEAD request, or SizeUnknown if the server doesn't report it
+func (c *Client) sourceSize(sourceURL string) (size int64, err error) {
+	var req *http.Request
+	if req, err = c.GetRequest(http.MethodHead, sourceURL, nil, c, c.client); err != nil {
+		return
+	}
+	var response *http.Response
+	if response, err = c.tusRequest(c.ctx, req); err != nil {
+		return
+	}
+	defer c.closeResponse(response)
+
+	switch {
+	case response.StatusCode == http.StatusOK:
+		if response.ContentLength >= 0 {
+			return response.ContentLength, nil
+		}
+		return SizeUnknown, nil
+	case response.StatusCode == http.StatusMethodNotAllowed || response.StatusCode == http.StatusNotImplemented:
+		return SizeUnknown, nil
+	case response.StatusCode == http.StatusNotFound || response.StatusCode == http.StatusGone:
+		return SizeUnknown, c.notExistError(&Upload{Location: sourceURL}, response)
+	default:
+		return SizeUnknown, c.withResponse(ErrUnexpectedResponse, response)
+	}
+}
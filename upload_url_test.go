@@ -0,0 +1,148 @@
+package tusgo
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("UploadFromURL", func() {
+	var testSrv *httptest.Server
+	var testClient *Client
+	var data []byte
+	var mu sync.Mutex
+	var dstData *bytes.Buffer
+	var dstLength, dstDeclaredLength string
+	var srcHeaders []http.Header
+	var headAllowed bool
+	var breakAfter int
+
+	BeforeEach(func() {
+		data, _ = io.ReadAll(io.LimitReader(rand.New(rand.NewSource(time.Now().UnixNano())), 1000))
+		dstData = nil
+		dstLength, dstDeclaredLength = "", ""
+		srcHeaders = nil
+		headAllowed = true
+		breakAfter = -1
+		// Source object is at /src/obj, destination uploads are created at /dst/
+		testSrv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			defer mu.Unlock()
+			switch r.Method + " " + r.URL.Path {
+			case "HEAD /src/obj":
+				srcHeaders = append(srcHeaders, r.Header)
+				if !headAllowed {
+					w.WriteHeader(http.StatusMethodNotAllowed)
+					return
+				}
+				http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+			case "GET /src/obj":
+				srcHeaders = append(srcHeaders, r.Header)
+				if breakAfter >= 0 {
+					w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+					_, _ = w.Write(data[:breakAfter])
+					w.(http.Flusher).Flush()
+					conn, _, _ := w.(http.Hijacker).Hijack()
+					_ = conn.Close()
+					breakAfter = -1
+					return
+				}
+				http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+			case "POST /dst/":
+				w.Header().Set("Tus-Resumable", "1.0.0")
+				dstData = bytes.NewBuffer(nil)
+				dstLength = r.Header.Get("Upload-Length")
+				w.Header().Set("Location", "/dst/bar")
+				w.WriteHeader(http.StatusCreated)
+			case "HEAD /dst/bar":
+				w.Header().Set("Tus-Resumable", "1.0.0")
+				w.Header().Set("Upload-Length", strconv.Itoa(len(data)))
+				w.Header().Set("Upload-Offset", strconv.Itoa(dstData.Len()))
+			case "PATCH /dst/bar":
+				w.Header().Set("Tus-Resumable", "1.0.0")
+				if v := r.Header.Get("Upload-Length"); v != "" {
+					dstDeclaredLength = v
+				}
+				_, _ = io.Copy(dstData, r.Body)
+				w.Header().Set("Upload-Offset", strconv.Itoa(dstData.Len()))
+				w.WriteHeader(http.StatusNoContent)
+			default:
+				w.WriteHeader(http.StatusNotFound)
+			}
+		}))
+		u, _ := url.Parse(testSrv.URL + "/dst/")
+		testClient = NewClient(testSrv.Client(), u)
+		testClient.AssumeCapabilities(ServerCapabilities{
+			ProtocolVersions: []string{"1.0.0"},
+			Extensions:       []string{"creation", "creation-defer-length"},
+		})
+		testClient.DefaultHeaders = http.Header{"X-Tus-Token": []string{"secret"}}
+	})
+	AfterEach(func() {
+		testSrv.Close()
+	})
+
+	It("should upload the object of known size", func() {
+		u := Upload{}
+		opts := URLUploadOptions{
+			HTTPClient: testSrv.Client(),
+			Header:     http.Header{"Authorization": []string{"Bearer foo"}},
+			ChunkSize:  256,
+		}
+
+		Ω(testClient.UploadFromURL(context.Background(), &u, testSrv.URL+"/src/obj", map[string]string{"filename": "obj"}, opts)).Should(Succeed())
+		Ω(u.Location).Should(Equal("/dst/bar"))
+		Ω(u.RemoteOffset).Should(BeEquivalentTo(len(data)))
+		Ω(dstLength).Should(Equal(strconv.Itoa(len(data))))
+		Ω(dstData.Bytes()).Should(Equal(data))
+		for _, h := range srcHeaders {
+			Ω(h.Get("Authorization")).Should(Equal("Bearer foo"))
+			Ω(h.Get("Tus-Resumable")).Should(BeEmpty())
+			Ω(h.Get("X-Tus-Token")).Should(BeEmpty())
+		}
+	})
+	It("should resume fetching by Range request after interrupt", func() {
+		breakAfter = 300
+		u := Upload{}
+		opts := URLUploadOptions{HTTPClient: testSrv.Client(), RetryDelay: time.Millisecond}
+
+		Ω(testClient.UploadFromURL(context.Background(), &u, testSrv.URL+"/src/obj", nil, opts)).Should(Succeed())
+		Ω(dstData.Bytes()).Should(Equal(data))
+		Ω(srcHeaders[len(srcHeaders)-1].Get("Range")).Should(Equal("bytes=300-"))
+	})
+	It("should upload with deferred length if size is unknown", func() {
+		headAllowed = false
+		u := Upload{}
+		opts := URLUploadOptions{HTTPClient: testSrv.Client(), ChunkSize: 256}
+
+		Ω(testClient.UploadFromURL(context.Background(), &u, testSrv.URL+"/src/obj", nil, opts)).Should(Succeed())
+		Ω(dstLength).Should(BeEmpty())
+		Ω(dstDeclaredLength).Should(Equal(strconv.Itoa(len(data))))
+		Ω(dstData.Bytes()).Should(Equal(data))
+		Ω(u.RemoteSize).Should(BeEquivalentTo(len(data)))
+	})
+	It("should create an empty upload if object is empty and size is unknown", func() {
+		headAllowed = false
+		data = nil
+		u := Upload{}
+
+		Ω(testClient.UploadFromURL(context.Background(), &u, testSrv.URL+"/src/obj", nil, URLUploadOptions{HTTPClient: testSrv.Client()})).Should(Succeed())
+		Ω(dstLength).Should(Equal("0"))
+	})
+	It("should return ErrUploadDoesNotExist if object is not found", func() {
+		u := Upload{}
+		err := testClient.UploadFromURL(context.Background(), &u, testSrv.URL+"/src/missing", nil, URLUploadOptions{HTTPClient: testSrv.Client()})
+		Ω(err).Should(MatchError(ErrUploadDoesNotExist))
+		Ω(dstData).Should(BeNil())
+	})
+})
@@ -0,0 +1,137 @@
+package tusgo
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+
+	"github.com/bdragon300/tusgo/checksum"
+)
+
+// VerifyOptions set up the VerifyUpload
+type VerifyOptions struct {
+	// ExpectedSize, if positive, is compared with the upload size reported by the server
+	ExpectedSize int64
+
+	// ChecksumAlgorithm and ExpectedChecksum are the checksum of the original data. If not set, we take them from the
+	// "checksum" key of upload metadata, if any. If the checksum is known, we download the data by GET request and
+	// compare the checksums. ChecksumAlgorithm is required if ExpectedChecksum is set.
+	ChecksumAlgorithm string
+	ExpectedChecksum  []byte
+
+	// ExpectedParts, if set, are the partial upload locations the final upload must be concatenated from. They are
+	// compared with Upload.FinalParts if the server reports them
+	ExpectedParts []string
+}
+
+// VerificationReport is the result of VerifyUpload
+type VerificationReport struct {
+	// Location is the verified upload location
+	Location string
+
+	// RemoteSize and RemoteOffset are reported by the server
+	RemoteSize   int64
+	RemoteOffset int64
+
+	// DigestChecked is true if the data has been downloaded and its checksum has been compared with the expected one.
+	// The check is skipped if the expected checksum is unknown or the server doesn't serve the data by GET request.
+	DigestChecked bool
+
+	// ChecksumAlgorithm is the algorithm of ExpectedDigest and ActualDigest
+	ChecksumAlgorithm string
+
+	// ExpectedDigest is the checksum of the original data
+	ExpectedDigest []byte
+
+	// ActualDigest is the checksum of the data downloaded from the server
+	ActualDigest []byte
+
+	// Problems describes the failed checks. Empty if all checks have passed.
+	Problems []string
+}
+
+// Passed returns true if all checks have passed
+func (r VerificationReport) Passed() bool {
+	return len(r.Problems) == 0
+}
+
+// VerifyUpload checks the upload after it has been completed. We request the upload by HEAD request to confirm that
+// its offset is equal to its size, and, if the checksum of the original data is known, download the data by GET
+// request and compare the checksums. See VerifyOptions.
+//
+// The failed checks are reported in VerificationReport.Problems. The error is returned if the verification itself
+// has failed, e.g. due to network error, or if opts have the expected checksum with unknown algorithm.
+func (c *Client) VerifyUpload(ctx context.Context, location string, opts VerifyOptions) (report VerificationReport, err error) {
+	report.Location = location
+	if opts.ExpectedChecksum != nil {
+		if _, ok := checksum.GetAlgorithm(opts.ChecksumAlgorithm); !ok {
+			err = fmt.Errorf("unknown checksum algorithm %q of the expected checksum", opts.ChecksumAlgorithm)
+			return
+		}
+	}
+	cl := c.WithContext(ctx)
+	u := Upload{}
+	if _, err = cl.GetUpload(&u, location); err != nil {
+		return
+	}
+	report.RemoteSize, report.RemoteOffset = u.RemoteSize, u.RemoteOffset
+	if !u.IsComplete() {
+		report.Problems = append(report.Problems, fmt.Sprintf("upload is not complete: offset %d, size %d", u.RemoteOffset, u.RemoteSize))
+	}
+	if opts.ExpectedSize > 0 && u.RemoteSize != opts.ExpectedSize {
+		report.Problems = append(report.Problems, fmt.Sprintf("upload size %d differs from the expected %d", u.RemoteSize, opts.ExpectedSize))
+	}
+	if opts.ExpectedParts != nil && u.FinalParts != nil && !slices.Equal(u.FinalParts, opts.ExpectedParts) {
+		report.Problems = append(report.Problems, fmt.Sprintf("upload is concatenated from %v, expected %v", u.FinalParts, opts.ExpectedParts))
+	}
+
+	report.ChecksumAlgorithm, report.ExpectedDigest = opts.ChecksumAlgorithm, opts.ExpectedChecksum
+	if report.ExpectedDigest == nil {
+		if report.ChecksumAlgorithm, report.ExpectedDigest, err = Metadata(u.Metadata).Checksum(); err != nil {
+			return report, nil // Nothing to compare the data with
+		}
+	}
+
+	ds := NewDownloadStream(cl, &u).WithChecksumAlgorithm(report.ChecksumAlgorithm)
+	defer ds.Close()
+	if _, err = io.Copy(io.Discard, ds); err != nil {
+		if getUnsupported(err) {
+			return report, nil
+		}
+		return
+	}
+	report.DigestChecked = true
+	report.ActualDigest = ds.Digest()
+	if !bytes.Equal(report.ActualDigest, report.ExpectedDigest) {
+		report.Problems = append(report.Problems, fmt.Sprintf(
+			"data checksum %s differs from the expected %s",
+			formatChecksum(report.ChecksumAlgorithm, report.ActualDigest), formatChecksum(report.ChecksumAlgorithm, report.ExpectedDigest),
+		))
+	}
+	return
+}
+
+// Verify checks the upload after the stream has uploaded all its data, see Client.VerifyUpload. The expected size is
+// Upload.RemoteSize. If the stream has a checksum algorithm and has uploaded the data from offset 0, the data
+// checksum is compared with Digest, otherwise the checksum from upload metadata is used, if any.
+func (us *UploadStream) Verify(ctx context.Context) (VerificationReport, error) {
+	opts := VerifyOptions{ExpectedSize: us.Upload.RemoteSize}
+	if d := us.Digest(); d != nil && us.digestStart == 0 {
+		opts.ChecksumAlgorithm, opts.ExpectedChecksum = us.rawChecksumHashName, d
+	}
+	return us.client.VerifyUpload(ctx, us.Upload.Location, opts)
+}
+
+// getUnsupported returns true if err means that the server doesn't serve the upload data by GET request
+func getUnsupported(err error) bool {
+	var ed ErrorDetails
+	if errors.Is(err, ErrUploadDoesNotExist) {
+		return true
+	}
+	return errors.Is(err, ErrUnexpectedResponse) && errors.As(err, &ed) &&
+		(ed.StatusCode == http.StatusMethodNotAllowed || ed.StatusCode == http.StatusNotImplemented)
+}
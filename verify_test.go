@@ -0,0 +1,126 @@
+package tusgo
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/base64"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("VerifyUpload", func() {
+	var testSrv *httptest.Server
+	var testClient *Client
+	var data []byte
+	var offset int
+	var metadata string
+	var getStatus int
+
+	BeforeEach(func() {
+		data, _ = io.ReadAll(io.LimitReader(rand.New(rand.NewSource(time.Now().UnixNano())), 1000))
+		offset = len(data)
+		metadata = ""
+		getStatus = http.StatusOK
+		testSrv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Tus-Resumable", "1.0.0")
+			if r.URL.Path != "/files/foo" {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			switch r.Method {
+			case http.MethodHead:
+				w.Header().Set("Cache-Control", "no-store")
+				w.Header().Set("Upload-Length", strconv.Itoa(len(data)))
+				w.Header().Set("Upload-Offset", strconv.Itoa(offset))
+				if metadata != "" {
+					w.Header().Set("Upload-Metadata", metadata)
+				}
+			case http.MethodGet:
+				if getStatus != http.StatusOK {
+					w.WriteHeader(getStatus)
+					return
+				}
+				http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+			}
+		}))
+		u, _ := url.Parse(testSrv.URL + "/files/")
+		testClient = NewClient(testSrv.Client(), u)
+	})
+	AfterEach(func() {
+		testSrv.Close()
+	})
+
+	It("should pass if data checksum matches the one from metadata", func() {
+		sum := sha1.Sum(data)
+		metadata = "checksum " + base64.StdEncoding.EncodeToString([]byte("sha1 "+base64.StdEncoding.EncodeToString(sum[:])))
+
+		report, err := testClient.VerifyUpload(context.Background(), "foo", VerifyOptions{ExpectedSize: int64(len(data))})
+		Ω(err).Should(Succeed())
+		Ω(report.Passed()).Should(BeTrue())
+		Ω(report.DigestChecked).Should(BeTrue())
+		Ω(report.ChecksumAlgorithm).Should(Equal("sha1"))
+		Ω(report.ActualDigest).Should(Equal(sum[:]))
+		Ω(report.RemoteSize).Should(BeEquivalentTo(len(data)))
+		Ω(report.RemoteOffset).Should(BeEquivalentTo(len(data)))
+	})
+	It("should report checksum mismatch", func() {
+		opts := VerifyOptions{ChecksumAlgorithm: "sha1", ExpectedChecksum: make([]byte, 20)}
+
+		report, err := testClient.VerifyUpload(context.Background(), "foo", opts)
+		Ω(err).Should(Succeed())
+		Ω(report.Passed()).Should(BeFalse())
+		Ω(report.DigestChecked).Should(BeTrue())
+		Ω(report.Problems).Should(ConsistOf(ContainSubstring("data checksum")))
+	})
+	It("should report incomplete upload and unexpected size", func() {
+		offset = 500
+
+		report, err := testClient.VerifyUpload(context.Background(), "foo", VerifyOptions{ExpectedSize: 2000})
+		Ω(err).Should(Succeed())
+		Ω(report.Passed()).Should(BeFalse())
+		Ω(report.DigestChecked).Should(BeFalse())
+		Ω(report.Problems).Should(ConsistOf(ContainSubstring("not complete"), ContainSubstring("differs from the expected 2000")))
+	})
+	It("should skip digest check if server doesn't serve data", func() {
+		getStatus = http.StatusMethodNotAllowed
+		opts := VerifyOptions{ChecksumAlgorithm: "sha1", ExpectedChecksum: make([]byte, 20)}
+
+		report, err := testClient.VerifyUpload(context.Background(), "foo", opts)
+		Ω(err).Should(Succeed())
+		Ω(report.Passed()).Should(BeTrue())
+		Ω(report.DigestChecked).Should(BeFalse())
+	})
+	DescribeTable("should return error if expected checksum algorithm is unknown",
+		func(alg string) {
+			opts := VerifyOptions{ChecksumAlgorithm: alg, ExpectedChecksum: make([]byte, 20)}
+
+			_, err := testClient.VerifyUpload(context.Background(), "foo", opts)
+			Ω(err).Should(MatchError(ContainSubstring("unknown checksum algorithm")))
+		},
+		Entry("empty", ""),
+		Entry("unsupported", "foo"),
+	)
+	It("should return error if upload does not exist", func() {
+		_, err := testClient.VerifyUpload(context.Background(), "bar", VerifyOptions{})
+		Ω(err).Should(MatchError(ErrUploadDoesNotExist))
+	})
+	It("should compare with stream digest", func() {
+		u := Upload{Location: "foo", RemoteSize: int64(len(data)), RemoteOffset: int64(len(data))}
+		s := NewUploadStream(testClient, &u).WithChecksumAlgorithm("sha1")
+		s.updateDigest(0, data)
+
+		report, err := s.Verify(context.Background())
+		Ω(err).Should(Succeed())
+		Ω(report.Passed()).Should(BeTrue())
+		Ω(report.DigestChecked).Should(BeTrue())
+	})
+})